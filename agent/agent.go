@@ -56,6 +56,8 @@ type Agent struct {
 	api       pct.APIConnector
 	services  map[string]pct.ServiceManager
 	updater   *pct.Updater
+	policy    *pct.CmdPolicy
+	audit     *pct.AuditLog
 	keepalive *time.Ticker
 	// --
 	cmdSync        *pct.SyncChan
@@ -66,9 +68,12 @@ type Agent struct {
 	status            *pct.Status
 	statusChan        chan *proto.Cmd
 	statusHandlerSync *pct.SyncChan
+	//
+	updateMux     *sync.Mutex
+	pendingUpdate string // version, waiting for the maintenance window
 }
 
-func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client pct.WebsocketClient, services map[string]pct.ServiceManager) *Agent {
+func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client pct.WebsocketClient, services map[string]pct.ServiceManager, policy *pct.CmdPolicy, audit *pct.AuditLog) *Agent {
 	agent := &Agent{
 		config:    config,
 		api:       api,
@@ -77,10 +82,19 @@ func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client p
 		client:    client,
 		services:  services,
 		updater:   pct.NewUpdater(logger, api, pct.PublicKey, os.Args[0], VERSION),
+		policy:    policy,
+		audit:     audit,
 		// --
-		status:     pct.NewStatus([]string{"agent", "agent-cmd-handler"}),
+		status:     pct.NewStatus(append([]string{"agent", "agent-cmd-handler", "agent-update"}, cmdQueueProcs(services)...)),
 		cmdChan:    make(chan *proto.Cmd, CMD_QUEUE_SIZE),
 		statusChan: make(chan *proto.Cmd, STATUS_QUEUE_SIZE),
+		updateMux:  &sync.Mutex{},
+	}
+	// LoadConfig validates the update policy, so this shouldn't fail.
+	if updatePolicy, err := config.UpdatePolicy(); err != nil {
+		logger.Error(err)
+	} else {
+		agent.updater.SetPolicy(updatePolicy)
 	}
 	return agent
 }
@@ -107,8 +121,9 @@ func (agent *Agent) Run() error {
 	/*
 	 * Start the status and cmd handlers.  Most messages must be serialized because,
 	 * for example, handling start-service and stop-service at the same
-	 * time would cause weird problems.  The cmdChan serializes messages,
-	 * so it's "first come, first serve" (i.e. fifo).  Concurrency has
+	 * time would cause weird problems.  The cmdHandler queues messages per
+	 * service, so they're "first come, first serve" (i.e. fifo) for each
+	 * service while a slow service doesn't block the others.  Concurrency has
 	 * consequences: e.g. if user1 sends a start-service and it succeeds
 	 * and user2 send the same start-service, user2 will get a ServiceIsRunningError.
 	 * Status requests are handled concurrently so the user can always see what
@@ -129,6 +144,44 @@ func (agent *Agent) Run() error {
 	// https://jira.percona.com/browse/PCT-765
 	agent.keepalive = time.NewTicker(time.Duration(agent.config.Keepalive) * time.Second)
 
+	// If this agent was just updated, it's on probation, see pct.Updater.
+	var probation <-chan time.Time
+	probationConnected := false
+	update, err := agent.updater.Starting()
+	if err != nil {
+		logger.Warn("Cannot read update state:", err)
+	}
+	if update != nil {
+		if update.Starts > pct.UPDATE_MAX_STARTS {
+			reason := fmt.Sprintf("started %d times during probation", update.Starts)
+			if err := agent.rollbackUpdate(update, reason); err != nil {
+				logger.Error("Cannot roll back update:", err)
+			} else {
+				return nil
+			}
+		} else {
+			agent.configMux.RLock()
+			secs := agent.config.UpdateProbation
+			agent.configMux.RUnlock()
+			if secs == 0 {
+				secs = pct.UPDATE_PROBATION
+			}
+			d := time.Duration(secs) * time.Second
+			probation = time.After(d)
+			agent.status.Update("agent-update", fmt.Sprintf("%s on probation until %s", update.Version, pct.TimeString(time.Now().Add(d))))
+			logger.Info("Update to", update.Version, "on probation for", d)
+		}
+	}
+
+	// Updates and restarts outside the maintenance window wait for it to open.
+	var maintenance <-chan time.Time
+	var pendingRestart *proto.Cmd
+	if agent.updater.Policy().Window != nil {
+		maintenanceTicker := time.NewTicker(time.Minute)
+		defer maintenanceTicker.Stop()
+		maintenance = maintenanceTicker.C
+	}
+
 	logger.Info("Started")
 
 	for {
@@ -137,48 +190,34 @@ func (agent *Agent) Run() error {
 
 		select {
 		case cmd := <-cmdChan: // from API
+			// Every cmd is audited when its reply is sent, see reply().
+			if err := agent.audit.Received(cmd); err != nil {
+				logger.Warn("Cannot write audit log:", err)
+			}
+			// The local command policy applies to every API cmd, even Abort.
+			if err := agent.policy.Check(cmd); err != nil {
+				logger.Warn(fmt.Sprintf("Rejected %s (user %s): %s", cmd, cmd.User, err))
+				agent.reply(cmd.Reply(nil, err))
+				continue
+			}
 			if cmd.Cmd == "Abort" {
+				agent.audit.Replied(cmd.Reply(nil, errors.New("aborted")))
 				panic(cmd)
 			}
 			switch cmd.Cmd {
 			case "Restart":
 				logger.Debug("cmd:restart")
-				agent.status.UpdateRe("agent", "Restarting", cmd)
-
-				// Secure the start-lock file.  This lets us start our self but
-				// wait until this process has exited, at which time the start-lock
-				// is removed and the 2nd self continues starting.
-				if err := pct.MakeStartLock(); err != nil {
-					agent.reply(cmd.Reply(nil, err))
+				if window := agent.updater.Policy().Window; !window.Open(time.Now()) {
+					pendingRestart = cmd
+					msg := "Restart deferred until the maintenance window opens at " + pct.TimeString(window.Next(time.Now()))
+					logger.Info(msg)
+					agent.status.UpdateRe("agent", msg, cmd)
+					agent.reply(cmd.Reply(msg))
 					continue
 				}
-
-				// Start our self with the same args this process was started with.
-				cwd, err := os.Getwd()
-				if err != nil {
-					agent.reply(cmd.Reply(nil, err))
-				}
-				comment := fmt.Sprintf(
-					"This script was created by percona-agent in response to this Restart command:\n"+
-						"# %s\n"+
-						"# It is safe to delete.", cmd)
-				sh := fmt.Sprintf("#!/bin/sh\n# %s\ncd %s\n%s %s >> %s/percona-agent.log 2>&1 &\n",
-					comment,
-					cwd,
-					os.Args[0],
-					strings.Join(os.Args[1:len(os.Args)], " "),
-					pct.Basedir.Path(),
-				)
-				startScript := pct.Basedir.File("start-script")
-				if err := ioutil.WriteFile(startScript, []byte(sh), os.FileMode(0754)); err != nil {
-					agent.reply(cmd.Reply(nil, err))
+				if agent.restart(cmd) {
+					return nil
 				}
-				logger.Debug("Restart:sh")
-				self := pctCmd.Factory.Make(startScript)
-				output, err := self.Run()
-				agent.reply(cmd.Reply(output, err))
-				logger.Debug("Restart:done")
-				return nil
 			case "Stop":
 				logger.Debug("cmd:stop")
 				logger.Info("Stopping", cmd)
@@ -230,6 +269,7 @@ func (agent *Agent) Run() error {
 		case connected = <-client.ConnectChan():
 			if connected {
 				logger.Info("Connected to API")
+				probationConnected = true
 				cmdHandlerErrors = 0
 				statusHandlerErrors = 0
 			} else {
@@ -237,6 +277,51 @@ func (agent *Agent) Run() error {
 				logger.Warn("Lost connection to API")
 				go agent.connect()
 			}
+		case <-probation:
+			// The updated agent must have connected to the API, and its
+			// services must be running, else roll back to the previous version.
+			probation = nil
+			if err := agent.healthy(probationConnected); err != nil {
+				if err := agent.rollbackUpdate(update, err.Error()); err != nil {
+					logger.Error("Cannot roll back update:", err)
+					continue
+				}
+				return nil
+			}
+			if err := agent.updater.Passed(update); err != nil {
+				logger.Warn(err)
+			}
+			agent.status.Update("agent-update", update.Version+" passed probation")
+		case now := <-maintenance:
+			if !agent.updater.Policy().Window.Open(now) {
+				continue
+			}
+			// Update first, then restart on the next tick to run the new version.
+			agent.updateMux.Lock()
+			version := agent.pendingUpdate
+			agent.updateMux.Unlock()
+			if version != "" {
+				cmd := &proto.Cmd{
+					Ts:      now.UTC(),
+					User:    "agent (maintenance window)",
+					Service: "agent",
+					Cmd:     "Update",
+					Data:    []byte(version),
+				}
+				select {
+				case agent.cmdChan <- cmd:
+				default:
+					logger.Warn("Cannot queue deferred update to", version)
+				}
+				continue
+			}
+			if pendingRestart != nil {
+				logger.Info("Maintenance window open, restarting for", pendingRestart)
+				if agent.restart(pendingRestart) {
+					return nil
+				}
+				pendingRestart = nil
+			}
 		case <-agent.keepalive.C:
 			// Send keepalive (i.e. check if ws cmd chan is still open on API end).
 			logger.Debug("pong")
@@ -267,16 +352,11 @@ func (agent *Agent) stop() {
 	agent.cmdHandlerSync.Stop()
 	agent.cmdHandlerSync.Wait()
 
-	for service, manager := range agent.services {
-		if service == "log" {
-			continue
-		}
-		agent.logger.Info("Stopping " + service)
-		agent.status.UpdateRe("agent", "Stopping "+service, cmd)
-		if err := manager.Stop(); err != nil {
-			agent.logger.Warn(err)
-		}
-	}
+	agent.status.UpdateRe("agent", "Stopping services", cmd)
+	agent.configMux.RLock()
+	timeout := time.Duration(agent.config.ShutdownTimeout) * time.Second
+	agent.configMux.RUnlock()
+	Shutdown(agent.logger, agent.services, timeout) // logs its errors
 
 	agent.logger.Info("Stopping statusHandler")
 	agent.status.UpdateRe("agent", "Stopping statusHandler", cmd)
@@ -284,6 +364,127 @@ func (agent *Agent) stop() {
 	agent.statusHandlerSync.Wait()
 }
 
+// Restart our self, see makeStartScript.  Returns false if that fails.
+// @goroutine[0]
+func (agent *Agent) restart(cmd *proto.Cmd) bool {
+	agent.status.UpdateRe("agent", "Restarting", cmd)
+	startScript, err := agent.makeStartScript(cmd)
+	if err != nil {
+		agent.reply(cmd.Reply(nil, err))
+		return false
+	}
+	agent.logger.Debug("Restart:sh")
+	self := pctCmd.Factory.Make(startScript)
+	output, err := self.Run()
+	agent.reply(cmd.Reply(output, err))
+	// The new self waits for us to exit, so stop like the Stop cmd.
+	agent.stop()
+	agent.logger.Debug("Restart:done")
+	return true
+}
+
+// Write the start-script which starts our self with the same args this process
+// was started with, and secure the start-lock file.  This lets us start our
+// self but wait until this process has exited, at which time the start-lock
+// is removed and the 2nd self continues starting.  If an update is on probation
+// and the 2nd self exits with an error, the script reinstalls and starts the
+// previous bin.
+// @goroutine[0]
+func (agent *Agent) makeStartScript(cmd *proto.Cmd) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	update, err := pct.ReadUpdateState()
+	if err != nil {
+		return "", err
+	}
+	comment := fmt.Sprintf(
+		"This script was created by percona-agent in response to this Restart command:\n"+
+			"# %s\n"+
+			"# It is safe to delete.", cmd)
+	self := fmt.Sprintf("%s %s >> %s 2>&1",
+		os.Args[0],
+		strings.Join(os.Args[1:len(os.Args)], " "),
+		logFileArg(os.Args[1:]),
+	)
+	run := self + " &"
+	if update != nil {
+		run = fmt.Sprintf("(%s || (test -f %s && cp -p %s %s && %s)) &",
+			self,
+			pct.Basedir.File("update"),
+			update.PrevBin,
+			os.Args[0],
+			self,
+		)
+	}
+	sh := fmt.Sprintf("#!/bin/sh\n# %s\ncd %s\n%s\n", comment, cwd, run)
+	startScript := pct.Basedir.File("start-script")
+	if err := ioutil.WriteFile(startScript, []byte(sh), os.FileMode(0754)); err != nil {
+		return "", err
+	}
+	if err := pct.MakeStartLock(); err != nil {
+		return "", err
+	}
+	return startScript, nil
+}
+
+// The -log-file arg, which is the file stdout and stderr are redirected to,
+// else the default: percona-agent.log in the basedir.
+func logFileArg(args []string) string {
+	for i, arg := range args {
+		arg = strings.TrimPrefix(arg, "-")
+		if arg == "-log-file" || arg == "log-file" {
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		} else if strings.HasPrefix(arg, "-log-file=") || strings.HasPrefix(arg, "log-file=") {
+			return arg[strings.Index(arg, "=")+1:]
+		}
+	}
+	return filepath.Join(pct.Basedir.Path(), "percona-agent.log")
+}
+
+// healthy returns nil if the agent connected to the API and no service crashed.
+// @goroutine[0]
+func (agent *Agent) healthy(connected bool) error {
+	if !connected {
+		return errors.New("not connected to API")
+	}
+	for service, manager := range agent.services {
+		for proc, status := range manager.Status() {
+			if strings.HasPrefix(status, "Crash") {
+				return fmt.Errorf("%s %s: %s", service, proc, status)
+			}
+		}
+	}
+	return nil
+}
+
+// Roll back the update on probation and restart the previous version.
+// @goroutine[0]
+func (agent *Agent) rollbackUpdate(update *pct.UpdateState, reason string) error {
+	agent.status.Update("agent-update", fmt.Sprintf("Rolling back %s to %s: %s", update.Version, update.PrevVersion, reason))
+	if err := agent.updater.Rollback(update, reason); err != nil {
+		return err
+	}
+	cmd := &proto.Cmd{
+		Ts:      time.Now().UTC(),
+		User:    "agent (rollback)",
+		Service: "agent",
+		Cmd:     "Restart",
+	}
+	startScript, err := agent.makeStartScript(cmd)
+	if err != nil {
+		return err
+	}
+	if _, err := pctCmd.Factory.Make(startScript).Run(); err != nil {
+		return err
+	}
+	agent.stop()
+	return nil
+}
+
 func LoadConfig() ([]byte, error) {
 	config := &Config{}
 	if err := pct.Basedir.ReadConfig("agent", config); err != nil {
@@ -298,11 +499,16 @@ func LoadConfig() ([]byte, error) {
 	if config.PidFile == "" {
 		config.PidFile = DEFAULT_PIDFILE
 	}
-	if config.ApiKey == "" {
-		return nil, errors.New("Missing ApiKey")
+	if _, err := config.UpdatePolicy(); err != nil {
+		return nil, err
 	}
-	if config.AgentUuid == "" {
-		return nil, errors.New("Missing AgentUuid")
+	if !config.Standalone {
+		if config.ApiKey == "" && !pct.HaveAgentIdentity() {
+			return nil, errors.New("Missing ApiKey")
+		}
+		if config.AgentUuid == "" {
+			return nil, errors.New("Missing AgentUuid")
+		}
 	}
 	data, err := json.Marshal(config)
 	if err != nil {
@@ -311,6 +517,20 @@ func LoadConfig() ([]byte, error) {
 	return data, nil
 }
 
+// LoadStandaloneConfig returns the agent config for running without the API.
+// The agent config file is optional.
+func LoadStandaloneConfig() (*Config, error) {
+	config := &Config{}
+	if err := pct.Basedir.ReadConfig("agent", config); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	config.Standalone = true
+	if config.PidFile == "" {
+		config.PidFile = DEFAULT_PIDFILE
+	}
+	return config, nil
+}
+
 func (agent *Agent) GetConfig() ([]proto.AgentConfig, []error) {
 	agent.logger.Debug("GetConfig:call")
 	defer agent.logger.Debug("GetConfig:return")
@@ -343,12 +563,24 @@ func (agent *Agent) GetConfig() ([]proto.AgentConfig, []error) {
 
 // Run:@goroutine[1]
 func (agent *Agent) cmdHandler() {
-	cmdReply := make(chan *proto.Reply, 1)
+	// Per-service cmd queues, see queue.go.
+	agent.configMux.RLock()
+	concurrency := agent.config.CmdConcurrency
+	agent.configMux.RUnlock()
+	queues := make(map[string]*cmdQueue)
+	for _, service := range agent.queueServices() {
+		q := newCmdQueue(agent, service, concurrency[service])
+		q.Start()
+		queues[service] = q
+	}
 
 	defer func() {
 		if err := recover(); err != nil {
 			agent.logger.Error("Agent command handler crashed: ", err)
 		}
+		for _, q := range queues {
+			q.Stop()
+		}
 		agent.status.Update("agent-cmd-handler", "Stopped")
 		agent.cmdHandlerSync.Done()
 	}()
@@ -358,49 +590,9 @@ func (agent *Agent) cmdHandler() {
 
 		select {
 		case cmd := <-agent.cmdChan:
-			agent.status.UpdateRe("agent-cmd-handler", "Handling", cmd)
-
-			// Handle the cmd in a separate goroutine so if it gets stuck it won't affect us.
-			go func() {
-				var reply *proto.Reply
-				defer func() {
-					if err := recover(); err != nil {
-						agent.logger.Error(fmt.Sprintf("Command %s crashed: %s", cmd, err))
-						reply = cmd.Reply(nil, fmt.Errorf("%s", err))
-					}
-					cmdReply <- reply
-				}()
-				if cmd.Service == "agent" {
-					reply = agent.Handle(cmd)
-				} else {
-					if manager, ok := agent.services[cmd.Service]; ok {
-						reply = manager.Handle(cmd)
-					} else {
-						reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
-					}
-				}
-			}()
-
-			// Wait for the cmd to complete.
-			var timeout <-chan time.Time
-			if cmd.Cmd == "Update" {
-				timeout = time.After(5 * time.Minute)
-			} else {
-				timeout = time.After(20 * time.Second)
-			}
-			var reply *proto.Reply
-			select {
-			case reply = <-cmdReply:
-				// todo: instrument cmd exec time
-			case <-timeout:
-				reply = cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
-			}
-
-			// Reply to cmd.
-			if reply != nil {
-				agent.reply(reply)
-			} else {
-				agent.logger.Info(cmd, "executed, no reply")
+			agent.status.UpdateRe("agent-cmd-handler", "Queueing", cmd)
+			if err := queues[agent.cmdQueueName(cmd)].Queue(cmd); err != nil {
+				agent.reply(cmd.Reply(nil, err))
 			}
 		case <-agent.cmdHandlerSync.StopChan: // from stop()
 			agent.cmdHandlerSync.Graceful()
@@ -410,6 +602,9 @@ func (agent *Agent) cmdHandler() {
 }
 
 func (agent *Agent) reply(reply *proto.Reply) {
+	if err := agent.audit.Replied(reply); err != nil {
+		agent.logger.Warn("Cannot write audit log:", err)
+	}
 	select {
 	case agent.client.SendChan() <- reply:
 		// SendChan is buffered so this should be very quick.
@@ -447,6 +642,8 @@ func (agent *Agent) Handle(cmd *proto.Cmd) *proto.Reply {
 		data, errs = agent.handleUpdate(cmd)
 	case "Version":
 		data, errs = agent.handleVersion(cmd)
+	case "RotateIdentity":
+		data, err = agent.handleRotateIdentity(cmd)
 	case "Reconnect":
 		/*
 			Reconnect is a special case: there's no reply because we can't
@@ -609,6 +806,37 @@ func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	return &finalConfig, errs
 }
 
+// Handle:@goroutine[3]
+func (agent *Agent) handleRotateIdentity(cmd *proto.Cmd) (interface{}, error) {
+	agent.status.UpdateRe("agent-cmd-handler", "RotateIdentity", cmd)
+	agent.logger.Info(cmd)
+
+	agent.configMux.RLock()
+	config := *agent.config
+	agent.configMux.RUnlock()
+
+	if config.CertFile != "" {
+		return nil, errors.New("Cannot rotate agent identity: agent config has CertFile, so the identity is not used")
+	}
+
+	// Get a cert for a new key, authenticating with the current cert (or API key).
+	url := agent.api.URL("agents", config.AgentUuid, "cert")
+	if err := pct.NewAgentCert(agent.api, agent.api.ApiKey(), url, config.AgentUuid); err != nil {
+		return nil, err
+	}
+
+	// New connections to the API use the new cert.  Connected websockets keep
+	// using the old one until they reconnect.
+	if err := pct.Transport.Init(config.TransportConfig()); err != nil {
+		return nil, err
+	}
+	if err := agent.api.Connect(agent.api.Hostname(), agent.api.ApiKey(), agent.api.AgentUuid()); err != nil {
+		return nil, err
+	}
+	agent.logger.Info("Rotated agent identity")
+	return nil, nil
+}
+
 func (agent *Agent) handleVersion(cmd *proto.Cmd) (interface{}, []error) {
 	v := &proto.Version{
 		Running:  VERSION + REL,
@@ -634,6 +862,26 @@ func (agent *Agent) handleUpdate(cmd *proto.Cmd) (interface{}, []error) {
 	if version == "" {
 		return nil, []error{fmt.Errorf("Invalid version: '%s'", version)}
 	}
+	policy := agent.updater.Policy()
+	if err := policy.Allow(version); err != nil {
+		return nil, []error{err}
+	}
+
+	// Outside the maintenance window, Run() queues this cmd again when it opens.
+	// Run() locks updateMux too, so don't hold it while updating, which can
+	// take minutes.
+	agent.updateMux.Lock()
+	if now := time.Now(); !policy.Window.Open(now) {
+		agent.pendingUpdate = version
+		agent.updateMux.Unlock()
+		msg := fmt.Sprintf("Update to %s deferred until the maintenance window opens at %s",
+			version, pct.TimeString(policy.Window.Next(now)))
+		agent.logger.Info(msg)
+		agent.status.Update("agent-update", msg)
+		return msg, nil
+	}
+	agent.pendingUpdate = ""
+	agent.updateMux.Unlock()
 	err := agent.updater.Update(version)
 	return nil, []error{err}
 }
@@ -658,18 +906,23 @@ func (agent *Agent) statusHandler() {
 	for {
 		select {
 		case cmd := <-agent.statusChan:
+			var reply *proto.Reply
 			switch cmd.Service {
 			case "":
-				replyChan <- cmd.Reply(agent.AllStatus())
+				reply = cmd.Reply(agent.AllStatus())
 			case "agent":
-				replyChan <- cmd.Reply(agent.Status())
+				reply = cmd.Reply(agent.Status())
 			default:
 				if manager, ok := agent.services[cmd.Service]; ok {
-					replyChan <- cmd.Reply(manager.Status())
+					reply = cmd.Reply(manager.Status())
 				} else {
-					replyChan <- cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
+					reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
 				}
 			}
+			if err := agent.audit.Replied(reply); err != nil {
+				agent.logger.Warn("Cannot write audit log:", err)
+			}
+			replyChan <- reply
 		case <-agent.statusHandlerSync.StopChan:
 			agent.statusHandlerSync.Graceful()
 			return
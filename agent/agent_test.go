@@ -19,6 +19,7 @@ package agent_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/agent"
 	"github.com/percona/percona-agent/pct"
@@ -120,7 +121,7 @@ func (s *AgentTestSuite) SetUpTest(t *C) {
 		"mm":  s.services["mm"],
 		"qan": s.services["qan"],
 	}
-	s.agent = agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap)
+	s.agent = agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap, nil, nil)
 
 	// Run the agent.
 	s.agentRunning = true
@@ -434,6 +435,46 @@ func (s *AgentTestSuite) TestStartServiceSlow(t *C) {
 	t.Check(reply.Error, Equals, "")
 }
 
+func (s *AgentTestSuite) TestSlowServiceDoesNotBlock(t *C) {
+	// Cmds are queued per service, so while qan is slow to start, cmds for
+	// the agent are handled.
+	serviceData, _ := json.Marshal(&proto.ServiceData{Name: "qan"})
+	startCmd := &proto.Cmd{
+		Id:      "1",
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "StartService",
+		Data:    serviceData,
+	}
+	s.sendChan <- startCmd
+	gotReplies := test.WaitReply(s.recvChan)
+	t.Assert(gotReplies, HasLen, 0)
+
+	versionCmd := &proto.Cmd{
+		Id:      "2",
+		Ts:      time.Now(),
+		User:    "daniel",
+		Service: "agent",
+		Cmd:     "Version",
+	}
+	s.sendChan <- versionCmd
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(gotReplies, HasLen, 1)
+	t.Check(gotReplies[0].Id, Equals, "2")
+
+	// StartService qan is in qan's queue, not the agent's.
+	status := test.GetStatus(s.sendChan, s.recvChan)
+	t.Check(status[agent.CMD_QUEUE_PREFIX+"qan"], Matches, "1 running, 0 queued.+")
+	t.Check(status[agent.CMD_QUEUE_PREFIX+"agent"], Matches, "0 running, 0 queued.+")
+
+	s.readyChan <- true
+	gotReplies = test.WaitReply(s.recvChan)
+	t.Assert(gotReplies, HasLen, 1)
+	t.Check(gotReplies[0].Id, Equals, "1")
+	t.Check(gotReplies[0].Error, Equals, "")
+}
+
 func (s *AgentTestSuite) TestStartStopUnknownService(t *C) {
 	// Starting an unknown service should return an error.
 	serviceCmd := &proto.ServiceData{
@@ -803,12 +844,16 @@ func (s *AgentTestSuite) TestRestart(t *C) {
 		os.Remove(pct.Basedir.File("start-script"))
 	}()
 
-	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap)
+	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap, nil, nil)
 	doneChan := make(chan error, 1)
 	go func() {
 		doneChan <- newAgent.Run()
 	}()
 
+	// Agent stops all services after starting its new self.
+	s.readyChan <- true
+	s.readyChan <- true
+
 	cmd := &proto.Cmd{
 		Service: "agent",
 		Cmd:     "Restart",
@@ -854,3 +899,438 @@ func (s *AgentTestSuite) TestCmdToService(t *C) {
 	t.Assert(s.services["mm"].Cmds, HasLen, 1)
 	t.Check(s.services["mm"].Cmds[0].Cmd, Equals, "Hello")
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Update test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type UpdateTestSuite struct {
+	tmpDir  string
+	args    []string
+	bin     string
+	prevBin string
+	// Log
+	logger  *pct.Logger
+	logChan chan *proto.LogEntry
+	// Agent
+	config      *agent.Config
+	servicesMap map[string]pct.ServiceManager
+	client      *mock.WebsocketClient
+	sendChan    chan *proto.Cmd
+	recvChan    chan *proto.Reply
+	api         *mock.API
+	cmdFactory  *mock.CmdFactory
+	readyChan   chan bool
+	traceChan   chan string
+}
+
+var _ = Suite(&UpdateTestSuite{})
+
+func (s *UpdateTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolling back reinstalls the previous bin as os.Args[0], so the agent
+	// must not run as the test bin.
+	s.args = os.Args
+	s.bin = filepath.Join(s.tmpDir, "percona-agent")
+	s.prevBin = filepath.Join(s.tmpDir, "percona-agent-prev")
+	os.Args = []string{s.bin}
+
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "agent-test")
+
+	s.config = &agent.Config{
+		AgentUuid:       "abc-123-def",
+		ApiKey:          "789",
+		ApiHostname:     agent.DEFAULT_API_HOSTNAME,
+		Keepalive:       10, // don't send while testing
+		UpdateProbation: 1,
+	}
+	links := map[string]string{
+		"agent":     "http://localhost/agent",
+		"instances": "http://localhost/instances",
+	}
+	s.api = mock.NewAPI("http://localhost", s.config.ApiHostname, s.config.ApiKey, s.config.AgentUuid, links)
+}
+
+func (s *UpdateTestSuite) SetUpTest(t *C) {
+	t.Assert(ioutil.WriteFile(s.bin, []byte("new"), 0755), IsNil)
+	t.Assert(ioutil.WriteFile(s.prevBin, []byte("prev"), 0755), IsNil)
+
+	s.sendChan = make(chan *proto.Cmd, 5)
+	s.recvChan = make(chan *proto.Reply, 5)
+	s.client = mock.NewWebsocketClient(s.sendChan, s.recvChan, nil, nil)
+	s.client.ErrChan = make(chan error)
+
+	// The agent stops its services when it restarts or stops.
+	s.readyChan = make(chan bool, 2)
+	s.readyChan <- true
+	s.readyChan <- true
+	s.traceChan = make(chan string, 100)
+	s.servicesMap = map[string]pct.ServiceManager{
+		"mm":  mock.NewMockServiceManager("mm", s.readyChan, s.traceChan),
+		"qan": mock.NewMockServiceManager("qan", s.readyChan, s.traceChan),
+	}
+
+	s.cmdFactory = &mock.CmdFactory{}
+	pctCmd.Factory = s.cmdFactory
+}
+
+func (s *UpdateTestSuite) TearDownTest(t *C) {
+	for _, file := range []string{"update", "update-history", "start-lock", "start-script"} {
+		os.Remove(pct.Basedir.File(file))
+	}
+	test.DrainLogChan(s.logChan)
+	test.DrainTraceChan(s.traceChan)
+}
+
+func (s *UpdateTestSuite) TearDownSuite(t *C) {
+	os.Args = s.args
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// Write the state of an update, from the previous bin to this version,
+// which has started the given number of times.
+func (s *UpdateTestSuite) writeUpdate(t *C, starts uint) {
+	update := &pct.UpdateState{
+		Version:     agent.VERSION,
+		PrevVersion: "1.0.0",
+		PrevBin:     s.prevBin,
+		Staged:      time.Now().UTC(),
+		Starts:      starts,
+	}
+	data, err := json.Marshal(update)
+	t.Assert(err, IsNil)
+	t.Assert(ioutil.WriteFile(pct.Basedir.File("update"), data, 0644), IsNil)
+}
+
+func (s *UpdateTestSuite) runAgent() chan error {
+	a := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap, nil, nil)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- a.Run()
+	}()
+	return doneChan
+}
+
+// Check that the previous bin was reinstalled, and the previous version was
+// restarted by the start script.
+func (s *UpdateTestSuite) checkRollback(t *C, reason string) {
+	data, err := ioutil.ReadFile(s.bin)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "prev")
+
+	t.Check(pct.FileExists(pct.Basedir.File("update")), Equals, false)
+	events, err := pct.UpdateHistory()
+	t.Assert(err, IsNil)
+	t.Assert(len(events) > 0, Equals, true)
+	last := events[len(events)-1]
+	t.Check(last.Event, Equals, pct.UPDATE_ROLLBACK)
+	t.Check(last.Version, Equals, agent.VERSION)
+	t.Check(last.PrevVersion, Equals, "1.0.0")
+	t.Check(last.Reason, Equals, reason)
+
+	t.Assert(s.cmdFactory.Cmds, HasLen, 1)
+	t.Check(s.cmdFactory.Cmds[0].Name, Equals, pct.Basedir.File("start-script"))
+	script, err := ioutil.ReadFile(pct.Basedir.File("start-script"))
+	t.Assert(err, IsNil)
+	t.Check(string(script), Matches, "(?s).*\n"+s.bin+" .*")
+	t.Check(pct.FileExists(pct.Basedir.File("start-lock")), Equals, true)
+}
+
+func (s *UpdateTestSuite) TestRollbackTooManyStarts(t *C) {
+	// The new version keeps crashing: this is one start too many.
+	s.writeUpdate(t, pct.UPDATE_MAX_STARTS)
+
+	doneChan := s.runAgent()
+	select {
+	case err := <-doneChan:
+		t.Check(err, IsNil)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Agent did not roll back the update")
+	}
+	s.checkRollback(t, fmt.Sprintf("started %d times during probation", pct.UPDATE_MAX_STARTS+1))
+
+	events, err := pct.UpdateHistory()
+	t.Assert(err, IsNil)
+	t.Assert(events, HasLen, 2)
+	t.Check(events[0].Event, Equals, pct.UPDATE_STARTED)
+}
+
+func (s *UpdateTestSuite) TestRollbackUnhealthy(t *C) {
+	s.writeUpdate(t, 0)
+
+	// Don't let the agent connect, so it fails the health check at the end
+	// of probation.
+	connectChan := make(chan bool)
+	s.client.SetConnectChan(connectChan)
+	defer func() {
+		<-connectChan
+		connectChan <- true
+	}()
+
+	doneChan := s.runAgent()
+	select {
+	case err := <-doneChan:
+		t.Check(err, IsNil)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Agent did not roll back the update")
+	}
+	s.checkRollback(t, "not connected to API")
+
+	events, err := pct.UpdateHistory()
+	t.Assert(err, IsNil)
+	t.Assert(events, HasLen, 2)
+	t.Check(events[0].Event, Equals, pct.UPDATE_STARTED)
+}
+
+func (s *UpdateTestSuite) TestProbationPassed(t *C) {
+	s.writeUpdate(t, 0)
+
+	doneChan := s.runAgent()
+	var events []pct.UpdateEvent
+	for i := 0; i < 30; i++ {
+		time.Sleep(100 * time.Millisecond)
+		var err error
+		events, err = pct.UpdateHistory()
+		t.Assert(err, IsNil)
+		if len(events) == 2 {
+			break
+		}
+	}
+	t.Assert(events, HasLen, 2)
+	t.Check(events[0].Event, Equals, pct.UPDATE_STARTED)
+	t.Check(events[1].Event, Equals, pct.UPDATE_OK)
+	t.Check(pct.FileExists(pct.Basedir.File("update")), Equals, false)
+
+	// The new bin is kept.
+	data, err := ioutil.ReadFile(s.bin)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "new")
+	t.Check(s.cmdFactory.Cmds, HasLen, 0)
+
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Stop"}
+	select {
+	case err := <-doneChan:
+		t.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent didn't respond to Stop cmd")
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Cmd queue test suite
+/////////////////////////////////////////////////////////////////////////////
+
+// A service whose Slow cmd doesn't return until the test closes releaseChan.
+type slowServiceManager struct {
+	*mock.MockServiceManager
+	releaseChan chan bool
+	handleChan  chan string
+}
+
+func (m *slowServiceManager) Handle(cmd *proto.Cmd) *proto.Reply {
+	m.handleChan <- cmd.Id
+	if cmd.Cmd == "Slow" {
+		<-m.releaseChan
+	}
+	return cmd.Reply(nil)
+}
+
+type CmdQueueTestSuite struct {
+	timeout uint
+	logger  *pct.Logger
+	logChan chan *proto.LogEntry
+	// Agent
+	config    *agent.Config
+	slow      *slowServiceManager
+	client    *mock.WebsocketClient
+	sendChan  chan *proto.Cmd
+	recvChan  chan *proto.Reply
+	api       *mock.API
+	readyChan chan bool
+	traceChan chan string
+	doneChan  chan error
+}
+
+var _ = Suite(&CmdQueueTestSuite{})
+
+func (s *CmdQueueTestSuite) SetUpSuite(t *C) {
+	s.timeout = agent.CMD_TIMEOUT
+	agent.CMD_TIMEOUT = 1
+
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "agent-test")
+
+	s.config = &agent.Config{
+		AgentUuid:   "abc-123-def",
+		ApiKey:      "789",
+		ApiHostname: agent.DEFAULT_API_HOSTNAME,
+		Keepalive:   10, // don't send while testing
+	}
+	links := map[string]string{
+		"agent":     "http://localhost/agent",
+		"instances": "http://localhost/instances",
+	}
+	s.api = mock.NewAPI("http://localhost", s.config.ApiHostname, s.config.ApiKey, s.config.AgentUuid, links)
+}
+
+func (s *CmdQueueTestSuite) SetUpTest(t *C) {
+	s.sendChan = make(chan *proto.Cmd, 5)
+	s.recvChan = make(chan *proto.Reply, 5)
+	s.client = mock.NewWebsocketClient(s.sendChan, s.recvChan, nil, nil)
+	s.client.ErrChan = make(chan error)
+
+	s.readyChan = make(chan bool, 2)
+	s.traceChan = make(chan string, 100)
+	s.slow = &slowServiceManager{
+		MockServiceManager: mock.NewMockServiceManager("qan", s.readyChan, s.traceChan),
+		releaseChan:        make(chan bool),
+		handleChan:         make(chan string, 10),
+	}
+	services := map[string]pct.ServiceManager{
+		"qan": s.slow,
+		"mm":  mock.NewMockServiceManager("mm", s.readyChan, s.traceChan),
+	}
+
+	a := agent.NewAgent(s.config, s.logger, s.api, s.client, services, nil, nil)
+	s.doneChan = make(chan error, 1)
+	go func() {
+		s.doneChan <- a.Run()
+	}()
+}
+
+func (s *CmdQueueTestSuite) TearDownTest(t *C) {
+	s.readyChan <- true // qan.Stop() immediately
+	s.readyChan <- true // mm.Stop() immediately
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Stop"}
+	select {
+	case <-s.doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent didn't respond to Stop cmd")
+	}
+	test.DrainLogChan(s.logChan)
+	test.DrainTraceChan(s.traceChan)
+}
+
+func (s *CmdQueueTestSuite) TearDownSuite(t *C) {
+	agent.CMD_TIMEOUT = s.timeout
+}
+
+func (s *CmdQueueTestSuite) TestTimeoutKeepsOrder(t *C) {
+	// The first qan cmd times out, but it's still running.
+	s.sendChan <- &proto.Cmd{Id: "1", Service: "qan", Cmd: "Slow"}
+	s.sendChan <- &proto.Cmd{Id: "2", Service: "qan", Cmd: "Fast"}
+	select {
+	case reply := <-s.recvChan:
+		t.Check(reply.Id, Equals, "1")
+		t.Check(reply.Error, Equals, pct.CmdTimeoutError{Cmd: "Slow"}.Error())
+	case <-time.After(time.Duration(agent.CMD_TIMEOUT+1) * time.Second):
+		t.Fatal("Slow cmd did not time out")
+	}
+
+	// Other services' cmds don't wait for it.
+	s.sendChan <- &proto.Cmd{Id: "3", Service: "mm", Cmd: "Hello"}
+	replies := test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Check(replies[0].Id, Equals, "3")
+	t.Check(replies[0].Error, Equals, "")
+
+	// The next qan cmd waits for the timed out cmd to return.
+	t.Check(<-s.slow.handleChan, Equals, "1")
+	select {
+	case id := <-s.slow.handleChan:
+		t.Fatalf("qan cmd %s ran while cmd 1 was still running", id)
+	default:
+	}
+
+	close(s.slow.releaseChan)
+	replies = test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Check(replies[0].Id, Equals, "2")
+	t.Check(replies[0].Error, Equals, "")
+	t.Check(<-s.slow.handleChan, Equals, "2")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Shutdown test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ShutdownTestSuite struct {
+	logChan   chan *proto.LogEntry
+	logger    *pct.Logger
+	readyChan chan bool
+	traceChan chan string
+}
+
+var _ = Suite(&ShutdownTestSuite{})
+
+func (s *ShutdownTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "shutdown-test")
+}
+
+func (s *ShutdownTestSuite) SetUpTest(t *C) {
+	s.readyChan = make(chan bool, 20)
+	s.traceChan = make(chan string, 20)
+}
+
+func (s *ShutdownTestSuite) TearDownTest(t *C) {
+	test.DrainLogChan(s.logChan)
+}
+
+func (s *ShutdownTestSuite) TestOrder(t *C) {
+	services := map[string]pct.ServiceManager{
+		"log":     mock.NewMockDrainServiceManager("log", s.readyChan, s.traceChan),
+		"data":    mock.NewMockDrainServiceManager("data", s.readyChan, s.traceChan),
+		"mm":      mock.NewMockDrainServiceManager("mm", s.readyChan, s.traceChan),
+		"sysinfo": mock.NewMockServiceManager("sysinfo", s.readyChan, s.traceChan),
+		"foo":     mock.NewMockServiceManager("foo", s.readyChan, s.traceChan),
+		"qan":     mock.NewMockServiceManager("qan", s.readyChan, s.traceChan),
+	}
+	for i := 0; i < 8; i++ {
+		s.readyChan <- true
+	}
+
+	err := agent.Shutdown(s.logger, services, time.Second)
+	t.Check(err, IsNil)
+
+	// Producers stop first, in SHUTDOWN_ORDER then others, then mm flushes,
+	// data spools and sends, log sends, and data stops.  Log never stops.
+	got := test.WaitTrace(s.traceChan)
+	expect := []string{
+		"Stop qan",
+		"Stop mm",
+		"Stop sysinfo",
+		"Stop foo",
+		"Drain mm",
+		"Drain data",
+		"Drain log",
+		"Stop data",
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+func (s *ShutdownTestSuite) TestTimeout(t *C) {
+	services := map[string]pct.ServiceManager{
+		"qan":  mock.NewMockServiceManager("qan", s.readyChan, s.traceChan),
+		"data": mock.NewMockDrainServiceManager("data", s.readyChan, s.traceChan),
+	}
+
+	// qan.Stop() never returns, so shutdown times out and skips the data steps.
+	t0 := time.Now()
+	err := agent.Shutdown(s.logger, services, 200*time.Millisecond)
+	d := time.Now().Sub(t0)
+	t.Check(err, ErrorMatches, "Stop qan: shutdown timeout")
+	t.Check(d < time.Second, Equals, true)
+
+	got := test.WaitTrace(s.traceChan)
+	t.Check(got, DeepEquals, []string{"Stop qan"})
+}
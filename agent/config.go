@@ -17,6 +17,11 @@
 
 package agent
 
+import (
+	"fmt"
+	"github.com/percona/percona-agent/pct"
+)
+
 const (
 	DEFAULT_API_HOSTNAME = "cloud-api.percona.com"
 	DEFAULT_KEEPALIVE    = 76
@@ -30,4 +35,66 @@ type Config struct {
 	Keepalive   uint
 	Links       map[string]string `json:",omitempty"`
 	PidFile     string
+	// API connection, see pct.TransportConfig:
+	Proxy    string `json:",omitempty"` // http://[user:pass@]host:port, or "none"
+	NoProxy  string `json:",omitempty"` // hosts not to proxy
+	CAFile   string `json:",omitempty"` // PEM CA bundle
+	CertFile string `json:",omitempty"` // PEM client cert
+	KeyFile  string `json:",omitempty"` // PEM client key
+	// Max concurrent cmds per service, default 1 (cmds run in order):
+	CmdConcurrency map[string]uint `json:",omitempty"`
+	// Run without the API: no cmds, log relay, or updates; data saved locally:
+	Standalone bool `json:",omitempty"`
+	// Max seconds to stop, drain, and flush all services, see Shutdown():
+	ShutdownTimeout uint `json:",omitempty"`
+	// Seconds an updated agent is on probation, see pct.Updater:
+	UpdateProbation uint `json:",omitempty"`
+	// Which versions to update to, and when updates and restarts are allowed
+	// (cron-like "min hour day month weekday", host time), see pct.UpdatePolicy:
+	UpdateChannel     string `json:",omitempty"` // stable (default) or testing
+	UpdatePin         string `json:",omitempty"`
+	UpdateMaxMajor    uint   `json:",omitempty"`
+	MaintenanceWindow string `json:",omitempty"`
+}
+
+// TransportConfig returns the config for all connections to the API.  If the
+// agent has an identity (pct.HaveAgentIdentity) and no other client cert is
+// configured, its cert is the client cert.
+func (c *Config) TransportConfig() pct.TransportConfig {
+	config := pct.TransportConfig{
+		Proxy:    c.Proxy,
+		NoProxy:  c.NoProxy,
+		CAFile:   c.CAFile,
+		CertFile: c.CertFile,
+		KeyFile:  c.KeyFile,
+	}
+	if config.CertFile == "" && config.KeyFile == "" && pct.HaveAgentIdentity() {
+		config.CertFile = pct.Basedir.File("agent-cert")
+		config.KeyFile = pct.Basedir.File("agent-key")
+	}
+	return config
+}
+
+// UpdatePolicy returns the self-update policy, or an error if the update channel
+// or maintenance window is invalid.
+func (c *Config) UpdatePolicy() (pct.UpdatePolicy, error) {
+	policy := pct.UpdatePolicy{
+		Channel:  c.UpdateChannel,
+		Pin:      c.UpdatePin,
+		MaxMajor: int64(c.UpdateMaxMajor),
+	}
+	switch c.UpdateChannel {
+	case "", pct.UPDATE_CHANNEL_STABLE, pct.UPDATE_CHANNEL_TESTING:
+	default:
+		return policy, fmt.Errorf("Invalid UpdateChannel: %s (expected %s or %s)",
+			c.UpdateChannel, pct.UPDATE_CHANNEL_STABLE, pct.UPDATE_CHANNEL_TESTING)
+	}
+	if c.MaintenanceWindow != "" {
+		window, err := pct.ParseMaintenanceWindow(c.MaintenanceWindow)
+		if err != nil {
+			return policy, err
+		}
+		policy.Window = window
+	}
+	return policy, nil
 }
@@ -0,0 +1,269 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * Cmds are handled in per-service queues so a slow cmd for one service (e.g.
+ * an Explain against an unreachable MySQL) doesn't delay cmds for others.
+ * Each queue runs its cmds in order, one at a time, unless Config.CmdConcurrency
+ * allows more for the service, in which case order is not guaranteed.  Agent
+ * StartService and StopService cmds are queued for the service they start or
+ * stop, so they're ordered with the service's own cmds.  If a cmd times out,
+ * its timeout reply is sent but the worker waits for the cmd to return before
+ * running the next one, so cmds never overlap.
+ */
+
+const (
+	CMD_QUEUE_PREFIX = "agent-cmd-queue-" // + service, status proc name
+)
+
+// Seconds to wait for a cmd to return before replying with a CmdTimeoutError,
+// except Update, see pct.UPDATE_TIMEOUT.
+var CMD_TIMEOUT uint = 20
+
+type queuedCmd struct {
+	cmd *proto.Cmd
+	ts  time.Time // queued
+}
+
+type cmdQueue struct {
+	agent   *Agent
+	service string
+	workers uint
+	cmdChan chan *queuedCmd
+	stop    chan bool
+	wg      *sync.WaitGroup
+	// --
+	mux     *sync.Mutex
+	running uint
+	stuck   uint // timed out but still running
+	waited  uint64
+	maxWait time.Duration
+	sumWait time.Duration
+}
+
+func newCmdQueue(agent *Agent, service string, workers uint) *cmdQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &cmdQueue{
+		agent:   agent,
+		service: service,
+		workers: workers,
+		cmdChan: make(chan *queuedCmd, CMD_QUEUE_SIZE),
+		stop:    make(chan bool),
+		wg:      &sync.WaitGroup{},
+		mux:     &sync.Mutex{},
+	}
+	return q
+}
+
+func (q *cmdQueue) Start() {
+	for i := uint(0); i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	q.updateStatus()
+}
+
+// Stop stops the workers after their current cmds and waits for them.
+func (q *cmdQueue) Stop() {
+	close(q.stop)
+	q.wg.Wait()
+	q.agent.status.Update(CMD_QUEUE_PREFIX+q.service, "Stopped")
+}
+
+// Queue returns a QueueFullError if the queue is full, else the cmd is run
+// after the cmds queued before it.
+func (q *cmdQueue) Queue(cmd *proto.Cmd) error {
+	select {
+	case q.cmdChan <- &queuedCmd{cmd: cmd, ts: time.Now()}:
+		q.updateStatus()
+		return nil
+	default:
+		return pct.QueueFullError{Cmd: cmd.Cmd, Name: CMD_QUEUE_PREFIX + q.service, Size: CMD_QUEUE_SIZE}
+	}
+}
+
+// cmdQueue:@goroutine[1]
+func (q *cmdQueue) worker() {
+	defer q.wg.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			q.agent.logger.Error(fmt.Sprintf("Agent command queue %s crashed: %s", q.service, err))
+		}
+	}()
+	for {
+		select {
+		case qc := <-q.cmdChan:
+			wait := time.Now().Sub(qc.ts)
+			q.mux.Lock()
+			q.running++
+			q.waited++
+			q.sumWait += wait
+			if wait > q.maxWait {
+				q.maxWait = wait
+			}
+			q.mux.Unlock()
+			q.updateStatus()
+
+			reply, done := q.agent.runCmd(qc.cmd)
+			if reply != nil {
+				q.agent.reply(reply)
+			} else {
+				q.agent.logger.Info(qc.cmd, "executed, no reply")
+			}
+
+			// If the cmd timed out, it's still running, so wait for it to
+			// keep the service's cmds in order.
+			select {
+			case <-done:
+			default:
+				q.mux.Lock()
+				q.stuck++
+				q.mux.Unlock()
+				q.updateStatus()
+				select {
+				case <-done:
+					q.agent.logger.Warn(qc.cmd, "returned after timeout")
+				case <-q.stop:
+					return
+				}
+				q.mux.Lock()
+				q.stuck--
+				q.mux.Unlock()
+			}
+
+			q.mux.Lock()
+			q.running--
+			q.mux.Unlock()
+			q.updateStatus()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+func (q *cmdQueue) updateStatus() {
+	q.mux.Lock()
+	running := q.running
+	stuck := q.stuck
+	var avgWait time.Duration
+	if q.waited > 0 {
+		avgWait = q.sumWait / time.Duration(q.waited)
+	}
+	maxWait := q.maxWait
+	q.mux.Unlock()
+	status := fmt.Sprintf("%d running, %d queued (max %d), wait avg %s max %s",
+		running, len(q.cmdChan), CMD_QUEUE_SIZE, avgWait, maxWait)
+	if stuck > 0 {
+		status += fmt.Sprintf(", %d timed out", stuck)
+	}
+	q.agent.status.Update(CMD_QUEUE_PREFIX+q.service, status)
+}
+
+// cmdQueueName returns the service whose queue the cmd goes into.
+func (agent *Agent) cmdQueueName(cmd *proto.Cmd) string {
+	if cmd.Service == "agent" && (cmd.Cmd == "StartService" || cmd.Cmd == "StopService") {
+		s := &proto.ServiceData{}
+		if err := json.Unmarshal(cmd.Data, s); err == nil {
+			if _, ok := agent.services[s.Name]; ok {
+				return s.Name
+			}
+		}
+		return "agent"
+	}
+	if _, ok := agent.services[cmd.Service]; ok {
+		return cmd.Service
+	}
+	return "agent" // including unknown services, which Handle rejects
+}
+
+// runCmd handles the cmd and returns its reply, or a CmdTimeoutError if the
+// cmd takes too long.  The returned chan is closed when the cmd returns, which
+// is later than the reply if it timed out.
+// cmdQueue:@goroutine[1]
+func (agent *Agent) runCmd(cmd *proto.Cmd) (*proto.Reply, <-chan bool) {
+	cmdReply := make(chan *proto.Reply, 1)
+	done := make(chan bool)
+
+	// Handle the cmd in a separate goroutine so if it gets stuck we can reply.
+	go func() {
+		var reply *proto.Reply
+		defer func() {
+			if err := recover(); err != nil {
+				agent.logger.Error(fmt.Sprintf("Command %s crashed: %s", cmd, err))
+				reply = cmd.Reply(nil, fmt.Errorf("%s", err))
+			}
+			cmdReply <- reply
+			close(done)
+		}()
+		if cmd.Service == "agent" {
+			reply = agent.Handle(cmd)
+		} else {
+			if manager, ok := agent.services[cmd.Service]; ok {
+				reply = manager.Handle(cmd)
+			} else {
+				reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
+			}
+		}
+	}()
+
+	// Wait for the cmd to complete.
+	var timeout <-chan time.Time
+	if cmd.Cmd == "Update" {
+		timeout = time.After(pct.UPDATE_TIMEOUT * time.Second)
+	} else {
+		timeout = time.After(time.Duration(CMD_TIMEOUT) * time.Second)
+	}
+	select {
+	case reply := <-cmdReply:
+		<-done
+		return reply, done
+	case <-timeout:
+		return cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd}), done
+	}
+}
+
+// queueServices returns the services which have a cmd queue: the agent and
+// its services.
+func (agent *Agent) queueServices() []string {
+	services := []string{"agent"}
+	for service := range agent.services {
+		services = append(services, service)
+	}
+	return services
+}
+
+func cmdQueueProcs(services map[string]pct.ServiceManager) []string {
+	procs := []string{CMD_QUEUE_PREFIX + "agent"}
+	for service := range services {
+		procs = append(procs, CMD_QUEUE_PREFIX+service)
+	}
+	return procs
+}
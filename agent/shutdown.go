@@ -0,0 +1,137 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+	"github.com/percona/percona-agent/pct"
+	"sort"
+	"time"
+)
+
+/**
+ * Shutdown stops all services in dependency order so no data is lost: first
+ * the services which produce data (SHUTDOWN_ORDER, then any others), then the
+ * services in DRAIN_ORDER are drained and stopped: mm reports its partial
+ * interval, data writes its spool buffer and makes a last send, and log sends
+ * its buffered entries.  The log service is never stopped so the agent can
+ * keep logging until it exits.  Every step must finish before the deadline
+ * (Config.ShutdownTimeout); steps after the deadline are skipped.
+ */
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 10 // seconds
+)
+
+var SHUTDOWN_ORDER = []string{"qan", "mm", "sysconfig", "query", "sysinfo", "mrms", "instance"}
+var DRAIN_ORDER = []string{"mm", "data", "log"}
+
+// Shutdown is used for signals and the Stop and Restart cmds.  It returns
+// the first error, but every step is tried.
+// @goroutine[0]
+func Shutdown(logger *pct.Logger, services map[string]pct.ServiceManager, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DEFAULT_SHUTDOWN_TIMEOUT * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	logger.Info("Shutting down, timeout", timeout)
+
+	var firstErr error
+	step := func(desc string, f func() error) {
+		if err := shutdownStep(desc, deadline, f); err != nil {
+			logger.Warn(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	for _, name := range shutdownOrder(services) {
+		manager := services[name]
+		step("Stop "+name, manager.Stop)
+	}
+
+	for _, name := range DRAIN_ORDER {
+		manager, ok := services[name]
+		if !ok {
+			continue
+		}
+		drainer, ok := manager.(pct.Drainer)
+		if !ok {
+			continue
+		}
+		step("Drain "+name, func() error {
+			return drainer.Drain(deadline.Sub(time.Now()))
+		})
+	}
+
+	if manager, ok := services["data"]; ok {
+		step("Stop data", manager.Stop)
+	}
+
+	if firstErr == nil {
+		logger.Info("Shut down")
+	}
+	return firstErr
+}
+
+// Services in SHUTDOWN_ORDER, then other services sorted by name, excluding
+// data and log which are stopped last, if at all.
+func shutdownOrder(services map[string]pct.ServiceManager) []string {
+	order := []string{}
+	ordered := map[string]bool{"data": true, "log": true}
+	for _, name := range SHUTDOWN_ORDER {
+		if _, ok := services[name]; ok {
+			order = append(order, name)
+		}
+		ordered[name] = true
+	}
+	others := []string{}
+	for name := range services {
+		if !ordered[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(order, others...)
+}
+
+func shutdownStep(desc string, deadline time.Time, f func() error) error {
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return fmt.Errorf("%s: skipped, shutdown timeout", desc)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				errChan <- fmt.Errorf("crashed: %s", err)
+			}
+		}()
+		errChan <- f()
+	}()
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return fmt.Errorf("%s: %s", desc, err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%s: shutdown timeout", desc)
+	}
+}
@@ -23,10 +23,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
 	"io/ioutil"
 	golog "log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,10 +48,18 @@ type Cli struct {
 	client      *http.Client
 	entryLinks  map[string]string
 	agentLinks  map[string]string
+	metricsAddr string // agent's local metrics store, see metrics()
+	basedir     string // agent's local basedir, see audit()
 }
 
+// Default local address of the agent's metrics store (mm.DEFAULT_STORE_LISTEN).
+const DEFAULT_METRICS_ADDR = "127.0.0.1:9001"
+
 func main() {
-	cli := &Cli{}
+	cli := &Cli{
+		metricsAddr: DEFAULT_METRICS_ADDR,
+		basedir:     pct.DEFAULT_BASEDIR,
+	}
 	cli.Run()
 }
 
@@ -94,6 +106,10 @@ func (cli *Cli) doCmd(args []string) {
 		cli.send(args)
 	case "info":
 		cli.info(args)
+	case "metrics":
+		cli.metrics(args)
+	case "audit":
+		cli.audit(args)
 	default:
 		fmt.Println("Unknown command: " + args[0])
 		return
@@ -104,7 +120,7 @@ func (cli *Cli) doCmd(args []string) {
 }
 
 func (cli *Cli) help() {
-	fmt.Printf("Commands:\n  connect\n  agent\n  status\n  ?\n\n")
+	fmt.Printf("Commands:\n  connect\n  agent\n  status\n  metrics\n  audit\n  ?\n\n")
 	fmt.Printf("Prompt:\n  agent@api>\n  Use 'connect' command to connect to API, then 'agent' command to set agent.\n\n")
 	fmt.Printf("CTRL-C to exit\n\n")
 }
@@ -185,6 +201,154 @@ func (cli *Cli) agent(args []string) {
 	fmt.Printf("Agent links:\n%+v\n\n", cli.agentLinks)
 }
 
+// metrics queries the agent's local metrics store directly, so it works on the
+// agent's host without connecting to the API.
+func (cli *Cli) metrics(args []string) {
+	if len(args) == 3 && args[1] == "addr" {
+		cli.metricsAddr = args[2]
+		return
+	}
+
+	if len(args) != 1 && len(args) != 3 && len(args) != 4 && len(args) != 5 {
+		fmt.Printf("ERROR: Invalid number of args: got %d, expected 1, 3, 4, or 5\n", len(args))
+		fmt.Println("Usage: metrics [service instance-id [metric [minutes]]]")
+		fmt.Println("       metrics addr host:port")
+		fmt.Println("Exmaple: metrics mysql 1 mysql/status/Threads_running 60")
+		return
+	}
+
+	params := url.Values{}
+	if len(args) >= 3 {
+		params.Set("service", args[1])
+		params.Set("instance", args[2])
+	}
+	if len(args) >= 4 {
+		params.Set("metric", args[3])
+	}
+	if len(args) == 5 {
+		minutes, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || minutes < 1 {
+			fmt.Printf("ERROR: Invalid minutes: %s\n", args[4])
+			return
+		}
+		params.Set("begin", fmt.Sprintf("%d", time.Now().UTC().Unix()-minutes*60))
+	}
+
+	queryUrl := "http://" + cli.metricsAddr + "/metrics?" + params.Encode()
+	resp, err := http.Get(queryUrl)
+	if err != nil {
+		golog.Printf("GET %s error: %s", queryUrl, err)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		golog.Printf("GET %s error: %s", queryUrl, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("ERROR: %s", string(data))
+		return
+	}
+
+	if len(args) < 4 {
+		names := []string{}
+		if err := json.Unmarshal(data, &names); err != nil {
+			golog.Printf("GET %s error: json.Unmarshal: %s: %s", queryUrl, err, string(data))
+			return
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	points := []struct {
+		Ts  int64
+		Val float64
+	}{}
+	if err := json.Unmarshal(data, &points); err != nil {
+		golog.Printf("GET %s error: json.Unmarshal: %s: %s", queryUrl, err, string(data))
+		return
+	}
+	for _, p := range points {
+		fmt.Printf("%s %v\n", time.Unix(p.Ts, 0).UTC().Format("2006-01-02 15:04:05"), p.Val)
+	}
+}
+
+// audit searches the agent's local audit log of commands received from the
+// API, so it works on the agent's host without connecting to the API.
+func (cli *Cli) audit(args []string) {
+	if len(args) == 3 && args[1] == "basedir" {
+		cli.basedir = args[2]
+		return
+	}
+
+	filter := pct.AuditFilter{}
+	showData := false
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			fmt.Printf("ERROR: Invalid arg: %s: expected key=value\n", arg)
+			fmt.Println("Usage: audit [since=time] [until=time] [user=user] [service=service] [cmd=cmd] [id=cmd-id] [errors=yes] [data=yes]")
+			fmt.Println("       audit basedir dir")
+			fmt.Println("Time is a duration ago (e.g. 24h) or YYYY-MM-DDTHH:MM:SSZ")
+			fmt.Println("Exmaple: audit since=24h service=mysql errors=yes")
+			return
+		}
+		var err error
+		switch kv[0] {
+		case "since":
+			filter.Since, err = auditTime(kv[1])
+		case "until":
+			filter.Until, err = auditTime(kv[1])
+		case "user":
+			filter.User = kv[1]
+		case "service":
+			filter.Service = kv[1]
+		case "cmd":
+			filter.Cmd = kv[1]
+		case "id":
+			filter.CmdId = kv[1]
+		case "errors":
+			filter.ErrorsOnly = kv[1] == "yes"
+		case "data":
+			showData = kv[1] == "yes"
+		default:
+			err = fmt.Errorf("unknown key: %s", kv[0])
+		}
+		if err != nil {
+			fmt.Printf("ERROR: Invalid arg: %s: %s\n", arg, err)
+			return
+		}
+	}
+
+	file := filepath.Join(cli.basedir, pct.AUDIT_FILE)
+	records, err := pct.SearchAuditLog(file, filter)
+	if err != nil {
+		golog.Println(err)
+	}
+	for _, rec := range records {
+		errMsg := "OK"
+		if rec.Error != "" {
+			errMsg = "ERROR: " + rec.Error
+		}
+		fmt.Printf("%s %s user=%s service=%s cmd=%s duration=%s %s\n",
+			rec.Ts.Format("2006-01-02 15:04:05"), rec.CmdId, rec.User, rec.Service, rec.Cmd, rec.Duration, errMsg)
+		if showData && rec.DataSHA256 != "" {
+			fmt.Printf("  data sha256=%s %s\n", rec.DataSHA256, rec.Data)
+		}
+	}
+	fmt.Printf("%d commands in %s\n", len(records), file)
+}
+
+func auditTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
 func (cli *Cli) status(args []string) {
 	if !cli.connected {
 		fmt.Println("Not connected to API.  Use 'connect' command.")
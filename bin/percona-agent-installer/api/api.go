@@ -370,3 +370,15 @@ func (a *Api) GetQanConfig(mi *proto.MySQLInstance) (*proto.AgentConfig, error)
 	}
 	return agentConfig, nil
 }
+
+// CreateAgentCert gets a cert for a new agent key, so the agent can
+// authenticate as itself rather than with the API key.
+func (a *Api) CreateAgentCert(agentUuid string) error {
+	// POST <api>/agents/:uuid/cert
+	url := a.apiConnector.URL("agents", agentUuid, "cert")
+	err := pct.NewAgentCert(a.apiConnector, a.apiConnector.ApiKey(), url, agentUuid)
+	if a.debug {
+		log.Printf("err=%s\n", err)
+	}
+	return err
+}
@@ -63,11 +63,16 @@ func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanc
 	}
 	hostname, _ := os.Hostname()
 	defaultDSN := mysql.DSN{
-		Username: flags.String["mysql-user"],
-		Password: flags.String["mysql-pass"],
-		Hostname: flags.String["mysql-host"],
-		Port:     flags.String["mysql-port"],
-		Socket:   flags.String["mysql-socket"],
+		Username:                flags.String["mysql-user"],
+		Password:                flags.String["mysql-pass"],
+		Hostname:                flags.String["mysql-host"],
+		Port:                    flags.String["mysql-port"],
+		Socket:                  flags.String["mysql-socket"],
+		SSLMode:                 flags.String["mysql-ssl-mode"],
+		SSLCA:                   flags.String["mysql-ssl-ca"],
+		SSLCert:                 flags.String["mysql-ssl-cert"],
+		SSLKey:                  flags.String["mysql-ssl-key"],
+		AllowCleartextPasswords: flags.Bool["mysql-cleartext-passwords"],
 	}
 	installer := &Installer{
 		term:         terminal,
@@ -109,6 +114,16 @@ func (i *Installer) Run() (err error) {
 		// To save data we need agent config with uuid and links
 		i.agentConfig.AgentUuid = protoAgent.Uuid
 		i.agentConfig.Links = protoAgent.Links
+
+		// Give the agent its own identity so it doesn't need the API key.
+		if i.flags.Bool["agent-cert"] {
+			if err := i.api.CreateAgentCert(protoAgent.Uuid); err != nil {
+				fmt.Printf("WARNING: cannot create agent certificate, agent will use API key: %s\n", err)
+			} else {
+				fmt.Println("Created agent certificate")
+				i.agentConfig.ApiKey = ""
+			}
+		}
 	}
 
 	/**
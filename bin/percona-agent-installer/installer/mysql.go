@@ -39,12 +39,17 @@ func MakeGrant(dsn mysql.DSN, user string, pass string, mysqlMaxUserConns int64)
 	} else if dsn.Hostname == "127.0.0.1" {
 		host = "127.0.0.1"
 	}
+	// If the agent connects with TLS, the agent user must too.
+	require := ""
+	if dsn.UsesTLS() {
+		require = " REQUIRE SSL"
+	}
 	// Creating/updating a user's password doesn't work correctly if old_passwords is active.
 	// Just in case, disable it for this session
 	grants := []string{
 		"SET SESSION old_passwords=0",
-		fmt.Sprintf("GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
-		fmt.Sprintf("GRANT UPDATE, DELETE, DROP ON performance_schema.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
+		fmt.Sprintf("GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO '%s'@'%s' IDENTIFIED BY '%s'%s WITH MAX_USER_CONNECTIONS %d", user, host, pass, require, mysqlMaxUserConns),
+		fmt.Sprintf("GRANT UPDATE, DELETE, DROP ON performance_schema.* TO '%s'@'%s' IDENTIFIED BY '%s'%s WITH MAX_USER_CONNECTIONS %d", user, host, pass, require, mysqlMaxUserConns),
 	}
 	return grants
 }
@@ -156,6 +161,8 @@ func (i *Installer) createMySQLUser(dsn mysql.DSN) (mysql.DSN, error) {
 	userDSN.Username = "percona-agent"
 	userDSN.Password = fmt.Sprintf("%p%d", &dsn, rand.Uint32())
 	userDSN.OldPasswords = i.flags.Bool["old-passwords"]
+	// Agent's connection pool must fit in the user's MAX_USER_CONNECTIONS.
+	userDSN.MaxOpenConns = i.flags.Int64["mysql-max-user-connections"]
 
 	dsnString, _ := dsn.DSN()
 	conn := mysql.NewConnection(dsnString)
@@ -80,6 +80,18 @@ func (s *MySQLTestSuite) TestMakeGrant(t *C) {
 		"GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'new-user'@'localhost' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 1",
 	}
 	t.Check(got, DeepEquals, expect)
+
+	// Agent user must use TLS if the agent does.
+	dsn.Socket = ""
+	dsn.Hostname = "10.1.1.1"
+	dsn.SSLMode = "required"
+	got = i.MakeGrant(dsn, user, pass, maxOpenConnections)
+	expect = []string{
+		"SET SESSION old_passwords=0",
+		"GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' REQUIRE SSL WITH MAX_USER_CONNECTIONS 1",
+		"GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' REQUIRE SSL WITH MAX_USER_CONNECTIONS 1",
+	}
+	t.Check(got, DeepEquals, expect)
 }
 
 func (s *MySQLTestSuite) TestParseMySQLDefaults(t *C) {
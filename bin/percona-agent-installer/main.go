@@ -26,6 +26,7 @@ import (
 	"github.com/percona/percona-agent/bin/percona-agent-installer/installer"
 	"github.com/percona/percona-agent/bin/percona-agent-installer/term"
 	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"log"
 	"os"
@@ -60,6 +61,18 @@ var (
 	flagMySQLPort               string
 	flagMySQLSocket             string
 	flagMySQLMaxUserConnections int64
+	flagMySQLSSLMode            string
+	flagMySQLSSLCA              string
+	flagMySQLSSLCert            string
+	flagMySQLSSLKey             string
+	flagMySQLCleartextPasswords bool
+	flagProxy                   string
+	flagNoProxy                 string
+	flagCAFile                  string
+	flagCertFile                string
+	flagKeyFile                 string
+	flagAgentCert               bool
+	flagConfigKey               string
 )
 
 func init() {
@@ -91,6 +104,18 @@ func init() {
 	flag.StringVar(&flagMySQLPort, "mysql-port", "", "MySQL port")
 	flag.StringVar(&flagMySQLSocket, "mysql-socket", "", "MySQL socket file")
 	flag.Int64Var(&flagMySQLMaxUserConnections, "mysql-max-user-connections", 5, "Max number of MySQL connections")
+	flag.StringVar(&flagMySQLSSLMode, "mysql-ssl-mode", "", "MySQL TLS: DISABLED, REQUIRED, VERIFY_CA, or VERIFY_IDENTITY (default: VERIFY_CA if -mysql-ssl-ca)")
+	flag.StringVar(&flagMySQLSSLCA, "mysql-ssl-ca", "", "PEM CA file to verify MySQL server cert (default: system CAs)")
+	flag.StringVar(&flagMySQLSSLCert, "mysql-ssl-cert", "", "PEM client cert file for MySQL")
+	flag.StringVar(&flagMySQLSSLKey, "mysql-ssl-key", "", "PEM client key file for -mysql-ssl-cert")
+	flag.BoolVar(&flagMySQLCleartextPasswords, "mysql-cleartext-passwords", false, "Allow cleartext MySQL passwords (PAM, LDAP auth); requires TLS or socket")
+	flag.StringVar(&flagProxy, "proxy", "", "HTTP proxy for API connections, http://[user:pass@]host:port (default: HTTPS_PROXY), or none")
+	flag.StringVar(&flagNoProxy, "no-proxy", "", "Comma-separated hosts not to proxy (default: NO_PROXY)")
+	flag.StringVar(&flagCAFile, "ca-file", "", "PEM CA bundle to verify API connections")
+	flag.StringVar(&flagCertFile, "cert-file", "", "PEM client certificate for API connections")
+	flag.StringVar(&flagKeyFile, "key-file", "", "PEM client key for -cert-file")
+	flag.BoolVar(&flagAgentCert, "agent-cert", true, "Create agent certificate so agent does not store API key")
+	flag.StringVar(&flagConfigKey, "config-key", "", "Key to encrypt sensitive config values: file:PATH, keyring:NAME, or env:VAR (default $"+pct.CONFIG_KEY_ENV+")")
 }
 
 func main() {
@@ -106,6 +131,11 @@ func main() {
 	agentConfig := &agent.Config{
 		ApiHostname: flagApiHostname,
 		ApiKey:      flagApiKey,
+		Proxy:       flagProxy,
+		NoProxy:     flagNoProxy,
+		CAFile:      flagCAFile,
+		CertFile:    flagCertFile,
+		KeyFile:     flagKeyFile,
 	}
 	// todo: do flags a better way
 	if !flagMySQL {
@@ -123,20 +153,28 @@ func main() {
 		os.Exit(1)
 	}
 
+	mysqlTLS := mysql.DSN{SSLMode: flagMySQLSSLMode, SSLCA: flagMySQLSSLCA, SSLCert: flagMySQLSSLCert, SSLKey: flagMySQLSSLKey}
+	if flagMySQLCleartextPasswords && flagMySQLSocket == "" && !mysqlTLS.UsesTLS() {
+		log.Println("Option -mysql-cleartext-passwords requires -mysql-ssl-mode or -mysql-socket")
+		os.Exit(1)
+	}
+
 	flags := installer.Flags{
 		Bool: map[string]bool{
-			"debug":                  flagDebug,
-			"create-server-instance": flagCreateServerInstance,
-			"start-services":         flagStartServices,
-			"create-mysql-instance":  flagCreateMySQLInstance,
-			"start-mysql-services":   flagStartMySQLServices,
-			"create-agent":           flagCreateAgent,
-			"old-passwords":          flagOldPasswords,
-			"plain-passwords":        flagPlainPasswords,
-			"interactive":            flagInteractive,
-			"auto-detect-mysql":      flagAutoDetectMySQL,
-			"create-mysql-user":      flagCreateMySQLUser,
-			"mysql":                  flagMySQL,
+			"debug":                     flagDebug,
+			"create-server-instance":    flagCreateServerInstance,
+			"start-services":            flagStartServices,
+			"create-mysql-instance":     flagCreateMySQLInstance,
+			"start-mysql-services":      flagStartMySQLServices,
+			"create-agent":              flagCreateAgent,
+			"old-passwords":             flagOldPasswords,
+			"plain-passwords":           flagPlainPasswords,
+			"interactive":               flagInteractive,
+			"auto-detect-mysql":         flagAutoDetectMySQL,
+			"create-mysql-user":         flagCreateMySQLUser,
+			"mysql":                     flagMySQL,
+			"agent-cert":                flagAgentCert,
+			"mysql-cleartext-passwords": flagMySQLCleartextPasswords,
 		},
 		String: map[string]string{
 			"app-host":            DEFAULT_APP_HOSTNAME,
@@ -148,6 +186,10 @@ func main() {
 			"mysql-host":          flagMySQLHost,
 			"mysql-port":          flagMySQLPort,
 			"mysql-socket":        flagMySQLSocket,
+			"mysql-ssl-mode":      flagMySQLSSLMode,
+			"mysql-ssl-ca":        flagMySQLSSLCA,
+			"mysql-ssl-cert":      flagMySQLSSLCert,
+			"mysql-ssl-key":       flagMySQLSSLKey,
 		},
 		Int64: map[string]int64{
 			"mysql-max-user-connections": flagMySQLMaxUserConnections,
@@ -161,6 +203,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Encrypt the API key, MySQL DSNs, etc. in configs if there's a key.
+	// The agent must be started with the same key.
+	configKey, err := pct.LoadConfigKey(flagConfigKey)
+	if err != nil {
+		log.Printf("Invalid config key: %s\n", err)
+		os.Exit(1)
+	}
+	if err := pct.SetConfigKey(configKey); err != nil {
+		log.Printf("Invalid config key: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Proxy and TLS settings for all connections to API.  They're saved in
+	// the agent config, so the agent uses them too.
+	if err := pct.Transport.Init(agentConfig.TransportConfig()); err != nil {
+		log.Printf("Invalid proxy or TLS options: %s\n", err)
+		os.Exit(1)
+	}
+
 	apiConnector := pct.NewAPI()
 	api := api.New(apiConnector, flagDebug)
 	logChan := make(chan *proto.LogEntry, 100)
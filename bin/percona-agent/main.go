@@ -23,6 +23,8 @@ import (
 	"flag"
 	"fmt"
 	golog "log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
@@ -37,23 +39,12 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/log"
 	"github.com/percona/percona-agent/mm"
-	mmMonitor "github.com/percona/percona-agent/mm/monitor"
 	"github.com/percona/percona-agent/mrms"
 	mrmsMonitor "github.com/percona/percona-agent/mrms/monitor"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	pctCmd "github.com/percona/percona-agent/pct/cmd"
-	"github.com/percona/percona-agent/qan"
-	qanFactory "github.com/percona/percona-agent/qan/factory"
-	"github.com/percona/percona-agent/qan/perfschema"
-	"github.com/percona/percona-agent/qan/slowlog"
-	"github.com/percona/percona-agent/query"
-	queryService "github.com/percona/percona-agent/query/service"
-	"github.com/percona/percona-agent/sysconfig"
-	sysconfigMonitor "github.com/percona/percona-agent/sysconfig/monitor"
-	"github.com/percona/percona-agent/sysinfo"
-	mysqlSysinfo "github.com/percona/percona-agent/sysinfo/mysql"
-	systemSysinfo "github.com/percona/percona-agent/sysinfo/system"
+	"github.com/percona/percona-agent/plugin"
 	"github.com/percona/percona-agent/ticker"
 )
 
@@ -63,6 +54,14 @@ var (
 	flagBasedir string
 	flagPidFile string
 	flagVersion bool
+	// --
+	flagConfigKey     string
+	flagEncryptConfig bool
+	flagPolicy        string
+	flagConfirm       string
+	flagCmdPublicKey  string
+	flagStandalone    bool
+	flagLogFile       string
 )
 
 func init() {
@@ -74,6 +73,13 @@ func init() {
 	flag.StringVar(&flagBasedir, "basedir", pct.DEFAULT_BASEDIR, "Agent basedir")
 	flag.StringVar(&flagPidFile, "pidfile", agent.DEFAULT_PIDFILE, "PID file")
 	flag.BoolVar(&flagVersion, "version", false, "Print version")
+	flag.StringVar(&flagConfigKey, "config-key", "", "Key to encrypt configs: file:PATH, keyring:NAME, or env:VAR (default $"+pct.CONFIG_KEY_ENV+")")
+	flag.BoolVar(&flagEncryptConfig, "encrypt-config", false, "Encrypt sensitive values in existing configs with the config key, then exit")
+	flag.StringVar(&flagPolicy, "policy", pct.DEFAULT_POLICY_FILE, "Local policy file of commands the API may run")
+	flag.StringVar(&flagConfirm, "confirm", "", "Confirm the next service/cmd command (e.g. agent/Update) which the policy requires confirmation for, then exit")
+	flag.StringVar(&flagCmdPublicKey, "cmd-public-key", pct.DEFAULT_CMD_PUBLIC_KEY_FILE, "PEM public key to verify signed commands; if the file exists, unsigned commands are rejected")
+	flag.BoolVar(&flagStandalone, "standalone", false, "Run without the API, from local config files; data is saved locally")
+	flag.StringVar(&flagLogFile, "log-file", "", "File that stdout and stderr are redirected to (>> FILE 2>&1); it's rotated by copy-truncate like the log config")
 	flag.Parse()
 	// We don't accept any possitional arguments
 	if len(flag.Args()) != 0 {
@@ -99,6 +105,46 @@ func run() error {
 		return err
 	}
 
+	// Config key to decrypt and encrypt sensitive config values (API key,
+	// MySQL DSNs, etc.).  It's optional: without it, configs are plain text.
+	configKey, err := pct.LoadConfigKey(flagConfigKey)
+	if err != nil {
+		return err
+	}
+	if err := pct.SetConfigKey(configKey); err != nil {
+		return err
+	}
+	if flagEncryptConfig {
+		if configKey == nil {
+			return fmt.Errorf("-encrypt-config requires a config key: set -config-key or $%s", pct.CONFIG_KEY_ENV)
+		}
+		files, err := pct.EncryptConfigFiles(pct.Basedir.Dir("config"))
+		for _, file := range files {
+			fmt.Println("Encrypted " + file)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Encrypted %d config files\n", len(files))
+		return nil
+	}
+
+	// Local command policy: what the API is allowed to make the agent do.
+	if flagConfirm != "" {
+		if err := pct.ConfirmCmd(flagConfirm); err != nil {
+			return err
+		}
+		fmt.Printf("Confirmed %s for %s\n", flagConfirm, pct.CONFIRM_TTL)
+		return nil
+	}
+	policy, err := pct.LoadCmdPolicy(flagPolicy)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		golog.Println("Command policy: " + policy.File())
+	}
+
 	// Start-lock file is used to let agent1 self-update, create start-lock,
 	// start updated agent2, exit cleanly, then agent2 starts.  agent1 may
 	// not use a PID file, so this special file is required.
@@ -112,21 +158,54 @@ func run() error {
 	 * Agent config (require API key and agent UUID)
 	 */
 
-	if !pct.FileExists(pct.Basedir.ConfigFile("agent")) {
-		return fmt.Errorf("Agent config file %s does not exist", pct.Basedir.ConfigFile("agent"))
+	var agentConfig *agent.Config
+	if flagStandalone {
+		agentConfig, err = agent.LoadStandaloneConfig()
+		if err != nil {
+			return fmt.Errorf("Invalid agent config: %s\n", err)
+		}
+	} else {
+		if !pct.FileExists(pct.Basedir.ConfigFile("agent")) {
+			return fmt.Errorf("Agent config file %s does not exist", pct.Basedir.ConfigFile("agent"))
+		}
+		bytes, err := agent.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("Invalid agent config: %s\n", err)
+		}
+		agentConfig = &agent.Config{}
+		if err := json.Unmarshal(bytes, agentConfig); err != nil {
+			return fmt.Errorf("Error parsing "+pct.Basedir.ConfigFile("agent")+": ", err)
+		}
 	}
 
-	bytes, err := agent.LoadConfig()
-	if err != nil {
-		return fmt.Errorf("Invalid agent config: %s\n", err)
-	}
-	agentConfig := &agent.Config{}
-	if err := json.Unmarshal(bytes, agentConfig); err != nil {
-		return fmt.Errorf("Error parsing "+pct.Basedir.ConfigFile("agent")+": ", err)
-	}
+	// Standalone agents don't connect to the API: there are no cmds, log relay,
+	// instance info pushes, or updates, and data is saved locally.
+	standalone := agentConfig.Standalone
+	var cmdVerifier *pct.CmdVerifier
+	if standalone {
+		golog.Println("Standalone: not using the API")
+		if flagPing || flagStatus {
+			return fmt.Errorf("-ping and -status require the API, but the agent is standalone")
+		}
+	} else {
+		golog.Println("ApiHostname: " + agentConfig.ApiHostname)
+		golog.Println("AgentUuid: " + agentConfig.AgentUuid)
 
-	golog.Println("ApiHostname: " + agentConfig.ApiHostname)
-	golog.Println("AgentUuid: " + agentConfig.AgentUuid)
+		// Proxy and TLS settings for all connections to API, REST and websockets.
+		if err := pct.Transport.Init(agentConfig.TransportConfig()); err != nil {
+			return fmt.Errorf("Invalid agent config: %s\n", err)
+		}
+
+		// Command signing: if the host owner installed the public key, only
+		// commands signed with its private key are accepted.
+		cmdVerifier, err = pct.LoadCmdVerifier(flagCmdPublicKey, agentConfig.AgentUuid)
+		if err != nil {
+			return err
+		}
+		if cmdVerifier != nil {
+			golog.Println("Signed commands required: " + flagCmdPublicKey)
+		}
+	}
 
 	/**
 	 * Ping and exit, maybe.
@@ -170,30 +249,34 @@ func run() error {
 	 * REST API
 	 */
 
-	retry := -1 // unlimited
-	if flagStatus {
-		retry = 1
-	}
-	api, err := ConnectAPI(agentConfig, retry)
-	if err != nil {
-		golog.Fatal(err)
-	}
-
-	// Get agent status via API and exit.
-	if flagStatus {
-		code, bytes, err := api.Get(agentConfig.ApiKey, api.AgentLink("self")+"/status")
-		if err != nil {
-			return err
+	var api pct.APIConnector // nil if standalone
+	if !standalone {
+		retry := -1 // unlimited
+		if flagStatus {
+			retry = 1
 		}
-		if code == 404 {
-			return fmt.Errorf("Agent not found")
+		realAPI, err := ConnectAPI(agentConfig, retry)
+		if err != nil {
+			golog.Fatal(err)
 		}
-		status := make(map[string]string)
-		if err := json.Unmarshal(bytes, &status); err != nil {
-			return err
+		api = realAPI
+
+		// Get agent status via API and exit.
+		if flagStatus {
+			code, bytes, err := api.Get(agentConfig.ApiKey, api.AgentLink("self")+"/status")
+			if err != nil {
+				return err
+			}
+			if code == 404 {
+				return fmt.Errorf("Agent not found")
+			}
+			status := make(map[string]string)
+			if err := json.Unmarshal(bytes, &status); err != nil {
+				return err
+			}
+			golog.Println(status)
+			return nil
 		}
-		golog.Println(status)
-		return nil
 	}
 
 	/**
@@ -207,10 +290,14 @@ func run() error {
 
 	logChan := make(chan *proto.LogEntry, log.BUFFER_SIZE*3)
 
-	// Log websocket client, possibly disabled later.
-	logClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "log-ws"), api, "log", headers)
-	if err != nil {
-		golog.Fatalln(err)
+	// Log websocket client, possibly disabled later.  None if standalone.
+	var logClient pct.WebsocketClient
+	if !standalone {
+		wsClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "log-ws"), api, "log", headers)
+		if err != nil {
+			golog.Fatalln(err)
+		}
+		logClient = wsClient
 	}
 	logManager := log.NewManager(
 		logClient,
@@ -220,6 +307,14 @@ func run() error {
 		return fmt.Errorf("Error starting logmanager: %s\n", err)
 	}
 
+	// The shell owns the stdout log file, so it can't be reopened, but we
+	// can rotate it like the log file.
+	if flagLogFile != "" {
+		stopRotateChan := make(chan bool)
+		defer close(stopRotateChan)
+		go log.RotateRedirected(flagLogFile, logManager.RotateConfig, stopRotateChan)
+	}
+
 	/**
 	 * MRMS (MySQL Restart Monitoring Service)
 	 */
@@ -254,9 +349,14 @@ func run() error {
 
 	hostname, _ := os.Hostname()
 
-	dataClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "data-ws"), api, "data", headers)
-	if err != nil {
-		golog.Fatalln(err)
+	// Data websocket client.  None if standalone: data is saved locally.
+	var dataClient pct.WebsocketClient
+	if !standalone {
+		wsClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "data-ws"), api, "data", headers)
+		if err != nil {
+			golog.Fatalln(err)
+		}
+		dataClient = wsClient
 	}
 	dataManager := data.NewManager(
 		pct.NewLogger(logChan, "data"),
@@ -277,184 +377,183 @@ func run() error {
 	clock := ticker.NewClock(&ticker.RealTickerFactory{}, nowFunc)
 
 	/**
-	 * Metric and system config monitors
+	 * Local metrics store: recent raw metrics queryable on the host
 	 */
 
-	mmManager := mm.NewManager(
-		pct.NewLogger(logChan, "mm"),
-		mmMonitor.NewFactory(logChan, itManager.Repo(), mrm),
-		clock,
-		dataManager.Spooler(),
-		itManager.Repo(),
-		mrm,
-	)
-	if err := mmManager.Start(); err != nil {
-		return fmt.Errorf("Error starting mm manager: %s\n", err)
-	}
-
-	sysconfigManager := sysconfig.NewManager(
-		pct.NewLogger(logChan, "sysconfig"),
-		sysconfigMonitor.NewFactory(logChan, itManager.Repo()),
-		clock,
-		dataManager.Spooler(),
-		itManager.Repo(),
-	)
-	if err := sysconfigManager.Start(); err != nil {
-		return fmt.Errorf("Error starting sysconfig manager: %s\n", err)
-	}
-
-	/**
-	 * Query service
-	 */
-	explainService := queryService.NewExplain(
-		pct.NewLogger(logChan, "query-explain"),
-		&mysql.RealConnectionFactory{},
-		itManager.Repo(),
-	)
-	queryManager := query.NewManager(
-		pct.NewLogger(logChan, "query"),
-		explainService,
-	)
-	if err := queryManager.Start(); err != nil {
-		return fmt.Errorf("Error starting query manager: %s\n", err)
+	storeConfig := &mm.StoreConfig{} // disabled unless configured
+	if err := pct.Basedir.ReadConfig("metrics", storeConfig); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Invalid metrics config: %s\n", err)
+	}
+	sinks := []mm.CollectionSink{}
+	if storeConfig.Retention > 0 {
+		store := mm.NewStore(
+			pct.NewLogger(logChan, "mm-store"),
+			pct.Basedir.Dir("metrics"),
+			storeConfig.Retention,
+		)
+		store.Start()
+		defer store.Close()
+		sinks = append(sinks, store)
+		if storeConfig.Listen != "" {
+			// Queries are not authenticated.
+			if host, _, err := net.SplitHostPort(storeConfig.Listen); err == nil {
+				if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+					golog.Println("WARNING: serving metrics on non-loopback address " + storeConfig.Listen)
+				}
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", store)
+			go func() {
+				logger := pct.NewLogger(logChan, "mm-store")
+				if err := http.ListenAndServe(storeConfig.Listen, mux); err != nil {
+					logger.Error("Cannot serve metrics on " + storeConfig.Listen + ": " + err.Error())
+				}
+			}()
+		}
 	}
 
 	/**
-	 * Query Analytics
+	 * Alerting on collected metrics
 	 */
 
-	qanManager := qan.NewManager(
-		pct.NewLogger(logChan, "qan"),
-		clock,
-		itManager.Repo(),
-		mrm,
-		connFactory,
-		qanFactory.NewRealAnalyzerFactory(
-			logChan,
-			qanFactory.NewRealIntervalIterFactory(logChan),
-			slowlog.NewRealWorkerFactory(logChan),
-			perfschema.NewRealWorkerFactory(logChan),
+	alertConfig := &mm.AlertConfig{}
+	if err := pct.Basedir.ReadConfig("alert", alertConfig); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Invalid alert config: %s\n", err)
+	}
+	if len(alertConfig.Rules) > 0 {
+		alerter, err := mm.NewAlerter(
+			pct.NewLogger(logChan, "mm-alert"),
 			dataManager.Spooler(),
-			clock,
-		),
-	)
-
-	if err := qanManager.Start(); err != nil {
-		return fmt.Errorf("Error starting qan manager: %s\n", err)
+			alertConfig,
+		)
+		if err != nil {
+			return fmt.Errorf("Invalid alert config: %s\n", err)
+		}
+		alerter.Start()
+		defer alerter.Stop()
+		sinks = append(sinks, alerter)
 	}
 
 	/**
-	 * Sysinfo
+	 * Plugins: mm, qan, etc. (see plugins.go) and external collectors
 	 */
-	sysinfoManager := sysinfo.NewManager(
-		pct.NewLogger(logChan, "sysinfo"),
-	)
-
-	// MySQL Sysinfo
-	mysqlSysinfoService := mysqlSysinfo.NewMySQL(
-		pct.NewLogger(logChan, "sysinfo-mysql"),
-		itManager.Repo(),
-	)
-	if err := sysinfoManager.RegisterService("MySQLSummary", mysqlSysinfoService); err != nil {
-		return fmt.Errorf("Error registering Mysql Sysinfo service: %s\n", err)
-	}
-
-	// System Sysinfo
-	systemSysinfoService := systemSysinfo.NewSystem(
-		pct.NewLogger(logChan, "sysinfo-system"),
-	)
-	if err := sysinfoManager.RegisterService("SystemSummary", systemSysinfoService); err != nil {
-		return fmt.Errorf("Error registering System Sysinfo service: %s\n", err)
-	}
 
-	// Start Sysinfo manager
-	if err := sysinfoManager.Start(); err != nil {
-		return fmt.Errorf("Error starting Sysinfo manager: %s\n", err)
+	// The core services which the plugins depend on.  Adding a new service only
+	// requires registering it as a plugin, see plugin.Register.
+	services := map[string]pct.ServiceManager{
+		"log":      logManager,
+		"data":     dataManager,
+		"instance": itManager,
+		"mrms":     mrmsManager,
+	}
+	deps := plugin.Deps{
+		LogChan:     logChan,
+		Spooler:     dataManager.Spooler(),
+		Clock:       clock,
+		Repo:        itManager.Repo(),
+		MRMS:        mrm,
+		ConnFactory: connFactory,
+		Sinks:       sinks,
+	}
+	started, err := plugin.StartAll(deps, services)
+	if err != nil {
+		return err
 	}
-
-	/**
-	 * Signal handler
-	 */
-
-	// Generally the agent has a crash-only design, but QAN is so far the only service
-	// which reconfigures MySQL: it enables the slow log, sets long_query_time, etc.
-	// It's not terrible to leave slow log on, but it's nicer to turn it off.
-	sigChan := make(chan os.Signal, 1)
-	stopChan := make(chan error, 2)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		sig := <-sigChan
-		golog.Printf("Caught %s signal, shutting down...\n", sig)
-		stopChan <- qanManager.Stop()
-	}()
+	golog.Printf("Started services: %v\n", started)
 
 	/**
 	 * Agent
 	 */
 
-	cmdClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "agent-ws"), api, "cmd", headers)
-	if err != nil {
-		golog.Fatal(err)
+	// Standalone, the services run from their config files until stopped
+	// by a signal, without an agent to handle cmds from the API.
+	var runningAgent *agent.Agent
+	stopChan := make(chan error, 1)
+	allStatus := func() map[string]string {
+		status := map[string]string{}
+		for _, manager := range services {
+			for k, v := range manager.Status() {
+				status[k] = v
+			}
+		}
+		return status
 	}
 
-	// The official list of services known to the agent.  Adding a new service
-	// requires a manager, starting the manager as above, and adding the manager
-	// to this map.
-	services := map[string]pct.ServiceManager{
-		"log":       logManager,
-		"data":      dataManager,
-		"qan":       qanManager,
-		"mm":        mmManager,
-		"instance":  itManager,
-		"mrms":      mrmsManager,
-		"sysconfig": sysconfigManager,
-		"query":     queryManager,
-		"sysinfo":   sysinfoManager,
-	}
-
-	// Set the global pct/cmd.Factory, used for the Restart cmd.
-	pctCmd.Factory = &pctCmd.RealCmdFactory{}
-
-	agent := agent.NewAgent(
-		agentConfig,
-		pct.NewLogger(logChan, "agent"),
-		api,
-		cmdClient,
-		services,
-	)
-
-	/**
-	 * Run agent, wait for it to stop, signal, or crash.
-	 */
+	if !standalone {
+		audit := pct.NewAuditLog(pct.Basedir.File("audit-log"), pct.AUDIT_MAX_SIZE)
 
-	var stopErr error
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				errMsg := fmt.Sprintf("Agent crashed: %s", err)
-				logger := pct.NewLogger(logChan, "agent")
-				logger.Error(errMsg)
-				stopChan <- fmt.Errorf("%s", errMsg)
-			}
+		cmdClient, err := client.NewWebsocketClient(pct.NewLogger(logChan, "agent-ws"), api, "cmd", headers)
+		if err != nil {
+			golog.Fatal(err)
+		}
+		cmdClient.SetCmdVerifier(cmdVerifier, audit)
+
+		// Set the global pct/cmd.Factory, used for the Restart cmd.
+		pctCmd.Factory = &pctCmd.RealCmdFactory{}
+
+		runningAgent = agent.NewAgent(
+			agentConfig,
+			pct.NewLogger(logChan, "agent"),
+			api,
+			cmdClient,
+			services,
+			policy,
+			audit,
+		)
+		allStatus = runningAgent.AllStatus
+
+		/**
+		 * Run agent, wait for it to stop, signal, or crash.
+		 */
+
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					errMsg := fmt.Sprintf("Agent crashed: %s", err)
+					logger := pct.NewLogger(logChan, "agent")
+					logger.Error(errMsg)
+					stopChan <- fmt.Errorf("%s", errMsg)
+				}
+			}()
+			stopChan <- runningAgent.Run()
 		}()
-		stopChan <- agent.Run()
-	}()
+	}
 
-	// Wait for agent to stop, or for signals.
+	// Wait for agent to stop, or for signals.  On SIGTERM, the services are
+	// shut down like the Stop cmd does, see agent.Shutdown(): QAN turns off
+	// the slow log it enabled, mm reports its partial interval, etc.
+	var stopErr error
+	shutdown := true // false if the agent did it (Stop or Restart cmd)
 	agentRunning := true
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	statusSigChan := make(chan os.Signal, 1)
 	signal.Notify(statusSigChan, syscall.SIGUSR1) // kill -USER1 PID
 	reconnectSigChan := make(chan os.Signal, 1)
 	signal.Notify(reconnectSigChan, syscall.SIGHUP) // kill -HUP PID
+	reopenSigChan := make(chan os.Signal, 1)
+	signal.Notify(reopenSigChan, syscall.SIGUSR2) // kill -USR2 PID, e.g. logrotate postrotate
 	for agentRunning {
 		select {
-		case stopErr = <-stopChan: // agent or signal
+		case stopErr = <-stopChan: // agent
 			golog.Println("Agent stopped, shutting down...")
+			shutdown = stopErr != nil // crashed
+			agentRunning = false
+		case sig := <-sigChan:
+			golog.Printf("Caught %s signal, shutting down...\n", sig)
 			agentRunning = false
 		case <-statusSigChan:
-			status := agent.AllStatus()
+			status := allStatus()
 			golog.Printf("Status: %+v\n", status)
+		case <-reopenSigChan:
+			if err := logManager.Reopen(); err != nil {
+				golog.Println(err)
+			}
 		case <-reconnectSigChan:
+			if runningAgent == nil {
+				golog.Println("Standalone: no API to reconnect to")
+				continue
+			}
 			u, _ := user.Current()
 			cmd := &proto.Cmd{
 				Ts:        time.Now().UTC(),
@@ -463,12 +562,15 @@ func run() error {
 				Service:   "agent",
 				Cmd:       "Reconnect",
 			}
-			agent.Handle(cmd)
+			runningAgent.Handle(cmd)
 		}
 	}
 
-	qanManager.Stop()           // see Signal handler ^
-	time.Sleep(2 * time.Second) // wait for final replies and log entries
+	if shutdown {
+		timeout := time.Duration(agentConfig.ShutdownTimeout) * time.Second
+		agent.Shutdown(pct.NewLogger(logChan, "agent"), services, timeout)
+	}
+	logManager.Drain(2 * time.Second) // final log entries
 	return stopErr
 }
 
@@ -0,0 +1,143 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/mm"
+	mmMonitor "github.com/percona/percona-agent/mm/monitor"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/plugin"
+	_ "github.com/percona/percona-agent/plugin/external"
+	"github.com/percona/percona-agent/qan"
+	qanFactory "github.com/percona/percona-agent/qan/factory"
+	"github.com/percona/percona-agent/qan/perfschema"
+	"github.com/percona/percona-agent/qan/slowlog"
+	"github.com/percona/percona-agent/query"
+	queryService "github.com/percona/percona-agent/query/service"
+	"github.com/percona/percona-agent/sysconfig"
+	sysconfigMonitor "github.com/percona/percona-agent/sysconfig/monitor"
+	"github.com/percona/percona-agent/sysinfo"
+	mysqlSysinfo "github.com/percona/percona-agent/sysinfo/mysql"
+	systemSysinfo "github.com/percona/percona-agent/sysinfo/system"
+)
+
+// The built-in services other than the core services (log, data, instance,
+// and mrms) which main() starts first.  Other packages register their own
+// plugins; they only need to be imported, like plugin/external above.
+func init() {
+	/**
+	 * Metric monitors
+	 */
+	plugin.Register(plugin.Plugin{
+		Name: "mm",
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			manager := mm.NewManager(
+				deps.Logger("mm"),
+				mmMonitor.NewFactory(deps.LogChan, deps.Repo, deps.MRMS),
+				deps.Clock,
+				deps.Spooler,
+				deps.Repo,
+				deps.MRMS,
+				deps.Sinks...,
+			)
+			return manager, nil
+		},
+	})
+
+	/**
+	 * System config monitors
+	 */
+	plugin.Register(plugin.Plugin{
+		Name: "sysconfig",
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			manager := sysconfig.NewManager(
+				deps.Logger("sysconfig"),
+				sysconfigMonitor.NewFactory(deps.LogChan, deps.Repo),
+				deps.Clock,
+				deps.Spooler,
+				deps.Repo,
+			)
+			return manager, nil
+		},
+	})
+
+	/**
+	 * Query service
+	 */
+	plugin.Register(plugin.Plugin{
+		Name: "query",
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			explainService := queryService.NewExplain(
+				deps.Logger("query-explain"),
+				deps.ConnFactory,
+				deps.Repo,
+			)
+			return query.NewManager(deps.Logger("query"), explainService), nil
+		},
+	})
+
+	/**
+	 * Query Analytics
+	 */
+	plugin.Register(plugin.Plugin{
+		Name: "qan",
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			manager := qan.NewManager(
+				deps.Logger("qan"),
+				deps.Clock,
+				deps.Repo,
+				deps.MRMS,
+				deps.ConnFactory,
+				qanFactory.NewRealAnalyzerFactory(
+					deps.LogChan,
+					qanFactory.NewRealIntervalIterFactory(deps.LogChan),
+					slowlog.NewRealWorkerFactory(deps.LogChan),
+					perfschema.NewRealWorkerFactory(deps.LogChan),
+					deps.Spooler,
+					deps.Clock,
+				),
+			)
+			return manager, nil
+		},
+	})
+
+	/**
+	 * Sysinfo
+	 */
+	plugin.Register(plugin.Plugin{
+		Name: "sysinfo",
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			manager := sysinfo.NewManager(deps.Logger("sysinfo"))
+
+			// MySQL Sysinfo
+			mysqlSysinfoService := mysqlSysinfo.NewMySQL(deps.Logger("sysinfo-mysql"), deps.Repo)
+			if err := manager.RegisterService("MySQLSummary", mysqlSysinfoService); err != nil {
+				return nil, fmt.Errorf("Error registering Mysql Sysinfo service: %s", err)
+			}
+
+			// System Sysinfo
+			systemSysinfoService := systemSysinfo.NewSystem(deps.Logger("sysinfo-system"))
+			if err := manager.RegisterService("SystemSummary", systemSysinfoService); err != nil {
+				return nil, fmt.Errorf("Error registering System Sysinfo service: %s", err)
+			}
+			return manager, nil
+		},
+	})
+}
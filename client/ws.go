@@ -54,6 +54,8 @@ type WebsocketClient struct {
 	recvSync    *pct.SyncChan
 	status      *pct.Status
 	name        string
+	verifier    *pct.CmdVerifier
+	audit       *pct.AuditLog
 }
 
 func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, headers map[string]string) (*WebsocketClient, error) {
@@ -80,6 +82,14 @@ func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, h
 	return c, nil
 }
 
+// SetCmdVerifier makes recv() reject cmds which the verifier does not accept,
+// replying with the error, so they never reach the agent.  Rejected cmds are
+// audited.  Call it before Start.
+func (c *WebsocketClient) SetCmdVerifier(verifier *pct.CmdVerifier, audit *pct.AuditLog) {
+	c.verifier = verifier
+	c.audit = audit
+}
+
 func (c *WebsocketClient) Start() {
 	// Start send() and recv() goroutines, but they wait for successful Connect().
 	if !c.started {
@@ -142,7 +152,10 @@ func (c *WebsocketClient) ConnectOnce(timeout uint) error {
 	if err != nil {
 		return err
 	}
-	config.Header.Add("X-Percona-API-Key", c.api.ApiKey())
+	if apiKey := c.api.ApiKey(); apiKey != "" {
+		// Else the agent authenticates with its cert (pct.Transport).
+		config.Header.Add("X-Percona-API-Key", apiKey)
+	}
 	if c.headers != nil {
 		for k, v := range c.headers {
 			config.Header.Add(k, v)
@@ -178,12 +191,7 @@ func (c *WebsocketClient) dialTimeout(config *websocket.Config, timeout uint) (w
 
 	var conn net.Conn
 	switch config.Location.Scheme {
-	case "ws":
-		conn, err = net.DialTimeout("tcp", config.Location.Host, time.Duration(timeout)*time.Second)
-	case "wss":
-		dialer := &net.Dialer{
-			Timeout: time.Duration(timeout) * time.Second,
-		}
+	case "ws", "wss":
 		if config.Location.Host == "localhost:8443" {
 			// Test uses mock ws server which uses self-signed cert which causes Go to throw
 			// an error like "x509: certificate signed by unknown authority".  This disables
@@ -192,7 +200,8 @@ func (c *WebsocketClient) dialTimeout(config *websocket.Config, timeout uint) (w
 				InsecureSkipVerify: true,
 			}
 		}
-		conn, err = tls.DialWithDialer(dialer, "tcp", config.Location.Host, config.TlsConfig)
+		// Connect directly or through a proxy, with TLS for wss, per pct.Transport.
+		conn, err = pct.Transport.Dial(config.Location.Scheme, config.Location.Host, time.Duration(timeout)*time.Second, config.TlsConfig)
 	default:
 		err = websocket.ErrBadScheme
 	}
@@ -365,8 +374,8 @@ func (c *WebsocketClient) recv() {
 			}
 
 			// Wait for Cmd from API.
-			cmd := &proto.Cmd{}
-			if err := c.Recv(cmd, 0); err != nil {
+			signedCmd := &pct.SignedCmd{}
+			if err := c.Recv(signedCmd, 0); err != nil {
 				c.logger.DebugOffline("recv:err:", err)
 				select {
 				case c.errChan <- err:
@@ -375,6 +384,14 @@ func (c *WebsocketClient) recv() {
 				break RECV_LOOP
 			}
 
+			cmd := &signedCmd.Cmd
+
+			// Verify Cmd signature, if required.
+			if err := c.verifier.Verify(signedCmd); err != nil {
+				c.reject(cmd, err)
+				continue
+			}
+
 			// Forward Cmd to agent.
 			c.logger.DebugOffline("recv:cmd:", cmd)
 			c.recvChan <- cmd
@@ -385,6 +402,20 @@ func (c *WebsocketClient) recv() {
 	}
 }
 
+func (c *WebsocketClient) reject(cmd *proto.Cmd, err error) {
+	c.logger.Warn(fmt.Sprintf("Rejected %s (user %s): %s", cmd, cmd.User, err))
+	reply := cmd.Reply(nil, err)
+	c.audit.Received(cmd)
+	if err := c.audit.Replied(reply); err != nil {
+		c.logger.Warn("Cannot write audit log:", err)
+	}
+	select {
+	case c.sendChan <- reply:
+	default:
+		c.logger.Warn("Failed to send reply:", reply)
+	}
+}
+
 func (c *WebsocketClient) SendChan() chan *proto.Reply {
 	return c.sendChan
 }
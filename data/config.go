@@ -20,10 +20,15 @@ package data
 const (
 	DEFAULT_DATA_ENCODING      = "gzip"
 	DEFAULT_DATA_SEND_INTERVAL = 63
+	DEFAULT_LOCAL_DIR          = "local" // in basedir
+	DEFAULT_LOCAL_RETENTION    = 7       // days
 )
 
 type Config struct {
 	Encoding     string
 	SendInterval uint
 	Blackhole    bool
+	// Standalone agents (no API) save data locally, see LocalSink:
+	LocalDir       string `json:",omitempty"`
+	LocalRetention uint   `json:",omitempty"` // days, 0 = default
 }
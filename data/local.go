@@ -0,0 +1,191 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/**
+ * LocalSink keeps data on the host instead of sending it to the API, for
+ * standalone agents (see Config.LocalDir).  On every tick it moves spooled
+ * data to dir/<service>/<created>.json, decoded, and removes files older than
+ * the retention.
+ */
+type LocalSink struct {
+	logger    *pct.Logger
+	dir       string
+	retention time.Duration
+	// --
+	spool      Spooler
+	tickerChan <-chan time.Time
+	sync       *pct.SyncChan
+	flushChan  chan chan bool
+	status     *pct.Status
+}
+
+func NewLocalSink(logger *pct.Logger, dir string, retention time.Duration) *LocalSink {
+	s := &LocalSink{
+		logger:    logger,
+		dir:       dir,
+		retention: retention,
+		sync:      pct.NewSyncChan(),
+		flushChan: make(chan chan bool),
+		status:    pct.NewStatus([]string{"data-local", "data-local-last"}),
+	}
+	return s
+}
+
+func (s *LocalSink) Start(spool Spooler, tickerChan <-chan time.Time) error {
+	if err := pct.MakeDir(s.dir); err != nil && !os.IsExist(err) {
+		return err
+	}
+	s.spool = spool
+	s.tickerChan = tickerChan
+	go s.run()
+	s.logger.Info("Started")
+	return nil
+}
+
+func (s *LocalSink) Stop() error {
+	s.sync.Stop()
+	s.sync.Wait()
+	s.spool = nil
+	s.tickerChan = nil
+	s.logger.Info("Stopped")
+	return nil
+}
+
+// Drain saves all spooled data, e.g. on shutdown after the spooler has been drained.
+func (s *LocalSink) Drain(timeout time.Duration) error {
+	return pct.DrainChan("data local sink", s.flushChan, timeout)
+}
+
+func (s *LocalSink) Status() map[string]string {
+	return s.status.All()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (s *LocalSink) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error("Data local sink crashed: ", err)
+		}
+		if s.sync.IsGraceful() {
+			s.status.Update("data-local", "Stopped")
+		} else {
+			s.status.Update("data-local", "Crashed")
+		}
+		s.sync.Done()
+	}()
+
+	s.status.Update("data-local", "Idle")
+	for {
+		select {
+		case <-s.tickerChan:
+			s.save()
+			s.purge()
+			s.status.Update("data-local", "Idle")
+		case done := <-s.flushChan:
+			s.save()
+			s.status.Update("data-local", "Idle")
+			close(done)
+		case <-s.sync.StopChan:
+			s.sync.Graceful()
+			return
+		}
+	}
+}
+
+func (s *LocalSink) save() {
+	s.status.Update("data-local", "Saving")
+	files := 0
+	errs := 0
+	for file := range s.spool.Files() {
+		if err := s.saveFile(file); err != nil {
+			s.logger.Warn(fmt.Sprintf("Cannot save %s in %s: %s", file, s.dir, err))
+			errs++
+			continue
+		}
+		s.spool.Remove(file)
+		files++
+	}
+	s.status.Update("data-local-last", fmt.Sprintf("at %s: %d files saved in %s, %d errors", pct.TimeString(time.Now()), files, s.dir, errs))
+}
+
+func (s *LocalSink) saveFile(file string) error {
+	data, err := s.spool.Read(file)
+	if err != nil {
+		return err
+	}
+	protoData := &proto.Data{}
+	if err := json.Unmarshal(data, protoData); err != nil {
+		return err
+	}
+
+	content := protoData.Data
+	if protoData.ContentEncoding == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(protoData.Data))
+		if err != nil {
+			return err
+		}
+		content, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Join(s.dir, protoData.Service)
+	if err := pct.MakeDir(dir); err != nil && !os.IsExist(err) {
+		return err
+	}
+	name := fmt.Sprintf("%d.json", protoData.Created.UnixNano())
+	return ioutil.WriteFile(filepath.Join(dir, name), content, 0640)
+}
+
+func (s *LocalSink) purge() {
+	if s.retention == 0 {
+		return
+	}
+	s.status.Update("data-local", "Purging")
+	cutoff := time.Now().Add(-s.retention)
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(path); err != nil {
+				s.logger.Warn(err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data_test
+
+import (
+	"encoding/json"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// LocalSink test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type LocalSinkTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+	tmpDir  string
+}
+
+var _ = Suite(&LocalSinkTestSuite{})
+
+func (s *LocalSinkTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "data-local-test")
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-data-local-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *LocalSinkTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *LocalSinkTestSuite) TestSave(t *C) {
+	// Spooled data like the real spooler writes it, one plain, one gzip.
+	created := time.Unix(1400000000, 0).UTC()
+	plainData, _ := json.Marshal(&proto.Data{
+		Created:     created,
+		Service:     "mm",
+		ContentType: "application/json",
+		Data:        []byte(`{"Metrics":[1,2,3]}`),
+	})
+	gzipData, err := data.NewJsonGzipSerializer().ToBytes(map[string]int{"Queries": 5})
+	t.Assert(err, IsNil)
+	gzipData, _ = json.Marshal(&proto.Data{
+		Created:         created.Add(time.Second),
+		Service:         "qan",
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Data:            gzipData,
+	})
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"mm_1", "qan_1"}
+	spool.DataOut = map[string][]byte{"mm_1": plainData, "qan_1": gzipData}
+
+	// An old file which should be purged.
+	oldFile := filepath.Join(s.tmpDir, "mm", "1.json")
+	t.Assert(pct.MakeDir(filepath.Dir(oldFile)), IsNil)
+	t.Assert(ioutil.WriteFile(oldFile, []byte("{}"), 0640), IsNil)
+	old := time.Now().Add(-48 * time.Hour)
+	t.Assert(os.Chtimes(oldFile, old, old), IsNil)
+
+	tickChan := make(chan time.Time)
+	local := data.NewLocalSink(s.logger, s.tmpDir, 24*time.Hour)
+	t.Assert(local.Start(spool, tickChan), IsNil)
+	tickChan <- time.Now()
+	t.Assert(local.Stop(), IsNil) // returns after the tick is done
+
+	got, err := ioutil.ReadFile(filepath.Join(s.tmpDir, "mm", "1400000000000000000.json"))
+	t.Assert(err, IsNil)
+	t.Check(string(got), Equals, `{"Metrics":[1,2,3]}`)
+
+	got, err = ioutil.ReadFile(filepath.Join(s.tmpDir, "qan", "1400000001000000000.json"))
+	t.Assert(err, IsNil)
+	t.Check(string(got), Equals, "{\"Queries\":5}\n")
+
+	// Saved files are removed from the spool.
+	t.Check(spool.DataOut, HasLen, 0)
+
+	t.Check(pct.FileExists(oldFile), Equals, false)
+	t.Check(local.Status()["data-local-last"], Matches, ".+2 files saved.+0 errors")
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/pct"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -40,9 +41,11 @@ type Manager struct {
 	sz      Serializer
 	spooler Spooler
 	sender  *Sender
+	local   *LocalSink
 	status  *pct.Status
 }
 
+// If client is nil (standalone agent), data is saved locally, not sent.
 func NewManager(logger *pct.Logger, dataDir, trashDir, hostname string, client pct.WebsocketClient) *Manager {
 	m := &Manager{
 		logger:   logger,
@@ -110,16 +113,37 @@ func (m *Manager) Start() error {
 	}
 	m.spooler = spooler
 
-	// Start data sender.
-	m.status.Update("data", "Starting sender")
-	sender := NewSender(
-		pct.NewLogger(m.logger.LogChan(), "data-sender"),
-		m.client,
-	)
-	if err := sender.Start(m.spooler, time.Tick(time.Duration(config.SendInterval)*time.Second), config.SendInterval, config.Blackhole); err != nil {
-		return err
+	// Start data sender, or local sink if there's no API (standalone agent).
+	if m.client == nil {
+		m.status.Update("data", "Starting local sink")
+		localDir := config.LocalDir
+		if localDir == "" {
+			localDir = filepath.Join(pct.Basedir.Path(), DEFAULT_LOCAL_DIR)
+		}
+		retention := config.LocalRetention
+		if retention == 0 {
+			retention = DEFAULT_LOCAL_RETENTION
+		}
+		local := NewLocalSink(
+			pct.NewLogger(m.logger.LogChan(), "data-local"),
+			localDir,
+			time.Duration(retention)*24*time.Hour,
+		)
+		if err := local.Start(m.spooler, time.Tick(time.Duration(config.SendInterval)*time.Second)); err != nil {
+			return err
+		}
+		m.local = local
+	} else {
+		m.status.Update("data", "Starting sender")
+		sender := NewSender(
+			pct.NewLogger(m.logger.LogChan(), "data-sender"),
+			m.client,
+		)
+		if err := sender.Start(m.spooler, time.Tick(time.Duration(config.SendInterval)*time.Second), config.SendInterval, config.Blackhole); err != nil {
+			return err
+		}
+		m.sender = sender
 	}
-	m.sender = sender
 
 	m.config = config
 	m.running = true
@@ -131,8 +155,13 @@ func (m *Manager) Start() error {
 
 // @goroutine[0]
 func (m *Manager) Stop() error {
-	m.status.Update("data", "Stopping sender")
-	m.sender.Stop()
+	if m.local != nil {
+		m.status.Update("data", "Stopping local sink")
+		m.local.Stop()
+	} else {
+		m.status.Update("data", "Stopping sender")
+		m.sender.Stop()
+	}
 
 	m.status.Update("data", "Stopping spooler")
 	m.spooler.Stop()
@@ -147,6 +176,42 @@ func (m *Manager) Stop() error {
 	return nil
 }
 
+// Drain writes buffered data to the spool, then sends it (or saves it locally)
+// one last time, e.g. on shutdown after all services that write data have stopped.
+// @goroutine[0]
+func (m *Manager) Drain(timeout time.Duration) error {
+	m.mux.Lock()
+	running := m.running
+	m.mux.Unlock()
+	if !running {
+		return pct.ServiceIsNotRunningError{Service: "data"}
+	}
+
+	deadline := time.Now().Add(timeout)
+	m.status.Update("data", "Draining spooler")
+	if spooler, ok := m.spooler.(pct.Drainer); ok {
+		if err := spooler.Drain(timeout); err != nil {
+			return err
+		}
+	}
+
+	if m.local != nil {
+		m.status.Update("data", "Draining local sink")
+		if err := m.local.Drain(deadline.Sub(time.Now())); err != nil {
+			return err
+		}
+	} else {
+		m.status.Update("data", "Draining sender")
+		if err := m.sender.Drain(deadline.Sub(time.Now())); err != nil {
+			return err
+		}
+	}
+
+	m.logger.Info("Drained")
+	m.status.Update("data", "Running")
+	return nil
+}
+
 // @goroutine[0]
 func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.status.UpdateRe("data", "Handling", cmd)
@@ -168,6 +233,9 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 // @goroutine[0:1]
 func (m *Manager) Status() map[string]string {
+	if m.local != nil {
+		return m.status.Merge(m.spooler.Status(), m.local.Status())
+	}
 	return m.status.Merge(m.client.Status(), m.spooler.Status(), m.sender.Status())
 }
 
@@ -235,7 +303,7 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	 * Data sender
 	 */
 
-	if newConfig.SendInterval != finalConfig.SendInterval {
+	if newConfig.SendInterval != finalConfig.SendInterval && m.sender != nil {
 		m.sender.Stop()
 		if err := m.sender.Start(m.spooler, time.Tick(time.Duration(newConfig.SendInterval)*time.Second), newConfig.SendInterval, newConfig.Blackhole); err != nil {
 			errs = append(errs, err)
@@ -38,6 +38,8 @@ type Sender struct {
 	timeout    uint
 	blackhole  bool
 	sync       *pct.SyncChan
+	flushChan  chan chan bool
+	flushTime  uint // send timeout for Drain
 	status     *pct.Status
 	// --
 	lastStats  *SenderStats
@@ -49,6 +51,7 @@ func NewSender(logger *pct.Logger, client pct.WebsocketClient) *Sender {
 		logger:     logger,
 		client:     client,
 		sync:       pct.NewSyncChan(),
+		flushChan:  make(chan chan bool),
 		status:     pct.NewStatus([]string{"data-sender", "data-sender-last", "data-sender-1d"}),
 		lastStats:  NewSenderStats(0),
 		dailyStats: NewSenderStats(24 * time.Hour),
@@ -75,6 +78,16 @@ func (s *Sender) Stop() error {
 	return nil
 }
 
+// Drain makes one last attempt to send all spooled data, e.g. on shutdown after
+// the spooler has been drained.  The send timeout is reduced to the given timeout.
+func (s *Sender) Drain(timeout time.Duration) error {
+	s.flushTime = s.timeout
+	if secs := uint(timeout.Seconds()); secs < s.flushTime {
+		s.flushTime = secs
+	}
+	return pct.DrainChan("data sender", s.flushChan, timeout)
+}
+
 func (s *Sender) Status() map[string]string {
 	return s.status.Merge(s.client.Status())
 }
@@ -103,7 +116,10 @@ func (s *Sender) run() {
 	for {
 		select {
 		case <-s.tickerChan:
-			s.send()
+			s.send(s.timeout)
+		case done := <-s.flushChan:
+			s.send(s.flushTime)
+			close(done)
 		case <-s.sync.StopChan:
 			s.sync.Graceful()
 			return
@@ -111,7 +127,7 @@ func (s *Sender) run() {
 	}
 }
 
-func (s *Sender) send() {
+func (s *Sender) send(timeout uint) {
 	s.logger.Debug("send:call")
 	defer s.logger.Debug("send:return")
 
@@ -145,9 +161,9 @@ func (s *Sender) send() {
 
 		// Check runtime, don't send forever.
 		runTime := time.Now().Sub(startTime).Seconds()
-		if uint(runTime) > s.timeout {
+		if uint(runTime) > timeout {
 			sent.Timeouts++
-			s.logger.Warn(fmt.Sprintf("Timeout sending data: %.2fs > %ds", runTime, s.timeout))
+			s.logger.Warn(fmt.Sprintf("Timeout sending data: %.2fs > %ds", runTime, timeout))
 			return
 		}
 
@@ -165,7 +181,7 @@ func (s *Sender) send() {
 		s.logger.Debug("send:connected")
 
 		// Send all files, or stop on error or timeout.
-		if err := s.sendAllFiles(startTime, &sent); err != nil {
+		if err := s.sendAllFiles(startTime, timeout, &sent); err != nil {
 			sent.Errs++
 			s.logger.Warn(err)
 			s.client.DisconnectOnce()
@@ -175,16 +191,16 @@ func (s *Sender) send() {
 	}
 }
 
-func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
+func (s *Sender) sendAllFiles(startTime time.Time, timeout uint, sent *SentInfo) error {
 	s.status.Update("data-sender", "Running")
 	for file := range s.spool.Files() {
 		s.logger.Debug("send:" + file)
 
 		// Check runtime, don't send forever.
 		runTime := time.Now().Sub(startTime).Seconds()
-		if uint(runTime) > s.timeout {
+		if uint(runTime) > timeout {
 			sent.Timeouts++
-			s.logger.Warn(fmt.Sprintf("Timeout sending data: %.2fs > %ds", runTime, s.timeout))
+			s.logger.Warn(fmt.Sprintf("Timeout sending data: %.2fs > %ds", runTime, timeout))
 			return nil // warn about timeout error here, not in caller
 		}
 
@@ -210,7 +226,7 @@ func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
 		// todo: number/time/rate limit so we dont DDoS API
 		s.status.Update("data-sender", "Sending "+file)
 		t0 := time.Now()
-		if err := s.client.SendBytes(data, s.timeout); err != nil {
+		if err := s.client.SendBytes(data, timeout); err != nil {
 			return fmt.Errorf("Sending %s: %s", file, err)
 		}
 		sent.SendTime += time.Now().Sub(t0).Seconds()
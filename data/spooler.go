@@ -59,6 +59,7 @@ type DiskvSpooler struct {
 	// --
 	sz           Serializer
 	dataChan     chan *proto.Data
+	drainChan    chan chan bool
 	sync         *pct.SyncChan
 	cache        *diskv.Diskv
 	status       *pct.Status
@@ -77,11 +78,12 @@ func NewDiskvSpooler(logger *pct.Logger, dataDir, trashDir, hostname string) *Di
 		trashDir: trashDir,
 		hostname: hostname,
 		// --
-		dataChan: make(chan *proto.Data, WRITE_BUFFER),
-		sync:     pct.NewSyncChan(),
-		status:   pct.NewStatus([]string{"data-spooler", "data-spooler-count", "data-spooler-size", "data-spooler-oldest"}),
-		mux:      new(sync.Mutex),
-		fileSize: make(map[string]int),
+		dataChan:  make(chan *proto.Data, WRITE_BUFFER),
+		drainChan: make(chan chan bool),
+		sync:      pct.NewSyncChan(),
+		status:    pct.NewStatus([]string{"data-spooler", "data-spooler-count", "data-spooler-size", "data-spooler-oldest"}),
+		mux:       new(sync.Mutex),
+		fileSize:  make(map[string]int),
 	}
 	return s
 }
@@ -170,6 +172,12 @@ func (s *DiskvSpooler) Status() map[string]string {
 	return s.status.All()
 }
 
+// Drain writes the data in the write buffer to disk, e.g. on shutdown after
+// the services that write data have stopped.
+func (s *DiskvSpooler) Drain(timeout time.Duration) error {
+	return pct.DrainChan("data spooler", s.drainChan, timeout)
+}
+
 func (s *DiskvSpooler) Write(service string, data interface{}) error {
 	/**
 	 * This method is shared: multiple goroutines call it to write data.
@@ -282,31 +290,41 @@ func (s *DiskvSpooler) run() {
 		s.status.Update("data-spooler", "Idle")
 		select {
 		case protoData := <-s.dataChan:
-			ts := protoData.Created.UnixNano()
-			key := fmt.Sprintf("%s_%d", protoData.Service, ts)
-			s.logger.Debug("run:spool:" + key)
-			s.status.Update("data-spooler", "Spooling "+key)
-
-			bytes, err := json.Marshal(protoData)
-			if err != nil {
-				s.logger.Error(err)
-				continue
+			s.spool(protoData)
+		case done := <-s.drainChan:
+			for n := len(s.dataChan); n > 0; n-- {
+				s.spool(<-s.dataChan)
 			}
-
-			if err := s.cache.Write(key, bytes); err != nil {
-				s.logger.Error(err)
-			}
-
-			s.mux.Lock()
-			s.count++
-			s.size += uint64(len(bytes))
-			if ts < s.oldest {
-				s.oldest = ts
-			}
-			s.mux.Unlock()
+			close(done)
 		case <-s.sync.StopChan:
 			s.sync.Graceful()
 			return
 		}
 	}
 }
+
+// @goroutine[1]
+func (s *DiskvSpooler) spool(protoData *proto.Data) {
+	ts := protoData.Created.UnixNano()
+	key := fmt.Sprintf("%s_%d", protoData.Service, ts)
+	s.logger.Debug("run:spool:" + key)
+	s.status.Update("data-spooler", "Spooling "+key)
+
+	bytes, err := json.Marshal(protoData)
+	if err != nil {
+		s.logger.Error(err)
+		return
+	}
+
+	if err := s.cache.Write(key, bytes); err != nil {
+		s.logger.Error(err)
+	}
+
+	s.mux.Lock()
+	s.count++
+	s.size += uint64(len(bytes))
+	if ts < s.oldest {
+		s.oldest = ts
+	}
+	s.mux.Unlock()
+}
@@ -178,6 +178,37 @@ func (s *RepoTestSuite) TestErrors(t *C) {
 	t.Assert(err, NotNil)
 }
 
+func (s *RepoTestSuite) TestRemoteCredentials(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	// Credential sources are allowed only in local instance config.
+	mysqlIt := &proto.MySQLInstance{
+		Id:  5,
+		DSN: "user@tcp(127.0.0.1:3306)/?parseTime=true&passwordExec=%2Fsbin%2Freboot",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	s.api.GetData = [][]byte{data}
+
+	got := &proto.MySQLInstance{}
+	err = im.Get("mysql", 5, got)
+	t.Check(err, ErrorMatches, ".+allowed only in local instance config")
+	t.Check(test.FileExists(s.configDir+"/mysql-5.conf"), Equals, false)
+}
+
+func (s *RepoTestSuite) TestStandalone(t *C) {
+	// Without an API, only local instances exist.
+	m := instance.NewManager(s.logger, s.configDir, nil, mock.NewMrmsMonitor())
+	t.Assert(m, NotNil)
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	got := &proto.MySQLInstance{}
+	err = m.Repo().Get("mysql", 7, got)
+	t.Check(err, Equals, pct.UnknownServiceInstanceError{Service: "mysql", Id: 7})
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Manager test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -338,3 +369,24 @@ func (s *ManagerTestSuite) TestHandleAdd(t *C) {
 	t.Assert(len(is), Equals, 1)
 	t.Assert(is[0].Id, Equals, uint(9))
 }
+
+func (s *ManagerTestSuite) TestHandleAddRemoteCredentials(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm)
+	t.Assert(m, NotNil)
+
+	mysqlIt := &proto.MySQLInstance{
+		Id:  3,
+		DSN: "user@tcp(127.0.0.1:3306)/?parseTime=true&passwordFile=%2Fetc%2Fshadow",
+	}
+	mysqlData, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	serviceData, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: 3, Instance: mysqlData})
+	t.Assert(err, IsNil)
+
+	for _, cmd := range []string{"Add", "GetInfo"} {
+		reply := m.Handle(&proto.Cmd{Cmd: cmd, Service: "instance", Data: serviceData})
+		t.Check(reply.Error, Matches, ".+allowed only in local instance config", Commentf(cmd))
+	}
+	t.Check(test.FileExists(s.configDir+"/mysql-3.conf"), Equals, false)
+}
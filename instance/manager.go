@@ -122,6 +122,9 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 	switch cmd.Cmd {
 	case "Add":
+		if err := checkRemote(it.Service, it.Instance); err != nil {
+			return cmd.Reply(nil, err)
+		}
 		err := m.repo.Add(it.Service, it.InstanceId, it.Instance, true) // true = write to disk
 		if err != nil {
 			return cmd.Reply(nil, err)
@@ -209,6 +212,9 @@ func (m *Manager) handleGetInfo(service string, data []byte) (interface{}, error
 		if it.DSN == "" {
 			return nil, fmt.Errorf("MySQL instance DSN is not set")
 		}
+		if err := mysql.CheckRemoteDSN(it.DSN); err != nil {
+			return nil, err
+		}
 		if err := GetMySQLInfo(it); err != nil {
 			return nil, err
 		}
@@ -228,7 +234,9 @@ func GetMySQLInfo(it *proto.MySQLInstance) error {
 		" CONCAT_WS('.', @@hostname, IF(@@port='3306',NULL,@@port)) AS Hostname," +
 		" @@version_comment AS Distro," +
 		" @@version AS Version"
-	err := conn.DB().QueryRow(sql).Scan(
+	ctx, cancel := conn.Context()
+	defer cancel()
+	err := conn.DB().QueryRowContext(ctx, sql).Scan(
 		&it.Hostname,
 		&it.Distro,
 		&it.Version,
@@ -316,6 +324,9 @@ func (m *Manager) monitorInstancesRestart(ch chan string) {
 }
 
 func (m *Manager) pushInstanceInfo(instance *proto.MySQLInstance) error {
+	if m.api == nil {
+		return nil // standalone agent, no API
+	}
 
 	uri := fmt.Sprintf("%s/%s/%d", m.api.EntryLink("instances"), "mysql", instance.Id)
 	data, err := json.Marshal(instance)
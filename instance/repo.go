@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"io/ioutil"
 	"log"
@@ -91,6 +92,9 @@ func (r *Repo) loadInstances(service string) error {
 		if err != nil {
 			return errors.New(file + ":" + err.Error())
 		}
+		if data, err = pct.DecryptConfig(data); err != nil {
+			return errors.New(file + ":" + err.Error())
+		}
 
 		if err := r.Add(service, uint(id), data, false); err != nil {
 			return errors.New(file + ":" + err.Error())
@@ -179,6 +183,9 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 	name := r.Name(service, id)
 	it, ok := r.it[name]
 	if !ok {
+		if r.api == nil {
+			return pct.UnknownServiceInstanceError{Service: service, Id: id} // standalone agent, no API
+		}
 		// Get instance info from API.
 		link := r.api.EntryLink("instances")
 		if link == "" {
@@ -194,6 +201,8 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 			return fmt.Errorf("Getting %s instance from %s returned code %d, expected 200", name, link, code)
 		} else if data == nil {
 			return fmt.Errorf("Getting %s instance from %s did not return data")
+		} else if err := checkRemote(service, data); err != nil {
+			return fmt.Errorf("Invalid %s instance from %s: %s", name, link, err)
 		} else {
 			// Save new instance locally.
 			if err := r.add(service, uint(id), data, true); err != nil {
@@ -249,6 +258,19 @@ func (r *Repo) Remove(service string, id uint) error {
 	return nil
 }
 
+// checkRemote returns an error if the instance info from the API is a MySQL
+// instance with credential sources in its DSN, see mysql.CheckRemoteDSN.
+func checkRemote(service string, data []byte) error {
+	if service != "mysql" {
+		return nil
+	}
+	it := &proto.MySQLInstance{}
+	if err := json.Unmarshal(data, it); err != nil {
+		return errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+	}
+	return mysql.CheckRemoteDSN(it.DSN)
+}
+
 func valid(service string, id uint) bool {
 	if _, ok := proto.ExternalService[service]; !ok {
 		return false
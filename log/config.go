@@ -17,13 +17,75 @@
 
 package log
 
+import (
+	"time"
+)
+
 const (
-	DEFAULT_LOG_FILE  = ""
-	DEFAULT_LOG_LEVEL = "info"
+	DEFAULT_LOG_FILE   = ""
+	DEFAULT_LOG_LEVEL  = "info"
+	DEFAULT_LOG_FORMAT = "text"
 )
 
+// Log file formats.  JSON is one object per line (JSON lines) with the entry's
+// structured fields, see pct.Logger.With().
+var LogFormats = map[string]bool{
+	"text": true,
+	"json": true,
+}
+
 type Config struct {
 	Level   string
 	File    string
 	Offline bool
+	Levels  map[string]string `json:",omitempty"` // per-service levels, e.g. qan-analyzer-1: debug, qan-*: warning
+	Format  string            `json:",omitempty"` // log file format: text (default) or json
+	// Max MiB of log entries queued on disk while the API is unreachable
+	// (0 = DEFAULT_QUEUE_SIZE, -1 = no queue, entries are lost).
+	QueueSize int `json:",omitempty"`
+	// Log file rotation, see rotate.go.
+	RotateSize     int  `json:",omitempty"` // MiB: rotate when larger (0 = DEFAULT_ROTATE_SIZE, -1 = never)
+	RotateInterval uint `json:",omitempty"` // hours: rotate when older (0 = never)
+	RotateKeep     int  `json:",omitempty"` // rotated files to keep (0 = DEFAULT_ROTATE_KEEP, -1 = none)
+	NoCompress     bool `json:",omitempty"` // don't gzip rotated files
+	// Local outputs besides the API and log file, see syslog.go.  Set Offline
+	// to use them instead of the API.
+	Syslog         string `json:",omitempty"` // local, unix:///path, udp://host:port or tcp://host:port
+	SyslogFacility string `json:",omitempty"` // default: DEFAULT_SYSLOG_FACILITY
+	Journald       bool   `json:",omitempty"` // send to systemd-journald
+}
+
+// RotateConfig returns the log file rotation config, with defaults.
+func (c *Config) RotateConfig() RotateConfig {
+	config := RotateConfig{
+		Size:     DEFAULT_ROTATE_SIZE * 1024 * 1024,
+		Interval: time.Duration(c.RotateInterval) * time.Hour,
+		Keep:     DEFAULT_ROTATE_KEEP,
+		Compress: !c.NoCompress,
+	}
+	if c.RotateSize > 0 {
+		config.Size = int64(c.RotateSize) * 1024 * 1024
+	} else if c.RotateSize < 0 {
+		config.Size = 0
+	}
+	if c.RotateKeep > 0 {
+		config.Keep = c.RotateKeep
+	} else if c.RotateKeep < 0 {
+		config.Keep = 0
+	}
+	return config
+}
+
+// OutputConfig returns the syslog and journald outputs config, with defaults.
+func (c *Config) OutputConfig() OutputConfig {
+	facility, ok := SyslogFacilities[c.SyslogFacility]
+	if !ok {
+		facility = SyslogFacilities[DEFAULT_SYSLOG_FACILITY]
+	}
+	config := OutputConfig{
+		Syslog:   c.Syslog,
+		Facility: facility,
+		Journald: c.Journald,
+	}
+	return config
 }
@@ -18,6 +18,7 @@
 package log_test
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
@@ -28,7 +29,10 @@ import (
 	. "gopkg.in/check.v1"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -726,3 +730,587 @@ func (s *ManagerTestSuite) TestReconnect(t *C) {
 		t.Error(diff)
 	}
 }
+
+func (s *ManagerTestSuite) TestServiceLevels(t *C) {
+	jsonLogFile := s.logFile + "-json"
+	defer os.Remove(jsonLogFile)
+	config := &log.Config{
+		File:  jsonLogFile,
+		Level: "warning",
+		Levels: map[string]string{
+			"qan-analyzer-1": "debug",
+			"qan-*":          "error",
+		},
+		Format: "json",
+	}
+	pct.Basedir.WriteConfig("log", config)
+	defer pct.Basedir.RemoveConfig("log")
+
+	// Standalone, so entries are only written to the log file.
+	logChan := make(chan *proto.LogEntry, log.BUFFER_SIZE)
+	m := log.NewManager(nil, logChan)
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	pct.NewLogger(logChan, "qan-analyzer-1").With("interval", 5).Debug("debug 1")
+	pct.NewLogger(logChan, "qan-analyzer-2").Warn("warning 2") // qan-* level
+	pct.NewLogger(logChan, "qan-analyzer-2").Error("error 2")
+	pct.NewLogger(logChan, "mm").Info("info mm") // global level
+	pct.NewLogger(logChan, "mm").With("instance", "db 1").Warn("warning mm")
+
+	err = m.Drain(time.Second)
+	t.Assert(err, IsNil)
+
+	content, err := ioutil.ReadFile(jsonLogFile)
+	t.Assert(err, IsNil)
+	got := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid JSON line: %s: %s", line, err)
+		}
+		if entry["Service"] == "log" {
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s %s %s %v", entry["Service"], entry["Level"], entry["Msg"], entry["Fields"]))
+	}
+	t.Check(got, DeepEquals, []string{
+		"qan-analyzer-1 debug debug 1 map[interval:5]",
+		"qan-analyzer-2 error error 2 <nil>",
+		"mm warning warning mm map[instance:db 1]",
+	})
+
+	status := m.Status()
+	t.Check(status["log-levels"], Equals, "qan-*=error qan-analyzer-1=debug")
+	t.Check(status["log-format"], Equals, "json")
+
+	// Invalid per-service levels are rejected.
+	config.Levels["mm"] = "loud"
+	configData, err := json.Marshal(config)
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "log",
+		Cmd:     "SetConfig",
+		Data:    configData,
+	}
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Equals, "Invalid log level for mm: loud")
+
+	// Per-service levels can be changed dynamically.
+	config.Levels = map[string]string{"mm": "debug"}
+	configData, _ = json.Marshal(config)
+	cmd.Data = configData
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	t.Check(test.WaitStatus(1, m, "log-levels", "mm=debug"), Equals, true)
+}
+
+func (s *ManagerTestSuite) TestQueue(t *C) {
+	// The API is down: the relay can't connect until the test lets it.
+	n := log.BUFFER_SIZE + log.QUEUE_REPLAY_BATCH*2 // replayed in several batches
+	logChan := make(chan *proto.LogEntry, n*2)
+	recvChan := make(chan interface{}, n*2)
+	client := mock.NewWebsocketClient(nil, nil, nil, recvChan)
+	connectChan := make(chan bool)
+	client.SetConnectChan(connectChan)
+	pct.Basedir.WriteConfig("log", &log.Config{Level: "info"})
+	defer pct.Basedir.RemoveConfig("log")
+
+	m := log.NewManager(client, logChan)
+	err := m.Start()
+	t.Assert(err, IsNil)
+	<-connectChan // relay is connecting
+
+	// Entries overflow the memory buffer into the on-disk queue.
+	logger := pct.NewLogger(logChan, "queue-test")
+	for i := 0; i < n; i++ {
+		logger.Info(fmt.Sprintf("entry %d", i))
+	}
+	err = m.Drain(time.Second)
+	t.Assert(err, IsNil)
+
+	// On drain (shutdown), the memory buffer is queued too, so every entry
+	// (and "Started") survives a restart.
+	status := m.Status()
+	t.Check(status["log-queue"], Matches, fmt.Sprintf("%d entries, .*", n+1))
+	t.Check(status["log-lost"], Equals, "0")
+
+	// Restart with the API up: the queue is replayed in order, and entries
+	// logged while replaying are sent after it.
+	logChan2 := make(chan *proto.LogEntry, n*2)
+	client2 := mock.NewWebsocketClient(nil, nil, nil, recvChan)
+	stopTrace := make(chan bool)
+	defer close(stopTrace)
+	go func() {
+		for {
+			select {
+			case <-client2.TraceChan: // more sends than it holds
+			case <-stopTrace:
+				return
+			}
+		}
+	}()
+	m2 := log.NewManager(client2, logChan2)
+	err = m2.Start()
+	t.Assert(err, IsNil)
+	logger2 := pct.NewLogger(logChan2, "queue-test")
+	for i := 0; i < 10; i++ {
+		logger2.Info(fmt.Sprintf("live %d", i))
+	}
+
+	got := test.WaitLog(recvChan, n+13)
+	msgs := []string{}
+	for _, entry := range got {
+		if entry.Service == "queue-test" {
+			msgs = append(msgs, entry.Msg)
+		}
+	}
+	expect := []string{}
+	for i := 0; i < n; i++ {
+		expect = append(expect, fmt.Sprintf("entry %d", i))
+	}
+	for i := 0; i < 10; i++ {
+		expect = append(expect, fmt.Sprintf("live %d", i))
+	}
+	t.Check(msgs, DeepEquals, expect)
+	t.Check(test.WaitStatus(1, m2, "log-queue", "0 entries, 0 bytes"), Equals, true)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Queue test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type QueueTestSuite struct {
+	tmpDir string
+}
+
+var _ = Suite(&QueueTestSuite{})
+
+func (s *QueueTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *QueueTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *QueueTestSuite) entry(i int) *proto.LogEntry {
+	return &proto.LogEntry{Ts: test.Ts, Level: proto.LOG_INFO, Service: "test", Msg: fmt.Sprintf("%3d", i)}
+}
+
+func (s *QueueTestSuite) pop(t *C, q *log.Queue) []string {
+	msgs := []string{}
+	for {
+		entry, err := q.Peek()
+		t.Assert(err, IsNil)
+		if entry == nil {
+			return msgs
+		}
+		msgs = append(msgs, strings.TrimSpace(entry.Msg))
+		q.Pop()
+	}
+}
+
+func (s *QueueTestSuite) TestQueue(t *C) {
+	// Every entry is the same size, and the queue holds 10.
+	line, _ := json.Marshal(s.entry(0))
+	size := int64(len(line)+1) * 10
+	q, err := log.NewQueue(s.tmpDir, size)
+	t.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		err := q.Push(s.entry(i))
+		t.Assert(err, IsNil)
+	}
+	t.Check(q.Push(s.entry(10)), Equals, log.ErrQueueFull)
+	t.Check(q.Len(), Equals, 10)
+	t.Check(q.Size(), Equals, size)
+
+	// Read one, then reopen: the queue survives restarts.
+	entry, err := q.Peek()
+	t.Assert(err, IsNil)
+	t.Check(entry.Msg, Equals, "  0")
+	q.Pop()
+	q.Close()
+	q, err = log.NewQueue(s.tmpDir, size)
+	t.Assert(err, IsNil)
+	t.Check(q.Len(), Equals, 10) // position isn't saved
+
+	entry, err = q.Peek()
+	t.Assert(err, IsNil)
+	t.Check(entry.Msg, Equals, "  0")
+	q.Pop()
+	q.Pop()
+
+	// Older entries are prepended before the unread entries.
+	lost, err := q.Prepend([]*proto.LogEntry{s.entry(-2), s.entry(-1)})
+	t.Check(err, IsNil)
+	t.Check(lost, Equals, 0)
+	t.Check(q.Push(s.entry(10)), Equals, log.ErrQueueFull) // read entries were freed
+	t.Check(s.pop(t, q), DeepEquals, []string{"-2", "-1", "2", "3", "4", "5", "6", "7", "8", "9"})
+	t.Check(q.Len(), Equals, 0)
+	t.Check(q.Size(), Equals, int64(0))
+
+	files, _ := filepath.Glob(filepath.Join(s.tmpDir, "*"))
+	t.Check(files, HasLen, 0)
+}
+
+func (s *QueueTestSuite) TestLongEntries(t *C) {
+	// A segment with a line too long to read (e.g. from an older agent) and
+	// a partial line: they're skipped, not an error.
+	line0, _ := json.Marshal(s.entry(0))
+	line1, _ := json.Marshal(s.entry(1))
+	data := append(line0, '\n')
+	data = append(data, []byte(strings.Repeat("x", 2*log.QUEUE_MAX_LINE)+"\n")...)
+	data = append(data, line1...)
+	data = append(data, []byte("\n{\"Ts\":")...)
+	err := ioutil.WriteFile(filepath.Join(s.tmpDir, log.QUEUE_FILE_PREFIX+"0"), data, 0600)
+	t.Assert(err, IsNil)
+
+	q, err := log.NewQueue(s.tmpDir, 10*1024*1024)
+	t.Assert(err, IsNil)
+	t.Check(q.Len(), Equals, 2)
+	t.Check(q.Size(), Equals, int64(len(data)))
+
+	// Long entries are truncated.
+	long := s.entry(2)
+	long.Msg = strings.Repeat("y", 1024*1024)
+	t.Assert(q.Push(long), IsNil)
+	t.Check(q.Size() < int64(len(data)+log.QUEUE_MAX_LINE), Equals, true)
+
+	msgs := s.pop(t, q)
+	t.Assert(msgs, HasLen, 3)
+	t.Check(msgs[0:2], DeepEquals, []string{"0", "1"})
+	t.Check(strings.HasSuffix(msgs[2], " [truncated]"), Equals, true)
+	t.Check(len(msgs[2]) < log.QUEUE_MAX_LINE, Equals, true)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Rotate test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type RotateTestSuite struct {
+	tmpDir string
+	file   string
+}
+
+var _ = Suite(&RotateTestSuite{})
+
+func (s *RotateTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	s.file = filepath.Join(s.tmpDir, "log")
+}
+
+func (s *RotateTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *RotateTestSuite) files() []string {
+	files, _ := filepath.Glob(s.file + "*")
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	return files
+}
+
+// The rotated file is compressed in the background.
+func (s *RotateTestSuite) waitFiles(expect []string) []string {
+	var files []string
+	for i := 0; i < 100; i++ {
+		if files = s.files(); reflect.DeepEqual(files, expect) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return files
+}
+
+func (s *RotateTestSuite) TestRotatingFile(t *C) {
+	config := log.RotateConfig{Size: 10, Keep: 2, Compress: true}
+	f, err := log.OpenRotatingFile(s.file, config)
+	t.Assert(err, IsNil)
+	defer f.Close()
+
+	// Each write fills the file, so the next one rotates it.
+	for _, line := range []string{"one......\n", "two......\n", "three....\n", "four.....\n"} {
+		_, err := f.Write([]byte(line))
+		t.Assert(err, IsNil)
+	}
+	t.Check(s.waitFiles([]string{"log", "log.1.gz", "log.2.gz"}), DeepEquals, []string{"log", "log.1.gz", "log.2.gz"})
+	data, _ := ioutil.ReadFile(s.file)
+	t.Check(string(data), Equals, "four.....\n")
+
+	// The newest rotated file is .1.
+	gz, err := os.Open(s.file + ".1.gz")
+	t.Assert(err, IsNil)
+	defer gz.Close()
+	r, err := gzip.NewReader(gz)
+	t.Assert(err, IsNil)
+	data, _ = ioutil.ReadAll(r)
+	t.Check(string(data), Equals, "three....\n")
+
+	// Keep fewer, uncompressed: extra rotated files are removed.
+	f.SetConfig(log.RotateConfig{Size: 10, Keep: 1})
+	_, err = f.Write([]byte("five.....\n"))
+	t.Assert(err, IsNil)
+	t.Check(s.files(), DeepEquals, []string{"log", "log.1"})
+
+	// Reopen after something else, e.g. logrotate, moved the file.
+	err = os.Rename(s.file, s.file+".moved")
+	t.Assert(err, IsNil)
+	err = f.Reopen()
+	t.Assert(err, IsNil)
+	_, err = f.Write([]byte("six\n"))
+	t.Assert(err, IsNil)
+	data, _ = ioutil.ReadFile(s.file)
+	t.Check(string(data), Equals, "six\n")
+
+	f.Close()
+	_, err = f.Write([]byte("seven\n"))
+	t.Check(err, NotNil)
+}
+
+func (s *RotateTestSuite) TestCopyTruncate(t *C) {
+	// Another process, like the shell, has the file open for appending.
+	file, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	t.Assert(err, IsNil)
+	defer file.Close()
+	file.WriteString("before\n")
+
+	err = log.Rotate(s.file, log.RotateConfig{Keep: 3, CopyTruncate: true})
+	t.Assert(err, IsNil)
+	file.WriteString("after\n")
+
+	t.Check(s.files(), DeepEquals, []string{"log", "log.1"})
+	data, _ := ioutil.ReadFile(s.file + ".1")
+	t.Check(string(data), Equals, "before\n")
+	data, _ = ioutil.ReadFile(s.file)
+	t.Check(string(data), Equals, "after\n")
+
+	// Keep=0: the file is just emptied.
+	err = log.Rotate(s.file, log.RotateConfig{CopyTruncate: true})
+	t.Assert(err, IsNil)
+	data, _ = ioutil.ReadFile(s.file)
+	t.Check(string(data), Equals, "")
+
+	// Rotating a file that doesn't exist isn't an error.
+	err = log.Rotate(filepath.Join(s.tmpDir, "nope"), log.RotateConfig{Keep: 3})
+	t.Check(err, IsNil)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Output (syslog, journald) test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type OutputTestSuite struct {
+	tmpDir string
+	entry  *proto.LogEntry
+}
+
+var _ = Suite(&OutputTestSuite{})
+
+func (s *OutputTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	s.entry = &proto.LogEntry{
+		Ts:      time.Date(2014, 6, 1, 10, 30, 0, 500000000, time.UTC),
+		Level:   proto.LOG_WARNING,
+		Service: "qan-analyzer-1",
+		Msg:     "Slow log rotated" + pct.LOG_FIELDS_SEP + "instance-id=1",
+	}
+}
+
+func (s *OutputTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *OutputTestSuite) read(t *C, conn net.PacketConn) string {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	t.Assert(err, IsNil)
+	return string(buf[0:n])
+}
+
+func (s *OutputTestSuite) TestParseSyslogAddr(t *C) {
+	addrs := []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{"local", "", ""},
+		{"unix:///dev/log", "unix", "/dev/log"},
+		{"udp://127.0.0.1", "udp", "127.0.0.1:514"},
+		{"tcp://logs:10514", "tcp", "logs:10514"},
+	}
+	for _, a := range addrs {
+		network, address, err := log.ParseSyslogAddr(a.addr)
+		t.Check(err, IsNil)
+		t.Check(network, Equals, a.network)
+		t.Check(address, Equals, a.address)
+	}
+	for _, addr := range []string{"", "/dev/log", "http://localhost", "udp://"} {
+		_, _, err := log.ParseSyslogAddr(addr)
+		t.Check(err, NotNil, Commentf(addr))
+	}
+}
+
+func (s *OutputTestSuite) TestSyslog(t *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	syslog, err := log.NewSyslog("udp://"+conn.LocalAddr().String(), log.SyslogFacilities["local0"])
+	t.Assert(err, IsNil)
+	defer syslog.Close()
+	err = syslog.Write(s.entry)
+	t.Assert(err, IsNil)
+
+	// PRI = local0 (16) * 8 + warning (4)
+	hostname, _ := os.Hostname()
+	t.Check(s.read(t, conn), Equals, fmt.Sprintf("<132>1 2014-06-01T10:30:00.500000Z %s qan-analyzer-1 %d - - Slow log rotated instance-id=1", hostname, os.Getpid()))
+}
+
+func (s *OutputTestSuite) TestSyslogTCP(t *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer ln.Close()
+
+	syslog, err := log.NewSyslog("tcp://"+ln.Addr().String(), log.SyslogFacilities["daemon"])
+	t.Assert(err, IsNil)
+	defer syslog.Close()
+	err = syslog.Write(s.entry)
+	t.Assert(err, IsNil)
+	syslog.Close()
+
+	conn, err := ln.Accept()
+	t.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	t.Assert(err, IsNil)
+
+	// Octet counting: "LEN MSG"
+	msg := string(data)
+	n := strings.Index(msg, " ")
+	t.Assert(n > 0, Equals, true)
+	t.Check(msg[0:n], Equals, fmt.Sprintf("%d", len(msg)-n-1))
+	t.Check(strings.HasPrefix(msg[n+1:], "<28>1 "), Equals, true)
+}
+
+func (s *OutputTestSuite) TestJournald(t *C) {
+	socket := filepath.Join(s.tmpDir, "journal")
+	conn, err := net.ListenPacket("unixgram", socket)
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	journald := log.NewJournald(socket, log.SyslogFacilities["daemon"])
+	defer journald.Close()
+	err = journald.Write(s.entry)
+	t.Assert(err, IsNil)
+	t.Check(s.read(t, conn), Equals,
+		"MESSAGE=Slow log rotated\n"+
+			"PRIORITY=4\n"+
+			"SYSLOG_FACILITY=3\n"+
+			"SYSLOG_IDENTIFIER=qan-analyzer-1\n"+
+			"SYSLOG_TIMESTAMP=2014-06-01T10:30:00.5Z\n"+
+			"INSTANCE_ID=1\n")
+
+	// Multi-line values are length-prefixed.
+	s.entry.Msg = "line 1\nline 2"
+	err = journald.Write(s.entry)
+	t.Assert(err, IsNil)
+	t.Check(strings.HasPrefix(s.read(t, conn), "MESSAGE\n\x0d\x00\x00\x00\x00\x00\x00\x00line 1\nline 2\nPRIORITY=4\n"), Equals, true)
+}
+
+// An output which blocks until unblocked, like a stalled TCP syslog.
+type stalledOutput struct {
+	writing chan bool
+	unblock chan bool
+	written chan *proto.LogEntry
+}
+
+func (o *stalledOutput) Write(entry *proto.LogEntry) error {
+	select {
+	case o.writing <- true:
+	default:
+	}
+	<-o.unblock
+	o.written <- entry
+	return nil
+}
+
+func (o *stalledOutput) Close() error {
+	return nil
+}
+
+func (o *stalledOutput) String() string {
+	return "stalled"
+}
+
+func (s *OutputTestSuite) TestQueuedOutput(t *C) {
+	out := &stalledOutput{
+		writing: make(chan bool, 1),
+		unblock: make(chan bool),
+		written: make(chan *proto.LogEntry, log.OUTPUT_QUEUE_SIZE+1),
+	}
+	q := log.NewQueuedOutput(out, nil)
+
+	// Writes don't block while the output is stalled; once the queue is full,
+	// entries are dropped.  The first entry is being written, the rest queued.
+	t.Assert(q.Write(s.entry), IsNil)
+	<-out.writing
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < log.OUTPUT_QUEUE_SIZE; i++ {
+			t.Check(q.Write(s.entry), IsNil)
+		}
+		t.Check(q.Write(s.entry), Equals, log.ErrOutputQueueFull)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("QueuedOutput.Write blocked")
+	}
+	t.Check(q.Dropped(), Equals, uint64(1))
+
+	// Queued entries are written when the output unblocks, and on Close.
+	close(out.unblock)
+	q.Close()
+	t.Check(len(out.written), Equals, log.OUTPUT_QUEUE_SIZE+1)
+}
+
+func (s *OutputTestSuite) TestRelay(t *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	// Standalone relay (no API) without a log file: only syslog.
+	logChan := make(chan *proto.LogEntry, 10)
+	relay := log.NewRelay(nil, logChan, "", proto.LOG_INFO, false)
+	go relay.Run()
+	relay.OutputChan() <- log.OutputConfig{Syslog: "udp://" + conn.LocalAddr().String(), Facility: 3}
+	t.Check(test.WaitStatus(3, relay, "log-outputs", "syslog udp://"+conn.LocalAddr().String()), Equals, true)
+
+	logger := pct.NewLogger(logChan, "test")
+	logger.Debug("too verbose")
+	logger.Warn("disk full")
+	// The debug entry isn't sent, so the first message is the warning.
+	t.Check(strings.HasSuffix(s.read(t, conn), fmt.Sprintf(" test %d - - disk full", os.Getpid())), Equals, true)
+
+	// Disabling syslog closes it.
+	relay.OutputChan() <- log.OutputConfig{}
+	t.Check(test.WaitStatus(3, relay, "log-outputs", ""), Equals, true)
+}
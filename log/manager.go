@@ -20,9 +20,11 @@ package log
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/pct"
 	"os"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -39,6 +41,7 @@ type Manager struct {
 	status  *pct.Status
 }
 
+// If client is nil (standalone agent), log entries are only written to the log file.
 func NewManager(client pct.WebsocketClient, logChan chan *proto.LogEntry) *Manager {
 	m := &Manager{
 		client:  client,
@@ -70,9 +73,29 @@ func (m *Manager) Start() error {
 		return err
 	}
 
+	// Without an API (standalone agent), log to stdout by default.
+	if m.client == nil && config.File == "" {
+		config.File = "STDOUT"
+	}
+
 	// Start relay (it buffers and sends log entries to API).
 	level := proto.LogLevelNumber[config.Level]
 	m.relay = NewRelay(m.client, m.logChan, config.File, level, config.Offline)
+	m.relay.logLevels = logLevels(config.Levels)
+	m.relay.logFormat = config.Format
+	m.relay.rotate = config.RotateConfig()
+	m.relay.output = config.OutputConfig()
+	if m.client != nil && !config.Offline && config.QueueSize >= 0 {
+		size := config.QueueSize
+		if size == 0 {
+			size = DEFAULT_QUEUE_SIZE
+		}
+		queue, err := NewQueue(pct.Basedir.Dir("log-queue"), int64(size)*1024*1024)
+		if err != nil {
+			return err
+		}
+		m.relay.queue = queue
+	}
 	go m.relay.Run()
 
 	m.logger = pct.NewLogger(m.relay.LogChan(), "log")
@@ -89,6 +112,44 @@ func (m *Manager) Stop() error {
 	return nil
 }
 
+// @goroutine[0]
+func (m *Manager) Drain(timeout time.Duration) error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if m.relay == nil {
+		return pct.ServiceIsNotRunningError{Service: "log"}
+	}
+	return m.relay.Drain(timeout)
+}
+
+// Reopen makes the relay reopen its log file, e.g. on SIGUSR2 after logrotate
+// renamed it.
+// @goroutine[0]
+func (m *Manager) Reopen() error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if m.relay == nil {
+		return pct.ServiceIsNotRunningError{Service: "log"}
+	}
+	select {
+	case m.relay.ReopenChan() <- true:
+	case <-time.After(3 * time.Second):
+		return errors.New("Timeout reopening log file")
+	}
+	return nil
+}
+
+// RotateConfig returns the current log file rotation config, which is also
+// used for the agent's stdout log, see RotateRedirected.
+func (m *Manager) RotateConfig() RotateConfig {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if m.config == nil {
+		return (&Config{}).RotateConfig()
+	}
+	return m.config.RotateConfig()
+}
+
 // @goroutine[0]
 func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.status.UpdateRe("log", "Handling", cmd)
@@ -127,6 +188,48 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 				errs = append(errs, errors.New("Timeout setting new log level"))
 			}
 		}
+		if !reflect.DeepEqual(m.config.Levels, newConfig.Levels) {
+			select {
+			case m.relay.LogLevelsChan() <- logLevels(newConfig.Levels):
+				m.config.Levels = newConfig.Levels
+			case <-time.After(3 * time.Second):
+				errs = append(errs, errors.New("Timeout setting new service log levels"))
+			}
+		}
+		if m.config.Format != newConfig.Format {
+			select {
+			case m.relay.LogFormatChan() <- newConfig.Format:
+				m.config.Format = newConfig.Format
+			case <-time.After(3 * time.Second):
+				errs = append(errs, errors.New("Timeout setting new log format"))
+			}
+		}
+
+		if newConfig.RotateConfig() != m.config.RotateConfig() {
+			select {
+			case m.relay.RotateChan() <- newConfig.RotateConfig():
+				m.config.RotateSize = newConfig.RotateSize
+				m.config.RotateInterval = newConfig.RotateInterval
+				m.config.RotateKeep = newConfig.RotateKeep
+				m.config.NoCompress = newConfig.NoCompress
+			case <-time.After(3 * time.Second):
+				errs = append(errs, errors.New("Timeout setting new log rotation"))
+			}
+		}
+
+		if newConfig.OutputConfig() != m.config.OutputConfig() {
+			select {
+			case m.relay.OutputChan() <- newConfig.OutputConfig():
+				m.config.Syslog = newConfig.Syslog
+				m.config.SyslogFacility = newConfig.SyslogFacility
+				m.config.Journald = newConfig.Journald
+			case <-time.After(3 * time.Second):
+				errs = append(errs, errors.New("Timeout setting new log outputs"))
+			}
+		}
+
+		// The queue is opened on start, so a new size is used after restart.
+		m.config.QueueSize = newConfig.QueueSize
 
 		// Write the new, updated config.  If this fails, agent will use old config if restarted.
 		if err := pct.Basedir.WriteConfig("log", m.config); err != nil {
@@ -138,7 +241,9 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
 	case "Reconnect":
-		m.client.Disconnect()
+		if m.client != nil {
+			m.client.Disconnect()
+		}
 		return cmd.Reply(nil)
 	default:
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
@@ -147,6 +252,9 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 // @goroutine[0]
 func (m *Manager) Status() map[string]string {
+	if m.client == nil {
+		return m.status.Merge(m.relay.Status())
+	}
 	return m.status.Merge(m.client.Status(), m.relay.Status())
 }
 
@@ -180,6 +288,42 @@ func (m *Manager) validateConfig(config *Config) error {
 			return errors.New("Invalid log level: " + config.Level)
 		}
 	}
+	for service, level := range config.Levels {
+		if _, ok := proto.LogLevelNumber[level]; !ok {
+			return errors.New("Invalid log level for " + service + ": " + level)
+		}
+	}
+	if config.RotateSize < -1 || config.RotateKeep < -1 {
+		return errors.New("Invalid log rotation: RotateSize and RotateKeep must be -1 or greater")
+	}
+	if config.QueueSize < -1 {
+		return fmt.Errorf("Invalid log queue size: %d", config.QueueSize)
+	}
+	if config.Format != "" && !LogFormats[config.Format] {
+		return errors.New("Invalid log format: " + config.Format)
+	}
+	if config.Syslog != "" {
+		if _, _, err := ParseSyslogAddr(config.Syslog); err != nil {
+			return err
+		}
+	}
+	if config.SyslogFacility != "" {
+		if _, ok := SyslogFacilities[config.SyslogFacility]; !ok {
+			return errors.New("Invalid syslog facility: " + config.SyslogFacility)
+		}
+	}
 	// todo: log file should be relative to basedir, e.g. can't be /etc/passwd
 	return nil
 }
+
+// Config.Levels are names, but the relay uses numbers, like Config.Level.
+func logLevels(levels map[string]string) map[string]byte {
+	if len(levels) == 0 {
+		return nil
+	}
+	numbers := make(map[string]byte, len(levels))
+	for service, level := range levels {
+		numbers[service] = proto.LogLevelNumber[level] // already validated
+	}
+	return numbers
+}
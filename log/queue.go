@@ -0,0 +1,385 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto"
+)
+
+/**
+ * Queue is a size-capped, on-disk FIFO of log entries which the relay uses
+ * when it can't send entries to the API for a long time, so the entries that
+ * explain an outage aren't lost.  It's a directory of segment files, each a
+ * list of JSON log entries, one per line.  Entries are pushed to the tail
+ * segment and read from the head segment which is removed when every entry
+ * in it is popped.  Since the queue is on disk, it survives restarts.  The
+ * position in the head segment is not saved, so entries can be replayed twice
+ * if the agent restarts while replaying.  Entries longer than QUEUE_MAX_LINE are
+ * truncated, and unreadable lines (e.g. a partial line if the agent crashed) are
+ * skipped.
+ *
+ * A Queue is not safe for concurrent use; only the relay goroutine uses it.
+ */
+
+const (
+	DEFAULT_QUEUE_SIZE = 10          // MiB
+	QUEUE_SEGMENT_SIZE = 1024 * 1024 // bytes
+	QUEUE_FILE_PREFIX  = "log-queue-"
+	QUEUE_MAX_LINE     = 256 * 1024 // bytes, longer entries are truncated
+)
+
+var ErrQueueFull = errors.New("log queue is full")
+
+type Queue struct {
+	dir     string
+	maxSize int64
+	// --
+	segments []int64 // sequence numbers, oldest (head) first
+	size     int64   // bytes in all segments
+	len      int     // entries in all segments
+	tail     *os.File
+	tailSize int64
+	head     []*proto.LogEntry // entries in head segment, loaded by Peek()
+	headPos  int               // next entry in head
+}
+
+// NewQueue opens the queue in dir, which is created if needed, keeping the
+// entries queued before, if any.
+func NewQueue(dir string, maxSize int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:      dir,
+		maxSize:  maxSize,
+		segments: []int64{},
+	}
+	files, err := filepath.Glob(filepath.Join(dir, QUEUE_FILE_PREFIX+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(file), QUEUE_FILE_PREFIX), 10, 64)
+		if err != nil {
+			continue // not a segment
+		}
+		entries, size, err := readSegment(file)
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, seq)
+		q.size += size
+		q.len += len(entries)
+	}
+	sort.Sort(int64Slice(q.segments))
+	return q, nil
+}
+
+// Push adds the entry at the end of the queue.  It returns ErrQueueFull if
+// there's no space for it.
+func (q *Queue) Push(entry *proto.LogEntry) error {
+	line, err := queueLine(entry)
+	if err != nil {
+		return err
+	}
+	if q.size+int64(len(line)) > q.maxSize {
+		return ErrQueueFull
+	}
+	if q.tail == nil || q.tailSize >= QUEUE_SEGMENT_SIZE {
+		if err := q.newTail(); err != nil {
+			return err
+		}
+	}
+	n, err := q.tail.Write(line)
+	q.tailSize += int64(n)
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+	q.len++
+	return nil
+}
+
+// Prepend adds the entries at the front of the queue, before the head, e.g.
+// entries buffered in memory which are older than the queued entries.  If not
+// every entry fits, the newest entries are kept because they're closest to the
+// queued entries, and the number of entries not queued is returned with
+// ErrQueueFull.
+func (q *Queue) Prepend(entries []*proto.LogEntry) (int, error) {
+	// If the head segment is being read, it's rewritten with its unread
+	// entries, which frees the space of its read entries.
+	var unread []byte
+	var oldSize int64
+	if q.head != nil {
+		for _, entry := range q.head[q.headPos:] {
+			line, _ := queueLine(entry)
+			unread = append(unread, line...)
+		}
+		if info, err := os.Stat(q.segmentFile(q.segments[0])); err == nil {
+			oldSize = info.Size()
+		}
+	}
+	free := q.maxSize - (q.size - oldSize + int64(len(unread)))
+
+	lines := [][]byte{}
+	var size int64
+	for i := len(entries) - 1; i >= 0; i-- {
+		line, err := queueLine(entries[i])
+		if err != nil {
+			return len(entries), err
+		}
+		if size+int64(len(line)) > free {
+			break
+		}
+		lines = append([][]byte{line}, lines...)
+		size += int64(len(line))
+	}
+	lost := len(entries) - len(lines)
+
+	if len(lines) > 0 {
+		// Write a new head segment, or rewrite the head segment being read.
+		var seq int64
+		if q.head != nil {
+			seq = q.segments[0]
+		} else if len(q.segments) > 0 {
+			seq = q.segments[0] - 1
+		}
+		data := append(joinLines(lines), unread...)
+		file := q.segmentFile(seq)
+		if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+			return len(entries), err
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			return len(entries), err
+		}
+		if q.head != nil {
+			q.head = nil // reload on next Peek()
+			q.headPos = 0
+		} else {
+			q.segments = append([]int64{seq}, q.segments...)
+		}
+		q.size += int64(len(data)) - oldSize
+		q.len += len(lines)
+	}
+	if lost > 0 {
+		return lost, ErrQueueFull
+	}
+	return 0, nil
+}
+
+// Peek returns the entry at the front of the queue, or nil if it's empty.
+func (q *Queue) Peek() (*proto.LogEntry, error) {
+	for q.head == nil || q.headPos >= len(q.head) {
+		if q.head != nil {
+			// Every entry in the head segment was popped.
+			if err := q.removeHead(); err != nil {
+				return nil, err
+			}
+		}
+		if len(q.segments) == 0 {
+			return nil, nil
+		}
+		if q.tail != nil && q.tailSeq() == q.segments[0] {
+			// Don't read the segment being written: new entries go to a new tail.
+			q.closeTail()
+		}
+		entries, _, err := readSegment(q.segmentFile(q.segments[0]))
+		if err != nil {
+			return nil, err
+		}
+		q.head = entries
+		q.headPos = 0
+	}
+	return q.head[q.headPos], nil
+}
+
+// Pop removes the entry returned by Peek.
+func (q *Queue) Pop() {
+	if q.head == nil || q.headPos >= len(q.head) {
+		return
+	}
+	q.headPos++
+	q.len--
+	if q.headPos >= len(q.head) {
+		q.removeHead()
+	}
+}
+
+// Len returns the number of entries in the queue.
+func (q *Queue) Len() int {
+	return q.len
+}
+
+// Size returns the number of bytes in the queue.
+func (q *Queue) Size() int64 {
+	return q.size
+}
+
+func (q *Queue) Close() error {
+	return q.closeTail()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (q *Queue) segmentFile(seq int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s%d", QUEUE_FILE_PREFIX, seq))
+}
+
+func (q *Queue) tailSeq() int64 {
+	return q.segments[len(q.segments)-1]
+}
+
+func (q *Queue) newTail() error {
+	q.closeTail()
+	var seq int64
+	if len(q.segments) > 0 {
+		seq = q.tailSeq() + 1
+	}
+	file, err := os.OpenFile(q.segmentFile(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	q.segments = append(q.segments, seq)
+	q.tail = file
+	q.tailSize = 0
+	return nil
+}
+
+func (q *Queue) closeTail() error {
+	if q.tail == nil {
+		return nil
+	}
+	err := q.tail.Close()
+	q.tail = nil
+	q.tailSize = 0
+	return err
+}
+
+func (q *Queue) removeHead() error {
+	file := q.segmentFile(q.segments[0])
+	if info, err := os.Stat(file); err == nil {
+		q.size -= info.Size()
+	}
+	q.segments = q.segments[1:]
+	q.head = nil
+	q.headPos = 0
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(q.segments) == 0 {
+		q.size = 0
+		q.len = 0
+	}
+	return nil
+}
+
+// queueLine returns the entry as a JSON line, truncating its message if the
+// line would be longer than QUEUE_MAX_LINE.
+func queueLine(entry *proto.LogEntry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) >= QUEUE_MAX_LINE {
+		// Escaping can make a JSON string up to 6x longer (\u0000).
+		truncated := *entry
+		if len(entry.Msg) > QUEUE_MAX_LINE/8 {
+			truncated.Msg = entry.Msg[0:QUEUE_MAX_LINE/8] + " [truncated]"
+		}
+		if line, err = json.Marshal(&truncated); err != nil {
+			return nil, err
+		}
+		if len(line) >= QUEUE_MAX_LINE {
+			return nil, fmt.Errorf("log entry is too long: %d bytes", len(line))
+		}
+	}
+	return append(line, '\n'), nil
+}
+
+func readSegment(file string) ([]*proto.LogEntry, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := []*proto.LogEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), QUEUE_MAX_LINE)
+	scanner.Split(scanQueueLines())
+	for scanner.Scan() {
+		entry := &proto.LogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue // partial last line if the agent crashed while writing
+		}
+		entries = append(entries, entry)
+	}
+	return entries, info.Size(), scanner.Err()
+}
+
+// scanQueueLines is bufio.ScanLines, but lines longer than QUEUE_MAX_LINE (e.g.
+// written by an older agent) are skipped instead of stopping the scanner.
+func scanQueueLines() bufio.SplitFunc {
+	skipping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			n := bytes.IndexByte(data, '\n')
+			if n < 0 {
+				return len(data), nil, nil
+			}
+			skipping = false
+			return n + 1, nil, nil
+		}
+		if len(data) >= QUEUE_MAX_LINE && bytes.IndexByte(data, '\n') < 0 {
+			skipping = true
+			return len(data), nil, nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	}
+}
+
+func joinLines(lines [][]byte) []byte {
+	data := []byte{}
+	for _, line := range lines {
+		data = append(data, line...)
+	}
+	return data
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
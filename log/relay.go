@@ -18,17 +18,23 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/pct"
+	"io"
 	golog "log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	BUFFER_SIZE int = 50
+	BUFFER_SIZE        int = 50
+	QUEUE_REPLAY_BATCH int = 100
 )
 
 type Relay struct {
@@ -41,6 +47,7 @@ type Relay struct {
 	connected     bool
 	logLevelChan  chan byte
 	logFileChan   chan string
+	drainChan     chan chan bool
 	logger        *golog.Logger
 	firstBuf      []*proto.LogEntry
 	firstBufSize  int
@@ -48,6 +55,30 @@ type Relay struct {
 	secondBufSize int
 	lost          int
 	status        *pct.Status
+	logLevels     map[string]byte // per-service levels, set before Run()
+	logFormat     string          // log file format, set before Run()
+	logLevelsChan chan map[string]byte
+	logFormatChan chan string
+	logOut        io.Writer // log file
+	queue         *Queue    // on-disk buffer, set before Run(); nil if none
+	lostTotal     int
+	replayed      int
+	rotate        RotateConfig // log file rotation, set before Run()
+	rotateChan    chan RotateConfig
+	reopenChan    chan bool
+	output        OutputConfig // syslog, journald, set before Run()
+	outputChan    chan OutputConfig
+	outputs       []Output
+	outputErrors  uint64 // atomic, outputs write in their own goroutines
+}
+
+// A log file entry in JSON format (one per line).
+type jsonEntry struct {
+	Ts      time.Time
+	Level   string
+	Service string
+	Msg     string
+	Fields  map[string]string `json:",omitempty"`
 }
 
 func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile string, logLevel byte, offline bool) *Relay {
@@ -60,6 +91,7 @@ func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile
 		// --
 		logLevelChan: make(chan byte),
 		logFileChan:  make(chan string),
+		drainChan:    make(chan chan bool),
 		firstBuf:     make([]*proto.LogEntry, BUFFER_SIZE),
 		secondBuf:    make([]*proto.LogEntry, BUFFER_SIZE),
 		status: pct.NewStatus([]string{
@@ -69,7 +101,19 @@ func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile
 			"log-chan",
 			"log-buf1",
 			"log-buf2",
+			"log-levels",
+			"log-format",
+			"log-queue",
+			"log-lost",
+			"log-replayed",
+			"log-outputs",
+			"log-output-errors",
 		}),
+		logLevelsChan: make(chan map[string]byte),
+		logFormatChan: make(chan string),
+		rotateChan:    make(chan RotateConfig),
+		reopenChan:    make(chan bool),
+		outputChan:    make(chan OutputConfig),
 	}
 	return r
 }
@@ -86,7 +130,41 @@ func (r *Relay) LogFileChan() chan string {
 	return r.logFileChan
 }
 
+// LogLevelsChan sets the per-service log levels which override the log level.
+// Keys are service names, e.g. qan-analyzer-1, or prefixes ending with *, e.g.
+// qan-*.  The exact service name is used first, else the longest prefix.
+func (r *Relay) LogLevelsChan() chan map[string]byte {
+	return r.logLevelsChan
+}
+
+func (r *Relay) LogFormatChan() chan string {
+	return r.logFormatChan
+}
+
+func (r *Relay) RotateChan() chan RotateConfig {
+	return r.rotateChan
+}
+
+// ReopenChan makes the relay reopen its log file, e.g. after logrotate.
+func (r *Relay) ReopenChan() chan bool {
+	return r.reopenChan
+}
+
+// OutputChan sets the syslog and journald outputs.
+func (r *Relay) OutputChan() chan OutputConfig {
+	return r.outputChan
+}
+
+// Drain writes and sends the log entries in the log chan, and resends the
+// buffered entries if connected, e.g. on shutdown.
+func (r *Relay) Drain(timeout time.Duration) error {
+	return pct.DrainChan("log relay", r.drainChan, timeout)
+}
+
 func (r *Relay) Status() map[string]string {
+	if r.client == nil {
+		return r.status.All()
+	}
 	return r.status.Merge(r.client.Status())
 }
 
@@ -101,31 +179,49 @@ func (r *Relay) Run() {
 	r.status.Update("log-relay", "Running")
 
 	r.setLogLevel(r.logLevel)
+	r.setLogLevels(r.logLevels)
+	r.setLogFormat(r.logFormat)
 	r.setLogFile(r.logFile)
+	r.setOutputs(r.output)
 
 	go r.connect()
 
+	var connectChan chan bool // nil (never ready) if no client
+	if r.client != nil {
+		connectChan = r.client.ConnectChan()
+	}
+
+	// Queued entries are replayed in batches between new entries, so a long
+	// replay doesn't block the log chan.
+	ready := make(chan bool)
+	close(ready)
+
+	r.updateQueueStatus()
 	for {
 		r.status.Update("log-relay", "Idle")
+		var replayChan chan bool // nil (never ready) unless replaying queue
+		if r.connected && r.queue != nil && r.queue.Len() > 0 {
+			replayChan = ready
+		}
 		select {
 		case entry := <-r.logChan:
-			// Skip if log level too high, too verbose.
-			if entry.Level > r.logLevel {
-				continue
+			r.log(entry)
+			r.status.Update("log-chan", fmt.Sprintf("%d", len(r.logChan)))
+		case done := <-r.drainChan:
+			r.status.Update("log-relay", "Draining")
+			for n := len(r.logChan); n > 0; n-- {
+				r.log(<-r.logChan)
 			}
-
-			// Write to file if there's a file (usually there isn't).
-			if r.logger != nil {
-				r.logger.Printf("%s: %s: %s\n", entry.Service, proto.LogLevelName[entry.Level], entry.Msg)
+			if r.connected && (r.firstBufSize > 0 || r.secondBufSize > 0) {
+				r.resend()
 			}
-
-			// Send to API if we have a websocket client, and not in offline mode.
-			if !r.offline && !entry.Offline && r.client != nil {
-				r.send(entry, true) // buffer on err
+			if !r.connected && r.queue != nil {
+				// Save the entries buffered in memory so they're sent after restart.
+				r.spill()
 			}
-
 			r.status.Update("log-chan", fmt.Sprintf("%d", len(r.logChan)))
-		case connected := <-r.client.ConnectChan():
+			close(done)
+		case connected := <-connectChan:
 			r.connected = connected
 			if connected {
 				r.internal("Connected to API", proto.LOG_INFO)
@@ -138,14 +234,93 @@ func (r *Relay) Run() {
 				r.internal("Lost connection to API", proto.LOG_WARNING)
 				go r.connect()
 			}
+		case <-replayChan:
+			r.replay()
 		case file := <-r.logFileChan:
 			r.setLogFile(file)
 		case level := <-r.logLevelChan:
 			r.setLogLevel(level)
+		case levels := <-r.logLevelsChan:
+			r.setLogLevels(levels)
+		case format := <-r.logFormatChan:
+			r.setLogFormat(format)
+		case config := <-r.rotateChan:
+			r.setRotate(config)
+		case <-r.reopenChan:
+			r.reopen()
+		case config := <-r.outputChan:
+			r.setOutputs(config)
 		}
 	}
 }
 
+func (r *Relay) log(entry *proto.LogEntry) {
+	// Skip if log level too high, too verbose.
+	if entry.Level > r.level(entry.Service) {
+		return
+	}
+
+	// Write to file if there's a file (usually there isn't).
+	if r.logger != nil {
+		if r.logFormat == "json" {
+			msg, fields := pct.ParseLogFields(entry.Msg)
+			line, _ := json.Marshal(jsonEntry{
+				Ts:      entry.Ts,
+				Level:   proto.LogLevelName[entry.Level],
+				Service: entry.Service,
+				Msg:     msg,
+				Fields:  fields,
+			})
+			r.logger.Println(string(line))
+		} else {
+			r.logger.Printf("%s: %s: %s\n", entry.Service, proto.LogLevelName[entry.Level], entry.Msg)
+		}
+	}
+
+	// Write to syslog and journald if configured.  These are queued, not
+	// buffered, so entries are lost while they're down or slow.
+	for _, out := range r.outputs {
+		if err := out.Write(entry); err != nil {
+			r.outputError(out, err)
+		}
+	}
+
+	// Send to API if we have a websocket client, and not in offline mode.
+	// Until the queue is replayed, new entries are queued behind it so the
+	// API receives them in order.
+	if !r.offline && !entry.Offline && r.client != nil {
+		if r.queue != nil && r.queue.Len() > 0 {
+			r.enqueue(entry)
+		} else {
+			r.send(entry, true) // buffer on err
+		}
+	}
+}
+
+// The log level for the service: its own level, else the level of the longest
+// matching prefix, else the log level.
+func (r *Relay) level(service string) byte {
+	if len(r.logLevels) == 0 {
+		return r.logLevel
+	}
+	if level, ok := r.logLevels[service]; ok {
+		return level
+	}
+	level := r.logLevel
+	longest := -1
+	for name, l := range r.logLevels {
+		if !strings.HasSuffix(name, "*") {
+			continue
+		}
+		prefix := strings.TrimSuffix(name, "*")
+		if strings.HasPrefix(service, prefix) && len(prefix) > longest {
+			level = l
+			longest = len(prefix)
+		}
+	}
+	return level
+}
+
 // Even the relayer needs to log stuff.
 func (r *Relay) internal(msg string, level byte) {
 	logEntry := &proto.LogEntry{
@@ -176,16 +351,23 @@ func (r *Relay) buffer(e *proto.LogEntry) {
 
 	// First time we need to buffer delayed/lost log entries is closest to
 	// the events that are causing problems, so we keep some, and when this
-	// buffer is full...
-	if r.firstBufSize < BUFFER_SIZE {
+	// buffer is full (or entries are queued, which are older)...
+	if r.firstBufSize < BUFFER_SIZE && (r.queue == nil || r.queue.Len() == 0) {
 		r.firstBuf[r.firstBufSize] = e
 		r.firstBufSize++
 		return
 	}
 
-	// ...we switch to second, sliding window buffer, keeping the latest
-	// log entries and a tally of how many we've had to drop from the start
-	// (firstBuf) until now.
+	// ...we overflow into the on-disk queue, if any, which is size-capped but
+	// much larger and survives restarts.  When it's full, entries are lost.
+	if r.queue != nil {
+		r.enqueue(e)
+		return
+	}
+
+	// Without a queue, we switch to second, sliding window buffer, keeping
+	// the latest log entries and a tally of how many we've had to drop from
+	// the start (firstBuf) until now.
 	if r.secondBufSize < BUFFER_SIZE {
 		r.secondBuf[r.secondBufSize] = e
 		r.secondBufSize++
@@ -195,6 +377,8 @@ func (r *Relay) buffer(e *proto.LogEntry) {
 	// secondBuf is full too.  This problem is long-lived.  Throw away the
 	// buf and keep saving the latest log entries, counting how many we've lost.
 	r.lost += r.secondBufSize
+	r.lostTotal += r.secondBufSize
+	r.status.Update("log-lost", fmt.Sprintf("%d", r.lostTotal))
 	for i := 0; i < BUFFER_SIZE; i++ {
 		r.secondBuf[i] = nil
 	}
@@ -202,6 +386,17 @@ func (r *Relay) buffer(e *proto.LogEntry) {
 	r.secondBufSize = 1
 }
 
+func (r *Relay) enqueue(e *proto.LogEntry) {
+	if err := r.queue.Push(e); err != nil {
+		if err != ErrQueueFull {
+			golog.Println("Log queue: ", err)
+		}
+		r.lost++
+		r.lostTotal++
+	}
+	r.updateQueueStatus()
+}
+
 func (r *Relay) send(entry *proto.LogEntry, bufferOnErr bool) error {
 	var err error
 	if r.connected {
@@ -262,6 +457,58 @@ func (r *Relay) resend() {
 	}
 }
 
+// Send a batch of queued entries, oldest first.
+func (r *Relay) replay() {
+	r.status.Update("log-relay", "Replaying queue")
+	defer r.updateQueueStatus()
+	for i := 0; i < QUEUE_REPLAY_BATCH; i++ {
+		entry, err := r.queue.Peek()
+		if err != nil {
+			golog.Println("Log queue: ", err)
+			r.queue = nil // don't retry forever; entries stay on disk
+			return
+		}
+		if entry == nil {
+			return // queue is empty
+		}
+		if err := r.send(entry, false); err != nil {
+			// send() disconnected, so don't replay until reconnected.
+			r.connected = false
+			return
+		}
+		r.queue.Pop()
+		r.replayed++
+	}
+}
+
+// Move the entries buffered in memory to the front of the queue.  They're older
+// than the queued entries because the queue is used only when the buffer is full.
+func (r *Relay) spill() {
+	entries := []*proto.LogEntry{}
+	for i := 0; i < BUFFER_SIZE; i++ {
+		if r.firstBuf[i] != nil {
+			entries = append(entries, r.firstBuf[i])
+			r.firstBuf[i] = nil
+		}
+	}
+	r.firstBufSize = 0
+	lost, err := r.queue.Prepend(entries)
+	if err != nil && err != ErrQueueFull {
+		golog.Println("Log queue: ", err)
+	}
+	r.lostTotal += lost
+	r.updateQueueStatus()
+	r.status.Update("log-buf1", "0")
+}
+
+func (r *Relay) updateQueueStatus() {
+	if r.queue != nil {
+		r.status.Update("log-queue", fmt.Sprintf("%d entries, %d bytes", r.queue.Len(), r.queue.Size()))
+	}
+	r.status.Update("log-lost", fmt.Sprintf("%d", r.lostTotal))
+	r.status.Update("log-replayed", fmt.Sprintf("%d", r.replayed))
+}
+
 func (r *Relay) setLogLevel(level byte) {
 	r.status.Update("log-relay", fmt.Sprintf("Setting log level: %d", level))
 
@@ -274,34 +521,144 @@ func (r *Relay) setLogLevel(level byte) {
 	r.status.Update("log-level", proto.LogLevelName[level])
 }
 
+func (r *Relay) setLogLevels(levels map[string]byte) {
+	r.status.Update("log-relay", "Setting log levels")
+
+	for service, level := range levels {
+		if level < proto.LOG_EMERGENCY || level > proto.LOG_DEBUG {
+			r.internal(fmt.Sprintf("Invalid log level for %s: %d\n", service, level), proto.LOG_WARNING)
+			return
+		}
+	}
+
+	r.logLevels = levels
+	names := []string{}
+	for service, level := range levels {
+		names = append(names, service+"="+proto.LogLevelName[level])
+	}
+	sort.Strings(names)
+	r.status.Update("log-levels", strings.Join(names, " "))
+}
+
+func (r *Relay) setLogFormat(format string) {
+	r.status.Update("log-relay", "Setting log format: "+format)
+
+	if format == "" {
+		format = DEFAULT_LOG_FORMAT
+	}
+	if !LogFormats[format] {
+		r.internal("Invalid log format: "+format, proto.LOG_WARNING)
+		return
+	}
+
+	r.logFormat = format
+	r.status.Update("log-format", format)
+	if r.logOut != nil {
+		r.logger = r.newLogger(r.logOut)
+	}
+}
+
+func (r *Relay) newLogger(out io.Writer) *golog.Logger {
+	if r.logFormat == "json" {
+		return golog.New(out, "", 0) // JSON entries have their own Ts
+	}
+	return golog.New(out, "", golog.Ldate|golog.Ltime|golog.Lmicroseconds)
+}
+
+func (r *Relay) setRotate(config RotateConfig) {
+	r.rotate = config
+	if file, ok := r.logOut.(*RotatingFile); ok {
+		file.SetConfig(config)
+	}
+}
+
+func (r *Relay) reopen() {
+	file, ok := r.logOut.(*RotatingFile)
+	if !ok {
+		return // no log file, or stdout/stderr
+	}
+	r.status.Update("log-relay", "Reopening log file")
+	if err := file.Reopen(); err != nil {
+		r.internal("Cannot reopen log file: "+err.Error(), proto.LOG_WARNING)
+	}
+}
+
+// outputError is called by the relay and by the outputs' goroutines.
+func (r *Relay) outputError(out Output, err error) {
+	n := atomic.AddUint64(&r.outputErrors, 1)
+	r.status.Update("log-output-errors", fmt.Sprintf("%d, last: %s: %s", n, out, err))
+}
+
+func (r *Relay) setOutputs(config OutputConfig) {
+	r.status.Update("log-relay", "Setting log outputs")
+
+	for _, out := range r.outputs {
+		out.Close()
+	}
+	r.outputs = nil
+	r.output = config
+
+	if config.Syslog != "" {
+		syslog, err := NewSyslog(config.Syslog, config.Facility)
+		if err != nil {
+			r.internal(err.Error(), proto.LOG_WARNING)
+		} else {
+			r.outputs = append(r.outputs, NewQueuedOutput(syslog, r.outputError))
+		}
+	}
+	if config.Journald {
+		journald := NewJournald(JOURNALD_SOCKET, config.Facility)
+		r.outputs = append(r.outputs, NewQueuedOutput(journald, r.outputError))
+	}
+
+	names := []string{}
+	for _, out := range r.outputs {
+		names = append(names, out.String())
+	}
+	r.status.Update("log-outputs", strings.Join(names, ", "))
+}
+
 func (r *Relay) setLogFile(logFile string) {
 	r.status.Update("log-relay", "Setting log file: "+logFile)
 
+	oldFile, _ := r.logOut.(*RotatingFile)
+	defer func() {
+		if oldFile != nil {
+			oldFile.Close()
+		}
+	}()
+
 	if logFile == "" {
 		r.logger = nil
+		r.logOut = nil
 		r.logFile = ""
 		r.status.Update("log-file", "")
 		return
 	}
 
-	var file *os.File
+	var file io.Writer
+	var fileName string
 	if logFile == "STDOUT" {
 		file = os.Stdout
+		fileName = os.Stdout.Name()
 	} else if logFile == "STDERR" {
 		file = os.Stderr
+		fileName = os.Stderr.Name()
 	} else {
 		if !filepath.IsAbs(logFile) {
 			logFile = filepath.Join(pct.Basedir.Path(), logFile)
 		}
-		var err error
-		file, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		rotatingFile, err := OpenRotatingFile(logFile, r.rotate)
 		if err != nil {
 			r.internal(err.Error(), proto.LOG_WARNING)
+			oldFile = nil // keep using it
 			return
 		}
+		file = rotatingFile
+		fileName = rotatingFile.Name()
 	}
-	logger := golog.New(file, "", golog.Ldate|golog.Ltime|golog.Lmicroseconds)
-	r.logger = logger
-	r.logFile = file.Name()
+	r.logOut = file
+	r.logger = r.newLogger(file)
+	r.logFile = fileName
 	r.status.Update("log-file", logFile)
 }
@@ -0,0 +1,347 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+ * Log files are rotated when they're too large or too old: file.N is removed,
+ * file.N-1 is renamed file.N, etc., then file is renamed file.1, which is
+ * compressed to file.1.gz, and a new file is opened.  The log relay owns its
+ * log file so it uses a RotatingFile, which compresses file.1 in the background
+ * so a large file doesn't block logging.  The agent's stdout log is different:
+ * the shell that started the agent owns the file (>> file), so it's rotated
+ * by copying it to file.1 and truncating it (copy-truncate) in RotateRedirected.
+ * For external logrotate, send SIGUSR2 to make the relay reopen its log file.
+ */
+
+const (
+	DEFAULT_ROTATE_SIZE   = 100 // MiB
+	DEFAULT_ROTATE_KEEP   = 5
+	ROTATE_CHECK_INTERVAL = 60 // seconds, for RotateRedirected
+)
+
+type RotateConfig struct {
+	Size         int64         // bytes; 0 = don't rotate on size
+	Interval     time.Duration // 0 = don't rotate on time
+	Keep         int           // rotated files to keep
+	Compress     bool          // gzip rotated files
+	CopyTruncate bool          // copy then truncate the file instead of renaming it
+}
+
+// Rotate rotates the file now.  The file does not have to exist.
+func Rotate(file string, config RotateConfig) error {
+	if config.Keep < 1 {
+		// Nothing to keep, so just empty the file.
+		return emptyFile(file, config.CopyTruncate)
+	}
+
+	// Shift file.N-1 to file.N, etc.; the oldest is overwritten.
+	for n := config.Keep - 1; n >= 1; n-- {
+		for _, ext := range []string{"", ".gz"} {
+			from := fmt.Sprintf("%s.%d%s", file, n, ext)
+			to := fmt.Sprintf("%s.%d%s", file, n+1, ext)
+			if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	// Remove files beyond Keep, e.g. if Keep was larger.
+	for n := config.Keep + 1; ; n++ {
+		err1 := os.Remove(fmt.Sprintf("%s.%d", file, n))
+		err2 := os.Remove(fmt.Sprintf("%s.%d.gz", file, n))
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			break
+		}
+	}
+
+	rotated := file + ".1"
+	os.Remove(rotated + ".gz") // file.1.gz was shifted unless Keep=1
+	if config.CopyTruncate {
+		if err := copyFile(file, rotated); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := os.Truncate(file, 0); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Rename(file, rotated); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	if config.Compress {
+		return gzipFile(rotated)
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// RotatingFile
+/////////////////////////////////////////////////////////////////////////////
+
+// A RotatingFile is an append-only file which is rotated before a write if it's
+// too large or too old.  It's safe for concurrent use.
+type RotatingFile struct {
+	path   string
+	config RotateConfig
+	// --
+	file        *os.File
+	size        int64
+	opened      time.Time
+	mux         *sync.Mutex
+	compressing *sync.WaitGroup // gzipping file.1
+}
+
+func OpenRotatingFile(path string, config RotateConfig) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:        path,
+		config:      config,
+		mux:         &sync.Mutex{},
+		compressing: &sync.WaitGroup{},
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.file == nil {
+		return 0, os.ErrInvalid
+	}
+	if f.size > 0 && f.due(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than lose entries.
+			fmt.Fprintf(os.Stderr, "Cannot rotate %s: %s\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file, e.g. after logrotate renamed it.
+func (f *RotatingFile) Reopen() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.file != nil {
+		f.file.Close()
+	}
+	return f.open()
+}
+
+// SetConfig changes how the file is rotated, starting with the next write.
+func (f *RotatingFile) SetConfig(config RotateConfig) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.config = config
+}
+
+func (f *RotatingFile) Name() string {
+	return f.path
+}
+
+// Close closes the file and waits for the rotated file to be compressed.
+func (f *RotatingFile) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	defer f.compressing.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) due(n int64) bool {
+	if f.config.Size > 0 && f.size+n > f.config.Size {
+		return true
+	}
+	if f.config.Interval > 0 && time.Now().Sub(f.opened) >= f.config.Interval {
+		return true
+	}
+	return false
+}
+
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	// file.1 is shifted, so it must be compressed first.  It usually is: it
+	// was rotated a whole rotation ago.
+	f.compressing.Wait()
+
+	config := f.config
+	config.CopyTruncate = false // we own the file
+	config.Compress = false     // below, in the background
+	rotateErr := Rotate(f.path, config)
+	if rotateErr == nil && f.config.Compress && config.Keep > 0 {
+		rotated := f.path + ".1"
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			if err := gzipFile(rotated); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Cannot compress %s: %s\n", rotated, err)
+			}
+		}()
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Redirected output
+/////////////////////////////////////////////////////////////////////////////
+
+// RotateRedirected rotates the file which the agent's stdout and stderr are
+// redirected to (>> file 2>&1) when it's too large or too old, using
+// copy-truncate, until stopChan is closed.  The config is got before every
+// check so changes apply without restarting.
+// @goroutine[1]
+func RotateRedirected(file string, configFunc func() RotateConfig, stopChan chan bool) {
+	start := time.Now()
+	ticker := time.NewTicker(ROTATE_CHECK_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+		config := configFunc()
+		config.CopyTruncate = true
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		due := config.Size > 0 && info.Size() > config.Size
+		if config.Interval > 0 && time.Now().Sub(start) >= config.Interval && info.Size() > 0 {
+			due = true
+		}
+		if !due {
+			continue
+		}
+		if err := Rotate(file, config); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rotate %s: %s\n", file, err)
+			continue
+		}
+		start = time.Now()
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func emptyFile(file string, truncate bool) error {
+	var err error
+	if truncate {
+		err = os.Truncate(file, 0)
+	} else {
+		err = os.Remove(file)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func gzipFile(file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFile := file + ".gz.tmp"
+	dst, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, file+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
@@ -0,0 +1,491 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Besides the API and the log file, log entries can be sent to the local syslog
+ * and to systemd-journald.  Each output is written by its own goroutine from a
+ * small queue (OUTPUT_QUEUE_SIZE), so a slow or stalled output doesn't block
+ * the relay.  Entries are not saved: if syslog or journald is down, or its queue
+ * is full, entries for it are dropped.  After a failure, an output isn't retried
+ * for OUTPUT_RETRY_INTERVAL.  To use them instead of the API, set Config.Offline.
+ *
+ * Syslog messages are RFC5424.  The proto.LogEntry levels are the syslog
+ * severities (LOG_EMERGENCY=0 to LOG_DEBUG=7), and the service name is the
+ * APP-NAME (tag).  Journald entries are sent with its native protocol: the
+ * service name is SYSLOG_IDENTIFIER, the level is PRIORITY, and structured
+ * fields (see pct.Logger.With()) are journal fields, e.g. instance=1 is INSTANCE=1.
+ */
+
+const (
+	DEFAULT_SYSLOG_FACILITY = "daemon"
+	JOURNALD_SOCKET         = "/run/systemd/journal/socket"
+	OUTPUT_WRITE_TIMEOUT    = 5  // seconds
+	OUTPUT_RETRY_INTERVAL   = 10 // seconds between reconnects after a failure
+	OUTPUT_QUEUE_SIZE       = 100
+)
+
+var SyslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Local syslog sockets, tried in order, like Go's log/syslog.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var ErrOutputRetry = errors.New("not connected, waiting to retry")
+var ErrOutputQueueFull = errors.New("queue full, entry dropped")
+
+// OutputConfig is which outputs the relay writes besides the API and log file.
+type OutputConfig struct {
+	Syslog   string // address, see ParseSyslogAddr; "" = no syslog
+	Facility int    // syslog facility, also for journald
+	Journald bool
+}
+
+// An Output writes log entries to the local system.
+type Output interface {
+	Write(entry *proto.LogEntry) error
+	Close() error
+	String() string
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Queued output
+/////////////////////////////////////////////////////////////////////////////
+
+// QueuedOutput writes entries to an Output in its own goroutine.  Write only
+// queues the entry; write errors are passed to the error func, which is called
+// by the output's goroutine.
+type QueuedOutput struct {
+	out     Output
+	errFunc func(Output, error)
+	// --
+	entryChan chan *proto.LogEntry
+	stopChan  chan bool
+	doneChan  chan bool
+	dropped   uint64 // atomic
+}
+
+func NewQueuedOutput(out Output, errFunc func(Output, error)) *QueuedOutput {
+	q := &QueuedOutput{
+		out:     out,
+		errFunc: errFunc,
+		// --
+		entryChan: make(chan *proto.LogEntry, OUTPUT_QUEUE_SIZE),
+		stopChan:  make(chan bool),
+		doneChan:  make(chan bool),
+	}
+	go q.run()
+	return q
+}
+
+// Write queues the entry, or returns ErrOutputQueueFull.
+func (q *QueuedOutput) Write(entry *proto.LogEntry) error {
+	select {
+	case q.entryChan <- entry:
+		return nil
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		return ErrOutputQueueFull
+	}
+}
+
+// Close writes the queued entries, then closes the output.  It waits at most
+// OUTPUT_WRITE_TIMEOUT; if the output is stalled, the rest are dropped.
+func (q *QueuedOutput) Close() error {
+	close(q.stopChan)
+	select {
+	case <-q.doneChan:
+	case <-time.After(OUTPUT_WRITE_TIMEOUT * time.Second):
+	}
+	return nil
+}
+
+func (q *QueuedOutput) String() string {
+	return q.out.String()
+}
+
+// Dropped returns how many entries were dropped because the queue was full.
+func (q *QueuedOutput) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+func (q *QueuedOutput) run() {
+	defer close(q.doneChan)
+	defer q.out.Close()
+	for {
+		select {
+		case entry := <-q.entryChan:
+			q.write(entry)
+		case <-q.stopChan:
+			for {
+				select {
+				case entry := <-q.entryChan:
+					if err := q.write(entry); err != nil {
+						return // don't wait for a failed output
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *QueuedOutput) write(entry *proto.LogEntry) error {
+	err := q.out.Write(entry)
+	if err != nil && q.errFunc != nil {
+		q.errFunc(q.out, err)
+	}
+	return err
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Syslog
+/////////////////////////////////////////////////////////////////////////////
+
+// ParseSyslogAddr parses a syslog address: "local" for the local syslog socket
+// (network and address are ""), unix:///path, udp://host[:port] or
+// tcp://host[:port].  The default port is 514.
+func ParseSyslogAddr(addr string) (network, address string, err error) {
+	if addr == "local" {
+		return "", "", nil
+	}
+	n := strings.Index(addr, "://")
+	if n < 0 {
+		return "", "", errors.New("Invalid syslog address: " + addr + ": expected local, unix:///path, udp://host:port or tcp://host:port")
+	}
+	network = addr[0:n]
+	address = addr[n+3:]
+	if address == "" {
+		return "", "", errors.New("Invalid syslog address: " + addr + ": no path or host")
+	}
+	switch network {
+	case "unix":
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "514")
+		}
+	default:
+		return "", "", errors.New("Invalid syslog address: " + addr + ": network must be unix, udp or tcp")
+	}
+	return network, address, nil
+}
+
+type Syslog struct {
+	addr     string
+	network  string
+	address  string
+	facility int
+	// --
+	hostname string
+	pid      int
+	conn     net.Conn
+	stream   bool // tcp or unix stream socket
+	retry    time.Time
+}
+
+func NewSyslog(addr string, facility int) (*Syslog, error) {
+	network, address, err := ParseSyslogAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	s := &Syslog{
+		addr:     addr,
+		network:  network,
+		address:  address,
+		facility: facility,
+		// --
+		hostname: hostname,
+		pid:      os.Getpid(),
+	}
+	return s, nil
+}
+
+func (s *Syslog) Write(entry *proto.LogEntry) error {
+	msg := s.format(entry)
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	if err := s.write(msg); err != nil {
+		s.Close()
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// Syslog is stalled, so don't wait for it again until the retry.
+			s.retry = time.Now().Add(OUTPUT_RETRY_INTERVAL * time.Second)
+			return err
+		}
+		// Reconnect once, e.g. if syslog was restarted.
+		if err := s.connect(); err != nil {
+			return err
+		}
+		if err := s.write(msg); err != nil {
+			s.Close()
+			s.retry = time.Now().Add(OUTPUT_RETRY_INTERVAL * time.Second)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syslog) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Syslog) String() string {
+	return "syslog " + s.addr
+}
+
+func (s *Syslog) connect() error {
+	if time.Now().Before(s.retry) {
+		return ErrOutputRetry
+	}
+	var conn net.Conn
+	var stream bool
+	var err error
+	switch s.network {
+	case "":
+		for _, socket := range syslogSockets {
+			if conn, stream, err = dialUnix(socket); err == nil {
+				break
+			}
+		}
+	case "unix":
+		conn, stream, err = dialUnix(s.address)
+	default:
+		conn, err = net.DialTimeout(s.network, s.address, OUTPUT_WRITE_TIMEOUT*time.Second)
+		stream = s.network == "tcp"
+	}
+	if err != nil {
+		s.retry = time.Now().Add(OUTPUT_RETRY_INTERVAL * time.Second)
+		return err
+	}
+	s.conn = conn
+	s.stream = stream
+	return nil
+}
+
+func (s *Syslog) write(msg string) error {
+	if s.stream {
+		if s.network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg) // RFC6587 octet counting
+		} else {
+			msg += "\n"
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(OUTPUT_WRITE_TIMEOUT * time.Second))
+	_, err := s.conn.Write([]byte(msg))
+	return err
+}
+
+// RFC5424: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (s *Syslog) format(entry *proto.LogEntry) string {
+	pri := s.facility*8 + int(syslogSeverity(entry.Level))
+	ts := entry.Ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	msg := strings.Replace(entry.Msg, pct.LOG_FIELDS_SEP, " ", 1)
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, ts, s.hostname, syslogAppName(entry.Service), s.pid, msg)
+}
+
+// Connect to a unix socket, which can be datagram or stream.
+func dialUnix(socket string) (conn net.Conn, stream bool, err error) {
+	if conn, err = net.Dial("unixgram", socket); err == nil {
+		return conn, false, nil
+	}
+	conn, err = net.Dial("unix", socket)
+	return conn, true, err
+}
+
+// The proto levels are the syslog severities, but an invalid level shouldn't
+// change the facility.
+func syslogSeverity(level byte) byte {
+	if level > proto.LOG_DEBUG {
+		return proto.LOG_DEBUG
+	}
+	return level
+}
+
+// APP-NAME is 1-48 printable ASCII chars, no spaces.
+func syslogAppName(service string) string {
+	name := []byte{}
+	for i := 0; i < len(service) && len(name) < 48; i++ {
+		if service[i] > 32 && service[i] < 127 {
+			name = append(name, service[i])
+		}
+	}
+	if len(name) == 0 {
+		return "-"
+	}
+	return string(name)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Journald
+/////////////////////////////////////////////////////////////////////////////
+
+type Journald struct {
+	socket   string
+	facility int
+	// --
+	conn  net.Conn
+	retry time.Time
+}
+
+// NewJournald returns a journald output which sends entries to the socket,
+// usually JOURNALD_SOCKET.
+func NewJournald(socket string, facility int) *Journald {
+	j := &Journald{
+		socket:   socket,
+		facility: facility,
+	}
+	return j
+}
+
+func (j *Journald) Write(entry *proto.LogEntry) error {
+	if j.conn == nil {
+		if time.Now().Before(j.retry) {
+			return ErrOutputRetry
+		}
+		conn, err := net.Dial("unixgram", j.socket)
+		if err != nil {
+			j.retry = time.Now().Add(OUTPUT_RETRY_INTERVAL * time.Second)
+			return err
+		}
+		j.conn = conn
+	}
+	j.conn.SetWriteDeadline(time.Now().Add(OUTPUT_WRITE_TIMEOUT * time.Second))
+	if _, err := j.conn.Write(j.format(entry)); err != nil {
+		// Entries too large for a datagram (EMSGSIZE) are lost; the journal
+		// needs them passed as a memfd, which isn't worth it for log entries.
+		j.Close()
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			j.retry = time.Now().Add(OUTPUT_RETRY_INTERVAL * time.Second)
+		}
+		return err
+	}
+	return nil
+}
+
+func (j *Journald) Close() error {
+	if j.conn == nil {
+		return nil
+	}
+	err := j.conn.Close()
+	j.conn = nil
+	return err
+}
+
+func (j *Journald) String() string {
+	return "journald"
+}
+
+func (j *Journald) format(entry *proto.LogEntry) []byte {
+	msg, fields := pct.ParseLogFields(entry.Msg)
+	buf := &bytes.Buffer{}
+	journalField(buf, "MESSAGE", msg)
+	journalField(buf, "PRIORITY", fmt.Sprintf("%d", syslogSeverity(entry.Level)))
+	journalField(buf, "SYSLOG_FACILITY", fmt.Sprintf("%d", j.facility))
+	journalField(buf, "SYSLOG_IDENTIFIER", entry.Service)
+	journalField(buf, "SYSLOG_TIMESTAMP", entry.Ts.UTC().Format(time.RFC3339Nano))
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		journalField(buf, journalFieldName(key), fields[key])
+	}
+	return buf.Bytes()
+}
+
+// A field is NAME=value\n, or if the value has newlines: NAME\n, the value's
+// length as a little-endian uint64, the value, \n.
+func journalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.Contains(value, "\n") {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// Journal field names are uppercase letters, digits and _, 64 chars max, and
+// must start with a letter (names starting with _ are trusted fields).
+func journalFieldName(key string) string {
+	name := []byte{}
+	for _, c := range []byte(strings.ToUpper(key)) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			name = append(name, c)
+		} else {
+			name = append(name, '_')
+		}
+	}
+	if len(name) == 0 || name[0] < 'A' || name[0] > 'Z' {
+		name = append([]byte("F_"), name...)
+	}
+	if len(name) > 64 {
+		name = name[0:64]
+	}
+	return string(name)
+}
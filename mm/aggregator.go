@@ -23,27 +23,55 @@ import (
 	"github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/pct"
 	"math"
+	"sort"
+	"sync"
 	"time"
 )
 
+// Collections for the next interval held while waiting for late collections
+// for the current interval.  If more arrive, the grace period ends early.
+const MAX_HELD_COLLECTIONS = 100
+
+// How an instance's metrics are collected and summarized, set by the manager
+// for each monitor.  The zero value means unknown collect interval (so no
+// coverage metadata) and keep and summarize all values.
+type InstanceConfig struct {
+	Collect     uint // seconds, to know how many collections to expect
+	Sketch      bool
+	Percentiles []float64
+}
+
+type instanceKey struct {
+	service    string
+	instanceId uint
+}
+
 type Aggregator struct {
 	logger         *pct.Logger
 	interval       int64
 	collectionChan chan *Collection
 	spool          data.Spooler
+	sinks          []CollectionSink
 	// --
-	sync    *pct.SyncChan
-	running bool
+	sync      *pct.SyncChan
+	flushChan chan chan bool
+	running   bool
+	configs   map[instanceKey]InstanceConfig
+	configMux *sync.RWMutex
 }
 
-func NewAggregator(logger *pct.Logger, interval int64, collectionChan chan *Collection, spool data.Spooler) *Aggregator {
+func NewAggregator(logger *pct.Logger, interval int64, collectionChan chan *Collection, spool data.Spooler, sinks ...CollectionSink) *Aggregator {
 	a := &Aggregator{
 		logger:         logger,
 		interval:       interval,
 		collectionChan: collectionChan,
 		spool:          spool,
+		sinks:          sinks,
 		// --
-		sync: pct.NewSyncChan(),
+		sync:      pct.NewSyncChan(),
+		flushChan: make(chan chan bool),
+		configs:   make(map[instanceKey]InstanceConfig),
+		configMux: &sync.RWMutex{},
 	}
 	return a
 }
@@ -64,6 +92,31 @@ func (a *Aggregator) Stop() {
 	a.sync.Wait()
 }
 
+// Flush reports the current interval, although it's incomplete, e.g. on shutdown
+// after the monitors have stopped.  The next collection starts a new interval.
+// @goroutine[0]
+func (a *Aggregator) Flush(timeout time.Duration) error {
+	return pct.DrainChan(fmt.Sprintf("%ds aggregator", a.interval), a.flushChan, timeout)
+}
+
+// @goroutine[0]
+func (a *Aggregator) SetInstanceConfig(service string, instanceId uint, config InstanceConfig) error {
+	if err := ValidPercentiles(config.Percentiles); err != nil {
+		return err
+	}
+	a.configMux.Lock()
+	defer a.configMux.Unlock()
+	a.configs[instanceKey{service, instanceId}] = config
+	return nil
+}
+
+// @goroutine[0]
+func (a *Aggregator) RemoveInstanceConfig(service string, instanceId uint) {
+	a.configMux.Lock()
+	defer a.configMux.Unlock()
+	delete(a.configs, instanceKey{service, instanceId})
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
@@ -81,10 +134,17 @@ func (a *Aggregator) run() {
 	var curInterval int64
 	var startTs time.Time
 	cur := []*InstanceStats{}
+	held := []*Collection{} // for next interval, during grace period
 
 	for {
 		select {
 		case collection := <-a.collectionChan:
+			if len(a.sinks) > 0 {
+				collect := a.getInstanceConfig(collection.Service, collection.InstanceId).Collect
+				for _, sink := range a.sinks {
+					sink.Add(collection, collect)
+				}
+			}
 			interval := (collection.Ts / a.interval) * a.interval
 			if curInterval == 0 {
 				curInterval = interval
@@ -92,76 +152,178 @@ func (a *Aggregator) run() {
 				a.logger.Debug("Start first interval", startTs)
 			}
 			if interval > curInterval {
-				// Metrics for next interval have arrived.  Process and spool
-				// the current interval, then advance to this interval.
-				a.report(startTs, cur)
+				// Metrics for next interval have arrived, but metrics for the current
+				// interval from other instances can arrive a little late (e.g. a slow
+				// MySQL monitor), so hold these until the grace period ends.
+				if interval == curInterval+a.interval && collection.Ts < interval+a.grace() && len(held) < MAX_HELD_COLLECTIONS {
+					held = append(held, collection)
+					continue
+				}
 
-				// Init next stats based on current ones to avoid re-creating them.
-				// todo: what if metrics from an instance aren't collected?
-				for n := range cur {
-					for key, _ := range cur[n].Stats {
-						cur[n].Stats[key].Reset()
+				// Grace period has ended.  Process and spool the current interval,
+				// then advance to the next interval and add the metrics held for it.
+				a.report(startTs, cur)
+				a.reset(cur)
+				if len(held) > 0 {
+					curInterval += a.interval
+					startTs = GoTime(a.interval, curInterval)
+					a.logger.Debug("Start interval", startTs)
+					for _, c := range held {
+						cur = a.add(cur, c, true)
+					}
+					held = []*Collection{}
+					if interval > curInterval {
+						// This collection is even later, so the interval of
+						// the held metrics is complete too.
+						a.report(startTs, cur)
+						a.reset(cur)
 					}
 				}
-				curInterval = interval
-				startTs = GoTime(a.interval, interval)
-				a.logger.Debug("Start interval", startTs)
+				if interval > curInterval {
+					curInterval = interval
+					startTs = GoTime(a.interval, interval)
+					a.logger.Debug("Start interval", startTs)
+				}
 			} else if interval < curInterval {
 				t := GoTime(a.interval, interval)
 				a.logger.Info("Lost collection for interval", t, "; current interval is", startTs)
 			}
-
-			// Each collection is from a specific service instance.
-			// Find the stats for this instance, create if they don't exist.
-			var is *InstanceStats
-			for _, i := range cur {
-				if collection.Service == i.Service && collection.InstanceId == i.InstanceId {
-					is = i
-					break
+			cur = a.add(cur, collection, interval == curInterval)
+		case done := <-a.flushChan:
+			// Add the collections already sent, or hold those for the next
+			// interval, then report what we have.
+			for n := len(a.collectionChan); n > 0; n-- {
+				collection := <-a.collectionChan
+				interval := (collection.Ts / a.interval) * a.interval
+				if curInterval == 0 {
+					curInterval = interval
+					startTs = GoTime(a.interval, interval)
 				}
-			}
-
-			if is == nil {
-				// New service instance, create stats for it.
-				is = &InstanceStats{
-					ServiceInstance: proto.ServiceInstance{
-						Service:    collection.Service,
-						InstanceId: collection.InstanceId,
-					},
-					Stats: make(map[string]*Stats),
+				if interval == curInterval+a.interval {
+					held = append(held, collection)
+				} else if interval == curInterval {
+					cur = a.add(cur, collection, true)
 				}
-				cur = append(cur, is)
 			}
-
-			// Add each metric in the collection to its Stats.
-			for _, metric := range collection.Metrics {
-				stats, haveStats := is.Stats[metric.Name]
-				if !haveStats {
-					// New metric, create stats for it.
-					var err error
-					stats, err = NewStats(metric.Type)
-					if err != nil {
-						a.logger.Error(metric.Name, "invalid:", err.Error())
-						continue
-					}
-					is.Stats[metric.Name] = stats
-				}
-				if err := stats.Add(&metric, collection.Ts); err != nil {
-					f := a.logger.Error
-					switch err.(type) {
-					case ErrValueLap:
-						// Treat this error as info
-						f = a.logger.Info
+			if curInterval > 0 {
+				a.logger.Info("Flush interval", startTs)
+				a.report(startTs, cur)
+				a.reset(cur)
+				if len(held) > 0 {
+					startTs = GoTime(a.interval, curInterval+a.interval)
+					for _, c := range held {
+						cur = a.add(cur, c, true)
 					}
-					f(fmt.Sprintf("stats.Add(%+v, %d): %s", metric, collection.Ts, err))
+					held = []*Collection{}
+					a.report(startTs, cur)
+					a.reset(cur)
 				}
+				curInterval = 0
 			}
+			close(done)
 		case <-a.sync.StopChan:
 			return
 		}
 	}
 }
 
+// Add the metrics in the collection to the stats of the instance it's from.
+// Only collections for the current interval count toward the instance's coverage.
+// @goroutine[1]
+func (a *Aggregator) add(cur []*InstanceStats, collection *Collection, count bool) []*InstanceStats {
+	// Each collection is from a specific service instance.
+	// Find the stats for this instance, create if they don't exist.
+	var is *InstanceStats
+	for _, i := range cur {
+		if collection.Service == i.Service && collection.InstanceId == i.InstanceId {
+			is = i
+			break
+		}
+	}
+
+	if is == nil {
+		// New service instance, create stats for it.
+		is = &InstanceStats{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    collection.Service,
+				InstanceId: collection.InstanceId,
+			},
+			Stats: make(map[string]*Stats),
+		}
+		cur = append(cur, is)
+	}
+	if count {
+		is.collections++
+	}
+
+	// Add each metric in the collection to its Stats.
+	config := a.getInstanceConfig(collection.Service, collection.InstanceId)
+	for _, metric := range collection.Metrics {
+		stats, haveStats := is.Stats[metric.Name]
+		if !haveStats {
+			// New metric, create stats for it.
+			var err error
+			if config.Sketch {
+				stats, err = NewSketchStats(metric.Type, config.Percentiles)
+			} else {
+				stats, err = NewStats(metric.Type)
+			}
+			if err != nil {
+				a.logger.Error(metric.Name, "invalid:", err.Error())
+				continue
+			}
+			is.Stats[metric.Name] = stats
+		}
+		if err := stats.Add(&metric, collection.Ts); err != nil {
+			f := a.logger.Error
+			switch err.(type) {
+			case ErrValueLap:
+				// Treat this error as info
+				f = a.logger.Info
+			}
+			f(fmt.Sprintf("stats.Add(%+v, %d): %s", metric, collection.Ts, err))
+		}
+	}
+	return cur
+}
+
+// Init next stats based on current ones to avoid re-creating them.
+// @goroutine[1]
+func (a *Aggregator) reset(cur []*InstanceStats) {
+	for n := range cur {
+		cur[n].collections = 0
+		for key, _ := range cur[n].Stats {
+			cur[n].Stats[key].Reset()
+		}
+	}
+}
+
+// @goroutine[1]
+func (a *Aggregator) getInstanceConfig(service string, instanceId uint) InstanceConfig {
+	a.configMux.RLock()
+	defer a.configMux.RUnlock()
+	return a.configs[instanceKey{service, instanceId}]
+}
+
+// How long (seconds) into the next interval to wait for late collections for the
+// current interval: the longest collect interval, but at most half the report
+// interval.  Zero if no collect intervals are known, i.e. don't wait.
+// @goroutine[1]
+func (a *Aggregator) grace() int64 {
+	a.configMux.RLock()
+	defer a.configMux.RUnlock()
+	var grace int64
+	for _, config := range a.configs {
+		if int64(config.Collect) > grace {
+			grace = int64(config.Collect)
+		}
+	}
+	if grace > a.interval/2 {
+		grace = a.interval / 2
+	}
+	return grace
+}
+
 // @goroutine[1]
 func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 	a.logger.Debug("Summarize metrics for", startTs)
@@ -187,11 +349,12 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 			finalMetrics[metric] = finalStats
 		}
 
-		// If the instance has no metrics with stats; ignore it.  This can
-		// happen if, for example, the MySQL metrics take too long to collect.
-		// This isn't reported here; the metrics monitor should report it
-		// because it knows that it collect any metrics.
-		if len(finalMetrics) == 0 {
+		// If the instance has no metrics with stats and we don't know how many
+		// collections to expect, ignore it.  This can happen if, for example,
+		// the MySQL metrics take too long to collect.  If we know, report its
+		// coverage, even if it's zero (missed every collection).
+		expected := a.expected(i.Service, i.InstanceId)
+		if len(finalMetrics) == 0 && expected == 0 {
 			continue
 		}
 
@@ -203,6 +366,29 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 			},
 			Stats: finalMetrics,
 		}
+
+		// If we know how many collections to expect, report how many we got.
+		if expected > 0 {
+			if i.collections == 0 {
+				a.logger.Warn(fmt.Sprintf("No collections from %s-%d for %s", i.Service, i.InstanceId, startTs))
+			}
+			a.setCoverage(finalInstance, i.collections, expected)
+		}
+		finalInstanceStats = append(finalInstanceStats, finalInstance)
+	}
+
+	// Instances which have never sent a collection aren't in the buffer, but
+	// they missed every collection too.
+	for _, key := range a.missingInstances(is) {
+		a.logger.Warn(fmt.Sprintf("No collections from %s-%d for %s", key.service, key.instanceId, startTs))
+		finalInstance := &InstanceStats{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    key.service,
+				InstanceId: key.instanceId,
+			},
+			Stats: make(map[string]*Stats),
+		}
+		a.setCoverage(finalInstance, 0, a.expected(key.service, key.instanceId))
 		finalInstanceStats = append(finalInstanceStats, finalInstance)
 	}
 
@@ -222,6 +408,65 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 	}
 }
 
+// @goroutine[1]
+func (a *Aggregator) setCoverage(is *InstanceStats, collections, expected int) {
+	is.Collections = collections
+	if collections < expected {
+		is.Missing = expected - collections
+	}
+	is.Coverage = float64(collections) / float64(expected)
+	if is.Coverage > 1 {
+		is.Coverage = 1
+	}
+}
+
+// Instances with a collect interval which aren't in the buffer, i.e. which
+// have never sent a collection, sorted.
+// @goroutine[1]
+func (a *Aggregator) missingInstances(is []*InstanceStats) []instanceKey {
+	a.configMux.RLock()
+	defer a.configMux.RUnlock()
+	missing := []instanceKey{}
+	for key, config := range a.configs {
+		if config.Collect == 0 {
+			continue
+		}
+		found := false
+		for _, i := range is {
+			if i.Service == key.service && i.InstanceId == key.instanceId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, key)
+		}
+	}
+	sort.Sort(byInstance(missing))
+	return missing
+}
+
+type byInstance []instanceKey
+
+func (k byInstance) Len() int      { return len(k) }
+func (k byInstance) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k byInstance) Less(i, j int) bool {
+	if k[i].service == k[j].service {
+		return k[i].instanceId < k[j].instanceId
+	}
+	return k[i].service < k[j].service
+}
+
+// Number of collections expected per interval from the instance, or zero if unknown.
+// @goroutine[1]
+func (a *Aggregator) expected(service string, instanceId uint) int {
+	config := a.getInstanceConfig(service, instanceId)
+	if config.Collect == 0 {
+		return 0
+	}
+	return int(a.interval / int64(config.Collect))
+}
+
 func GoTime(interval, unixTs int64) time.Time {
 	// Calculate seconds (d) from begin to next interval.
 	i := float64(interval)
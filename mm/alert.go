@@ -0,0 +1,367 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+	"net/http"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	ALERT_HOOK_BUFFER  = 100
+	ALERT_HOOK_TIMEOUT = 10 * time.Second
+	ALERT_EXPIRE       = 10 // collect intervals a metric isn't seen before its state expires
+)
+
+const (
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+)
+
+// Comparisons allowed in AlertRule.Op.
+var AlertOps map[string]func(v, threshold float64) bool = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// A rule fires when a metric's collected value compares true to Value for at
+// least Duration seconds, and resolves at the first value that compares false.
+// Values are compared as collected, so rules are meant for gauges; counter,
+// delta and derive metrics, whose values are cumulative, are not evaluated.
+// If a firing metric isn't collected for ALERT_EXPIRE collect intervals (e.g.
+// a disk was unmounted), the alert resolves with its last value.
+type AlertRule struct {
+	Name       string  // unique, e.g. disk-full
+	Metric     string  // metric name pattern (path.Match), e.g. server/disk/*/used_pct
+	Service    string  `json:",omitempty"` // only this service, e.g. mysql; "" for any
+	InstanceId uint    `json:",omitempty"` // only this instance; 0 for any
+	Op         string  // >, >=, <, <=, ==, != (see AlertOps)
+	Value      float64 // threshold
+	Duration   uint    `json:",omitempty"` // seconds, 0 to fire immediately
+	Severity   string  // e.g. warning, critical
+}
+
+// Config for alerting, read from alert.conf.
+type AlertConfig struct {
+	Rules   []AlertRule
+	Webhook string `json:",omitempty"` // URL to POST each alert to, as JSON
+	Exec    string `json:",omitempty"` // command to run for each alert, alert JSON on stdin
+}
+
+// An Alert is spooled (data type "alert") and sent to hooks when a rule fires
+// or resolves for a metric of an instance.
+type Alert struct {
+	proto.ServiceInstance
+	Rule      string
+	Severity  string
+	State     string // firing or resolved
+	Metric    string
+	Op        string
+	Threshold float64
+	Value     float64   // value that fired or resolved the alert
+	Since     time.Time // when the condition was first true, UTC
+	Ts        time.Time // when the alert fired or resolved, UTC
+}
+
+func (a *Alert) String() string {
+	return fmt.Sprintf("%s %s %s: %s-%d %s %v %s %v since %s",
+		a.Severity, a.Rule, a.State, a.Service, a.InstanceId, a.Metric, a.Value, a.Op, a.Threshold, a.Since)
+}
+
+type alertState struct {
+	rule       AlertRule
+	service    string
+	instanceId uint
+	metric     Metric // last value
+	since      int64  // ts condition was first true
+	seen       int64  // ts of last value
+	firing     bool
+}
+
+/**
+ * Alerter evaluates alert rules against every collection.  It's a CollectionSink,
+ * so the aggregators feed it.  Alerts are logged (so they go to the log relay),
+ * spooled, and sent to the optional webhook and exec hook.  Hooks run in their
+ * own goroutine so slow hooks do not block the aggregators.
+ */
+type Alerter struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	config *AlertConfig
+	// --
+	state    map[string]*alertState // keyed on rule/service-instanceId/metric
+	mux      *sync.Mutex            // guards state
+	hookChan chan *Alert
+	sync     *pct.SyncChan
+	client   *http.Client
+}
+
+func NewAlerter(logger *pct.Logger, spool data.Spooler, config *AlertConfig) (*Alerter, error) {
+	if err := ValidAlertConfig(config); err != nil {
+		return nil, err
+	}
+	a := &Alerter{
+		logger: logger,
+		spool:  spool,
+		config: config,
+		// --
+		state:    make(map[string]*alertState),
+		mux:      &sync.Mutex{},
+		hookChan: make(chan *Alert, ALERT_HOOK_BUFFER),
+		sync:     pct.NewSyncChan(),
+		client:   &http.Client{Timeout: ALERT_HOOK_TIMEOUT},
+	}
+	return a, nil
+}
+
+func ValidAlertConfig(config *AlertConfig) error {
+	names := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("Alert rule has no name")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("Duplicate alert rule: %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if _, err := path.Match(rule.Metric, ""); rule.Metric == "" || err != nil {
+			return fmt.Errorf("Alert rule %s has invalid metric pattern: '%s'", rule.Name, rule.Metric)
+		}
+		if _, ok := AlertOps[rule.Op]; !ok {
+			return fmt.Errorf("Alert rule %s has invalid op: '%s'", rule.Name, rule.Op)
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[0]
+func (a *Alerter) Start() {
+	go a.runHooks()
+}
+
+// @goroutine[0]
+func (a *Alerter) Stop() {
+	a.sync.Stop()
+	a.sync.Wait()
+}
+
+// Add implements CollectionSink.
+// @goroutine[1]
+func (a *Alerter) Add(collection *Collection, collect uint) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for _, rule := range a.config.Rules {
+		if rule.Service != "" && rule.Service != collection.Service {
+			continue
+		}
+		if rule.InstanceId != 0 && rule.InstanceId != collection.InstanceId {
+			continue
+		}
+		for _, metric := range collection.Metrics {
+			switch metric.Type {
+			case "string", "counter", "counter32", "counter64", "delta", "derive":
+				continue
+			}
+			if ok, _ := path.Match(rule.Metric, metric.Name); !ok {
+				continue
+			}
+			a.eval(rule, collection, metric)
+		}
+	}
+	a.expire(collection, collect)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[1]
+func (a *Alerter) eval(rule AlertRule, collection *Collection, metric Metric) {
+	key := fmt.Sprintf("%s/%s-%d/%s", rule.Name, collection.Service, collection.InstanceId, metric.Name)
+	state, ok := a.state[key]
+
+	if !AlertOps[rule.Op](metric.Number, rule.Value) {
+		if ok && state.firing {
+			a.alert(rule, collection, metric, state, ALERT_RESOLVED)
+		}
+		delete(a.state, key)
+		return
+	}
+
+	if !ok {
+		state = &alertState{
+			rule:       rule,
+			service:    collection.Service,
+			instanceId: collection.InstanceId,
+			since:      collection.Ts,
+		}
+		a.state[key] = state
+	}
+	state.metric = metric
+	state.seen = collection.Ts
+	if !state.firing && collection.Ts-state.since >= int64(rule.Duration) {
+		state.firing = true
+		a.alert(rule, collection, metric, state, ALERT_FIRING)
+	}
+}
+
+// Remove the state of the instance's metrics which haven't been seen for
+// ALERT_EXPIRE collect intervals, resolving them if they're firing.  Nothing
+// expires if the collect interval is unknown (zero).
+// @goroutine[1]
+func (a *Alerter) expire(collection *Collection, collect uint) {
+	if collect == 0 {
+		return
+	}
+	before := collection.Ts - int64(ALERT_EXPIRE*collect)
+	for key, state := range a.state {
+		if state.service != collection.Service || state.instanceId != collection.InstanceId || state.seen > before {
+			continue
+		}
+		if state.firing {
+			a.alert(state.rule, collection, state.metric, state, ALERT_RESOLVED)
+		}
+		delete(a.state, key)
+	}
+}
+
+// @goroutine[1]
+func (a *Alerter) alert(rule AlertRule, collection *Collection, metric Metric, state *alertState, st string) {
+	alert := &Alert{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    collection.Service,
+			InstanceId: collection.InstanceId,
+		},
+		Rule:      rule.Name,
+		Severity:  rule.Severity,
+		State:     st,
+		Metric:    metric.Name,
+		Op:        rule.Op,
+		Threshold: rule.Value,
+		Value:     metric.Number,
+		Since:     time.Unix(state.since, 0).UTC(),
+		Ts:        time.Unix(collection.Ts, 0).UTC(),
+	}
+
+	if st == ALERT_FIRING {
+		a.logger.Warn("Alert " + alert.String())
+	} else {
+		a.logger.Info("Alert " + alert.String())
+	}
+
+	if err := a.spool.Write("alert", alert); err != nil {
+		a.logger.Warn("Lost alert:", err)
+	}
+
+	if a.config.Webhook == "" && a.config.Exec == "" {
+		return
+	}
+	select {
+	case a.hookChan <- alert:
+	default:
+		a.logger.Warn("Alert hooks are too slow, not running hooks for " + alert.Rule)
+	}
+}
+
+// @goroutine[2]
+func (a *Alerter) runHooks() {
+	defer func() {
+		if err := recover(); err != nil {
+			a.logger.Error("Alert hooks crashed: ", err)
+		}
+		a.sync.Done()
+	}()
+	for {
+		select {
+		case alert := <-a.hookChan:
+			bytes, err := json.Marshal(alert)
+			if err != nil {
+				a.logger.Warn("Cannot encode alert:", err)
+				continue
+			}
+			if a.config.Webhook != "" {
+				if err := a.webhook(bytes); err != nil {
+					a.logger.Warn("Alert webhook " + a.config.Webhook + ": " + err.Error())
+				}
+			}
+			if a.config.Exec != "" {
+				if err := a.exec(bytes); err != nil {
+					a.logger.Warn("Alert exec " + a.config.Exec + ": " + err.Error())
+				}
+			}
+		case <-a.sync.StopChan:
+			return
+		}
+	}
+}
+
+// @goroutine[2]
+func (a *Alerter) webhook(data []byte) error {
+	resp, err := a.client.Post(a.config.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// @goroutine[2]
+func (a *Alerter) exec(data []byte) error {
+	cmd := exec.Command(a.config.Exec)
+	cmd.Stdin = bytes.NewReader(data)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- cmd.Wait()
+	}()
+	select {
+	case err := <-doneChan:
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, output.String())
+		}
+	case <-time.After(ALERT_HOOK_TIMEOUT):
+		cmd.Process.Kill()
+		return fmt.Errorf("timeout after %s", ALERT_HOOK_TIMEOUT)
+	}
+	return nil
+}
@@ -28,7 +28,9 @@ import (
  */
 
 type Config struct {
-	proto.ServiceInstance      // info about external service being monitored
-	Collect               uint // how often monitor collects metrics (seconds)
-	Report                uint // how often aggregator reports metrics (seconds)
+	proto.ServiceInstance           // info about external service being monitored
+	Collect               uint      // how often monitor collects metrics (seconds)
+	Report                uint      // how often aggregator reports metrics (seconds)
+	Sketch                bool      `json:",omitempty"` // summarize metrics with a Sketch (sketch.go)
+	Percentiles           []float64 `json:",omitempty"` // extra percentiles to report if Sketch, e.g. 99.9
 }
@@ -60,9 +60,10 @@ type Manager struct {
 	status      *pct.Status
 	aggregators map[uint]*Binding
 	mrm         mrms.Monitor
+	sinks       []CollectionSink
 }
 
-func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager, spool data.Spooler, im *instance.Repo, mrm mrms.Monitor) *Manager {
+func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager, spool data.Spooler, im *instance.Repo, mrm mrms.Monitor, sinks ...CollectionSink) *Manager {
 	m := &Manager{
 		logger:  logger,
 		factory: factory,
@@ -75,6 +76,7 @@ func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager
 		aggregators: make(map[uint]*Binding),
 		mux:         &sync.RWMutex{},
 		mrm:         mrm,
+		sinks:       sinks,
 	}
 	return m
 }
@@ -150,6 +152,22 @@ func (m *Manager) Stop() error {
 	return nil
 }
 
+// Drain flushes the partial report of every aggregator to the spooler.  On
+// shutdown, call Stop first so the monitors don't start another interval.
+// @goroutine[0]
+func (m *Manager) Drain(timeout time.Duration) error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	deadline := time.Now().Add(timeout)
+	for _, a := range m.aggregators {
+		if err := a.aggregator.Flush(deadline.Sub(time.Now())); err != nil {
+			return err
+		}
+	}
+	m.logger.Info("Drained")
+	return nil
+}
+
 // @goroutine[0]
 func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.status.UpdateRe("mm", "Handling", cmd)
@@ -196,7 +214,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			// Make new aggregator for this report interval.
 			logger := pct.NewLogger(m.logger.LogChan(), fmt.Sprintf("mm-ag-%d", mm.Report))
 			collectionChan := make(chan *Collection, 5)
-			aggregator := NewAggregator(logger, int64(mm.Report), collectionChan, m.spool)
+			aggregator := NewAggregator(logger, int64(mm.Report), collectionChan, m.spool, m.sinks...)
 			aggregator.Start()
 
 			// Save aggregator for other monitors with same report interval.
@@ -205,6 +223,18 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			m.logger.Info("Created", mm.Report, "second aggregator")
 		}
 
+		// Tell the aggregator how many collections to expect from this instance
+		// and how to summarize its metrics.
+		instanceConfig := InstanceConfig{
+			Collect:     mm.Collect,
+			Sketch:      mm.Sketch,
+			Percentiles: mm.Percentiles,
+		}
+		if err := a.aggregator.SetInstanceConfig(mm.Service, mm.InstanceId, instanceConfig); err != nil {
+			m.clock.Remove(tickChan)
+			return cmd.Reply(nil, errors.New("Invalid "+name+" config: "+err.Error()))
+		}
+
 		// Start the monitor.
 		if err := monitor.Start(tickChan, a.collectionChan); err != nil {
 			return cmd.Reply(nil, errors.New("Start "+name+": "+err.Error()))
@@ -221,7 +251,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 		return cmd.Reply(nil) // success
 	case "StopService":
-		_, name, err := m.getMonitorConfig(cmd)
+		mm, name, err := m.getMonitorConfig(cmd)
 		if err != nil {
 			return cmd.Reply(nil, err)
 		}
@@ -237,6 +267,9 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			return cmd.Reply(nil, errors.New("Stop "+name+": "+err.Error()))
 		}
 		m.clock.Remove(monitor.TickChan())
+		for _, a := range m.aggregators {
+			a.aggregator.RemoveInstanceConfig(mm.Service, mm.InstanceId)
+		}
 		if err := pct.Basedir.RemoveConfig(name); err != nil {
 			return cmd.Reply(nil, errors.New("Remove "+name+": "+err.Error()))
 		}
@@ -21,6 +21,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -135,6 +138,42 @@ func (s *AggregatorTestSuite) TestC001(t *C) {
 	}
 }
 
+func (s *AggregatorTestSuite) TestFlush(t *C) {
+	interval := int64(300)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	go a.Start()
+	defer a.Stop()
+
+	// Same as c001, but the aggregator is flushed (e.g. on shutdown)
+	// instead of receiving a collection for the next interval.
+	if err := sendCollection(sample+"/c001-1.json", s.collectionChan); err != nil {
+		t.Fatal(err)
+	}
+	t1, _ := time.Parse("2006-01-02 15:04:05", "2009-11-10 23:00:00")
+
+	err := a.Flush(time.Second)
+	t.Assert(err, IsNil)
+
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Check(got.Ts, Equals, t1)
+	expect := &mm.Report{}
+	if err := test.LoadMmReport(sample+"/c001r.json", expect); err != nil {
+		t.Fatal(err)
+	}
+	if ok, diff := test.IsDeeply(got.Stats, expect.Stats); !ok {
+		test.Dump(got.Stats)
+		test.Dump(expect.Stats)
+		t.Fatal(diff)
+	}
+
+	// Nothing left to flush.
+	err = a.Flush(time.Second)
+	t.Assert(err, IsNil)
+	got = test.WaitMmReport(s.dataChan)
+	t.Check(got, IsNil)
+}
+
 func (s *AggregatorTestSuite) TestC002(t *C) {
 	interval := int64(300)
 	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
@@ -494,6 +533,122 @@ func (s *AggregatorTestSuite) TestMissingAllMetrics(t *C) {
 	t.Check(got.Stats[0].Stats["foo"].Avg, Equals, float64(170))
 }
 
+func gaugeCollection(service string, instanceId uint, ts int64, val float64) *mm.Collection {
+	return &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{Service: service, InstanceId: instanceId},
+		Ts:              ts,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "gauge", Number: val}},
+	}
+}
+
+func (s *AggregatorTestSuite) TestCoverage(t *C) {
+	interval := int64(60)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	err := a.SetInstanceConfig("mysql", 1, mm.InstanceConfig{Collect: 10})
+	t.Assert(err, IsNil)
+	go a.Start()
+	defer a.Stop()
+
+	// 2014-01-01 12:00:00.  Collect every 10s, so 6 collections expected,
+	// but only 3 are sent.
+	ts := int64(1388577600)
+	s.collectionChan <- gaugeCollection("mysql", 1, ts, 1)
+	s.collectionChan <- gaugeCollection("mysql", 1, ts+10, 2)
+	s.collectionChan <- gaugeCollection("mysql", 1, ts+20, 3)
+
+	// Next interval, but within the grace period (10s), so no report yet.
+	s.collectionChan <- gaugeCollection("mysql", 1, ts+60, 4)
+	got := test.WaitMmReport(s.dataChan)
+	t.Check(got, IsNil)
+
+	// After the grace period.
+	s.collectionChan <- gaugeCollection("mysql", 1, ts+70, 5)
+	got = test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 1)
+	t.Check(got.Stats[0].Collections, Equals, 3)
+	t.Check(got.Stats[0].Missing, Equals, 3)
+	t.Check(got.Stats[0].Coverage, Equals, 0.5)
+	t.Check(got.Stats[0].Stats["foo"].Cnt, Equals, 3)
+}
+
+func (s *AggregatorTestSuite) TestLateCollection(t *C) {
+	interval := int64(60)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	a.SetInstanceConfig("mysql", 1, mm.InstanceConfig{Collect: 10})
+	a.SetInstanceConfig("server", 1, mm.InstanceConfig{Collect: 10})
+	go a.Start()
+	defer a.Stop()
+
+	t1, _ := time.Parse("2006-01-02T15:04:05", "2014-01-01T12:00:00")
+	ts := int64(1388577600)
+	s.collectionChan <- gaugeCollection("mysql", 1, ts, 1)
+	s.collectionChan <- gaugeCollection("server", 1, ts, 10)
+
+	// Server metrics for the next interval arrive before the last MySQL
+	// metrics for the current interval.
+	s.collectionChan <- gaugeCollection("server", 1, ts+60, 20)
+	s.collectionChan <- gaugeCollection("mysql", 1, ts+50, 3)
+
+	// Grace period ends.
+	s.collectionChan <- gaugeCollection("server", 1, ts+70, 30)
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Check(got.Ts, Equals, t1)
+	t.Assert(got.Stats, HasLen, 2)
+	t.Check(got.Stats[0].Service, Equals, "mysql")
+	t.Check(got.Stats[0].Collections, Equals, 2)
+	t.Check(got.Stats[0].Stats["foo"].Max, Equals, float64(3)) // late value
+	t.Check(got.Stats[1].Service, Equals, "server")
+	t.Check(got.Stats[1].Collections, Equals, 1)
+	t.Check(got.Stats[1].Stats["foo"].Max, Equals, float64(10))
+
+	// The held server metrics are in the next interval.
+	s.collectionChan <- gaugeCollection("server", 1, ts+130, 40)
+	got = test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Check(got.Ts, Equals, t1.Add(60*time.Second))
+	t.Assert(got.Stats, HasLen, 2)
+	t.Check(got.Stats[0].Service, Equals, "mysql") // no collections
+	t.Check(got.Stats[0].Collections, Equals, 0)
+	t.Check(got.Stats[0].Missing, Equals, 6)
+	t.Check(got.Stats[0].Stats, HasLen, 0)
+	t.Check(got.Stats[1].Service, Equals, "server")
+	t.Check(got.Stats[1].Collections, Equals, 2)
+	t.Check(got.Stats[1].Stats["foo"].Min, Equals, float64(20))
+	t.Check(got.Stats[1].Stats["foo"].Max, Equals, float64(30))
+}
+
+func (s *AggregatorTestSuite) TestInstanceNeverReports(t *C) {
+	interval := int64(60)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	a.SetInstanceConfig("server", 1, mm.InstanceConfig{Collect: 10})
+	a.SetInstanceConfig("mysql", 2, mm.InstanceConfig{Collect: 20})
+	a.SetInstanceConfig("mysql", 3, mm.InstanceConfig{}) // collect interval unknown
+	go a.Start()
+	defer a.Stop()
+
+	// Only the server sends collections, so the MySQL instance has missed
+	// all 3 of its collections.
+	ts := int64(1388577600)
+	for i := int64(0); i < 6; i++ {
+		s.collectionChan <- gaugeCollection("server", 1, ts+i*10, 1)
+	}
+	s.collectionChan <- gaugeCollection("server", 1, ts+60, 1)
+	s.collectionChan <- gaugeCollection("server", 1, ts+80, 1) // grace period is 20s
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 2)
+	t.Check(got.Stats[0].Service, Equals, "server")
+	t.Check(got.Stats[0].Coverage, Equals, float64(1))
+	t.Check(got.Stats[1].Service, Equals, "mysql")
+	t.Check(got.Stats[1].InstanceId, Equals, uint(2))
+	t.Check(got.Stats[1].Collections, Equals, 0)
+	t.Check(got.Stats[1].Missing, Equals, 3)
+	t.Check(got.Stats[1].Coverage, Equals, float64(0))
+	t.Check(got.Stats[1].Stats, HasLen, 0)
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Manager test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -1030,3 +1185,492 @@ func (s *StatsTestSuite) TestPCT939(t *C) {
 		test.Dump(got)
 	*/
 }
+
+func (s *StatsTestSuite) TestSketchStats(t *C) {
+	stats, err := mm.NewSketchStats("gauge", []float64{99, 99.9})
+	t.Assert(err, IsNil)
+	for i := 1; i <= 1000; i++ {
+		stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: float64(i)}, int64(i))
+	}
+	got := stats.Finalize()
+	t.Assert(got, NotNil)
+	t.Check(got.Cnt, Equals, 1000)
+	t.Check(got.Min, Equals, float64(1))
+	t.Check(got.Avg, Equals, float64(500.5))
+	t.Check(got.Max, Equals, float64(1000))
+
+	// Quantiles are accurate to within 1% (SKETCH_ALPHA).
+	t.Check(got.Med > 495 && got.Med < 505, Equals, true, Commentf("Med=%f", got.Med))
+	t.Check(got.Pct95 > 940 && got.Pct95 < 960, Equals, true, Commentf("Pct95=%f", got.Pct95))
+	t.Check(got.Pct["99"] > 980 && got.Pct["99"] < 1000, Equals, true, Commentf("Pct=%+v", got.Pct))
+	t.Check(got.Pct["99.9"] > 989 && got.Pct["99.9"] <= 1000, Equals, true, Commentf("Pct=%+v", got.Pct))
+	t.Assert(got.Sketch, NotNil)
+	t.Check(got.Sketch.Cnt, Equals, uint64(1000))
+
+	// Next interval starts a new sketch; the reported one doesn't change.
+	stats.Reset()
+	stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: 5}, 1001)
+	got2 := stats.Finalize()
+	t.Check(got2.Cnt, Equals, 1)
+	t.Check(got2.Max, Equals, float64(5))
+	t.Check(got.Sketch.Cnt, Equals, uint64(1000))
+
+	_, err = mm.NewSketchStats("gauge", []float64{101})
+	t.Check(err, NotNil)
+}
+
+func (s *StatsTestSuite) TestSketchMerge(t *C) {
+	s1, _ := mm.NewSketch(mm.SKETCH_ALPHA, mm.SKETCH_MAX_BINS)
+	s2, _ := mm.NewSketch(mm.SKETCH_ALPHA, mm.SKETCH_MAX_BINS)
+	for i := 1; i <= 500; i++ {
+		s1.Add(float64(i))
+		s2.Add(float64(i + 500))
+	}
+	s2.Add(-10)
+	s2.Add(0)
+
+	// Sketches are serialized in reports, so merge a decoded copy.
+	bytes, err := json.Marshal(s2)
+	t.Assert(err, IsNil)
+	s3 := &mm.Sketch{}
+	t.Assert(json.Unmarshal(bytes, s3), IsNil)
+
+	err = s1.Merge(s3)
+	t.Assert(err, IsNil)
+	t.Check(s1.Cnt, Equals, uint64(1002))
+	t.Check(s1.Min, Equals, float64(-10))
+	t.Check(s1.Max, Equals, float64(1000))
+	t.Check(s1.Quantile(0), Equals, float64(-10))
+	med := s1.Quantile(0.5)
+	t.Check(med > 490 && med < 510, Equals, true, Commentf("med=%f", med))
+
+	other, _ := mm.NewSketch(0.05, mm.SKETCH_MAX_BINS)
+	other.Add(1)
+	t.Check(s1.Merge(other), NotNil)
+}
+
+func (s *StatsTestSuite) TestSketchMaxBins(t *C) {
+	sk, _ := mm.NewSketch(mm.SKETCH_ALPHA, 10)
+	for i := 1; i <= 1000000; i *= 2 {
+		sk.Add(float64(i))
+	}
+	t.Check(len(sk.Pos) <= 10, Equals, true)
+	t.Check(sk.Cnt, Equals, uint64(20))
+	t.Check(sk.Quantile(1), Equals, float64(524288))
+}
+
+func (s *StatsTestSuite) TestCounterWrap(t *C) {
+	// 32-bit counter wraps: 4294967290 -> 4 is +10 (5 to max, 1 to 0, then 4).
+	stats, _ := mm.NewStats("counter32")
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter32", Number: 4294967280}, 1)
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter32", Number: 4294967290}, 2) // +10
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter32", Number: 4}, 3)          // +10 (wrap)
+	got := stats.Finalize()
+	t.Check(got.Cnt, Equals, 2)
+	t.Check(got.Min, Equals, float64(10))
+	t.Check(got.Max, Equals, float64(10))
+
+	// The width of a plain counter is unknown, so the same decrease is a reset.
+	stats, _ = mm.NewStats("counter")
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 4294967280}, 1)
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 4294967290}, 2) // +10
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 4}, 3)          // reset
+	got = stats.Finalize()
+	t.Check(got.Cnt, Equals, 1)
+	t.Check(mm.CounterWrap(4294967290, 4, 0), Equals, float64(0))
+
+	// A 64-bit counter doesn't wrap at the 32-bit max.
+	t.Check(mm.CounterWrap(4294967290, 4, mm.MAX_COUNTER64), Equals, float64(0))
+
+	// 64-bit: the increase is approximate because float64 can't represent
+	// every uint64, but it must not be treated as a reset.
+	t.Check(mm.CounterWrap(mm.MAX_COUNTER64-1024, 1024, mm.MAX_COUNTER64) > 0, Equals, true)
+
+	// Decrease from a value in the middle of the range is a reset, not a wrap.
+	t.Check(mm.CounterWrap(1000000, 5, mm.MAX_COUNTER32), Equals, float64(0))
+	t.Check(mm.CounterWrap(mm.MAX_COUNTER32-10, mm.MAX_COUNTER32/2, mm.MAX_COUNTER32), Equals, float64(0))
+
+	// A value larger than the counter's max isn't from that counter.
+	t.Check(mm.CounterWrap(mm.MAX_COUNTER32+10, 4, mm.MAX_COUNTER32), Equals, float64(0))
+}
+
+func (s *StatsTestSuite) TestDerive(t *C) {
+	stats, _ := mm.NewStats("derive")
+	stats.Add(&mm.Metric{Name: "foo", Type: "derive", Number: 10}, 1)
+	stats.Add(&mm.Metric{Name: "foo", Type: "derive", Number: 20}, 2) // +10
+	stats.Add(&mm.Metric{Name: "foo", Type: "derive", Number: 14}, 4) // -3/s
+	got := stats.Finalize()
+	t.Check(got.Cnt, Equals, 2)
+	t.Check(got.Min, Equals, float64(-3))
+	t.Check(got.Max, Equals, float64(10))
+}
+
+func (s *StatsTestSuite) TestDelta(t *C) {
+	stats, _ := mm.NewStats("delta")
+	stats.Add(&mm.Metric{Name: "foo", Type: "delta", Number: 10}, 1)
+	stats.Add(&mm.Metric{Name: "foo", Type: "delta", Number: 30}, 3) // +20, not 10/s
+	stats.Add(&mm.Metric{Name: "foo", Type: "delta", Number: 0}, 4)  // reset
+	stats.Add(&mm.Metric{Name: "foo", Type: "delta", Number: 6}, 6)  // +6
+	got := stats.Finalize()
+	t.Check(got.Cnt, Equals, 2)
+	t.Check(got.Min, Equals, float64(6))
+	t.Check(got.Max, Equals, float64(20))
+}
+
+func (s *StatsTestSuite) TestString(t *C) {
+	stats, err := mm.NewStats("string")
+	t.Assert(err, IsNil)
+	t.Check(stats.Finalize(), IsNil)
+	stats.Add(&mm.Metric{Name: "foo", Type: "string", String: "OFF"}, 1)
+	stats.Add(&mm.Metric{Name: "foo", Type: "string", String: "ON"}, 2)
+	got := stats.Finalize()
+	t.Assert(got, NotNil)
+	t.Check(got.Cnt, Equals, 2)
+	t.Check(got.Str, Equals, "ON")
+
+	stats.Reset()
+	t.Check(stats.Finalize(), IsNil)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Store test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type StoreTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+	dir     string
+}
+
+var _ = Suite(&StoreTestSuite{})
+
+func (s *StoreTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-store-test")
+}
+
+func (s *StoreTestSuite) SetUpTest(t *C) {
+	dir, err := ioutil.TempDir("/tmp", "mm-store-test")
+	t.Assert(err, IsNil)
+	s.dir = dir
+}
+
+func (s *StoreTestSuite) TearDownTest(t *C) {
+	os.RemoveAll(s.dir)
+}
+
+func storeCollection(ts int64, threads float64) *mm.Collection {
+	return &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		Ts:              ts,
+		Metrics: []mm.Metric{
+			{Name: "mysql/status/Threads_running", Type: "gauge", Number: threads},
+			{Name: "mysql/status/Slave_running", Type: "string", String: "ON"},
+		},
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *StoreTestSuite) TestAddQuery(t *C) {
+	store := mm.NewStore(s.logger, s.dir, 60)
+	store.Start()
+	defer store.Close()
+
+	for i := int64(0); i < 5; i++ {
+		store.Add(storeCollection(1000+i*10, float64(i)), 10)
+	}
+	t.Assert(store.Flush(time.Second), IsNil)
+
+	got, err := store.Query("mysql", 1, "mysql/status/Threads_running", 1010, 1030)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []mm.Point{{Ts: 1010, Val: 1}, {Ts: 1020, Val: 2}, {Ts: 1030, Val: 3}})
+
+	// String metrics are not stored.
+	metrics, err := store.Metrics("mysql", 1)
+	t.Assert(err, IsNil)
+	t.Check(metrics, DeepEquals, []string{"mysql/status/Threads_running"})
+
+	instances, err := store.Instances()
+	t.Assert(err, IsNil)
+	t.Check(instances, DeepEquals, []string{"mysql-1"})
+
+	_, err = store.Query("mysql", 1, "mysql/status/Foo", 0, 2000)
+	t.Check(err, NotNil)
+}
+
+func (s *StoreTestSuite) TestInvalidService(t *C) {
+	store := mm.NewStore(s.logger, s.dir, 60)
+	store.Start()
+	defer store.Close()
+
+	// Services must not be paths out of the store dir.
+	for _, service := range []string{"../../etc/passwd", "../mysql", "mysql/..", `..\mysql`, ".."} {
+		_, err := store.Query(service, 1, "mysql/status/Threads_running", 0, 2000)
+		t.Check(err, ErrorMatches, "Invalid service: .*", Commentf(service))
+		_, err = store.Metrics(service, 1)
+		t.Check(err, ErrorMatches, "Invalid service: .*", Commentf(service))
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/metrics?instance=1&service="+url.QueryEscape(service), nil)
+		store.ServeHTTP(w, r)
+		t.Check(w.Code, Equals, http.StatusBadRequest, Commentf(service))
+	}
+}
+
+func (s *StoreTestSuite) TestRetention(t *C) {
+	// 60s at 10s resolution = 6 slots, so the oldest values are overwritten.
+	store := mm.NewStore(s.logger, s.dir, 60)
+	store.Start()
+	defer store.Close()
+
+	for i := int64(0); i < 10; i++ {
+		store.Add(storeCollection(1000+i*10, float64(i)), 10)
+	}
+	t.Assert(store.Flush(time.Second), IsNil)
+	got, err := store.Query("mysql", 1, "mysql/status/Threads_running", 0, 2000)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []mm.Point{{Ts: 1040, Val: 4}, {Ts: 1050, Val: 5}, {Ts: 1060, Val: 6}, {Ts: 1070, Val: 7}, {Ts: 1080, Val: 8}, {Ts: 1090, Val: 9}})
+
+	// Values survive a restart if the resolution doesn't change...
+	store.Close()
+	store = mm.NewStore(s.logger, s.dir, 60)
+	store.Start()
+	defer store.Close()
+	store.Add(storeCollection(1100, 10), 10)
+	t.Assert(store.Flush(time.Second), IsNil)
+	got, err = store.Query("mysql", 1, "mysql/status/Threads_running", 0, 2000)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 6)
+	t.Check(got[5], Equals, mm.Point{Ts: 1100, Val: 10})
+
+	// ...but are reset if it does.
+	store.Add(storeCollection(1101, 11), 1)
+	t.Assert(store.Flush(time.Second), IsNil)
+	got, err = store.Query("mysql", 1, "mysql/status/Threads_running", 0, 2000)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []mm.Point{{Ts: 1101, Val: 11}})
+}
+
+func (s *StoreTestSuite) TestStaleSlots(t *C) {
+	// If a metric isn't collected for longer than the retention, its old
+	// values remain in the slots which weren't overwritten, but they are
+	// older than the retention so they're not returned.
+	store := mm.NewStore(s.logger, s.dir, 60)
+	store.Start()
+	defer store.Close()
+
+	for i := int64(0); i < 6; i++ {
+		store.Add(storeCollection(1000+i*10, float64(i)), 10)
+	}
+	store.Add(storeCollection(1200, 20), 10)
+	t.Assert(store.Flush(time.Second), IsNil)
+
+	got, err := store.Query("mysql", 1, "mysql/status/Threads_running", 0, 2000)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []mm.Point{{Ts: 1200, Val: 20}})
+}
+
+func (s *StoreTestSuite) TestQueueFull(t *C) {
+	// The store isn't started, so nothing is written and Add must not block
+	// the aggregator when the queue is full.
+	store := mm.NewStore(s.logger, s.dir, 60)
+	defer store.Close()
+
+	done := make(chan bool)
+	go func() {
+		for i := int64(0); i < mm.STORE_QUEUE_SIZE+10; i++ {
+			store.Add(storeCollection(1000+i, 1), 1)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Store.Add blocked")
+	}
+}
+
+func (s *StoreTestSuite) TestAggregatorSink(t *C) {
+	store := mm.NewStore(s.logger, s.dir, 3600)
+	store.Start()
+	defer store.Close()
+
+	collectionChan := make(chan *mm.Collection)
+	dataChan := make(chan interface{}, 2)
+	a := mm.NewAggregator(s.logger, 60, collectionChan, mock.NewSpooler(dataChan), store)
+	a.Start()
+	defer a.Stop()
+
+	collectionChan <- storeCollection(1000, 3)
+	collectionChan <- storeCollection(1001, 4)
+
+	var got []mm.Point
+	for i := 0; i < 20; i++ {
+		got, _ = store.Query("mysql", 1, "mysql/status/Threads_running", 0, 2000)
+		if len(got) == 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Check(got, DeepEquals, []mm.Point{{Ts: 1000, Val: 3}, {Ts: 1001, Val: 4}})
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Alerter test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type AlerterTestSuite struct {
+	logChan  chan *proto.LogEntry
+	logger   *pct.Logger
+	dataChan chan interface{}
+	spool    *mock.Spooler
+}
+
+var _ = Suite(&AlerterTestSuite{})
+
+func (s *AlerterTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-alert-test")
+	s.dataChan = make(chan interface{}, 10)
+	s.spool = mock.NewSpooler(s.dataChan)
+}
+
+func (s *AlerterTestSuite) SetUpTest(t *C) {
+	for len(s.dataChan) > 0 {
+		<-s.dataChan
+	}
+}
+
+func (s *AlerterTestSuite) alerts() []*mm.Alert {
+	alerts := []*mm.Alert{}
+	for len(s.dataChan) > 0 {
+		alerts = append(alerts, (<-s.dataChan).(*mm.Alert))
+	}
+	return alerts
+}
+
+// --------------------------------------------------------------------------
+
+func (s *AlerterTestSuite) TestInvalidConfig(t *C) {
+	_, err := mm.NewAlerter(s.logger, s.spool, &mm.AlertConfig{
+		Rules: []mm.AlertRule{{Name: "foo", Metric: "mysql/status/*", Op: "=~"}},
+	})
+	t.Check(err, NotNil)
+
+	_, err = mm.NewAlerter(s.logger, s.spool, &mm.AlertConfig{
+		Rules: []mm.AlertRule{
+			{Name: "foo", Metric: "mysql/status/*", Op: ">"},
+			{Name: "foo", Metric: "mysql/status/*", Op: "<"},
+		},
+	})
+	t.Check(err, NotNil)
+}
+
+func (s *AlerterTestSuite) TestFireResolve(t *C) {
+	config := &mm.AlertConfig{
+		Rules: []mm.AlertRule{
+			{
+				Name:     "threads",
+				Metric:   "mysql/status/Threads_*",
+				Service:  "mysql",
+				Op:       ">=",
+				Value:    10,
+				Duration: 20,
+				Severity: "critical",
+			},
+		},
+	}
+	a, err := mm.NewAlerter(s.logger, s.spool, config)
+	t.Assert(err, IsNil)
+
+	// Must be true for 20s before firing.
+	a.Add(storeCollection(1000, 5), 10)
+	a.Add(storeCollection(1010, 10), 10)
+	a.Add(storeCollection(1020, 20), 10)
+	t.Check(s.alerts(), HasLen, 0)
+	a.Add(storeCollection(1030, 30), 10)
+	alerts := s.alerts()
+	t.Assert(alerts, HasLen, 1)
+	t.Check(alerts[0].Rule, Equals, "threads")
+	t.Check(alerts[0].State, Equals, mm.ALERT_FIRING)
+	t.Check(alerts[0].Value, Equals, float64(30))
+	t.Check(alerts[0].Since, Equals, time.Unix(1010, 0).UTC())
+
+	// Fires only once while true.
+	a.Add(storeCollection(1040, 40), 10)
+	t.Check(s.alerts(), HasLen, 0)
+
+	// Resolves at the first false value.
+	a.Add(storeCollection(1050, 1), 10)
+	alerts = s.alerts()
+	t.Assert(alerts, HasLen, 1)
+	t.Check(alerts[0].State, Equals, mm.ALERT_RESOLVED)
+	t.Check(alerts[0].Value, Equals, float64(1))
+
+	// Other instances don't match.
+	c := storeCollection(1060, 100)
+	c.Service = "server"
+	a.Add(c, 10)
+	a.Add(storeCollection(1070, 1), 10)
+	t.Check(s.alerts(), HasLen, 0)
+}
+
+func (s *AlerterTestSuite) TestCountersAndExpire(t *C) {
+	config := &mm.AlertConfig{
+		Rules: []mm.AlertRule{
+			{Name: "high", Metric: "mysql/status/*", Op: ">", Value: 10},
+		},
+	}
+	a, err := mm.NewAlerter(s.logger, s.spool, config)
+	t.Assert(err, IsNil)
+
+	// Counters, deltas and derives are cumulative, so they're not evaluated.
+	c := storeCollection(1000, 1)
+	c.Metrics = append(c.Metrics,
+		mm.Metric{Name: "mysql/status/Questions", Type: "counter", Number: 1000},
+		mm.Metric{Name: "mysql/status/Com_select", Type: "delta", Number: 1000},
+		mm.Metric{Name: "mysql/status/Bytes_sent", Type: "derive", Number: 1000},
+	)
+	a.Add(c, 10)
+	t.Check(s.alerts(), HasLen, 0)
+
+	// Fires, then the metric isn't collected anymore: after 10 intervals,
+	// it resolves with its last value.
+	a.Add(storeCollection(1010, 20), 10)
+	alerts := s.alerts()
+	t.Assert(alerts, HasLen, 1)
+	t.Check(alerts[0].State, Equals, mm.ALERT_FIRING)
+
+	gone := storeCollection(1020, 0)
+	gone.Metrics = gone.Metrics[1:] // only the string metric
+	a.Add(gone, 10)
+	t.Check(s.alerts(), HasLen, 0)
+	gone.Ts = 1110
+	a.Add(gone, 10)
+	alerts = s.alerts()
+	t.Assert(alerts, HasLen, 1)
+	t.Check(alerts[0].State, Equals, mm.ALERT_RESOLVED)
+	t.Check(alerts[0].Metric, Equals, "mysql/status/Threads_running")
+	t.Check(alerts[0].Value, Equals, float64(20))
+	t.Check(alerts[0].Ts, Equals, time.Unix(1110, 0).UTC())
+
+	// It's expired, so it's not resolved again.
+	gone.Ts = 1120
+	a.Add(gone, 10)
+	t.Check(s.alerts(), HasLen, 0)
+
+	// If the collect interval is unknown, nothing expires.
+	a.Add(storeCollection(1130, 20), 0)
+	alerts = s.alerts()
+	t.Assert(alerts, HasLen, 1)
+	t.Check(alerts[0].State, Equals, mm.ALERT_FIRING)
+	gone.Ts = 1140
+	a.Add(gone, 0)
+	t.Check(s.alerts(), HasLen, 0)
+	a.Add(storeCollection(1150, 0), 0)
+	alerts = s.alerts()
+	t.Assert(alerts, HasLen, 1)
+	t.Check(alerts[0].State, Equals, mm.ALERT_RESOLVED)
+	t.Check(alerts[0].Ts, Equals, time.Unix(1150, 0).UTC())
+}
@@ -45,16 +45,32 @@ type MonitorFactory interface {
 	Make(service string, instanceId uint, data []byte) (Monitor, error)
 }
 
+/**
+ * Metric types:
+ *   gauge    value as-is, e.g. Threads_running
+ *   counter  per-second rate of an ever-increasing value, e.g. Questions;
+ *            decreases are resets
+ *   counter32, counter64
+ *            counter of that width: decreases can be wraparounds (see CounterWrap)
+ *   derive   per-second rate of a value that can decrease (negative rates)
+ *   delta    like counter but reports the raw increase, not per-second rate
+ *   string   state value, e.g. Slave_running=ON; only the last one is reported
+ */
 var MetricTypes map[string]bool = map[string]bool{
-	"gauge":   true,
-	"counter": true,
+	"gauge":     true,
+	"counter":   true,
+	"counter32": true,
+	"counter64": true,
+	"derive":    true,
+	"delta":     true,
+	"string":    true,
 }
 
 // A single metric and its value at any time.  Monitors are responsible for
 // getting these and sending them as a Collection to an aggregator.
 type Metric struct {
 	Name   string // mysql/status/Threads_running
-	Type   string // gauge, counter, string
+	Type   string // gauge, counter, derive, delta, string (see MetricTypes)
 	Number float64
 	String string
 }
@@ -71,7 +87,11 @@ type Collection struct {
 // Stats for each metric from a service instance, computed at each report interval.
 type InstanceStats struct {
 	proto.ServiceInstance
-	Stats map[string]*Stats // keyed on metric name
+	Stats       map[string]*Stats // keyed on metric name
+	Collections int               `json:",omitempty"` // collections received in interval
+	Missing     int               `json:",omitempty"` // expected collections not received
+	Coverage    float64           `json:",omitempty"` // received/expected collections, 0 to 1 (omitted if 0, then Missing > 0)
+	collections int               // counter for current interval
 }
 
 type Report struct {
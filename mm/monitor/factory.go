@@ -68,7 +68,7 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (mm.Monitor
 		monitor = mysql.NewMonitor(
 			alias,
 			config,
-			pct.NewLogger(f.logChan, alias),
+			pct.NewLogger(f.logChan, alias).With("service", service, "instance", instanceId),
 			mysqlConn.NewConnection(mysqlIt.DSN),
 			f.mrm,
 		)
@@ -86,7 +86,7 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (mm.Monitor
 		monitor = system.NewMonitor(
 			alias,
 			config,
-			pct.NewLogger(f.logChan, alias),
+			pct.NewLogger(f.logChan, alias).With("service", service, "instance", instanceId),
 		)
 	default:
 		return nil, errors.New("Unknown metrics monitor type: " + service)
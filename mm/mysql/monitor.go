@@ -18,6 +18,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net"
@@ -122,7 +123,9 @@ func (m *Monitor) Stop() error {
 
 // @goroutine[0]
 func (m *Monitor) Status() map[string]string {
-	return m.status.All()
+	status := m.status.All()
+	status[m.name+"-mysql-pool"] = m.conn.Stats().String()
+	return status
 }
 
 // @goroutine[0]
@@ -193,7 +196,7 @@ func (m *Monitor) setGlobalVars() {
 	if len(m.config.InnoDB) > 0 {
 		for _, module := range m.config.InnoDB {
 			sql := "SET GLOBAL innodb_monitor_enable = '" + module + "'"
-			if _, err := m.conn.DB().Exec(sql); err != nil {
+			if _, err := m.exec(sql); err != nil {
 				errMsg := fmt.Sprintf("Cannot collect InnoDB stats because '%s' failed: %s", sql, err)
 				m.logger.Error(errMsg)
 				m.config.InnoDB = []string{}
@@ -206,7 +209,7 @@ func (m *Monitor) setGlobalVars() {
 		// 5.1.49 <= v <= 5.5.10: SET GLOBAL userstat_running=ON
 		// 5.5.10 <  v:           SET GLOBAL userstat=ON
 		sql := "SET GLOBAL userstat=ON"
-		if _, err := m.conn.DB().Exec(sql); err != nil {
+		if _, err := m.exec(sql); err != nil {
 			errMsg := fmt.Sprintf("Cannot collect user stats because '%s' failed: %s", sql, err)
 			m.logger.Error(errMsg)
 			m.config.UserStats = false
@@ -366,7 +369,10 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 
 	m.status.Update(m.name, "Getting global status metrics")
 
-	rows, err := conn.Query("SHOW /*!50002 GLOBAL */ STATUS")
+	ctx, cancel := m.conn.Context()
+	defer cancel()
+
+	rows, err := conn.QueryContext(ctx, "SHOW /*!50002 GLOBAL */ STATUS")
 	if err != nil {
 		return err
 	}
@@ -390,6 +396,11 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 			continue
 		}
 
+		if metricType == "string" {
+			c.Metrics = append(c.Metrics, mm.Metric{Name: "mysql/" + statName, Type: metricType, String: statValue})
+			continue
+		}
+
 		metricValue, err := strconv.ParseFloat(statValue, 64)
 		if err != nil {
 			m.logger.Warn(fmt.Sprintf("%s: strconv.ParseFloat('%s', 64): %s", statName, statValue, err))
@@ -418,7 +429,10 @@ func (m *Monitor) GetInnoDBMetrics(conn *sql.DB, c *mm.Collection) error {
 
 	m.status.Update(m.name, "Getting InnoDB metrics")
 
-	rows, err := conn.Query("SELECT NAME, SUBSYSTEM, COUNT, TYPE FROM INFORMATION_SCHEMA.INNODB_METRICS WHERE STATUS='enabled'")
+	ctx, cancel := m.conn.Context()
+	defer cancel()
+
+	rows, err := conn.QueryContext(ctx, "SELECT NAME, SUBSYSTEM, COUNT, TYPE FROM INFORMATION_SCHEMA.INNODB_METRICS WHERE STATUS='enabled'")
 	if err != nil {
 		return err
 	}
@@ -443,7 +457,7 @@ func (m *Monitor) GetInnoDBMetrics(conn *sql.DB, c *mm.Collection) error {
 		if statType == "value" {
 			metricType = "gauge"
 		} else {
-			metricType = "counter"
+			metricType = "counter64" // COUNT is a BIGINT
 		}
 		c.Metrics = append(c.Metrics, mm.Metric{metricName, metricType, metricValue, ""})
 	}
@@ -466,6 +480,9 @@ func (m *Monitor) getTableUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 
 	m.status.Update(m.name, "Getting userstat table metrics")
 
+	ctx, cancel := m.conn.Context()
+	defer cancel()
+
 	/**
 	 *  SELECT * FROM INFORMATION_SCHEMA.TABLE_STATISTICS;
 	 *  +--------------+-------------+-----------+--------------+------------------------+
@@ -476,7 +493,7 @@ func (m *Monitor) getTableUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 	if ignoreDb != "" {
 		sql += " WHERE TABLE_SCHEMA NOT LIKE '" + ignoreDb + "'"
 	}
-	rows, err := conn.Query(sql)
+	rows, err := conn.QueryContext(ctx, sql)
 	if err != nil {
 		return err
 	}
@@ -522,6 +539,9 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 
 	m.status.Update(m.name, "Getting userstat index metrics")
 
+	ctx, cancel := m.conn.Context()
+	defer cancel()
+
 	/**
 	 *  SELECT * FROM INFORMATION_SCHEMA.INDEX_STATISTICS;
 	 *  +--------------+-------------+------------+-----------+
@@ -533,7 +553,7 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 	if ignoreDb != "" {
 		sql = sql + " WHERE TABLE_SCHEMA NOT LIKE '" + ignoreDb + "'"
 	}
-	rows, err := conn.Query(sql)
+	rows, err := conn.QueryContext(ctx, sql)
 	if err != nil {
 		return err
 	}
@@ -559,11 +579,20 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 	return nil
 }
 
+func (m *Monitor) exec(query string) (sql.Result, error) {
+	ctx, cancel := m.conn.Context()
+	defer cancel()
+	return m.conn.DB().ExecContext(ctx, query)
+}
+
 func (m *Monitor) collectError(err error) error {
 	switch {
 	case mysql.MySQLErrorCode(err) == mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR:
 		m.logger.Error(fmt.Sprintf("Cannot collect InnoDB stats: %s", err))
 		return accessDenied
+	case err == context.DeadlineExceeded:
+		m.logger.Warn(fmt.Sprintf("MySQL query timed out (%s)", m.conn.Stats().QueryTimeout))
+		return err
 	}
 	switch err.(type) {
 	case *net.OpError:
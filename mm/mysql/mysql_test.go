@@ -252,10 +252,10 @@ func (s *TestSuite) TestCollectInnoDBStats(t *C) {
 		t.Fatal("Collect 4 InnoDB metrics; got %+v", c.Metrics)
 	}
 	expect := []mm.Metric{
-		{Name: "mysql/innodb/dml/dml_reads", Type: "counter", Number: 0},
-		{Name: "mysql/innodb/dml/dml_inserts", Type: "counter", Number: 1}, // <-- our INSERT
-		{Name: "mysql/innodb/dml/dml_deletes", Type: "counter", Number: 0},
-		{Name: "mysql/innodb/dml/dml_updates", Type: "counter", Number: 0},
+		{Name: "mysql/innodb/dml/dml_reads", Type: "counter64", Number: 0},
+		{Name: "mysql/innodb/dml/dml_inserts", Type: "counter64", Number: 1}, // <-- our INSERT
+		{Name: "mysql/innodb/dml/dml_deletes", Type: "counter64", Number: 0},
+		{Name: "mysql/innodb/dml/dml_updates", Type: "counter64", Number: 0},
 	}
 	if ok, diff := test.IsDeeply(c.Metrics, expect); !ok {
 		t.Error(diff)
@@ -451,10 +451,10 @@ func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
 		t.Fatal("Collect 4 InnoDB metrics; got %+v", c.Metrics)
 	}
 	expect := []mm.Metric{
-		{Name: "mysql/innodb/dml/dml_reads", Type: "counter", Number: 0},
-		{Name: "mysql/innodb/dml/dml_inserts", Type: "counter", Number: 1}, // <-- our INSERT
-		{Name: "mysql/innodb/dml/dml_deletes", Type: "counter", Number: 0},
-		{Name: "mysql/innodb/dml/dml_updates", Type: "counter", Number: 0},
+		{Name: "mysql/innodb/dml/dml_reads", Type: "counter64", Number: 0},
+		{Name: "mysql/innodb/dml/dml_inserts", Type: "counter64", Number: 1}, // <-- our INSERT
+		{Name: "mysql/innodb/dml/dml_deletes", Type: "counter64", Number: 0},
+		{Name: "mysql/innodb/dml/dml_updates", Type: "counter64", Number: 0},
 	}
 	if ok, diff := test.IsDeeply(c.Metrics, expect); !ok {
 		t.Error(diff)
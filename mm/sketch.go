@@ -0,0 +1,244 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	SKETCH_ALPHA    = 0.01 // relative accuracy of quantiles (1%)
+	SKETCH_MAX_BINS = 2048 // max bins per sketch, bounds memory per metric
+)
+
+/**
+ * A Sketch is a streaming, mergeable summary of values.  Values are counted
+ * in logarithmically sized bins such that any quantile is accurate to within
+ * Alpha of its true value (relative error), so memory depends on the range
+ * of values, not on how many values are added.  The number of bins is capped
+ * at MaxBins by collapsing the smallest bins, which only affects the accuracy
+ * of the lowest quantiles.  Sketches with the same Alpha can be merged, so
+ * reports can be re-aggregated across intervals and agents.
+ */
+type Sketch struct {
+	Alpha   float64
+	MaxBins int
+	Cnt     uint64
+	Sum     float64
+	Min     float64
+	Max     float64
+	Zero    uint64         // values too close to zero to index
+	Pos     map[int]uint64 // positive values, keyed on bin index
+	Neg     map[int]uint64 `json:",omitempty"` // negative values, keyed on bin index of -value
+	lnGamma float64        // ln((1+Alpha)/(1-Alpha)), computed lazily
+}
+
+// Smallest value that can be indexed; anything smaller is counted as Zero.
+const sketchMinValue = 1e-9
+
+func NewSketch(alpha float64, maxBins int) (*Sketch, error) {
+	if alpha <= 0 || alpha >= 1 {
+		return nil, fmt.Errorf("Invalid sketch alpha: %f", alpha)
+	}
+	if maxBins < 1 {
+		return nil, fmt.Errorf("Invalid sketch max bins: %d", maxBins)
+	}
+	s := &Sketch{
+		Alpha:   alpha,
+		MaxBins: maxBins,
+		Pos:     make(map[int]uint64),
+		Neg:     make(map[int]uint64),
+	}
+	return s, nil
+}
+
+func (s *Sketch) Add(v float64) {
+	if s.Cnt == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Cnt == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Cnt++
+	s.Sum += v
+	switch {
+	case v > sketchMinValue:
+		s.Pos[s.index(v)]++
+	case v < -sketchMinValue:
+		s.Neg[s.index(-v)]++
+	default:
+		s.Zero++
+	}
+	s.collapse()
+}
+
+// Merge adds all values from another sketch to this sketch.  Both sketches
+// must have the same Alpha, else their bins do not align.
+func (s *Sketch) Merge(o *Sketch) error {
+	if o == nil || o.Cnt == 0 {
+		return nil
+	}
+	if o.Alpha != s.Alpha {
+		return fmt.Errorf("Cannot merge sketches with different alpha: %f != %f", s.Alpha, o.Alpha)
+	}
+	if s.Cnt == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Cnt == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Cnt += o.Cnt
+	s.Sum += o.Sum
+	s.Zero += o.Zero
+	if s.Pos == nil {
+		s.Pos = make(map[int]uint64)
+	}
+	if s.Neg == nil {
+		s.Neg = make(map[int]uint64)
+	}
+	for i, n := range o.Pos {
+		s.Pos[i] += n
+	}
+	for i, n := range o.Neg {
+		s.Neg[i] += n
+	}
+	s.collapse()
+	return nil
+}
+
+// Quantile returns the value at quantile q (0 <= q <= 1), e.g. 0.999 for
+// the 99.9th percentile.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.Cnt == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+
+	// Walk bins in value order, from the most negative to the most positive,
+	// until the rank of the quantile is reached.
+	rank := uint64(q * float64(s.Cnt-1))
+	var n uint64
+	var v float64
+	found := false
+	for _, i := range sortedKeys(s.Neg, true) {
+		n += s.Neg[i]
+		if n > rank {
+			v = -s.value(i)
+			found = true
+			break
+		}
+	}
+	if !found {
+		n += s.Zero
+		if n > rank {
+			v = 0
+			found = true
+		}
+	}
+	if !found {
+		v = s.Max
+		for _, i := range sortedKeys(s.Pos, false) {
+			n += s.Pos[i]
+			if n > rank {
+				v = s.value(i)
+				break
+			}
+		}
+	}
+
+	// Bin values are approximate, but min and max are exact.
+	if v < s.Min {
+		v = s.Min
+	} else if v > s.Max {
+		v = s.Max
+	}
+	return v
+}
+
+func (s *Sketch) Copy() *Sketch {
+	c := *s
+	c.Pos = make(map[int]uint64, len(s.Pos))
+	for i, n := range s.Pos {
+		c.Pos[i] = n
+	}
+	c.Neg = make(map[int]uint64, len(s.Neg))
+	for i, n := range s.Neg {
+		c.Neg[i] = n
+	}
+	return &c
+}
+
+// --------------------------------------------------------------------------
+
+func (s *Sketch) logGamma() float64 {
+	if s.lnGamma == 0 {
+		s.lnGamma = math.Log((1 + s.Alpha) / (1 - s.Alpha))
+	}
+	return s.lnGamma
+}
+
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma()))
+}
+
+func (s *Sketch) value(i int) float64 {
+	// Midpoint of bin i: 2 * gamma^i / (gamma + 1)
+	g := math.Exp(s.logGamma())
+	return 2 * math.Exp(float64(i)*s.logGamma()) / (g + 1)
+}
+
+// collapse merges the smallest bins of the larger store while there are more
+// than MaxBins bins.  Small values lose accuracy first, which is the least
+// interesting end for metrics where we care about p99 and p99.9.
+func (s *Sketch) collapse() {
+	if s.MaxBins <= 0 || len(s.Pos)+len(s.Neg) <= s.MaxBins {
+		return
+	}
+	for len(s.Pos)+len(s.Neg) > s.MaxBins {
+		bins := s.Pos
+		if len(s.Neg) > len(s.Pos) {
+			bins = s.Neg
+		}
+		keys := sortedKeys(bins, false)
+		if len(keys) < 2 {
+			return
+		}
+		bins[keys[1]] += bins[keys[0]]
+		delete(bins, keys[0])
+	}
+}
+
+func sortedKeys(bins map[int]uint64, reverse bool) []int {
+	keys := make([]int, 0, len(bins))
+	for i := range bins {
+		keys = append(keys, i)
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+	} else {
+		sort.Ints(keys)
+	}
+	return keys
+}
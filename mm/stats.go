@@ -20,7 +20,9 @@ package mm
 import (
 	"fmt"
 	"log"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -39,9 +41,22 @@ func (e ErrValueLap) Error() string {
 	return fmt.Sprintf("Value lap: "+strings.Join(values, ", "), a...)
 }
 
+const (
+	MAX_COUNTER32 = float64(math.MaxUint32)
+	MAX_COUNTER64 = float64(math.MaxUint64)
+)
+
+// Max values of the counter types with a declared width.  The width of other
+// counters and deltas is unknown, so their decreases are resets.
+var CounterMax = map[string]float64{
+	"counter32": MAX_COUNTER32,
+	"counter64": MAX_COUNTER64,
+}
+
 type Stats struct {
 	metricType string    `json:"-"` // ignore
-	str        string    `json:",omitempty"`
+	str        string    `json:"-"` // last string value
+	nStr       int       `json:"-"` // number of string values
 	firstVal   bool      `json:"-"`
 	prevTs     int64     `json:"-"`
 	penuTs     int64     `json:"-"`
@@ -49,6 +64,8 @@ type Stats struct {
 	penuVal    float64   `json:"-"` // 2nd to last (penultimate) value
 	vals       []float64 `json:"-"`
 	sum        float64   `json:"-"`
+	sketch     *Sketch   `json:"-"` // used instead of vals if not nil
+	pcts       []float64 `json:"-"` // extra percentiles to report from sketch
 	Cnt        int
 	Min        float64
 	Pct5       float64
@@ -56,6 +73,9 @@ type Stats struct {
 	Med        float64
 	Pct95      float64
 	Max        float64
+	Str        string             `json:",omitempty"` // last value (string only)
+	Pct        map[string]float64 `json:",omitempty"` // extra percentiles, e.g. "99.9" (sketch only)
+	Sketch     *Sketch            `json:",omitempty"` // for re-aggregation (sketch only)
 }
 
 func NewStats(metricType string) (*Stats, error) {
@@ -70,64 +90,101 @@ func NewStats(metricType string) (*Stats, error) {
 	return s, nil
 }
 
+// NewSketchStats returns Stats that summarize values with a Sketch instead
+// of keeping every value, so memory per metric is bounded and the final
+// stats can be merged.  The percentiles (e.g. 99, 99.9) are reported in Pct
+// in addition to the standard stats.
+func NewSketchStats(metricType string, percentiles []float64) (*Stats, error) {
+	s, err := NewStats(metricType)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidPercentiles(percentiles); err != nil {
+		return nil, err
+	}
+	s.sketch, err = NewSketch(SKETCH_ALPHA, SKETCH_MAX_BINS)
+	if err != nil {
+		return nil, err
+	}
+	s.pcts = percentiles
+	return s, nil
+}
+
+func ValidPercentiles(percentiles []float64) error {
+	for _, p := range percentiles {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("Invalid percentile: %f", p)
+		}
+	}
+	return nil
+}
+
 func (s *Stats) Reset() {
 	s.sum = 0
 	s.vals = []float64{}
+	s.nStr = 0
+	if s.sketch != nil {
+		// Don't reuse the sketch: the last report may still reference it.
+		s.sketch, _ = NewSketch(s.sketch.Alpha, s.sketch.MaxBins)
+	}
 }
 
 func (s *Stats) Add(m *Metric, ts int64) error {
 	var err error
 	switch s.metricType {
 	case "gauge":
-		s.vals = append(s.vals, m.Number)
-		s.sum += m.Number
-	case "counter":
-		if !s.firstVal {
-			if m.Number >= s.prevVal {
-				// Metric value increased (or stayed same); this is what we expect.
-
-				// https://jira.percona.com/browse/PCT-939
-				if s.penuVal > 0 && s.prevVal == 0 && m.Number > s.penuVal {
-					// @1 x=100
-					// @2 x=0 (for whatever reason)
-					// @3 x > 100
-					// This means value reset then increased so quickly that it
-					// lapped the previous non-zero value, which shouldn't happen;
-					// or observation @2 was a blip and x should have been >100
-					// && < @3. However, if the values are very small, it could
-					// happen and could be legitimate, so for now we just return
-					// an error to warn the caller.
-					err = ErrValueLap{[]int64{s.penuTs, s.prevTs, ts}, []float64{s.penuVal, s.prevVal, m.Number}}
-				}
-
-				// Per-second rate of value = increase / duration
-				inc := m.Number - s.prevVal
-				dur := ts - s.prevTs
-				val := inc / float64(dur)
-				s.vals = append(s.vals, val)
-
-				// Keep running total to calc Avg.
-				s.sum += val
-
-				// Current values become previous values.
-				s.penuTs = s.prevTs
-				s.prevTs = ts
-				s.penuVal = s.prevVal
-				s.prevVal = m.Number
-			} else {
+		s.addValue(m.Number)
+	case "string":
+		// State value, e.g. Slave_running=ON.  Only the last value is reported.
+		s.str = m.String
+		s.nStr++
+	case "counter", "counter32", "counter64", "delta", "derive":
+		if s.firstVal {
+			s.firstVal = false
+			s.shift(m.Number, ts)
+			break
+		}
+
+		inc := m.Number - s.prevVal
+		if inc < 0 && s.metricType != "derive" {
+			// Counters and deltas only increase, so the value wrapped or reset.
+			// Derive values can decrease, so a negative rate is valid for them.
+			wrap := CounterWrap(s.prevVal, m.Number, CounterMax[s.metricType])
+			if wrap == 0 {
 				// Metric value reset, e.g. FLUSH GLOBAL STATUS.
-				s.penuTs = s.prevTs
-				s.prevTs = ts
-				s.penuVal = s.prevVal
-				s.prevVal = m.Number
+				s.shift(m.Number, ts)
+				break
 			}
+			inc = wrap
+		} else if s.metricType != "derive" {
+			// Metric value increased (or stayed same); this is what we expect.
+
+			// https://jira.percona.com/browse/PCT-939
+			if s.penuVal > 0 && s.prevVal == 0 && m.Number > s.penuVal {
+				// @1 x=100
+				// @2 x=0 (for whatever reason)
+				// @3 x > 100
+				// This means value reset then increased so quickly that it
+				// lapped the previous non-zero value, which shouldn't happen;
+				// or observation @2 was a blip and x should have been >100
+				// && < @3. However, if the values are very small, it could
+				// happen and could be legitimate, so for now we just return
+				// an error to warn the caller.
+				err = ErrValueLap{[]int64{s.penuTs, s.prevTs, ts}, []float64{s.penuVal, s.prevVal, m.Number}}
+			}
+		}
+
+		if s.metricType == "delta" {
+			// Raw increase since last value.
+			s.addValue(inc)
 		} else {
-			s.penuTs = s.prevTs
-			s.prevTs = ts
-			s.penuVal = s.prevVal
-			s.prevVal = m.Number
-			s.firstVal = false
+			// Per-second rate of value = increase / duration
+			dur := ts - s.prevTs
+			s.addValue(inc / float64(dur))
 		}
+
+		// Current values become previous values.
+		s.shift(m.Number, ts)
 	default:
 		// This should not happen because type is checked in NewStats().
 		log.Panic("mm:Aggregator:Add: Invalid metric type: " + s.metricType)
@@ -135,25 +192,81 @@ func (s *Stats) Add(m *Metric, ts int64) error {
 	return err
 }
 
+// CounterWrap returns the increase from prev to cur if the decrease looks like
+// a wraparound of a counter whose max value is max (see CounterMax), else zero.
+// A decrease is a wrap only if prev was in the top quarter of the counter's
+// range and cur is in the bottom quarter; anything else is a reset (FLUSH
+// STATUS, restart, etc.), which is far more common.  If max is zero (unknown
+// width), every decrease is a reset.
+func CounterWrap(prev, cur, max float64) float64 {
+	if max == 0 || prev > max {
+		return 0
+	}
+	if prev >= max-max/4 && cur <= max/4 {
+		return (max - prev) + cur + 1
+	}
+	return 0
+}
+
+func (s *Stats) shift(val float64, ts int64) {
+	s.penuTs = s.prevTs
+	s.prevTs = ts
+	s.penuVal = s.prevVal
+	s.prevVal = val
+}
+
+func (s *Stats) addValue(val float64) {
+	if s.sketch != nil {
+		s.sketch.Add(val)
+		return
+	}
+	s.vals = append(s.vals, val)
+
+	// Keep running total to calc Avg.
+	s.sum += val
+}
+
+func (s *Stats) count() int {
+	if s.metricType == "string" {
+		return s.nStr
+	}
+	if s.sketch != nil {
+		return int(s.sketch.Cnt)
+	}
+	return len(s.vals)
+}
+
 func (s *Stats) Finalize() *Stats {
-	if len(s.vals) == 0 {
+	if s.count() == 0 {
 		return nil
 	}
 	s.Summarize()
 	return &Stats{
-		Cnt:   s.Cnt,
-		Min:   s.Min,
-		Pct5:  s.Pct5,
-		Avg:   s.Avg,
-		Med:   s.Med,
-		Pct95: s.Pct95,
-		Max:   s.Max,
+		Cnt:    s.Cnt,
+		Min:    s.Min,
+		Pct5:   s.Pct5,
+		Avg:    s.Avg,
+		Med:    s.Med,
+		Pct95:  s.Pct95,
+		Max:    s.Max,
+		Str:    s.Str,
+		Pct:    s.Pct,
+		Sketch: s.Sketch,
 	}
 }
 
 func (s *Stats) Summarize() {
+	if s.metricType == "string" {
+		s.Cnt = s.nStr
+		s.Str = s.str
+		return
+	}
+	if s.sketch != nil {
+		s.summarizeSketch()
+		return
+	}
 	switch s.metricType {
-	case "gauge", "counter":
+	case "gauge", "counter", "counter32", "counter64", "derive", "delta":
 		s.Cnt = len(s.vals)
 		if s.Cnt > 1 {
 			sort.Float64s(s.vals)
@@ -173,3 +286,24 @@ func (s *Stats) Summarize() {
 		}
 	}
 }
+
+func (s *Stats) summarizeSketch() {
+	sk := s.sketch
+	s.Cnt = int(sk.Cnt)
+	if s.Cnt == 0 {
+		return
+	}
+	s.Min = sk.Min
+	s.Pct5 = sk.Quantile(0.05)
+	s.Avg = sk.Sum / float64(sk.Cnt)
+	s.Med = sk.Quantile(0.50)
+	s.Pct95 = sk.Quantile(0.95)
+	s.Max = sk.Max
+	if len(s.pcts) > 0 {
+		s.Pct = make(map[string]float64, len(s.pcts))
+		for _, p := range s.pcts {
+			s.Pct[strconv.FormatFloat(p, 'f', -1, 64)] = sk.Quantile(p / 100)
+		}
+	}
+	s.Sketch = sk.Copy()
+}
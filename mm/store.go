@@ -0,0 +1,507 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/percona/percona-agent/pct"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_STORE_LISTEN = "127.0.0.1:9001" // usual local address for queries, e.g. for percona-agent-cli
+	DEFAULT_STORE_QUERY  = 3600             // seconds of points to return if no begin
+	STORE_MAX_OPEN_FILES = 512
+	STORE_QUEUE_SIZE     = 100 // collections waiting to be written
+)
+
+const (
+	storeMagic      = "PCTTS001"
+	storeHeaderSize = 32 // magic, resolution, slots, reserved
+	storeSlotSize   = 16 // ts (int64), value (float64)
+	storeFileSuffix = ".ts"
+)
+
+// Config for the local metrics store, read from metrics.conf.  The store is
+// disabled by default: it writes a file per metric (16 bytes per value, e.g.
+// about 1.4MB per metric for 24h at 1s), so enable it with, for example,
+// {"Retention": 86400, "Listen": "127.0.0.1:9001"}.  Queries are not
+// authenticated, so Listen should be a loopback address.
+type StoreConfig struct {
+	Retention uint   // seconds of raw metrics to keep, 0 (default) disables the store
+	Listen    string // local address to serve queries, "" (default) disables queries
+}
+
+// A CollectionSink receives every collection an aggregator receives, before
+// the collection is summarized.  collect is the instance's collect interval
+// (seconds), or zero if unknown.
+type CollectionSink interface {
+	Add(collection *Collection, collect uint)
+}
+
+// A raw metric value at a time.
+type Point struct {
+	Ts  int64 // UTC Unix timestamp
+	Val float64
+}
+
+/**
+ * Store keeps raw metric values on disk so recent metrics can be queried on
+ * the host, e.g. when the API is unreachable.  Each metric of each instance is
+ * a file (dir/service-id/metric.ts) of fixed-size slots: a ring buffer holding
+ * retention seconds of values at the instance's collect resolution, so the
+ * files never grow.  Only numeric metrics are stored.  Collections are written
+ * by the store's own goroutine, so file I/O doesn't block the aggregator; if
+ * the store falls behind by STORE_QUEUE_SIZE collections, new ones are dropped.
+ */
+type Store struct {
+	logger    *pct.Logger
+	dir       string
+	retention uint
+	// --
+	files     map[string]*seriesFile // keyed on file path
+	failed    map[string]bool        // series which failed to open, to log once
+	mux       *sync.Mutex            // guards files and failed
+	writeChan chan storeWrite
+	flushChan chan chan bool
+	stopChan  chan bool
+	doneChan  chan bool
+	running   bool
+	runMux    *sync.Mutex // guards running, stopChan and doneChan
+	dropped   uint64      // atomic
+}
+
+type storeWrite struct {
+	collection *Collection
+	collect    uint
+}
+
+type seriesFile struct {
+	file  *os.File
+	res   int64 // seconds per slot
+	slots int64
+}
+
+func NewStore(logger *pct.Logger, dir string, retention uint) *Store {
+	s := &Store{
+		logger:    logger,
+		dir:       dir,
+		retention: retention,
+		// --
+		files:     make(map[string]*seriesFile),
+		failed:    make(map[string]bool),
+		mux:       &sync.Mutex{},
+		writeChan: make(chan storeWrite, STORE_QUEUE_SIZE),
+		flushChan: make(chan chan bool),
+		runMux:    &sync.Mutex{},
+	}
+	return s
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// Start starts the goroutine which writes the collections given to Add.
+// @goroutine[0]
+func (s *Store) Start() {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+	if s.running {
+		return
+	}
+	s.stopChan = make(chan bool)
+	s.doneChan = make(chan bool)
+	s.running = true
+	go s.run(s.stopChan, s.doneChan)
+}
+
+// Add implements CollectionSink.  It queues the collection to be written, so
+// it doesn't block.
+// @goroutine[1]
+func (s *Store) Add(collection *Collection, collect uint) {
+	select {
+	case s.writeChan <- storeWrite{collection, collect}:
+	default:
+		if n := atomic.AddUint64(&s.dropped, 1); n == 1 || n%1000 == 0 {
+			s.logger.Warn(fmt.Sprintf("Store is too slow, dropped %d collections", n))
+		}
+	}
+}
+
+// Flush writes the queued collections.
+// @goroutine[0]
+func (s *Store) Flush(timeout time.Duration) error {
+	return pct.DrainChan("mm store", s.flushChan, timeout)
+}
+
+// Query returns the points of the metric between begin and end (UTC Unix
+// timestamps, inclusive), in time order.
+// @goroutine[2]
+func (s *Store) Query(service string, instanceId uint, metric string, begin, end int64) ([]Point, error) {
+	if err := validService(service); err != nil {
+		return nil, err
+	}
+	file := filepath.Join(s.instanceDir(service, instanceId), url.QueryEscape(metric)+storeFileSuffix)
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Unknown metric %s for %s-%d", metric, service, instanceId)
+		}
+		return nil, err
+	}
+	res, slots, err := readHeader(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	// Slots not overwritten for a whole ring period, e.g. because the metric
+	// wasn't collected for a while, are older than the retention: skip them.
+	var newest int64
+	for off := storeHeaderSize; off+storeSlotSize <= len(bytes); off += storeSlotSize {
+		if ts := int64(binary.LittleEndian.Uint64(bytes[off : off+8])); ts > newest {
+			newest = ts
+		}
+	}
+	if oldest := newest - res*slots + 1; begin < oldest {
+		begin = oldest
+	}
+
+	points := []Point{}
+	for off := storeHeaderSize; off+storeSlotSize <= len(bytes); off += storeSlotSize {
+		ts := int64(binary.LittleEndian.Uint64(bytes[off : off+8]))
+		if ts == 0 || ts < begin || ts > end {
+			continue
+		}
+		val := math.Float64frombits(binary.LittleEndian.Uint64(bytes[off+8 : off+16]))
+		points = append(points, Point{Ts: ts, Val: val})
+	}
+	sort.Sort(byTs(points))
+	return points, nil
+}
+
+// Instances returns the service instances with stored metrics, e.g. mysql-1.
+// @goroutine[2]
+func (s *Store) Instances() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	instances := []string{}
+	for _, f := range files {
+		if f.IsDir() {
+			instances = append(instances, f.Name())
+		}
+	}
+	return instances, nil
+}
+
+// Metrics returns the names of the instance's stored metrics.
+// @goroutine[2]
+func (s *Store) Metrics(service string, instanceId uint) ([]string, error) {
+	if err := validService(service); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(s.instanceDir(service, instanceId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No metrics for %s-%d", service, instanceId)
+		}
+		return nil, err
+	}
+	metrics := []string{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), storeFileSuffix) {
+			continue
+		}
+		name, err := url.QueryUnescape(strings.TrimSuffix(f.Name(), storeFileSuffix))
+		if err != nil {
+			continue
+		}
+		metrics = append(metrics, name)
+	}
+	return metrics, nil
+}
+
+// Close writes the queued collections, stops the goroutine and closes the files.
+// @goroutine[0]
+func (s *Store) Close() {
+	s.runMux.Lock()
+	if s.running {
+		close(s.stopChan)
+		<-s.doneChan
+		s.running = false
+	}
+	s.runMux.Unlock()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closeAll()
+}
+
+/**
+ * ServeHTTP answers local queries:
+ *   GET /metrics                                     instances
+ *   GET /metrics?service=mysql&instance=1            instance's metrics
+ *   GET /metrics?service=mysql&instance=1&metric=M   points, optionally &begin=&end=
+ * begin and end are UTC Unix timestamps; the default range is the last hour.
+ * Replies are JSON.
+ */
+// @goroutine[2]
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+
+	var v interface{}
+	var err error
+	if q.Get("service") == "" {
+		v, err = s.Instances()
+	} else {
+		if err := validService(q.Get("service")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var instanceId uint64
+		instanceId, err = strconv.ParseUint(q.Get("instance"), 10, 0)
+		if err != nil {
+			http.Error(w, "Invalid instance: "+q.Get("instance"), http.StatusBadRequest)
+			return
+		}
+		if q.Get("metric") == "" {
+			v, err = s.Metrics(q.Get("service"), uint(instanceId))
+		} else {
+			end := time.Now().UTC().Unix()
+			begin := end - DEFAULT_STORE_QUERY
+			if end, err = queryTs(q.Get("end"), end); err != nil {
+				http.Error(w, "Invalid end: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if q.Get("end") != "" {
+				begin = end - DEFAULT_STORE_QUERY
+			}
+			if begin, err = queryTs(q.Get("begin"), begin); err != nil {
+				http.Error(w, "Invalid begin: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			v, err = s.Query(q.Get("service"), uint(instanceId), q.Get("metric"), begin, end)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[3]
+func (s *Store) run(stopChan, doneChan chan bool) {
+	defer close(doneChan)
+	for {
+		select {
+		case w := <-s.writeChan:
+			s.write(w.collection, w.collect)
+		case done := <-s.flushChan:
+			s.drain()
+			close(done)
+		case <-stopChan:
+			s.drain()
+			return
+		}
+	}
+}
+
+// @goroutine[3]
+func (s *Store) drain() {
+	for n := len(s.writeChan); n > 0; n-- {
+		w := <-s.writeChan
+		s.write(w.collection, w.collect)
+	}
+}
+
+// @goroutine[3]
+func (s *Store) write(collection *Collection, collect uint) {
+	res := int64(collect)
+	if res < 1 {
+		res = 1
+	}
+	slots := int64(s.retention) / res
+	if slots < 1 {
+		slots = 1
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	instanceDir := s.instanceDir(collection.Service, collection.InstanceId)
+	for _, metric := range collection.Metrics {
+		if metric.Type == "string" {
+			continue
+		}
+		file := filepath.Join(instanceDir, url.QueryEscape(metric.Name)+storeFileSuffix)
+		series, err := s.open(file, res, slots)
+		if err != nil {
+			if !s.failed[file] {
+				s.logger.Warn("Cannot store " + metric.Name + ": " + err.Error())
+				s.failed[file] = true
+			}
+			continue
+		}
+		delete(s.failed, file)
+		if err := series.write(collection.Ts, metric.Number); err != nil {
+			s.logger.Warn("Cannot store " + metric.Name + ": " + err.Error())
+			series.file.Close()
+			delete(s.files, file)
+		}
+	}
+}
+
+// Services come from queries, so they must not be paths out of the store dir,
+// e.g. service=../../etc.
+func validService(service string) error {
+	if service == "" || strings.Contains(service, "..") || strings.ContainsAny(service, `/\`) {
+		return fmt.Errorf("Invalid service: %s", service)
+	}
+	return nil
+}
+
+func (s *Store) instanceDir(service string, instanceId uint) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%d", service, instanceId))
+}
+
+// Open, or create, the series file.  If the file was created with a different
+// resolution or number of slots (i.e. the collect interval or retention changed),
+// the old values cannot be mapped to the new slots, so the file is reset.
+// @goroutine[3]
+func (s *Store) open(file string, res, slots int64) (*seriesFile, error) {
+	if series, ok := s.files[file]; ok {
+		if series.res == res && series.slots == slots {
+			return series, nil
+		}
+		series.file.Close()
+		delete(s.files, file)
+	}
+
+	if len(s.files) >= STORE_MAX_OPEN_FILES {
+		s.closeAll()
+	}
+
+	if err := pct.MakeDir(filepath.Dir(file)); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, storeHeaderSize)
+	n, _ := f.ReadAt(header, 0)
+	fileRes, fileSlots, err := readHeader(header[0:n])
+	if err != nil || fileRes != res || fileSlots != slots {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		copy(header, storeMagic)
+		binary.LittleEndian.PutUint64(header[8:16], uint64(res))
+		binary.LittleEndian.PutUint64(header[16:24], uint64(slots))
+		if _, err := f.WriteAt(header, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Sparse file; empty slots read as zero (ts=0).
+		if err := f.Truncate(storeHeaderSize + slots*storeSlotSize); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	series := &seriesFile{
+		file:  f,
+		res:   res,
+		slots: slots,
+	}
+	s.files[file] = series
+	return series, nil
+}
+
+// @goroutine[3]
+func (s *Store) closeAll() {
+	for file, series := range s.files {
+		series.file.Close()
+		delete(s.files, file)
+	}
+}
+
+func (f *seriesFile) write(ts int64, val float64) error {
+	slot := (ts / f.res) % f.slots
+	buf := make([]byte, storeSlotSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(ts))
+	binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(val))
+	_, err := f.file.WriteAt(buf, storeHeaderSize+slot*storeSlotSize)
+	return err
+}
+
+func readHeader(bytes []byte) (res, slots int64, err error) {
+	if len(bytes) < storeHeaderSize || string(bytes[0:8]) != storeMagic {
+		return 0, 0, errors.New("not a metrics store file")
+	}
+	res = int64(binary.LittleEndian.Uint64(bytes[8:16]))
+	slots = int64(binary.LittleEndian.Uint64(bytes[16:24]))
+	return res, slots, nil
+}
+
+func queryTs(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+type byTs []Point
+
+func (p byTs) Len() int           { return len(p) }
+func (p byTs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byTs) Less(i, j int) bool { return p[i].Ts < p[j].Ts }
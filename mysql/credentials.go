@@ -0,0 +1,307 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * A DSN can refer to a credential source instead of embedding the password,
+ * with these agent-only params (values url.QueryEscape'd):
+ *   defaultsFile=PATH  user and password from the [client] section of a my.cnf
+ *   passwordFile=PATH  password is the file's contents
+ *   passwordExec=PATH  password is the output of the executable
+ * e.g. percona-agent@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true&passwordFile=%2Fetc%2Fpercona%2Fmysql-pass
+ * Sources are read every time a Connection connects, so the password can be
+ * rotated without reconfiguring the agent.  A user in the DSN overrides the
+ * defaults file user; a password source overrides the password in the DSN.
+ *
+ * Sources are trusted only in DSNs from local config, i.e. written by the
+ * installer or the admin: DSNs from the API are checked with CheckRemoteDSN,
+ * else the API could make the agent read any file or run any program.  The
+ * files and helpers must also be in CredentialDirs and pass pct.CheckOwnerFile.
+ */
+
+const (
+	DSN_DEFAULTS_FILE     = "defaultsFile"
+	DSN_PASSWORD_FILE     = "passwordFile"
+	DSN_PASSWORD_EXEC     = "passwordExec"
+	PASSWORD_EXEC_TIMEOUT = 10 * time.Second
+)
+
+// Directories which credential source files and helpers must be in.
+var CredentialDirs = []string{"/etc/percona-agent", "/etc/mysql"}
+
+// CheckRemoteDSN returns an error if the DSN has credential sources, which
+// are not allowed in DSNs from the API.
+func CheckRemoteDSN(dsn string) error {
+	_, params := splitDSNParams(dsn)
+	for _, param := range strings.Split(params, "&") {
+		key := strings.SplitN(param, "=", 2)[0]
+		switch key {
+		case DSN_DEFAULTS_FILE, DSN_PASSWORD_FILE, DSN_PASSWORD_EXEC:
+			return fmt.Errorf("MySQL DSN param %s is allowed only in local instance config", key)
+		}
+	}
+	return nil
+}
+
+// ResolveDSN returns the DSN with the user and password from its credential
+// sources and with its TLS config registered (see tls.go), and without the
+// agent-only params, which the driver does not know.  A DSN without agent-only
+// params is returned as-is.
+func ResolveDSN(dsn string) (string, error) {
+	base, params := splitDSNParams(dsn)
+	if params == "" {
+		return dsn, nil
+	}
+
+	var user, pass string
+	var haveUser, havePass, haveAgentParam bool
+	keep := []string{}
+	ssl := make(map[string]string)
+	for _, param := range strings.Split(params, "&") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			keep = append(keep, param)
+			continue
+		}
+		switch kv[0] {
+		case DSN_DEFAULTS_FILE, DSN_PASSWORD_FILE, DSN_PASSWORD_EXEC:
+		case DSN_MAX_OPEN_CONNS, DSN_MAX_IDLE_CONNS, DSN_QUERY_TIMEOUT:
+			haveAgentParam = true // see NewConnection
+			continue
+		case DSN_SSL_MODE, DSN_SSL_CA, DSN_SSL_CERT, DSN_SSL_KEY:
+			value, err := url.QueryUnescape(kv[1])
+			if err != nil {
+				return "", fmt.Errorf("Invalid %s: %s", kv[0], err)
+			}
+			ssl[kv[0]] = value
+			continue
+		default:
+			keep = append(keep, param)
+			continue
+		}
+		haveAgentParam = true
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return "", fmt.Errorf("Invalid %s: %s", kv[0], err)
+		}
+		what := map[string]string{
+			DSN_DEFAULTS_FILE: "MySQL defaults",
+			DSN_PASSWORD_FILE: "MySQL password",
+			DSN_PASSWORD_EXEC: "MySQL password helper",
+		}[kv[0]]
+		if value, err = checkCredentialSource(value, what); err != nil {
+			return "", err
+		}
+		switch kv[0] {
+		case DSN_DEFAULTS_FILE:
+			u, p, err := ReadDefaultsFile(value)
+			if err != nil {
+				return "", err
+			}
+			if u != "" && !haveUser {
+				user, haveUser = u, true
+			}
+			if p != "" && !havePass {
+				pass, havePass = p, true
+			}
+		case DSN_PASSWORD_FILE:
+			data, err := ioutil.ReadFile(value)
+			if err != nil {
+				return "", fmt.Errorf("Cannot read MySQL password file: %s", err)
+			}
+			pass, havePass = strings.TrimRight(string(data), "\r\n"), true
+		case DSN_PASSWORD_EXEC:
+			p, err := execPassword(value)
+			if err != nil {
+				return "", err
+			}
+			pass, havePass = p, true
+		}
+	}
+	if !haveAgentParam && len(ssl) == 0 {
+		return dsn, nil
+	}
+
+	// [user[:password]@]rest
+	dsnUser, dsnPass, rest := "", "", base
+	if at := strings.LastIndex(base, "@"); at >= 0 {
+		userinfo := base[0:at]
+		rest = base[at+1:]
+		if colon := strings.Index(userinfo, ":"); colon >= 0 {
+			dsnUser, dsnPass = userinfo[0:colon], userinfo[colon+1:]
+		} else {
+			dsnUser = userinfo
+		}
+	}
+	if dsnUser != "" || !haveUser {
+		user = dsnUser
+	}
+	if !havePass {
+		pass = dsnPass
+	}
+
+	resolved := user
+	if pass != "" {
+		resolved += ":" + pass
+	}
+	if resolved != "" {
+		resolved += "@"
+	}
+	resolved += rest
+	if len(ssl) > 0 {
+		name, err := registerTLSConfig(ssl, dsnHost(rest))
+		if err != nil {
+			return "", err
+		}
+		keep = append(keep, "tls="+name)
+	}
+	if len(keep) > 0 {
+		resolved += "?" + strings.Join(keep, "&")
+	}
+	return resolved, nil
+}
+
+// ReadDefaultsFile returns the user and password in the [client] section of
+// a MySQL defaults file (my.cnf).
+func ReadDefaultsFile(file string) (user, pass string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot read MySQL defaults file: %s", err)
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != "client" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.Replace(strings.TrimSpace(kv[0]), "_", "-", -1)
+		value := unquote(strings.TrimSpace(kv[1]))
+		switch key {
+		case "user":
+			user = value
+		case "password":
+			pass = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("Cannot read MySQL defaults file: %s", err)
+	}
+	return user, pass, nil
+}
+
+// --------------------------------------------------------------------------
+
+// splitDSNParams splits the DSN at the "?" which starts its params.  The
+// params cannot start before the address, so "?" in a password is ignored.
+func splitDSNParams(dsn string) (base, params string) {
+	start := 0
+	if i := strings.LastIndex(dsn, ")/"); i >= 0 {
+		start = i
+	}
+	if i := strings.Index(dsn[start:], "?"); i >= 0 {
+		return dsn[0 : start+i], dsn[start+i+1:]
+	}
+	return dsn, ""
+}
+
+// checkCredentialSource returns the real path of the credential source file or
+// helper if it's in CredentialDirs and only root or the agent user can change it.
+func checkCredentialSource(file, what string) (string, error) {
+	if !filepath.IsAbs(file) {
+		return "", fmt.Errorf("%s file %s must be an absolute path", what, file)
+	}
+	realFile, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read %s file: %s", what, err)
+	}
+	for _, dir := range CredentialDirs {
+		if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = realDir
+		}
+		if strings.HasPrefix(realFile, filepath.Clean(dir)+string(filepath.Separator)) {
+			if err := pct.CheckOwnerFile(realFile, what); err != nil {
+				return "", err
+			}
+			return realFile, nil
+		}
+	}
+	return "", fmt.Errorf("%s file %s must be in %s", what, file, strings.Join(CredentialDirs, " or "))
+}
+
+func execPassword(helper string) (string, error) {
+	cmd := exec.Command(helper)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("Cannot run MySQL password helper %s: %s", helper, err)
+	}
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- cmd.Wait()
+	}()
+	select {
+	case err := <-doneChan:
+		if err != nil {
+			return "", fmt.Errorf("MySQL password helper %s failed: %s: %s", helper, err, strings.TrimSpace(stderr.String()))
+		}
+	case <-time.After(PASSWORD_EXEC_TIMEOUT):
+		cmd.Process.Kill()
+		return "", fmt.Errorf("MySQL password helper %s timed out after %s", helper, PASSWORD_EXEC_TIMEOUT)
+	}
+	pass := strings.TrimRight(stdout.String(), "\r\n")
+	if pass == "" {
+		return "", fmt.Errorf("MySQL password helper %s printed no password", helper)
+	}
+	return pass, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
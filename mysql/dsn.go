@@ -20,10 +20,12 @@ package mysql
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os/exec"
 	"os/user"
 	"path"
 	"strings"
+	"time"
 )
 
 type DSN struct {
@@ -34,6 +36,20 @@ type DSN struct {
 	Socket       string
 	OldPasswords bool
 	Protocol     string
+	// Credential sources, see ResolveDSN:
+	DefaultsFile string
+	PasswordFile string
+	PasswordExec string
+	// TLS, see ResolveDSN:
+	SSLMode string // DISABLED, REQUIRED, VERIFY_CA, VERIFY_IDENTITY
+	SSLCA   string // PEM CA file, implies VERIFY_CA if no SSLMode
+	SSLCert string // PEM client cert file
+	SSLKey  string // PEM client key file
+	// Send password in cleartext, for PAM or LDAP auth; requires TLS or socket.
+	AllowCleartextPasswords bool
+	// Connection pool and timeout, see NewConnection; zero for defaults:
+	MaxOpenConns int64
+	QueryTimeout time.Duration
 }
 
 const (
@@ -43,8 +59,14 @@ const (
 )
 
 var ErrNoSocket error = errors.New("Cannot find MySQL socket (localhost implies socket).  Specify socket or use 127.0.0.1 instead of localhost.")
+var ErrCleartextNoTLS error = errors.New("Cleartext passwords require TLS (SSL mode other than DISABLED) or a socket")
 
 func (dsn DSN) DSN() (string, error) {
+	sslMode, err := dsn.sslMode()
+	if err != nil {
+		return "", err
+	}
+
 	// Make Sprintf format easier; password doesn't really start with ":".
 	if dsn.Password != "" {
 		dsn.Password = ":" + dsn.Password
@@ -97,10 +119,44 @@ func (dsn DSN) DSN() (string, error) {
 		}
 		dsnString = fmt.Sprintf("%s@", user.Username)
 	}
+	if dsn.AllowCleartextPasswords && dsn.Socket == "" && (sslMode == "" || sslMode == SSL_MODE_DISABLED) {
+		return "", ErrCleartextNoTLS
+	}
+
 	dsnString = dsnString + dsnSuffix
 	if dsn.OldPasswords {
 		dsnString = dsnString + allowOldPasswords
 	}
+	if dsn.DefaultsFile != "" {
+		dsnString = dsnString + "&" + DSN_DEFAULTS_FILE + "=" + url.QueryEscape(dsn.DefaultsFile)
+	}
+	if dsn.PasswordFile != "" {
+		dsnString = dsnString + "&" + DSN_PASSWORD_FILE + "=" + url.QueryEscape(dsn.PasswordFile)
+	}
+	if dsn.PasswordExec != "" {
+		dsnString = dsnString + "&" + DSN_PASSWORD_EXEC + "=" + url.QueryEscape(dsn.PasswordExec)
+	}
+	if sslMode != "" && sslMode != SSL_MODE_DISABLED {
+		dsnString = dsnString + "&" + DSN_SSL_MODE + "=" + sslMode
+		if dsn.SSLCA != "" {
+			dsnString = dsnString + "&" + DSN_SSL_CA + "=" + url.QueryEscape(dsn.SSLCA)
+		}
+		if dsn.SSLCert != "" {
+			dsnString = dsnString + "&" + DSN_SSL_CERT + "=" + url.QueryEscape(dsn.SSLCert)
+		}
+		if dsn.SSLKey != "" {
+			dsnString = dsnString + "&" + DSN_SSL_KEY + "=" + url.QueryEscape(dsn.SSLKey)
+		}
+	}
+	if dsn.AllowCleartextPasswords {
+		dsnString = dsnString + "&allowCleartextPasswords=true"
+	}
+	if dsn.MaxOpenConns > 0 {
+		dsnString = dsnString + fmt.Sprintf("&%s=%d", DSN_MAX_OPEN_CONNS, dsn.MaxOpenConns)
+	}
+	if dsn.QueryTimeout > 0 {
+		dsnString = dsnString + "&" + DSN_QUERY_TIMEOUT + "=" + dsn.QueryTimeout.String()
+	}
 	return dsnString, nil
 }
 
@@ -121,6 +177,13 @@ func (dsn DSN) String() string {
 		dsn.Username = "<anonymous-user>"
 	}
 	dsn.Password = HiddenPassword
+	dsn.DefaultsFile = ""
+	dsn.PasswordFile = ""
+	dsn.PasswordExec = ""
+	dsn.SSLMode = SSL_MODE_DISABLED
+	dsn.AllowCleartextPasswords = false
+	dsn.MaxOpenConns = 0
+	dsn.QueryTimeout = 0
 	dsnString, _ := dsn.DSN()
 	dsnString = strings.TrimSuffix(dsnString, allowOldPasswords)
 	dsnString = strings.TrimSuffix(dsnString, dsnSuffix)
@@ -136,6 +199,31 @@ func (dsn DSN) StringWithSuffixes() string {
 	return dsnString
 }
 
+// UsesTLS returns true if connections with the DSN are encrypted.
+func (dsn DSN) UsesTLS() bool {
+	mode, err := dsn.sslMode()
+	return err == nil && mode != "" && mode != SSL_MODE_DISABLED
+}
+
+func (dsn DSN) sslMode() (string, error) {
+	mode := strings.ToUpper(dsn.SSLMode)
+	switch mode {
+	case "":
+		if dsn.SSLCA != "" {
+			mode = SSL_MODE_VERIFY_CA
+		} else if dsn.SSLCert != "" || dsn.SSLKey != "" {
+			mode = SSL_MODE_REQUIRED
+		}
+	case SSL_MODE_DISABLED, SSL_MODE_REQUIRED, SSL_MODE_VERIFY_CA, SSL_MODE_VERIFY_IDENTITY:
+	default:
+		return "", fmt.Errorf("Invalid SSL mode: %s: expected DISABLED, REQUIRED, VERIFY_CA, or VERIFY_IDENTITY", dsn.SSLMode)
+	}
+	if (dsn.SSLCert == "") != (dsn.SSLKey == "") {
+		return "", errors.New("SSL cert and key must both be set")
+	}
+	return mode, nil
+}
+
 func ParseSocketFromNetstat(out string) string {
 	lines := strings.Split(out, "\n")
 	for _, line := range lines {
@@ -23,6 +23,10 @@ import (
 	"github.com/percona/percona-agent/test"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type DSNTestSuite struct {
@@ -81,3 +85,193 @@ func (s *DSNTestSuite) TestHideDSNPassword(t *C) {
 	dsn = ""
 	t.Check(mysql.HideDSNPassword(dsn), Equals, ":"+mysql.HiddenPassword+"@")
 }
+
+func (s *DSNTestSuite) TestCredentialSources(t *C) {
+	tmpDir, err := ioutil.TempDir("/tmp", "percona-agent-test-mysql-dsn")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(tmpDir)
+	defer func(dirs []string) { mysql.CredentialDirs = dirs }(mysql.CredentialDirs)
+	mysql.CredentialDirs = []string{tmpDir}
+
+	passFile := filepath.Join(tmpDir, "pass")
+	t.Assert(ioutil.WriteFile(passFile, []byte("filepass\n"), 0600), IsNil)
+	myCnf := filepath.Join(tmpDir, "my.cnf")
+	t.Assert(ioutil.WriteFile(myCnf, []byte("[mysqld]\nuser=mysql\n\n[client]\nuser = cnfuser\npassword = \"cnf pass\"\n"), 0600), IsNil)
+	helper := filepath.Join(tmpDir, "helper")
+	t.Assert(ioutil.WriteFile(helper, []byte("#!/bin/sh\necho execpass\n"), 0700), IsNil)
+
+	// DSN without sources is not changed.
+	dsn := "user:pass@tcp(host.example.com:3306)/?parseTime=true"
+	got, err := mysql.ResolveDSN(dsn)
+	t.Check(err, IsNil)
+	t.Check(got, Equals, dsn)
+
+	dsn, err = mysql.DSN{Username: "user", Hostname: "host.example.com", PasswordFile: passFile}.DSN()
+	t.Assert(err, IsNil)
+	got, err = mysql.ResolveDSN(dsn)
+	t.Check(err, IsNil)
+	t.Check(got, Equals, "user:filepass@tcp(host.example.com:3306)/?parseTime=true")
+
+	// Password is read again on every resolve, e.g. after rotation.
+	t.Assert(ioutil.WriteFile(passFile, []byte("newpass"), 0600), IsNil)
+	got, err = mysql.ResolveDSN(dsn)
+	t.Check(err, IsNil)
+	t.Check(got, Equals, "user:newpass@tcp(host.example.com:3306)/?parseTime=true")
+
+	// Defaults file user and password, but DSN user wins.
+	dsn, err = mysql.DSN{Hostname: "host.example.com", DefaultsFile: myCnf, OldPasswords: true}.DSN()
+	t.Assert(err, IsNil)
+	got, err = mysql.ResolveDSN(dsn)
+	t.Check(err, IsNil)
+	t.Check(got, Equals, "cnfuser:cnf pass@tcp(host.example.com:3306)/?parseTime=true&allowOldPasswords=true")
+	dsn, err = mysql.DSN{Username: "user", Hostname: "host.example.com", DefaultsFile: myCnf}.DSN()
+	t.Assert(err, IsNil)
+	got, err = mysql.ResolveDSN(dsn)
+	t.Check(err, IsNil)
+	t.Check(got, Equals, "user:cnf pass@tcp(host.example.com:3306)/?parseTime=true")
+
+	dsn, err = mysql.DSN{Username: "user", Socket: "/tmp/mysql.sock", PasswordExec: helper}.DSN()
+	t.Assert(err, IsNil)
+	got, err = mysql.ResolveDSN(dsn)
+	t.Check(err, IsNil)
+	t.Check(got, Equals, "user:execpass@unix(/tmp/mysql.sock)/?parseTime=true")
+
+	// Sources are not shown.
+	t.Check(fmt.Sprintf("%s", mysql.DSN{Username: "user", Socket: "/tmp/mysql.sock", PasswordExec: helper}), Equals, "user:<password-hidden>@unix(/tmp/mysql.sock)")
+
+	_, err = mysql.ResolveDSN("user@tcp(host.example.com:3306)/?parseTime=true&passwordFile=%2Fdoes%2Fnot%2Fexist")
+	t.Check(err, NotNil)
+
+	// Sources must be in CredentialDirs...
+	_, err = mysql.ResolveDSN("user@tcp(host.example.com:3306)/?parseTime=true&passwordFile=%2Fetc%2Fpasswd")
+	t.Check(err, ErrorMatches, ".+ must be in .+")
+	_, err = mysql.ResolveDSN("user@tcp(host.example.com:3306)/?parseTime=true&passwordExec=%2Fbin%2Ftrue")
+	t.Check(err, ErrorMatches, ".+ must be in .+")
+	link := filepath.Join(tmpDir, "link")
+	t.Assert(os.Symlink("/etc/passwd", link), IsNil)
+	dsn, err = mysql.DSN{Username: "user", Hostname: "host.example.com", PasswordFile: link}.DSN()
+	t.Assert(err, IsNil)
+	_, err = mysql.ResolveDSN(dsn)
+	t.Check(err, ErrorMatches, ".+ must be in .+")
+
+	// ...and writable only by their owner.
+	t.Assert(os.Chmod(passFile, 0622), IsNil)
+	dsn, err = mysql.DSN{Username: "user", Hostname: "host.example.com", PasswordFile: passFile}.DSN()
+	t.Assert(err, IsNil)
+	_, err = mysql.ResolveDSN(dsn)
+	t.Check(err, ErrorMatches, ".+ must be writable only by its owner.+")
+
+	// DSNs from the API cannot have sources.
+	t.Check(mysql.CheckRemoteDSN(dsn), NotNil)
+	t.Check(mysql.CheckRemoteDSN("user:pass@tcp(host.example.com:3306)/?parseTime=true"), IsNil)
+}
+
+func (s *DSNTestSuite) TestTLS(t *C) {
+	dsn := mysql.DSN{
+		Username: "user",
+		Password: "pass",
+		Hostname: "host.example.com",
+		Port:     "3306",
+		SSLMode:  "required",
+	}
+	t.Check(dsn.UsesTLS(), Equals, true)
+	str, err := dsn.DSN()
+	t.Check(err, IsNil)
+	t.Check(str, Equals, "user:pass@tcp(host.example.com:3306)/?parseTime=true&sslMode=REQUIRED")
+	t.Check(fmt.Sprintf("%s", dsn), Equals, "user:<password-hidden>@tcp(host.example.com:3306)")
+
+	// Driver gets a registered TLS config instead of the SSL params.
+	str, err = mysql.ResolveDSN(str)
+	t.Check(err, IsNil)
+	t.Check(str, Matches, `user:pass@tcp\(host.example.com:3306\)/\?parseTime=true&tls=pct-[0-9a-f]+`)
+
+	// CA implies VERIFY_CA.
+	dsn.SSLMode = ""
+	dsn.SSLCA = "/etc/mysql/ca.pem"
+	str, err = dsn.DSN()
+	t.Check(err, IsNil)
+	t.Check(str, Equals, "user:pass@tcp(host.example.com:3306)/?parseTime=true&sslMode=VERIFY_CA&sslCa=%2Fetc%2Fmysql%2Fca.pem")
+	_, err = mysql.ResolveDSN(str)
+	t.Check(err, NotNil) // no such CA file
+
+	dsn.SSLMode = "bogus"
+	_, err = dsn.DSN()
+	t.Check(err, NotNil)
+	t.Check(dsn.UsesTLS(), Equals, false)
+
+	// Cleartext passwords only with TLS.
+	dsn = mysql.DSN{
+		Username:                "ldap-user",
+		Password:                "pass",
+		Hostname:                "host.example.com",
+		Port:                    "3306",
+		AllowCleartextPasswords: true,
+	}
+	_, err = dsn.DSN()
+	t.Check(err, Equals, mysql.ErrCleartextNoTLS)
+	dsn.SSLMode = mysql.SSL_MODE_VERIFY_IDENTITY
+	str, err = dsn.DSN()
+	t.Check(err, IsNil)
+	t.Check(str, Equals, "ldap-user:pass@tcp(host.example.com:3306)/?parseTime=true&sslMode=VERIFY_IDENTITY&allowCleartextPasswords=true")
+
+	// VERIFY_IDENTITY: every host has its own config, with its ServerName,
+	// which is registered once.
+	names := []string{}
+	for _, host := range []string{"db1.example.com", "db2.example.com", "db1.example.com"} {
+		dsn = mysql.DSN{Username: "user", Hostname: host, Port: "3306", SSLMode: mysql.SSL_MODE_VERIFY_IDENTITY, SSLCA: test.RootDir + "/keys/cert.pem"}
+		str, err = dsn.DSN()
+		t.Assert(err, IsNil)
+		str, err = mysql.ResolveDSN(str)
+		t.Assert(err, IsNil)
+		name := str[strings.Index(str, "tls=")+4:]
+		config := mysql.RegisteredTLSConfig(name)
+		t.Assert(config, NotNil)
+		t.Check(config.ServerName, Equals, host)
+		names = append(names, name)
+	}
+	t.Check(names[0], Not(Equals), names[1])
+	t.Check(names[0], Equals, names[2])
+	t.Check(mysql.RegisteredTLSConfig(names[0]), Equals, mysql.RegisteredTLSConfig(names[2]))
+}
+
+func (s *DSNTestSuite) TestPoolParams(t *C) {
+	// Defaults.
+	conn := mysql.NewConnection("user:pass@tcp(host.example.com:3306)/?parseTime=true")
+	stats := conn.Stats()
+	t.Check(stats.MaxOpenConns, Equals, mysql.DEFAULT_MAX_OPEN_CONNS)
+	t.Check(stats.MaxIdleConns, Equals, mysql.DEFAULT_MAX_IDLE_CONNS)
+	t.Check(stats.QueryTimeout, Equals, mysql.DEFAULT_QUERY_TIMEOUT)
+
+	dsn := mysql.DSN{
+		Username:     "user",
+		Password:     "pass",
+		Hostname:     "host.example.com",
+		Port:         "3306",
+		MaxOpenConns: 3,
+		QueryTimeout: 50 * time.Millisecond,
+	}
+	str, err := dsn.DSN()
+	t.Assert(err, IsNil)
+	t.Check(str, Equals, "user:pass@tcp(host.example.com:3306)/?parseTime=true&maxOpenConns=3&queryTimeout=50ms")
+	t.Check(fmt.Sprintf("%s", dsn), Equals, "user:<password-hidden>@tcp(host.example.com:3306)")
+
+	// Driver doesn't get the agent-only params.
+	resolved, err := mysql.ResolveDSN(str)
+	t.Check(err, IsNil)
+	t.Check(resolved, Equals, "user:pass@tcp(host.example.com:3306)/?parseTime=true")
+
+	conn = mysql.NewConnection(str)
+	stats = conn.Stats()
+	t.Check(stats.MaxOpenConns, Equals, 3)
+	t.Check(stats.MaxIdleConns, Equals, mysql.DEFAULT_MAX_IDLE_CONNS)
+	t.Check(stats.QueryTimeout, Equals, 50*time.Millisecond)
+
+	// Timed out contexts are counted.
+	ctx, cancel := conn.Context()
+	<-ctx.Done()
+	cancel()
+	ctx, cancel = conn.Context()
+	cancel()
+	t.Check(conn.Stats().Timeouts, Equals, uint64(1))
+	t.Check(conn.Stats().String(), Equals, "0/3 open (max idle 2), query timeout 50ms, 1 timeouts")
+}
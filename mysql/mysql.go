@@ -18,10 +18,16 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -29,6 +35,48 @@ import (
 	"github.com/percona/percona-agent/pct"
 )
 
+/**
+ * Connections with the same DSN, i.e. to the same instance, share one pool, so
+ * the pool limit is per instance, however many services use it.  The pool
+ * limit and the query timeout are so a hung or overloaded MySQL cannot block
+ * the agent or use too many connections.  Connecting times out after
+ * CONNECT_TIMEOUT.  The defaults can be changed per instance with agent-only
+ * DSN params:
+ *   maxOpenConns=N     max connections, e.g. the agent user's MAX_USER_CONNECTIONS
+ *   maxIdleConns=N     max idle connections kept open
+ *   queryTimeout=D     Go duration, e.g. 10s; 0 disables query timeouts
+ * The query timeout is enforced in the agent with Context, and by MySQL with
+ * the session lock_wait_timeout and, if the server has it, max_execution_time.
+ */
+
+const (
+	DEFAULT_MAX_OPEN_CONNS = 5 // same as installer -mysql-max-user-connections
+	DEFAULT_MAX_IDLE_CONNS = 2
+	DEFAULT_QUERY_TIMEOUT  = 10 * time.Second
+	CONNECT_TIMEOUT        = 10 * time.Second
+)
+
+const (
+	DSN_MAX_OPEN_CONNS = "maxOpenConns"
+	DSN_MAX_IDLE_CONNS = "maxIdleConns"
+	DSN_QUERY_TIMEOUT  = "queryTimeout"
+)
+
+// Pool limits and query timeout of a Connection, and its current usage.
+// OpenConns is for the pool, which is shared by Connections with the same DSN.
+type ConnectionStats struct {
+	MaxOpenConns int
+	MaxIdleConns int
+	QueryTimeout time.Duration
+	OpenConns    int
+	Timeouts     uint64 // queries which timed out
+}
+
+func (s ConnectionStats) String() string {
+	return fmt.Sprintf("%d/%d open (max idle %d), query timeout %s, %d timeouts",
+		s.OpenConns, s.MaxOpenConns, s.MaxIdleConns, s.QueryTimeout, s.Timeouts)
+}
+
 type Query struct {
 	Set    string // SET GLOBAL long_query_time=0
 	Verify string // SELECT @@long_query_time
@@ -45,6 +93,10 @@ type Connector interface {
 	GetGlobalVarString(varName string) string
 	GetGlobalVarNumber(varName string) float64
 	Uptime() (uptime int64, err error)
+	// Context returns a context with the query timeout for a Query, Exec, etc.
+	// The caller must call the cancel func when the query is done.
+	Context() (context.Context, context.CancelFunc)
+	Stats() ConnectionStats
 }
 
 type Connection struct {
@@ -53,13 +105,46 @@ type Connection struct {
 	backoff         *pct.Backoff
 	connectedAmount uint
 	connectionMux   *sync.Mutex
+	// --
+	maxOpenConns int
+	maxIdleConns int
+	queryTimeout time.Duration
+	timeouts     uint64 // atomic
 }
 
+// A pool is the *sql.DB shared by Connections with the same DSN.
+type pool struct {
+	db   *sql.DB
+	refs uint
+}
+
+var (
+	pools    = make(map[string]*pool) // keyed on DSN
+	poolsMux = &sync.Mutex{}
+)
+
 func NewConnection(dsn string) *Connection {
 	c := &Connection{
 		dsn:           dsn,
 		backoff:       pct.NewBackoff(20 * time.Second),
 		connectionMux: new(sync.Mutex),
+		// --
+		maxOpenConns: DEFAULT_MAX_OPEN_CONNS,
+		maxIdleConns: DEFAULT_MAX_IDLE_CONNS,
+		queryTimeout: DEFAULT_QUERY_TIMEOUT,
+	}
+	params := dsnParams(dsn)
+	if n, err := strconv.Atoi(params.Get(DSN_MAX_OPEN_CONNS)); err == nil && n > 0 {
+		c.maxOpenConns = n
+	}
+	if n, err := strconv.Atoi(params.Get(DSN_MAX_IDLE_CONNS)); err == nil && n >= 0 {
+		c.maxIdleConns = n
+	}
+	if c.maxIdleConns > c.maxOpenConns {
+		c.maxIdleConns = c.maxOpenConns
+	}
+	if d, err := time.ParseDuration(params.Get(DSN_QUERY_TIMEOUT)); err == nil && d >= 0 {
+		c.queryTimeout = d
 	}
 	return c
 }
@@ -89,16 +174,7 @@ func (c *Connection) Connect(tries uint) error {
 		// Wait before attempt.
 		time.Sleep(c.backoff.Wait())
 
-		// Open connection to MySQL but...
-		db, err = sql.Open("mysql", c.dsn)
-		if err != nil {
-			continue
-		}
-
-		// ...try to use the connection for real.
-		if err = db.Ping(); err != nil {
-			// Connection failed.  Wrong username or password?
-			db.Close()
+		if db, err = c.openPool(); err != nil {
 			continue
 		}
 
@@ -112,6 +188,34 @@ func (c *Connection) Connect(tries uint) error {
 	return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSNPassword(c.dsn), FormatError(err))
 }
 
+func (c *Connection) Context() (context.Context, context.CancelFunc) {
+	if c.queryTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.queryTimeout)
+	return ctx, func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&c.timeouts, 1)
+		}
+		cancel()
+	}
+}
+
+func (c *Connection) Stats() ConnectionStats {
+	stats := ConnectionStats{
+		MaxOpenConns: c.maxOpenConns,
+		MaxIdleConns: c.maxIdleConns,
+		QueryTimeout: c.queryTimeout,
+		Timeouts:     atomic.LoadUint64(&c.timeouts),
+	}
+	c.connectionMux.Lock()
+	if c.conn != nil {
+		stats.OpenConns = c.conn.Stats().OpenConnections
+	}
+	c.connectionMux.Unlock()
+	return stats
+}
+
 func (c *Connection) Close() {
 	c.connectionMux.Lock()
 	defer c.connectionMux.Unlock()
@@ -121,33 +225,36 @@ func (c *Connection) Close() {
 	}
 	c.connectedAmount--
 	if c.connectedAmount == 0 && c.conn != nil {
-		c.conn.Close()
+		c.closePool()
 		c.conn = nil
 	}
 }
 
 func (c *Connection) Explain(query string, db string) (explain *proto.ExplainResult, err error) {
+	ctx, cancel := c.Context()
+	defer cancel()
+
 	// Transaction because we need to ensure USE and EXPLAIN are run in one connection
-	tx, err := c.conn.Begin()
-	defer tx.Rollback()
+	tx, err := c.conn.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
 	// Some queries are not bound to database
 	if db != "" {
-		_, err := tx.Exec(fmt.Sprintf("USE %s", db))
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("USE %s", db))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	classicExplain, err := c.classicExplain(tx, query)
+	classicExplain, err := c.classicExplain(ctx, tx, query)
 	if err != nil {
 		return nil, err
 	}
 
-	jsonExplain, err := c.jsonExplain(tx, query)
+	jsonExplain, err := c.jsonExplain(ctx, tx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +273,10 @@ func (c *Connection) Set(queries []Query) error {
 	}
 	for _, query := range queries {
 		if query.Set != "" {
-			if _, err := c.conn.Exec(query.Set); err != nil {
+			ctx, cancel := c.Context()
+			_, err := c.conn.ExecContext(ctx, query.Set)
+			cancel()
+			if err != nil {
 				return err
 			}
 		}
@@ -188,8 +298,10 @@ func (c *Connection) GetGlobalVarString(varName string) string {
 	if c.conn == nil {
 		return ""
 	}
+	ctx, cancel := c.Context()
+	defer cancel()
 	var varValue string
-	c.conn.QueryRow("SELECT @@GLOBAL." + varName).Scan(&varValue)
+	c.conn.QueryRowContext(ctx, "SELECT @@GLOBAL."+varName).Scan(&varValue)
 	return varValue
 }
 
@@ -197,8 +309,10 @@ func (c *Connection) GetGlobalVarNumber(varName string) float64 {
 	if c.conn == nil {
 		return 0
 	}
+	ctx, cancel := c.Context()
+	defer cancel()
 	var varValue float64
-	c.conn.QueryRow("SELECT @@GLOBAL." + varName).Scan(&varValue)
+	c.conn.QueryRowContext(ctx, "SELECT @@GLOBAL."+varName).Scan(&varValue)
 	return varValue
 }
 
@@ -208,16 +322,18 @@ func (c *Connection) Uptime() (uptime int64, err error) {
 	}
 	// Result from SHOW STATUS includes two columns,
 	// Variable_name and Value, we ignore the first one as we need only Value
+	ctx, cancel := c.Context()
+	defer cancel()
 	var varName string
-	c.conn.QueryRow("SHOW STATUS LIKE 'Uptime'").Scan(&varName, &uptime)
+	c.conn.QueryRowContext(ctx, "SHOW STATUS LIKE 'Uptime'").Scan(&varName, &uptime)
 	return uptime, nil
 }
 
-func (c *Connection) classicExplain(tx *sql.Tx, query string) (classicExplain []*proto.ExplainRow, err error) {
+func (c *Connection) classicExplain(ctx context.Context, tx *sql.Tx, query string) (classicExplain []*proto.ExplainRow, err error) {
 	// Partitions are introduced since MySQL 5.1
 	// We can simply run EXPLAIN /*!50100 PARTITIONS*/ to get this column when it's available
 	// without prior check for MySQL version.
-	rows, err := tx.Query(fmt.Sprintf("EXPLAIN /*!50100 PARTITIONS*/ %s", query))
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("EXPLAIN /*!50100 PARTITIONS*/ %s", query))
 	if err != nil {
 		return nil, err
 	}
@@ -276,9 +392,9 @@ func (c *Connection) classicExplain(tx *sql.Tx, query string) (classicExplain []
 	return classicExplain, nil
 }
 
-func (c *Connection) jsonExplain(tx *sql.Tx, query string) (jsonExplain string, err error) {
+func (c *Connection) jsonExplain(ctx context.Context, tx *sql.Tx, query string) (jsonExplain string, err error) {
 	// EXPLAIN in JSON format is introduced since MySQL 5.6.5
-	err = tx.QueryRow(fmt.Sprintf("/*!50605 EXPLAIN FORMAT=JSON %s*/", query)).Scan(&jsonExplain)
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("/*!50605 EXPLAIN FORMAT=JSON %s*/", query)).Scan(&jsonExplain)
 	switch err {
 	case nil:
 		return jsonExplain, nil // json format supported
@@ -288,3 +404,145 @@ func (c *Connection) jsonExplain(tx *sql.Tx, query string) (jsonExplain string,
 
 	return "", err // failure
 }
+
+// openPool returns the pool for the DSN, opening it if this is its first
+// Connection.  Either way, MySQL is pinged, so errors like a wrong password or
+// a down server are returned.
+func (c *Connection) openPool() (*sql.DB, error) {
+	poolsMux.Lock()
+	p := pools[c.dsn]
+	poolsMux.Unlock()
+	if p != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+		err := p.db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		poolsMux.Lock()
+		defer poolsMux.Unlock()
+		if pools[c.dsn] != p {
+			return nil, errors.New("MySQL connection pool closed while connecting")
+		}
+		p.refs++
+		return p.db, nil
+	}
+
+	db, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	if p := pools[c.dsn]; p != nil {
+		// Another Connection opened the pool first.
+		db.Close()
+		p.refs++
+		return p.db, nil
+	}
+	pools[c.dsn] = &pool{db: db, refs: 1}
+	return db, nil
+}
+
+func (c *Connection) closePool() {
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	p := pools[c.dsn]
+	if p == nil || p.db != c.conn {
+		c.conn.Close() // not shared
+		return
+	}
+	p.refs--
+	if p.refs == 0 {
+		delete(pools, c.dsn)
+		p.db.Close()
+	}
+}
+
+// open opens a new pool for the DSN, with the current credentials from their
+// sources, if any, and with lock_wait_timeout and, if the server has it (MySQL
+// 5.7.8+), max_execution_time set to the query timeout.  The driver sets these
+// on every new connection in the pool.  MySQL is pinged first with driver I/O
+// timeouts, and the ping is abandoned after CONNECT_TIMEOUT: the driver doesn't
+// use a context's deadline for the handshake, and database/sql retries it, so a
+// server which accepts connections but never answers would block Connect.
+func (c *Connection) open() (*sql.DB, error) {
+	dsn, err := ResolveDSN(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	params := dsnParams(dsn)
+	timeouts := []string{}
+	for _, param := range []string{"timeout", "readTimeout", "writeTimeout"} {
+		if params.Get(param) == "" {
+			timeouts = append(timeouts, param+"="+CONNECT_TIMEOUT.String())
+		}
+	}
+	probe, err := sql.Open("mysql", addDSNParams(dsn, strings.Join(timeouts, "&")))
+	if err != nil {
+		return nil, err
+	}
+	pingChan := make(chan error, 1)
+	go func() {
+		pingChan <- probe.Ping()
+	}()
+	select {
+	case err := <-pingChan:
+		if err != nil {
+			// Connection failed.  Wrong username or password?
+			probe.Close()
+			return nil, err
+		}
+	case <-time.After(CONNECT_TIMEOUT):
+		go func() {
+			<-pingChan // driver I/O timeouts end it
+			probe.Close()
+		}()
+		return nil, fmt.Errorf("timeout after %s", CONNECT_TIMEOUT)
+	}
+	defer probe.Close()
+
+	vars := []string{}
+	if params.Get("timeout") == "" {
+		vars = append(vars, "timeout="+CONNECT_TIMEOUT.String()) // dial only
+	}
+	if c.queryTimeout > 0 {
+		if params.Get("readTimeout") == "" {
+			// Backstop for new connections in the pool, e.g. for Ping.
+			vars = append(vars, "readTimeout="+(c.queryTimeout+CONNECT_TIMEOUT).String())
+		}
+		lockWait := int64(math.Ceil(c.queryTimeout.Seconds()))
+		vars = append(vars, fmt.Sprintf("lock_wait_timeout=%d", lockWait))
+		var maxExecTime string
+		if err := probe.QueryRow("SELECT @@max_execution_time").Scan(&maxExecTime); err == nil {
+			vars = append(vars, fmt.Sprintf("max_execution_time=%d", int64(c.queryTimeout/time.Millisecond)))
+		}
+	}
+	if len(vars) > 0 {
+		dsn = addDSNParams(dsn, strings.Join(vars, "&"))
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(c.maxOpenConns)
+	db.SetMaxIdleConns(c.maxIdleConns)
+	return db, nil
+}
+
+// dsnParams returns the DSN params, or empty values if it has none.
+func dsnParams(dsn string) url.Values {
+	_, params := splitDSNParams(dsn)
+	values, _ := url.ParseQuery(params)
+	if values == nil {
+		values = url.Values{}
+	}
+	return values
+}
+
+func addDSNParams(dsn, params string) string {
+	if _, p := splitDSNParams(dsn); p != "" || strings.HasSuffix(dsn, "?") {
+		return dsn + "&" + params
+	}
+	return dsn + "?" + params
+}
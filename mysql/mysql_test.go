@@ -25,6 +25,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -69,6 +70,25 @@ func (s *MysqlTestSuite) TestConnection(t *C) {
 	t.Assert(conn.DB(), IsNil)
 }
 
+func (s *MysqlTestSuite) TestSharedPool(t *C) {
+	// Connections with the same DSN share one pool, so the pool limit is
+	// per instance.
+	conn1 := mysql.NewConnection(s.dsn)
+	err := conn1.Connect(1)
+	t.Assert(err, IsNil)
+	conn2 := mysql.NewConnection(s.dsn)
+	err = conn2.Connect(1)
+	t.Assert(err, IsNil)
+	t.Check(conn1.DB(), Equals, conn2.DB())
+
+	// The pool stays open until its last Connection is closed.
+	db := conn1.DB()
+	conn1.Close()
+	t.Check(db.Ping(), IsNil)
+	conn2.Close()
+	t.Check(db.Ping(), NotNil)
+}
+
 func (s *MysqlTestSuite) TestDSNString(t *C) {
 	dsn := mysql.DSN{
 		Username: "root",
@@ -110,3 +130,39 @@ func (s *MysqlTestSuite) TestErrorFormatting(t *C) {
 	}
 	t.Check(mysql.FormatError(e1), Equals, "connection refused: 127.0.0.1:3306")
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Connect test suite (no MySQL needed)
+/////////////////////////////////////////////////////////////////////////////
+
+type ConnectTestSuite struct{}
+
+var _ = Suite(&ConnectTestSuite{})
+
+func (s *ConnectTestSuite) TestTimeout(t *C) {
+	// A server which accepts connections but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	conn := mysql.NewConnection("user:pass@tcp(" + ln.Addr().String() + ")/?parseTime=true")
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- conn.Connect(1)
+	}()
+	select {
+	case err := <-errChan:
+		t.Check(err, NotNil)
+	case <-time.After(mysql.CONNECT_TIMEOUT + 5*time.Second):
+		t.Fatal("Connect did not time out")
+	}
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	driver "github.com/go-sql-driver/mysql"
+)
+
+/**
+ * TLS for MySQL connections is set in the DSN with agent-only params which
+ * mirror the mysql client options (values url.QueryEscape'd):
+ *   sslMode=REQUIRED|VERIFY_CA|VERIFY_IDENTITY
+ *   sslCa=PATH    PEM CA file, else the system CAs
+ *   sslCert=PATH  PEM client cert file
+ *   sslKey=PATH   PEM client key file
+ * REQUIRED encrypts but does not verify the server cert, VERIFY_CA verifies it
+ * was issued by the CA, and VERIFY_IDENTITY also verifies the server hostname.
+ * ResolveDSN registers the TLS config with the driver once per SSL params and
+ * host, and again when the files change, so they're re-read.  TLS also lets
+ * allowCleartextPasswords=true (DSN.AllowCleartextPasswords) send passwords
+ * for PAM and LDAP users safely.  The driver (go-sql-driver/mysql v1.3.0) does
+ * not support the caching_sha2_password or sha256_password auth plugins, so
+ * the agent's MySQL user must use mysql_native_password, even with TLS.
+ */
+
+const (
+	DSN_SSL_MODE = "sslMode"
+	DSN_SSL_CA   = "sslCa"
+	DSN_SSL_CERT = "sslCert"
+	DSN_SSL_KEY  = "sslKey"
+)
+
+const (
+	SSL_MODE_DISABLED        = "DISABLED"
+	SSL_MODE_REQUIRED        = "REQUIRED"
+	SSL_MODE_VERIFY_CA       = "VERIFY_CA"
+	SSL_MODE_VERIFY_IDENTITY = "VERIFY_IDENTITY"
+)
+
+// NewTLSConfig returns the TLS config for the SSL params, or nil if the mode
+// is DISABLED.
+func NewTLSConfig(mode, caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read MySQL SSL CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM certificates in MySQL SSL CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load MySQL SSL cert and key: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch mode {
+	case SSL_MODE_DISABLED:
+		return nil, nil
+	case SSL_MODE_REQUIRED:
+		config.InsecureSkipVerify = true
+	case SSL_MODE_VERIFY_CA:
+		// Verify the chain but not the hostname: the driver would verify the
+		// hostname unless InsecureSkipVerify, so verify the chain ourselves.
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	case SSL_MODE_VERIFY_IDENTITY:
+		// Caller sets ServerName to the host.  The driver would set it in the
+		// registered config, which is shared, so registerTLSConfig sets it.
+	default:
+		return nil, fmt.Errorf("Invalid SSL mode: %s", mode)
+	}
+	return config, nil
+}
+
+// --------------------------------------------------------------------------
+
+var (
+	tlsConfigs    = make(map[string]*tls.Config) // keyed on registered name
+	tlsConfigsMux = &sync.Mutex{}
+)
+
+// RegisteredTLSConfig returns the TLS config registered with the driver by
+// ResolveDSN for the DSN tls param, or nil.
+func RegisteredTLSConfig(name string) *tls.Config {
+	tlsConfigsMux.Lock()
+	defer tlsConfigsMux.Unlock()
+	return tlsConfigs[name]
+}
+
+// registerTLSConfig registers the TLS config for the SSL params and host with
+// the driver and returns its name for the DSN tls param.  The name is a hash of
+// the params, the host, and the files' size and mtime, so DSNs for the same
+// host with the same params share a config, which is registered only once
+// unless the files change.  The driver's registry isn't locked, so configs are
+// registered under our lock, and not on every connect.
+func registerTLSConfig(ssl map[string]string, host string) (string, error) {
+	mode := ssl[DSN_SSL_MODE]
+	if mode == "" {
+		mode = SSL_MODE_REQUIRED
+		if ssl[DSN_SSL_CA] != "" {
+			mode = SSL_MODE_VERIFY_CA
+		}
+	}
+	if mode == SSL_MODE_DISABLED {
+		return "false", nil
+	}
+
+	keys := []string{}
+	for k := range ssl {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha1.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, ssl[k])
+	}
+	fmt.Fprintf(h, "host=%s\n", host)
+	for _, k := range []string{DSN_SSL_CA, DSN_SSL_CERT, DSN_SSL_KEY} {
+		if ssl[k] == "" {
+			continue
+		}
+		if fi, err := os.Stat(ssl[k]); err == nil {
+			fmt.Fprintf(h, "%s:%d:%d\n", k, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	name := "pct-" + hex.EncodeToString(h.Sum(nil))[0:16]
+
+	tlsConfigsMux.Lock()
+	defer tlsConfigsMux.Unlock()
+	if _, ok := tlsConfigs[name]; ok {
+		return name, nil
+	}
+	config, err := NewTLSConfig(mode, ssl[DSN_SSL_CA], ssl[DSN_SSL_CERT], ssl[DSN_SSL_KEY])
+	if err != nil {
+		return "", err
+	}
+	if mode == SSL_MODE_VERIFY_IDENTITY {
+		config.ServerName = host
+	}
+	if err := driver.RegisterTLSConfig(name, config); err != nil {
+		return "", err
+	}
+	tlsConfigs[name] = config
+	return name, nil
+}
+
+// dsnHost returns the host of the DSN address, e.g. tcp(host:port)/db, or
+// localhost for a socket.
+func dsnHost(addr string) string {
+	if !strings.HasPrefix(addr, "tcp(") {
+		return "localhost"
+	}
+	hostPort := addr[4:]
+	if end := strings.Index(hostPort, ")"); end >= 0 {
+		hostPort = hostPort[0:end]
+	}
+	if host, _, err := net.SplitHostPort(hostPort); err == nil {
+		return host
+	}
+	return hostPort
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("MySQL server sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -74,11 +74,7 @@ type TimeoutClientConfig struct {
 
 func NewAPI() *API {
 	hostname, _ := os.Hostname()
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(timeoutClientConfig),
-		},
-	}
+	client := newClient()
 	a := &API{
 		origin:     "http://" + hostname,
 		agentLinks: make(map[string]string),
@@ -94,18 +90,16 @@ func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("Ping %s error: http.NewRequest: %s", url, err)
 	}
-	req.Header.Add("X-Percona-API-Key", apiKey)
+	if apiKey != "" {
+		req.Header.Add("X-Percona-API-Key", apiKey)
+	}
 	if headers != nil {
 		for k, v := range headers {
 			req.Header.Add(k, v)
 		}
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(timeoutClientConfig),
-		},
-	}
+	client := newClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return 0, err
@@ -118,6 +112,18 @@ func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
 	return resp.StatusCode, nil
 }
 
+// HTTP client for the API: with timeouts, and proxy and TLS per Transport.
+func newClient() *http.Client {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           Transport.Proxy,
+			Dial:            TimeoutDialer(timeoutClientConfig),
+			TLSClientConfig: Transport.TLSConfig(""),
+		},
+	}
+	return client
+}
+
 func URL(hostname string, paths ...string) string {
 	schema := "https://"
 	httpPrefix := "http://"
@@ -162,6 +168,7 @@ func (a *API) Connect(hostname, apiKey, agentUuid string) error {
 	// Success: API responds with the links we need.
 	a.mux.Lock()
 	defer a.mux.Unlock()
+	a.client = newClient() // in case Transport changed, e.g. new agent cert
 	a.hostname = hostname
 	a.apiKey = apiKey
 	a.agentUuid = agentUuid
@@ -216,10 +223,12 @@ func (a *API) Get(apiKey, url string) (int, []byte, error) {
 	if err != nil {
 		return 0, nil, err
 	}
-	req.Header.Add("X-Percona-API-Key", apiKey)
+	if apiKey != "" {
+		req.Header.Add("X-Percona-API-Key", apiKey)
+	}
 
 	// todo: timeout
-	resp, err := a.client.Do(req)
+	resp, err := a.getClient().Do(req)
 	if err != nil {
 		return 0, nil, fmt.Errorf("GET %s error: client.Do: %s", url, err)
 	}
@@ -246,6 +255,60 @@ func (a *API) Get(apiKey, url string) (int, []byte, error) {
 	return resp.StatusCode, data, nil
 }
 
+// GetRange gets at most size bytes of url from offset and writes them to w.  It
+// returns the status code: 206 if the range was honored, 200 if the server sent
+// the whole resource instead, and the total size of the resource, or -1 if unknown.
+// If there's an error after some bytes are written to w, the caller can get the
+// rest by calling again with the new offset.
+func (a *API) GetRange(apiKey, url string, offset, size int64, w io.Writer) (int, int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, -1, err
+	}
+	if apiKey != "" {
+		req.Header.Add("X-Percona-API-Key", apiKey)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+
+	resp, err := a.getClient().Do(req)
+	if err != nil {
+		return 0, -1, fmt.Errorf("GET %s error: client.Do: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-1023/146515
+		contentRange := resp.Header.Get("Content-Range")
+		if n := strings.LastIndex(contentRange, "/"); n >= 0 {
+			fmt.Sscanf(contentRange[n+1:], "%d", &total)
+		}
+	case http.StatusOK:
+		total = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Content-Range: bytes */146515
+		contentRange := resp.Header.Get("Content-Range")
+		if n := strings.LastIndex(contentRange, "/"); n >= 0 {
+			fmt.Sscanf(contentRange[n+1:], "%d", &total)
+		}
+		return resp.StatusCode, total, nil
+	default:
+		return resp.StatusCode, -1, nil
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return resp.StatusCode, total, fmt.Errorf("GET %s error: %s", url, err)
+	}
+	return resp.StatusCode, total, nil
+}
+
+func (a *API) getClient() *http.Client {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.client
+}
+
 func (a *API) EntryLink(resource string) string {
 	a.mux.RLock()
 	defer a.mux.RUnlock()
@@ -295,11 +358,16 @@ func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, erro
 
 func (a *API) send(method, apiKey, url string, data []byte) (*http.Response, []byte, error) {
 	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
 	header := http.Header{}
-	header.Set("X-Percona-API-Key", apiKey)
+	if apiKey != "" {
+		header.Set("X-Percona-API-Key", apiKey)
+	}
 	req.Header = header
 
-	resp, err := a.client.Do(req)
+	resp, err := a.getClient().Do(req)
 	if err != nil {
 		return resp, nil, err
 	}
@@ -0,0 +1,319 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+)
+
+/**
+ * The audit log is a local record of every command the agent receives from
+ * the API and its outcome, so the host owner can see what was done remotely.
+ * It's JSON lines, one AuditRecord per command, appended to audit.log in the
+ * basedir.  When the file reaches AUDIT_MAX_SIZE, it's rotated to audit.log.1,
+ * .1 to .2, etc., keeping AUDIT_MAX_FILES old files.  Records are never
+ * changed once written.  A cmd without a reply after AUDIT_PENDING_TTL (e.g.
+ * Reconnect, which has none) is recorded with the error "no reply".
+ */
+
+const (
+	AUDIT_FILE        = "audit.log" // in basedir
+	AUDIT_MAX_SIZE    = 10 * 1024 * 1024
+	AUDIT_MAX_FILES   = 5
+	AUDIT_MAX_DATA    = 1024 // bytes of sanitized cmd data to keep
+	AUDIT_MAX_PENDING = 100
+	AUDIT_PENDING_TTL = 2 * UPDATE_TIMEOUT // seconds, longer than cmds take to run, including queue waits
+	AUDIT_REDACTED    = "***"
+)
+
+type AuditRecord struct {
+	Ts         time.Time // when cmd was received
+	CmdId      string
+	User       string
+	Service    string
+	Cmd        string
+	DataSHA256 string        `json:",omitempty"` // of the raw cmd data
+	Data       string        `json:",omitempty"` // sanitized, truncated
+	Duration   time.Duration // until reply
+	Error      string        `json:",omitempty"` // reply error
+}
+
+type AuditFilter struct {
+	Since      time.Time
+	Until      time.Time
+	CmdId      string
+	User       string
+	Service    string
+	Cmd        string
+	ErrorsOnly bool
+}
+
+type pendingCmd struct {
+	cmd *proto.Cmd
+	ts  time.Time
+}
+
+type AuditLog struct {
+	file    string
+	maxSize int64
+	// --
+	pending map[string]pendingCmd
+	mux     *sync.Mutex
+	NowFunc func() time.Time
+}
+
+func NewAuditLog(file string, maxSize int64) *AuditLog {
+	a := &AuditLog{
+		file:    file,
+		maxSize: maxSize,
+		pending: make(map[string]pendingCmd),
+		mux:     &sync.Mutex{},
+		NowFunc: time.Now,
+	}
+	return a
+}
+
+// Received starts auditing the cmd.  The record is written when Replied
+// receives its reply.  A nil AuditLog does nothing.
+func (a *AuditLog) Received(cmd *proto.Cmd) error {
+	if a == nil {
+		return nil
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	now := a.NowFunc()
+
+	// Don't keep cmds which were never replied to forever, but don't expire
+	// cmds which may still be running either: their reply is the outcome.
+	var err error
+	var oldestKey string
+	var oldest time.Time
+	for key, p := range a.pending {
+		if now.Sub(p.ts) >= AUDIT_PENDING_TTL*time.Second {
+			if wErr := a.expire(key, p); wErr != nil {
+				err = wErr
+			}
+			continue
+		}
+		if oldest.IsZero() || p.ts.Before(oldest) {
+			oldestKey, oldest = key, p.ts
+		}
+	}
+	if len(a.pending) >= AUDIT_MAX_PENDING {
+		if wErr := a.expire(oldestKey, a.pending[oldestKey]); wErr != nil {
+			err = wErr
+		}
+	}
+
+	a.pending[pendingKey(cmd.Id, cmd.Cmd)] = pendingCmd{cmd: cmd, ts: now}
+	return err
+}
+
+// Replied writes the record of the cmd the reply is for.  Replies to cmds
+// not received, like keepalive pongs, are ignored.
+func (a *AuditLog) Replied(reply *proto.Reply) error {
+	if a == nil || reply == nil {
+		return nil
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	key := pendingKey(reply.Id, reply.Cmd)
+	p, ok := a.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(a.pending, key)
+	return a.write(NewAuditRecord(p.cmd, p.ts, reply))
+}
+
+func (a *AuditLog) expire(key string, p pendingCmd) error {
+	delete(a.pending, key)
+	return a.write(NewAuditRecord(p.cmd, p.ts, nil))
+}
+
+func (a *AuditLog) File() string {
+	return a.file
+}
+
+func NewAuditRecord(cmd *proto.Cmd, ts time.Time, reply *proto.Reply) AuditRecord {
+	rec := AuditRecord{
+		Ts:       ts.UTC(),
+		CmdId:    cmd.Id,
+		User:     cmd.User,
+		Service:  cmd.Service,
+		Cmd:      cmd.Cmd,
+		Duration: time.Now().Sub(ts),
+	}
+	if len(cmd.Data) > 0 {
+		sum := sha256.Sum256(cmd.Data)
+		rec.DataSHA256 = hex.EncodeToString(sum[:])
+		rec.Data = SanitizeCmdData(cmd.Data, AUDIT_MAX_DATA)
+	}
+	if reply == nil {
+		rec.Error = "no reply"
+	} else {
+		rec.Error = reply.Error
+	}
+	return rec
+}
+
+// SanitizeCmdData returns the cmd data as JSON with sensitive values (see
+// SensitiveConfigKeys) redacted, including in nested configs, truncated to max
+// bytes.  Data which isn't JSON is only described by its size.
+func SanitizeCmdData(data []byte, max int) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("(%d bytes)", len(data))
+	}
+	clean, err := json.Marshal(sanitizeValue("", v))
+	if err != nil {
+		return fmt.Sprintf("(%d bytes)", len(data))
+	}
+	if max > 0 && len(clean) > max {
+		return string(clean[0:max]) + "..."
+	}
+	return string(clean)
+}
+
+// SearchAuditLog returns the records in the audit log and its rotated files
+// which match the filter, oldest first.
+func SearchAuditLog(file string, filter AuditFilter) ([]AuditRecord, error) {
+	files := []string{}
+	for i := AUDIT_MAX_FILES; i > 0; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", file, i))
+	}
+	files = append(files, file)
+
+	records := []AuditRecord{}
+	for _, f := range files {
+		fh, err := os.Open(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return records, err
+		}
+		scanner := bufio.NewScanner(fh)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue // partial line from a crash
+			}
+			if filter.match(rec) {
+				records = append(records, rec)
+			}
+		}
+		err = scanner.Err()
+		fh.Close()
+		if err != nil {
+			return records, fmt.Errorf("%s: %s", f, err)
+		}
+	}
+	return records, nil
+}
+
+// --------------------------------------------------------------------------
+
+func pendingKey(id, cmd string) string {
+	return id + "/" + cmd
+}
+
+func (a *AuditLog) write(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if fi, err := os.Stat(a.file); err == nil && fi.Size()+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	fh, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = fh.Write(line)
+	return err
+}
+
+func (a *AuditLog) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", a.file, AUDIT_MAX_FILES))
+	for i := AUDIT_MAX_FILES - 1; i > 0; i-- {
+		old := fmt.Sprintf("%s.%d", a.file, i)
+		if FileExists(old) {
+			if err := os.Rename(old, fmt.Sprintf("%s.%d", a.file, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(a.file, a.file+".1")
+}
+
+func (f AuditFilter) match(rec AuditRecord) bool {
+	if !f.Since.IsZero() && rec.Ts.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.Ts.After(f.Until) {
+		return false
+	}
+	if (f.CmdId != "" && rec.CmdId != f.CmdId) ||
+		(f.User != "" && rec.User != f.User) ||
+		(f.Service != "" && rec.Service != f.Service) ||
+		(f.Cmd != "" && rec.Cmd != f.Cmd) {
+		return false
+	}
+	if f.ErrorsOnly && rec.Error == "" {
+		return false
+	}
+	return true
+}
+
+func sanitizeValue(key string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = sanitizeValue(k, e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = sanitizeValue(key, e)
+		}
+	case string:
+		if SensitiveConfigKeys[key] && t != "" {
+			return AUDIT_REDACTED
+		}
+		if nested, ok := nestedJSON(t); ok {
+			return sanitizeValue("", nested)
+		}
+	}
+	return v
+}
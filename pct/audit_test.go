@@ -0,0 +1,196 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// audit.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type AuditTestSuite struct {
+	tmpDir string
+	file   string
+}
+
+var _ = Suite(&AuditTestSuite{})
+
+func (s *AuditTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test-pct-audit")
+	t.Assert(err, IsNil)
+	s.file = filepath.Join(s.tmpDir, pct.AUDIT_FILE)
+}
+
+func (s *AuditTestSuite) TearDownTest(t *C) {
+	files, _ := filepath.Glob(s.file + "*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func (s *AuditTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *AuditTestSuite) TestAudit(t *C) {
+	audit := pct.NewAuditLog(s.file, pct.AUDIT_MAX_SIZE)
+
+	config := []byte(`{"DSN":"user:secret@tcp(localhost:3306)/","Interval":60}`)
+	data, _ := json.Marshal(proto.ServiceData{Name: "mm", Config: config})
+	cmd1 := &proto.Cmd{Id: "1", User: "daniel", Service: "agent", Cmd: "StartService", Data: data}
+	cmd2 := &proto.Cmd{Id: "2", User: "ana", Service: "mm", Cmd: "Status"}
+
+	t.Check(audit.Received(cmd1), IsNil)
+	t.Check(audit.Received(cmd2), IsNil)
+
+	// Nothing is written until the cmd is replied to.
+	t.Check(pct.FileExists(s.file), Equals, false)
+
+	t.Check(audit.Replied(cmd2.Reply(nil, fmt.Errorf("oops"))), IsNil)
+	t.Check(audit.Replied(cmd1.Reply(nil)), IsNil)
+
+	// Replies to cmds not received aren't audited.
+	pong := &proto.Cmd{Cmd: "Pong"}
+	t.Check(audit.Replied(pong.Reply(nil)), IsNil)
+
+	fi, err := os.Stat(s.file)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	records, err := pct.SearchAuditLog(s.file, pct.AuditFilter{})
+	t.Assert(err, IsNil)
+	t.Assert(records, HasLen, 2)
+	t.Check(records[0].CmdId, Equals, "2")
+	t.Check(records[0].User, Equals, "ana")
+	t.Check(records[0].Error, Equals, "oops")
+	t.Check(records[1].CmdId, Equals, "1")
+	t.Check(records[1].Service, Equals, "agent")
+	t.Check(records[1].Cmd, Equals, "StartService")
+	t.Check(records[1].Error, Equals, "")
+	t.Check(records[1].DataSHA256, HasLen, 64)
+
+	// The DSN in the nested service config is redacted.
+	t.Check(strings.Contains(records[1].Data, "secret"), Equals, false)
+	t.Check(records[1].Data, Equals, `{"Config":{"DSN":"***","Interval":60},"Name":"mm"}`)
+
+	// Search.
+	records, err = pct.SearchAuditLog(s.file, pct.AuditFilter{User: "daniel"})
+	t.Assert(err, IsNil)
+	t.Assert(records, HasLen, 1)
+	t.Check(records[0].CmdId, Equals, "1")
+
+	records, err = pct.SearchAuditLog(s.file, pct.AuditFilter{ErrorsOnly: true})
+	t.Assert(err, IsNil)
+	t.Assert(records, HasLen, 1)
+	t.Check(records[0].CmdId, Equals, "2")
+
+	records, err = pct.SearchAuditLog(s.file, pct.AuditFilter{Since: time.Now().Add(time.Hour)})
+	t.Assert(err, IsNil)
+	t.Check(records, HasLen, 0)
+
+	// A nil audit log does nothing.
+	var noAudit *pct.AuditLog
+	t.Check(noAudit.Received(cmd1), IsNil)
+	t.Check(noAudit.Replied(cmd1.Reply(nil)), IsNil)
+}
+
+func (s *AuditTestSuite) TestPending(t *C) {
+	audit := pct.NewAuditLog(s.file, pct.AUDIT_MAX_SIZE)
+	now := time.Now()
+	audit.NowFunc = func() time.Time { return now }
+
+	// Reconnect has no reply, and Update is still running.
+	reconnect := &proto.Cmd{Id: "1", Service: "agent", Cmd: "Reconnect"}
+	update := &proto.Cmd{Id: "2", Service: "agent", Cmd: "Update"}
+	t.Check(audit.Received(reconnect), IsNil)
+	now = now.Add(time.Duration(pct.AUDIT_PENDING_TTL-1) * time.Second)
+	t.Check(audit.Received(update), IsNil)
+	t.Check(pct.FileExists(s.file), Equals, false)
+
+	// Pending cmds expire by age, not all at once.
+	now = now.Add(time.Second)
+	status := &proto.Cmd{Id: "3", Service: "agent", Cmd: "Status"}
+	t.Check(audit.Received(status), IsNil)
+	t.Check(audit.Replied(update.Reply(nil)), IsNil)
+	records, err := pct.SearchAuditLog(s.file, pct.AuditFilter{})
+	t.Assert(err, IsNil)
+	t.Assert(records, HasLen, 2)
+	t.Check(records[0].CmdId, Equals, "1")
+	t.Check(records[0].Error, Equals, "no reply")
+	t.Check(records[1].CmdId, Equals, "2")
+	t.Check(records[1].Error, Equals, "")
+
+	// If too many are pending, the oldest expires.
+	for i := 0; i < pct.AUDIT_MAX_PENDING; i++ {
+		now = now.Add(time.Millisecond)
+		t.Check(audit.Received(&proto.Cmd{Id: fmt.Sprintf("x%d", i), Service: "mm", Cmd: "Status"}), IsNil)
+	}
+	records, err = pct.SearchAuditLog(s.file, pct.AuditFilter{})
+	t.Assert(err, IsNil)
+	t.Assert(records, HasLen, 3)
+	t.Check(records[2].CmdId, Equals, "3")
+	t.Check(records[2].Error, Equals, "no reply")
+}
+
+func (s *AuditTestSuite) TestRotate(t *C) {
+	audit := pct.NewAuditLog(s.file, 1000)
+	for i := 0; i < 50; i++ {
+		cmd := &proto.Cmd{Id: fmt.Sprintf("%d", i), User: "daniel", Service: "agent", Cmd: "Status"}
+		t.Assert(audit.Received(cmd), IsNil)
+		t.Assert(audit.Replied(cmd.Reply(nil)), IsNil)
+	}
+
+	files, _ := filepath.Glob(s.file + "*")
+	t.Check(files, HasLen, pct.AUDIT_MAX_FILES+1)
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		t.Assert(err, IsNil)
+		t.Check(fi.Size() <= 1000, Equals, true)
+	}
+
+	// Oldest records are dropped, newest are last.
+	records, err := pct.SearchAuditLog(s.file, pct.AuditFilter{})
+	t.Assert(err, IsNil)
+	t.Assert(len(records) > 0 && len(records) < 50, Equals, true)
+	t.Check(records[len(records)-1].CmdId, Equals, "49")
+	for i := 1; i < len(records); i++ {
+		t.Check(records[i].Ts.Before(records[i-1].Ts), Equals, false)
+	}
+}
+
+func (s *AuditTestSuite) TestSanitizeCmdData(t *C) {
+	t.Check(pct.SanitizeCmdData([]byte("not json"), 100), Equals, "(8 bytes)")
+	t.Check(pct.SanitizeCmdData([]byte(`{"ApiKey":"123","Password":""}`), 100), Equals, `{"ApiKey":"***","Password":""}`)
+	t.Check(pct.SanitizeCmdData([]byte(`{"Query":"SELECT 1"}`), 10), Equals, `{"Query":"...`)
+}
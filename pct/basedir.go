@@ -19,6 +19,7 @@ package pct
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -33,16 +34,20 @@ const (
 	DATA_DIR     = "data"
 	BIN_DIR      = "bin"
 	TRASH_DIR    = "trash"
+	METRICS_DIR  = "metrics"
+	QUEUE_DIR    = "log-queue"
 	START_LOCK   = "start.lock"
 	START_SCRIPT = "start.sh"
 )
 
 type basedir struct {
-	path      string
-	configDir string
-	dataDir   string
-	binDir    string
-	trashDir  string
+	path       string
+	configDir  string
+	dataDir    string
+	binDir     string
+	trashDir   string
+	metricsDir string
+	queueDir   string
 }
 
 var Basedir basedir
@@ -81,6 +86,16 @@ func (b *basedir) Init(path string) error {
 		return err
 	}
 
+	b.metricsDir = filepath.Join(b.path, METRICS_DIR)
+	if err := MakeDir(b.metricsDir); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	b.queueDir = filepath.Join(b.path, QUEUE_DIR)
+	if err := MakeDir(b.queueDir); err != nil && !os.IsExist(err) {
+		return err
+	}
+
 	return nil
 }
 
@@ -98,6 +113,10 @@ func (b *basedir) Dir(service string) string {
 		return b.binDir
 	case "trash":
 		return b.trashDir
+	case "metrics":
+		return b.metricsDir
+	case "log-queue":
+		return b.queueDir
 	default:
 		log.Panic("Invalid service: " + service)
 	}
@@ -116,6 +135,9 @@ func (b *basedir) ReadConfig(service string, v interface{}) error {
 		return err
 	}
 	if len(data) > 0 {
+		if data, err = DecryptConfig(data); err != nil {
+			return fmt.Errorf("%s: %s", configFile, err)
+		}
 		err = json.Unmarshal(data, &v)
 	}
 	return err
@@ -127,12 +149,19 @@ func (b *basedir) WriteConfig(service string, config interface{}) error {
 	if err != nil {
 		return err
 	}
+	if data, err = EncryptConfig(data); err != nil {
+		return err
+	}
 	return ioutil.WriteFile(configFile, data, 0600)
 }
 
 func (b *basedir) WriteConfigString(service, config string) error {
 	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	return ioutil.WriteFile(configFile, []byte(config), 0600)
+	data, err := EncryptConfig([]byte(config))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, data, 0600)
 }
 
 func (b *basedir) RemoveConfig(service string) error {
@@ -146,6 +175,16 @@ func (b *basedir) File(file string) string {
 		file = START_LOCK
 	case "start-script":
 		file = START_SCRIPT
+	case "audit-log":
+		file = AUDIT_FILE
+	case "update":
+		file = UPDATE_STATE_FILE
+	case "update-history":
+		file = UPDATE_HISTORY_FILE
+	case "agent-key":
+		return filepath.Join(b.configDir, AGENT_KEY_FILE)
+	case "agent-cert":
+		return filepath.Join(b.configDir, AGENT_CERT_FILE)
 	default:
 		log.Panicf("Unknown basedir file: %s", file)
 	}
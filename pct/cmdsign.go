@@ -0,0 +1,190 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+)
+
+/**
+ * Signed commands let the agent verify that a command was issued by whoever
+ * holds the command signing key, not just that it arrived on the websocket.
+ * The API adds a unique Nonce and a Signature to the command JSON:
+ *
+ *   {"Id":"...", "Ts":"...", ..., "Nonce":"...", "Signature":"<base64>"}
+ *
+ * Signature is RSA PKCS #1 v1.5 SHA-256 of CmdSigningString.  If the host
+ * owner installs the public key, the agent rejects commands which are not
+ * signed, are signed with another key, are for another agent, are older than
+ * CMD_MAX_AGE (or older than the agent process), or reuse a nonce.
+ */
+
+const (
+	DEFAULT_CMD_PUBLIC_KEY_FILE = "/etc/percona-agent/cmd-key.pem"
+	CMD_MAX_AGE                 = 5 * time.Minute
+)
+
+// SignedCmd is a proto.Cmd as received from the API with its signature.
+type SignedCmd struct {
+	proto.Cmd
+	Nonce     string `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+}
+
+type CmdVerifier struct {
+	pubKey    *rsa.PublicKey
+	agentUuid string
+	maxAge    time.Duration
+	started   time.Time
+	// --
+	nonces map[string]time.Time
+	mux    *sync.Mutex
+}
+
+func NewCmdVerifier(pubKeyPEM []byte, agentUuid string, maxAge time.Duration) (*CmdVerifier, error) {
+	block, _ := pem.Decode(pubKeyPEM)
+	if block == nil {
+		return nil, errors.New("No PEM public key")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an RSA key")
+	}
+	v := &CmdVerifier{
+		pubKey:    rsaPubKey,
+		agentUuid: agentUuid,
+		maxAge:    maxAge,
+		started:   time.Now(),
+		nonces:    make(map[string]time.Time),
+		mux:       &sync.Mutex{},
+	}
+	return v, nil
+}
+
+// LoadCmdVerifier loads the command signing public key file.  If the file
+// does not exist, it returns nil, which accepts unsigned commands.
+func LoadCmdVerifier(file, agentUuid string) (*CmdVerifier, error) {
+	if !FileExists(file) {
+		return nil, nil
+	}
+	if err := CheckOwnerFile(file, "Command public key"); err != nil {
+		return nil, err
+	}
+	pubKeyPEM, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	v, err := NewCmdVerifier(pubKeyPEM, agentUuid, CMD_MAX_AGE)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid command public key %s: %s", file, err)
+	}
+	return v, nil
+}
+
+// Verify returns a CmdRejectedError if the cmd is not signed or not valid,
+// else nil.  A nil verifier accepts all commands.
+func (v *CmdVerifier) Verify(cmd *SignedCmd) error {
+	if v == nil {
+		return nil
+	}
+	if len(cmd.Signature) == 0 || cmd.Nonce == "" {
+		return CmdRejectedError{Cmd: cmd.Cmd.Cmd, Reason: "it is not signed"}
+	}
+	hash := sha256.Sum256(CmdSigningString(&cmd.Cmd, cmd.Nonce))
+	if err := rsa.VerifyPKCS1v15(v.pubKey, crypto.SHA256, hash[:], cmd.Signature); err != nil {
+		return CmdRejectedError{Cmd: cmd.Cmd.Cmd, Reason: "its signature is invalid"}
+	}
+
+	// The signature is valid, so the fields below are what the signer sent.
+	if cmd.AgentUuid != v.agentUuid {
+		return CmdRejectedError{Cmd: cmd.Cmd.Cmd, Reason: "it is signed for agent " + cmd.AgentUuid}
+	}
+	now := time.Now()
+	if cmd.Ts.Before(now.Add(-v.maxAge)) || cmd.Ts.After(now.Add(v.maxAge)) {
+		return CmdRejectedError{Cmd: cmd.Cmd.Cmd, Reason: fmt.Sprintf("it was signed at %s, more than %s from now", cmd.Ts.UTC(), v.maxAge)}
+	}
+	if cmd.Ts.Before(v.started) {
+		// Nonces are not saved, so cmds from before a restart could be replays.
+		return CmdRejectedError{Cmd: cmd.Cmd.Cmd, Reason: fmt.Sprintf("it was signed at %s, before the agent started", cmd.Ts.UTC())}
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+	if _, seen := v.nonces[cmd.Nonce]; seen {
+		return CmdRejectedError{Cmd: cmd.Cmd.Cmd, Reason: "it was already received (nonce " + cmd.Nonce + ")"}
+	}
+	// Cmds older than maxAge are rejected, so nonces can be forgotten after that.
+	v.nonces[cmd.Nonce] = cmd.Ts.Add(v.maxAge)
+	return nil
+}
+
+// CmdSigningString returns the data signed for the cmd: every field and the
+// nonce, one per line, with Ts in RFC 3339 UTC and Data as its SHA-256 hash.
+func CmdSigningString(cmd *proto.Cmd, nonce string) []byte {
+	dataHash := sha256.Sum256(cmd.Data)
+	fields := []string{
+		cmd.Id,
+		cmd.Ts.UTC().Format(time.RFC3339Nano),
+		cmd.User,
+		cmd.AgentUuid,
+		cmd.Service,
+		cmd.Cmd,
+		base64.StdEncoding.EncodeToString(dataHash[:]),
+		nonce,
+	}
+	return []byte(strings.Join(fields, "\n"))
+}
+
+// SignCmd returns the cmd signed with the private key.  The API signs cmds;
+// this is for tools and tests.
+func SignCmd(cmd *proto.Cmd, nonce string, key *rsa.PrivateKey) (*SignedCmd, error) {
+	hash := sha256.Sum256(CmdSigningString(cmd, nonce))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	signedCmd := &SignedCmd{
+		Cmd:       *cmd,
+		Nonce:     nonce,
+		Signature: sig,
+	}
+	return signedCmd, nil
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// cmdsign.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type CmdSignTestSuite struct {
+	tmpDir    string
+	key       *rsa.PrivateKey
+	otherKey  *rsa.PrivateKey
+	pubKeyPEM []byte
+}
+
+var _ = Suite(&CmdSignTestSuite{})
+
+func (s *CmdSignTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test-pct-cmdsign")
+	t.Assert(err, IsNil)
+
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	t.Assert(err, IsNil)
+	s.otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	t.Assert(err, IsNil)
+
+	pubKeyDER, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	t.Assert(err, IsNil)
+	s.pubKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyDER})
+}
+
+func (s *CmdSignTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *CmdSignTestSuite) newCmd() *proto.Cmd {
+	return &proto.Cmd{
+		Id:        "1",
+		Ts:        time.Now().UTC(),
+		User:      "daniel",
+		AgentUuid: "123",
+		Service:   "agent",
+		Cmd:       "StartService",
+		Data:      []byte(`{"Name":"qan"}`),
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *CmdSignTestSuite) TestVerify(t *C) {
+	v, err := pct.NewCmdVerifier(s.pubKeyPEM, "123", time.Minute)
+	t.Assert(err, IsNil)
+
+	// Signed cmd, sent as JSON.
+	signedCmd, err := pct.SignCmd(s.newCmd(), "nonce-1", s.key)
+	t.Assert(err, IsNil)
+	data, err := json.Marshal(signedCmd)
+	t.Assert(err, IsNil)
+	got := &pct.SignedCmd{}
+	t.Assert(json.Unmarshal(data, got), IsNil)
+	t.Check(got.Cmd.Cmd, Equals, "StartService")
+	t.Check(got.Nonce, Equals, "nonce-1")
+	t.Check(v.Verify(got), IsNil)
+
+	// Replay.
+	err = v.Verify(got)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+already received.+")
+
+	// Unsigned.
+	err = v.Verify(&pct.SignedCmd{Cmd: *s.newCmd()})
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+not signed")
+
+	// Signed with another key.
+	signedCmd, _ = pct.SignCmd(s.newCmd(), "nonce-2", s.otherKey)
+	err = v.Verify(signedCmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+signature is invalid")
+
+	// Changed after signing.
+	signedCmd, _ = pct.SignCmd(s.newCmd(), "nonce-3", s.key)
+	signedCmd.Data = []byte(`{"Name":"mm"}`)
+	err = v.Verify(signedCmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+signature is invalid")
+
+	// For another agent.
+	cmd := s.newCmd()
+	cmd.AgentUuid = "456"
+	signedCmd, _ = pct.SignCmd(cmd, "nonce-4", s.key)
+	err = v.Verify(signedCmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+for agent 456")
+
+	// Too old.
+	cmd = s.newCmd()
+	cmd.Ts = cmd.Ts.Add(-2 * time.Minute)
+	signedCmd, _ = pct.SignCmd(cmd, "nonce-5", s.key)
+	err = v.Verify(signedCmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+
+	// Signed before the verifier (agent) started.
+	cmd = s.newCmd()
+	v, _ = pct.NewCmdVerifier(s.pubKeyPEM, "123", time.Minute)
+	signedCmd, _ = pct.SignCmd(cmd, "nonce-6", s.key)
+	err = v.Verify(signedCmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+before the agent started")
+
+	// A nil verifier accepts unsigned cmds.
+	var noVerifier *pct.CmdVerifier
+	t.Check(noVerifier.Verify(&pct.SignedCmd{Cmd: *s.newCmd()}), IsNil)
+}
+
+func (s *CmdSignTestSuite) TestLoadCmdVerifier(t *C) {
+	file := filepath.Join(s.tmpDir, "cmd-key.pem")
+
+	// No key file: nil verifier.
+	v, err := pct.LoadCmdVerifier(file, "123")
+	t.Check(err, IsNil)
+	t.Check(v, IsNil)
+
+	t.Assert(ioutil.WriteFile(file, s.pubKeyPEM, 0644), IsNil)
+	v, err = pct.LoadCmdVerifier(file, "123")
+	t.Check(err, IsNil)
+	t.Check(v, NotNil)
+
+	// Others must not be able to change the key.
+	t.Assert(os.Chmod(file, 0666), IsNil)
+	_, err = pct.LoadCmdVerifier(file, "123")
+	t.Check(err, NotNil)
+
+	t.Assert(ioutil.WriteFile(file, []byte("foo"), 0644), IsNil)
+	t.Assert(os.Chmod(file, 0644), IsNil)
+	_, err = pct.LoadCmdVerifier(file, "123")
+	t.Check(err, NotNil)
+}
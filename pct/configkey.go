@@ -0,0 +1,321 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+/**
+ * Configs can have sensitive values encrypted at rest: the API key in
+ * agent.conf, MySQL DSNs in instance files, etc.  If a config key is set,
+ * WriteConfig encrypts the string values of SensitiveConfigKeys with
+ * AES-256-GCM and ReadConfig decrypts them, so callers never see encrypted
+ * values.  Encrypted values are "enc:v1:" + base64(nonce + ciphertext), and
+ * the rest of the config remains readable.
+ */
+
+const (
+	CONFIG_KEY_ENV   = "PERCONA_AGENT_CONFIG_KEY" // key, if no key spec
+	ENCRYPTED_PREFIX = "enc:v1:"
+)
+
+// Config values to encrypt, by JSON key at any level.
+var SensitiveConfigKeys = map[string]bool{
+	"ApiKey":   true,
+	"DSN":      true,
+	"Password": true,
+	"Proxy":    true, // can have user:pass
+}
+
+var ErrNoConfigKey = errors.New("Config is encrypted but no config key is set")
+
+var configKey cipher.AEAD
+var configKeyMux = &sync.RWMutex{}
+
+/**
+ * LoadConfigKey returns the config key from the spec:
+ *   file:PATH     file readable only by its owner, who must be the current user
+ *   keyring:NAME  user key NAME in the Linux kernel keyring (via keyctl)
+ *   env:VAR       env var VAR
+ *   ""            CONFIG_KEY_ENV if set, else no key (nil)
+ * The key is 32 bytes: raw, hex, or base64.
+ */
+func LoadConfigKey(spec string) ([]byte, error) {
+	var material []byte
+	switch {
+	case spec == "":
+		v := os.Getenv(CONFIG_KEY_ENV)
+		if v == "" {
+			return nil, nil
+		}
+		material = []byte(v)
+	case strings.HasPrefix(spec, "env:"):
+		v := os.Getenv(strings.TrimPrefix(spec, "env:"))
+		if v == "" {
+			return nil, fmt.Errorf("Config key env var %s is not set", strings.TrimPrefix(spec, "env:"))
+		}
+		material = []byte(v)
+	case strings.HasPrefix(spec, "file:"):
+		file := strings.TrimPrefix(spec, "file:")
+		if err := checkKeyFile(file); err != nil {
+			return nil, err
+		}
+		var err error
+		material, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(spec, "keyring:"):
+		name := strings.TrimPrefix(spec, "keyring:")
+		out, err := exec.Command("keyctl", "pipe", "%user:"+name).Output()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read key %s from kernel keyring: %s", name, err)
+		}
+		material = out
+	default:
+		return nil, fmt.Errorf("Invalid config key spec: %s: expected file:, keyring:, or env:", spec)
+	}
+	return parseConfigKey(material)
+}
+
+// SetConfigKey sets the key for all configs.  A nil key disables encryption.
+func SetConfigKey(key []byte) error {
+	var aead cipher.AEAD
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+	}
+	configKeyMux.Lock()
+	defer configKeyMux.Unlock()
+	configKey = aead
+	return nil
+}
+
+func HaveConfigKey() bool {
+	configKeyMux.RLock()
+	defer configKeyMux.RUnlock()
+	return configKey != nil
+}
+
+func IsEncryptedConfig(data []byte) bool {
+	return bytes.Contains(data, []byte(`"`+ENCRYPTED_PREFIX))
+}
+
+// EncryptConfig encrypts the sensitive values in the JSON config.  If there's
+// no config key, the config is returned as-is.
+func EncryptConfig(data []byte) ([]byte, error) {
+	configKeyMux.RLock()
+	aead := configKey
+	configKeyMux.RUnlock()
+	if aead == nil {
+		return data, nil
+	}
+	return transformConfig(data, func(key, value string) (string, error) {
+		if !SensitiveConfigKeys[key] || value == "" || strings.HasPrefix(value, ENCRYPTED_PREFIX) {
+			return value, nil
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		sealed := aead.Seal(nonce, nonce, []byte(value), []byte(key))
+		return ENCRYPTED_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+	})
+}
+
+// DecryptConfig decrypts all encrypted values in the JSON config.  A config
+// without encrypted values is returned as-is, even if there's no config key.
+func DecryptConfig(data []byte) ([]byte, error) {
+	if !IsEncryptedConfig(data) {
+		return data, nil
+	}
+	configKeyMux.RLock()
+	aead := configKey
+	configKeyMux.RUnlock()
+	if aead == nil {
+		return nil, ErrNoConfigKey
+	}
+	return transformConfig(data, func(key, value string) (string, error) {
+		if !strings.HasPrefix(value, ENCRYPTED_PREFIX) {
+			return value, nil
+		}
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ENCRYPTED_PREFIX))
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return "", fmt.Errorf("Invalid encrypted %s value", key)
+		}
+		nonce := sealed[0:aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(key))
+		if err != nil {
+			return "", fmt.Errorf("Cannot decrypt %s: wrong config key?", key)
+		}
+		return string(plain), nil
+	})
+}
+
+// EncryptConfigFiles encrypts the sensitive values in all config files in
+// dir, in place, and returns the files it changed.  It's used to migrate
+// plain text configs after setting a config key.
+func EncryptConfigFiles(dir string) ([]string, error) {
+	if !HaveConfigKey() {
+		return nil, errors.New("No config key is set")
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+CONFIG_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	changed := []string{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return changed, err
+		}
+		plainSensitive, err := hasPlainSensitive(data)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", file, err)
+		}
+		if !plainSensitive {
+			continue // nothing to encrypt
+		}
+		// Decrypt first to verify the key can decrypt values already encrypted.
+		plain, err := DecryptConfig(data)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", file, err)
+		}
+		encrypted, err := EncryptConfig(plain)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", file, err)
+		}
+		tmpFile := file + ".new"
+		if err := ioutil.WriteFile(tmpFile, encrypted, 0600); err != nil {
+			return changed, err
+		}
+		if err := os.Rename(tmpFile, file); err != nil {
+			return changed, err
+		}
+		changed = append(changed, file)
+	}
+	return changed, nil
+}
+
+// --------------------------------------------------------------------------
+
+func parseConfigKey(material []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(material))
+	if len(s) == 64 {
+		if key, err := hex.DecodeString(s); err == nil {
+			return key, nil
+		}
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(material) == 32 {
+		return material, nil
+	}
+	return nil, errors.New("Invalid config key: must be 32 bytes, raw, hex, or base64")
+}
+
+func checkKeyFile(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("Config key file %s must be readable only by its owner (mode 0400 or 0600), it is %s", file, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("Config key file %s must be owned by uid %d, it is owned by uid %d", file, os.Geteuid(), st.Uid)
+	}
+	return nil
+}
+
+// transformConfig calls f for every string value in the JSON config, keyed on
+// the value's JSON key, and returns the config with the values f returns.
+func transformConfig(data []byte, f func(key, value string) (string, error)) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber() // keep numbers as-is
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v, err := transformValue("", v, f)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
+
+func transformValue(key string, v interface{}, f func(key, value string) (string, error)) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		return f(key, t)
+	case map[string]interface{}:
+		for k, e := range t {
+			e, err := transformValue(k, e, f)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = e
+		}
+	case []interface{}:
+		for i, e := range t {
+			e, err := transformValue(key, e, f)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = e
+		}
+	}
+	return v, nil
+}
+
+// hasPlainSensitive returns true if the config has sensitive values which are
+// not encrypted.
+func hasPlainSensitive(data []byte) (bool, error) {
+	found := false
+	_, err := transformConfig(data, func(key, value string) (string, error) {
+		if SensitiveConfigKeys[key] && value != "" && !strings.HasPrefix(value, ENCRYPTED_PREFIX) {
+			found = true
+		}
+		return value, nil
+	})
+	return found, err
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/hex"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// configkey.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ConfigKeyTestSuite struct {
+	tmpDir string
+	key    []byte
+}
+
+var _ = Suite(&ConfigKeyTestSuite{})
+
+type secretConfig struct {
+	ApiKey    string
+	AgentUuid string
+	Keepalive uint
+	Mysql     []map[string]string
+}
+
+func (s *ConfigKeyTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test-pct-configkey")
+	t.Assert(err, IsNil)
+	t.Assert(pct.Basedir.Init(s.tmpDir), IsNil)
+	s.key = []byte("0123456789abcdef0123456789abcdef")
+}
+
+func (s *ConfigKeyTestSuite) TearDownTest(t *C) {
+	pct.SetConfigKey(nil)
+	files, _ := filepath.Glob(filepath.Join(pct.Basedir.Dir("config"), "*"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func (s *ConfigKeyTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ConfigKeyTestSuite) TestLoadConfigKey(t *C) {
+	// No spec and no env var: no key.
+	os.Setenv(pct.CONFIG_KEY_ENV, "")
+	key, err := pct.LoadConfigKey("")
+	t.Check(err, IsNil)
+	t.Check(key, IsNil)
+
+	os.Setenv(pct.CONFIG_KEY_ENV, hex.EncodeToString(s.key))
+	defer os.Setenv(pct.CONFIG_KEY_ENV, "")
+	key, err = pct.LoadConfigKey("")
+	t.Check(err, IsNil)
+	t.Check(key, DeepEquals, s.key)
+
+	key, err = pct.LoadConfigKey("env:" + pct.CONFIG_KEY_ENV)
+	t.Check(err, IsNil)
+	t.Check(key, DeepEquals, s.key)
+
+	// Key file must not be readable by group or others.
+	keyFile := filepath.Join(s.tmpDir, "config.key")
+	t.Assert(ioutil.WriteFile(keyFile, s.key, 0644), IsNil)
+	defer os.Remove(keyFile)
+	_, err = pct.LoadConfigKey("file:" + keyFile)
+	t.Check(err, NotNil)
+	t.Assert(os.Chmod(keyFile, 0600), IsNil)
+	key, err = pct.LoadConfigKey("file:" + keyFile)
+	t.Check(err, IsNil)
+	t.Check(key, DeepEquals, s.key)
+
+	_, err = pct.LoadConfigKey("env:PCT_TEST_NO_SUCH_VAR")
+	t.Check(err, NotNil)
+	_, err = pct.LoadConfigKey("foo:bar")
+	t.Check(err, NotNil)
+	t.Assert(ioutil.WriteFile(keyFile, []byte("too short"), 0600), IsNil)
+	_, err = pct.LoadConfigKey("file:" + keyFile)
+	t.Check(err, NotNil)
+}
+
+func (s *ConfigKeyTestSuite) TestReadWriteConfig(t *C) {
+	t.Assert(pct.SetConfigKey(s.key), IsNil)
+	config := &secretConfig{
+		ApiKey:    "123",
+		AgentUuid: "abc",
+		Keepalive: 76,
+		Mysql:     []map[string]string{{"DSN": "user:pass@tcp(localhost)/", "Name": "db1"}},
+	}
+	t.Assert(pct.Basedir.WriteConfig("secret", config), IsNil)
+
+	// Only sensitive values are encrypted.
+	data, err := ioutil.ReadFile(pct.Basedir.ConfigFile("secret"))
+	t.Assert(err, IsNil)
+	t.Check(pct.IsEncryptedConfig(data), Equals, true)
+	t.Check(strings.Contains(string(data), "123"), Equals, false)
+	t.Check(strings.Contains(string(data), "user:pass"), Equals, false)
+	t.Check(strings.Contains(string(data), `"abc"`), Equals, true)
+	t.Check(strings.Contains(string(data), `"db1"`), Equals, true)
+
+	got := &secretConfig{}
+	t.Assert(pct.Basedir.ReadConfig("secret", got), IsNil)
+	t.Check(got, DeepEquals, config)
+
+	// Without the key, or with the wrong key, the config can't be read.
+	pct.SetConfigKey(nil)
+	err = pct.Basedir.ReadConfig("secret", &secretConfig{})
+	t.Check(err, NotNil)
+	pct.SetConfigKey([]byte("fedcba9876543210fedcba9876543210"))
+	err = pct.Basedir.ReadConfig("secret", &secretConfig{})
+	t.Check(err, NotNil)
+
+	// Without a key, configs are written and read as plain text.
+	pct.SetConfigKey(nil)
+	t.Assert(pct.Basedir.WriteConfig("plain", config), IsNil)
+	data, err = ioutil.ReadFile(pct.Basedir.ConfigFile("plain"))
+	t.Assert(err, IsNil)
+	t.Check(pct.IsEncryptedConfig(data), Equals, false)
+	got = &secretConfig{}
+	t.Assert(pct.Basedir.ReadConfig("plain", got), IsNil)
+	t.Check(got, DeepEquals, config)
+}
+
+func (s *ConfigKeyTestSuite) TestEncryptConfigFiles(t *C) {
+	config := &secretConfig{ApiKey: "123", AgentUuid: "abc"}
+	t.Assert(pct.Basedir.WriteConfig("agent", config), IsNil)
+	t.Assert(pct.Basedir.WriteConfigString("qan", `{"Interval":60}`), IsNil)
+
+	_, err := pct.EncryptConfigFiles(pct.Basedir.Dir("config"))
+	t.Check(err, NotNil) // no key
+
+	t.Assert(pct.SetConfigKey(s.key), IsNil)
+	files, err := pct.EncryptConfigFiles(pct.Basedir.Dir("config"))
+	t.Assert(err, IsNil)
+	t.Check(files, DeepEquals, []string{pct.Basedir.ConfigFile("agent")})
+
+	data, err := ioutil.ReadFile(pct.Basedir.ConfigFile("agent"))
+	t.Assert(err, IsNil)
+	t.Check(pct.IsEncryptedConfig(data), Equals, true)
+	got := &secretConfig{}
+	t.Assert(pct.Basedir.ReadConfig("agent", got), IsNil)
+	t.Check(got, DeepEquals, config)
+
+	// Already encrypted, so nothing to do.
+	files, err = pct.EncryptConfigFiles(pct.Basedir.Dir("config"))
+	t.Assert(err, IsNil)
+	t.Check(files, HasLen, 0)
+}
@@ -0,0 +1,217 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+/**
+ * Updates are downloaded in chunks with HTTP Range requests and staged in
+ * the Basedir bin dir (DOWNLOAD_DIR) so a download interrupted by a flaky link,
+ * or by an agent restart, resumes where it stopped.  If the API has a patch
+ * from the current version to the new one (see MakePatch), only the patch is
+ * downloaded.
+ */
+
+const (
+	DOWNLOAD_DIR        = "download" // in Basedir bin dir
+	DOWNLOAD_CHUNK_SIZE = 256 * 1024
+	DOWNLOAD_MAX_TRIES  = 10  // in a row without getting any bytes
+	DOWNLOAD_TIMEOUT    = 240 // seconds, less than UPDATE_TIMEOUT to leave time to install
+)
+
+// A RangeGetter can get part of a resource, see API.GetRange.  If the Updater's
+// APIConnector is a RangeGetter, downloads are resumable.
+type RangeGetter interface {
+	GetRange(apiKey, url string, offset, size int64, w io.Writer) (int, int64, error)
+}
+
+type DownloadNotFoundError struct {
+	Url string
+}
+
+func (e DownloadNotFoundError) Error() string {
+	return "GET " + e.Url + " returned 404"
+}
+
+// Download the new bin and its signature.  Patch the current bin if possible,
+// else download the whole new bin.  Downloading stops after DOWNLOAD_TIMEOUT,
+// before the Update cmd times out; the next Update resumes it.
+func (u *Updater) downloadResumable(rg RangeGetter, url, version string) ([]byte, []byte, error) {
+	deadline := time.Now().Add(DOWNLOAD_TIMEOUT * time.Second)
+	sig, err := u.download(url + ".sig")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	patchUrl := fmt.Sprintf("%s/percona-agent-%s-%s.patch", u.api.EntryLink("download"), u.currentVersion, version)
+	if data, err := u.patchCurrentBin(rg, patchUrl, sig, deadline); err == nil {
+		return data, sig, nil
+	} else if _, ok := err.(DownloadNotFoundError); !ok {
+		u.logger.Warn("Cannot update with patch:", err)
+	}
+
+	data, err := u.downloadFile(rg, url+".gz", deadline)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		if data, err = ioutil.ReadAll(gz); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, sig, nil
+}
+
+func (u *Updater) patchCurrentBin(rg RangeGetter, url string, sig []byte, deadline time.Time) ([]byte, error) {
+	cur, err := ioutil.ReadFile(u.currentBin)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := u.downloadFile(rg, url, deadline)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ApplyPatch(cur, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.checkSignature(data, sig); err != nil {
+		return nil, fmt.Errorf("patched bin: %s", err)
+	}
+	u.logger.Info(fmt.Sprintf("Patched %s with %s (%s)", u.currentBin, url, Bytes(uint64(len(patch)))))
+	return data, nil
+}
+
+// Download url to a file in DOWNLOAD_DIR, resuming from the bytes already there.
+// The file is removed once it's complete.  Retries stop at the deadline.
+func (u *Updater) downloadFile(rg RangeGetter, url string, deadline time.Time) ([]byte, error) {
+	dir := filepath.Join(Basedir.Dir("bin"), DOWNLOAD_DIR)
+	if err := MakeDir(dir); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	file := filepath.Join(dir, path.Base(url)+".part")
+
+	backoff := NewBackoff(time.Minute)
+	for tries := 1; ; tries++ {
+		got, done, err := u.getChunks(rg, url, file, deadline)
+		if err == nil && done {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			os.Remove(file)
+			return data, nil
+		}
+		if _, ok := err.(DownloadNotFoundError); ok {
+			return nil, err
+		}
+		if got > 0 {
+			tries = 0 // progress, so keep trying
+		}
+		if tries >= DOWNLOAD_MAX_TRIES {
+			return nil, fmt.Errorf("%s (%d tries without progress, partial download in %s)", err, tries, file)
+		}
+		wait := backoff.Wait()
+		if time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("%s (download timeout, partial download in %s)", err, file)
+		}
+		u.logger.Warn(fmt.Sprintf("%s; retrying in %s", err, wait))
+		time.Sleep(wait)
+	}
+}
+
+// Get chunks of url, appending them to file, until done, error, or the deadline.
+// Returns how many bytes were downloaded.
+func (u *Updater) getChunks(rg RangeGetter, url, file string, deadline time.Time) (int64, bool, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	start := info.Size()
+	offset := start
+	if offset == 0 {
+		u.logger.Info("Downloading", url)
+	} else {
+		u.logger.Info("Resuming download of", url, "at", Bytes(uint64(offset)))
+	}
+
+	for {
+		if time.Now().After(deadline) {
+			return offset - start, false, fmt.Errorf("GET %s: download timeout at %s", url, Bytes(uint64(offset)))
+		}
+		code, total, err := rg.GetRange(u.api.ApiKey(), url, offset, DOWNLOAD_CHUNK_SIZE, f)
+		switch code {
+		case http.StatusPartialContent, http.StatusOK:
+		case http.StatusNotFound:
+			os.Remove(file)
+			return 0, false, DownloadNotFoundError{url}
+		case http.StatusRequestedRangeNotSatisfiable:
+			if offset > 0 && (total < 0 || total == offset) {
+				// We have the whole file, e.g. the agent stopped before it
+				// was used.  If it's not the right file, its signature fails.
+				return offset - start, true, nil
+			}
+			// The file is bigger than the resource, e.g. it changed, so start over.
+			f.Truncate(0)
+			return 0, false, fmt.Errorf("GET %s returned 416 at %d of %d bytes", url, offset, total)
+		default:
+			if err == nil {
+				err = fmt.Errorf("GET %s returned %d, expected 206", url, code)
+			}
+		}
+		if code == http.StatusOK && offset > 0 {
+			// The server ignored the range and sent the whole file, which we
+			// appended to what we had, so start over.
+			f.Truncate(0)
+			return 0, false, fmt.Errorf("GET %s returned 200, expected 206", url)
+		}
+
+		info, statErr := f.Stat()
+		if statErr != nil {
+			return 0, false, statErr
+		}
+		offset = info.Size()
+		if err != nil {
+			return offset - start, false, err
+		}
+		if code == http.StatusOK || (total >= 0 && offset >= total) {
+			return offset - start, true, nil
+		}
+	}
+}
@@ -19,6 +19,7 @@ package pct
 
 import (
 	"fmt"
+	"time"
 )
 
 type ServiceIsRunningError struct {
@@ -126,3 +127,25 @@ type DuplicateServiceInstanceError struct {
 func (e DuplicateServiceInstanceError) Error() string {
 	return fmt.Sprintf("Duplicate %s instance: %d", e.Service, e.Id)
 }
+
+/////////////////////////////////////////////////////////////////////////////
+
+type DrainTimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e DrainTimeoutError) Error() string {
+	return fmt.Sprintf("Timeout draining %s after %s", e.Name, e.Timeout)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type UpdateNotAllowedError struct {
+	Version string
+	Reason  string
+}
+
+func (e UpdateNotAllowedError) Error() string {
+	return fmt.Sprintf("Update to %s not allowed: %s", e.Version, e.Reason)
+}
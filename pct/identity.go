@@ -0,0 +1,155 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/**
+ * An agent identity is a private key, generated on the agent's host, and a
+ * certificate for it issued by the API with the agent's UUID as the subject
+ * common name.  The agent uses it as its TLS client certificate (see Transport)
+ * for every API request and websocket, so it does not need the account-wide
+ * API key.  The key never leaves the host: the API only receives a CSR.
+ */
+
+const (
+	AGENT_KEY_FILE  = "agent-key.pem"  // in config dir
+	AGENT_CERT_FILE = "agent-cert.pem" // in config dir
+)
+
+// NewAgentIdentity generates a new private key and a CSR for it, both PEM.
+func NewAgentIdentity(agentUuid string) (keyPEM, csrPEM []byte, err error) {
+	if agentUuid == "" {
+		return nil, nil, errors.New("Agent UUID is required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   agentUuid,
+			Organization: []string{"percona-agent"},
+		},
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	return keyPEM, csrPEM, nil
+}
+
+// RequestAgentCert sends the CSR to the API (url is usually
+// <api>/agents/<uuid>/cert) and returns the PEM certificate it issues.
+// If the agent already has an identity, it authenticates the request.
+func RequestAgentCert(api APIConnector, apiKey, url string, csrPEM []byte) ([]byte, error) {
+	resp, certPEM, err := api.Post(apiKey, url, csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("POST %s: no response", url)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return nil, fmt.Errorf("POST %s: API returned %s", url, resp.Status)
+	}
+	if len(certPEM) == 0 {
+		return nil, fmt.Errorf("POST %s: API returned no certificate", url)
+	}
+	return certPEM, nil
+}
+
+// VerifyAgentIdentity returns an error if the key and cert do not match, or
+// the cert is not for the agent or not valid now.
+func VerifyAgentIdentity(keyPEM, certPEM []byte, agentUuid string) error {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if cert.Subject.CommonName != agentUuid {
+		return fmt.Errorf("Agent certificate is for %s, not agent %s", cert.Subject.CommonName, agentUuid)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("Agent certificate is valid from %s to %s", cert.NotBefore, cert.NotAfter)
+	}
+	return nil
+}
+
+// WriteAgentIdentity saves the key and cert, replacing the current ones.  The
+// new files are written first and renamed so a crash doesn't leave a key that
+// doesn't match its cert.
+func WriteAgentIdentity(keyPEM, certPEM []byte) error {
+	keyFile := Basedir.File("agent-key")
+	certFile := Basedir.File("agent-cert")
+	if err := ioutil.WriteFile(keyFile+".new", keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile+".new", certPEM, 0600); err != nil {
+		os.Remove(keyFile + ".new")
+		return err
+	}
+	if err := os.Rename(keyFile+".new", keyFile); err != nil {
+		return err
+	}
+	return os.Rename(certFile+".new", certFile)
+}
+
+func HaveAgentIdentity() bool {
+	return FileExists(Basedir.File("agent-key")) && FileExists(Basedir.File("agent-cert"))
+}
+
+// NewAgentCert creates a new key, gets a cert for it from the API, verifies,
+// and saves both.  It's used by the installer and to rotate the identity.
+func NewAgentCert(api APIConnector, apiKey, url, agentUuid string) error {
+	keyPEM, csrPEM, err := NewAgentIdentity(agentUuid)
+	if err != nil {
+		return err
+	}
+	certPEM, err := RequestAgentCert(api, apiKey, url, csrPEM)
+	if err != nil {
+		return err
+	}
+	if err := VerifyAgentIdentity(keyPEM, certPEM, agentUuid); err != nil {
+		return err
+	}
+	return WriteAgentIdentity(keyPEM, certPEM)
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// identity.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type IdentityTestSuite struct {
+	tmpDir string
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	api    *httptest.Server
+	cn     string // override CN of issued certs
+}
+
+var _ = Suite(&IdentityTestSuite{})
+
+func (s *IdentityTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test-pct-identity")
+	t.Assert(err, IsNil)
+	t.Assert(pct.Basedir.Init(s.tmpDir), IsNil)
+
+	// Fake API CA which signs every CSR it receives.
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	t.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	t.Assert(err, IsNil)
+	s.caCert, err = x509.ParseCertificate(der)
+	t.Assert(err, IsNil)
+
+	s.api = httptest.NewServer(http.HandlerFunc(s.signCSR))
+}
+
+func (s *IdentityTestSuite) TearDownSuite(t *C) {
+	s.api.Close()
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *IdentityTestSuite) signCSR(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	block, _ := pem.Decode(data)
+	if block == nil {
+		http.Error(w, "no CSR", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		http.Error(w, "bad CSR", http.StatusBadRequest)
+		return
+	}
+	cn := csr.Subject.CommonName
+	if s.cn != "" {
+		cn = s.cn
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// --------------------------------------------------------------------------
+
+func (s *IdentityTestSuite) TestNewAgentCert(t *C) {
+	s.cn = ""
+	api := pct.NewAPI()
+	err := pct.NewAgentCert(api, "", s.api.URL+"/agents/abc-123/cert", "abc-123")
+	t.Assert(err, IsNil)
+	t.Check(pct.HaveAgentIdentity(), Equals, true)
+
+	key1, err := ioutil.ReadFile(pct.Basedir.File("agent-key"))
+	t.Assert(err, IsNil)
+	cert1, err := ioutil.ReadFile(pct.Basedir.File("agent-cert"))
+	t.Assert(err, IsNil)
+	t.Check(pct.VerifyAgentIdentity(key1, cert1, "abc-123"), IsNil)
+	t.Check(pct.VerifyAgentIdentity(key1, cert1, "def-456"), NotNil)
+
+	// Rotate: new key and cert.
+	err = pct.NewAgentCert(api, "", s.api.URL+"/agents/abc-123/cert", "abc-123")
+	t.Assert(err, IsNil)
+	key2, _ := ioutil.ReadFile(pct.Basedir.File("agent-key"))
+	cert2, _ := ioutil.ReadFile(pct.Basedir.File("agent-cert"))
+	t.Check(string(key2), Not(Equals), string(key1))
+	t.Check(pct.VerifyAgentIdentity(key2, cert2, "abc-123"), IsNil)
+	t.Check(pct.VerifyAgentIdentity(key1, cert2, "abc-123"), NotNil)
+}
+
+func (s *IdentityTestSuite) TestWrongAgent(t *C) {
+	// API issues a cert for another agent: it must not replace the identity.
+	os.Remove(pct.Basedir.File("agent-key"))
+	os.Remove(pct.Basedir.File("agent-cert"))
+	s.cn = "def-456"
+	defer func() { s.cn = "" }()
+	err := pct.NewAgentCert(pct.NewAPI(), "", s.api.URL+"/agents/abc-123/cert", "abc-123")
+	t.Check(err, NotNil)
+	t.Check(pct.HaveAgentIdentity(), Equals, false)
+}
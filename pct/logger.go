@@ -20,13 +20,28 @@ package pct
 import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
+	"strconv"
+	"strings"
 	"time"
 )
 
+/**
+ * Log entries can have structured fields, key/value pairs added with With().
+ * proto.LogEntry has only a message, so the fields are appended to the message
+ * in logfmt (key=value, quoted if needed) after LOG_FIELDS_SEP.  This is still
+ * readable in the API and plain text log files, and ParseLogFields gets them
+ * back for structured output like JSON lines.
+ */
+
+const (
+	LOG_FIELDS_SEP = "\t"
+)
+
 type Logger struct {
 	logChan chan *proto.LogEntry
 	service string
 	cmd     *proto.Cmd
+	fields  string // logfmt, see With()
 }
 
 func NewLogger(logChan chan *proto.LogEntry, service string) *Logger {
@@ -45,6 +60,27 @@ func (l *Logger) LogChan() chan *proto.LogEntry {
 	return l.logChan
 }
 
+// With returns a copy of the logger which adds the key/value fields to every
+// log entry, e.g. logger.With("instance", "db1", "interval", 60).  Fields are
+// added to the logger's own fields, if any.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := []string{}
+	if l.fields != "" {
+		fields = append(fields, l.fields)
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := logFieldKey(fmt.Sprintf("%v", keyvals[i]))
+		val := "" // odd number of keyvals
+		if i+1 < len(keyvals) {
+			val = fmt.Sprintf("%v", keyvals[i+1])
+		}
+		fields = append(fields, key+"="+logFieldValue(val))
+	}
+	newLogger := *l
+	newLogger.fields = strings.Join(fields, " ")
+	return &newLogger
+}
+
 func (l *Logger) Debug(entry ...interface{}) {
 	l.log(false, proto.LOG_DEBUG, entry)
 }
@@ -78,6 +114,9 @@ func (l *Logger) log(offline bool, level byte, entry []interface{}) {
 		}
 		fullMsg += fmt.Sprintf("%v", str)
 	}
+	if l.fields != "" {
+		fullMsg += LOG_FIELDS_SEP + l.fields
+	}
 	logEntry := &proto.LogEntry{
 		Ts:      time.Now().UTC(),
 		Level:   level,
@@ -93,3 +132,69 @@ func (l *Logger) log(offline bool, level byte, entry []interface{}) {
 		// is receiving log entries faster than it can buffer and send them.
 	}
 }
+
+// ParseLogFields splits a log entry message into the message and its fields,
+// see Logger.With().  fields is nil if the message has no fields.
+func ParseLogFields(msg string) (string, map[string]string) {
+	n := strings.LastIndex(msg, LOG_FIELDS_SEP)
+	if n < 0 {
+		return msg, nil
+	}
+	fields := make(map[string]string)
+	s := msg[n+len(LOG_FIELDS_SEP):]
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq <= 0 || logFieldKey(s[:eq]) != s[:eq] {
+			return msg, nil // not fields, just a tab in the message
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return msg, nil
+			}
+			var err error
+			if val, err = strconv.Unquote(s[:end+1]); err != nil {
+				return msg, nil
+			}
+			s = s[end+1:]
+		} else if sp := strings.Index(s, " "); sp >= 0 {
+			val = s[:sp]
+			s = s[sp:]
+		} else {
+			val = s
+			s = ""
+		}
+		if s != "" && s[0] != ' ' {
+			return msg, nil
+		}
+		s = strings.TrimPrefix(s, " ")
+		fields[key] = val
+	}
+	return msg[:n], fields
+}
+
+// Keys are letters, digits, and _ . - only; other characters become _.
+func logFieldKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func logFieldValue(val string) string {
+	if val == "" || strings.ContainsAny(val, " \t\n\"=") {
+		return strconv.Quote(val)
+	}
+	return val
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type LoggerTestSuite struct {
+}
+
+var _ = Suite(&LoggerTestSuite{})
+
+func (s *LoggerTestSuite) TestWith(t *C) {
+	logChan := make(chan *proto.LogEntry, 3)
+	logger := pct.NewLogger(logChan, "test")
+	logger.With("instance", "db1", "query", `select "a"`).With("n", 3).Info("hello", "world")
+	logger.Info("no\tfields")
+
+	entry := <-logChan
+	t.Check(entry.Msg, Equals, "hello world\tinstance=db1 query=\"select \\\"a\\\"\" n=3")
+	msg, fields := pct.ParseLogFields(entry.Msg)
+	t.Check(msg, Equals, "hello world")
+	t.Check(fields, DeepEquals, map[string]string{"instance": "db1", "query": `select "a"`, "n": "3"})
+
+	// The original logger doesn't have the fields.
+	entry = <-logChan
+	msg, fields = pct.ParseLogFields(entry.Msg)
+	t.Check(msg, Equals, "no\tfields")
+	t.Check(fields, IsNil)
+}
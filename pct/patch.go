@@ -0,0 +1,150 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/**
+ * A patch turns one bin into another by copying ranges of the old bin and
+ * inserting new bytes, so a patch between consecutive versions is much smaller
+ * than the new bin.  The format is PATCH_MAGIC, the new bin size (uvarint),
+ * then ops: PATCH_COPY offset length, or PATCH_INSERT length bytes (uvarints).
+ * The patched bin must be verified with its signature like a downloaded bin.
+ */
+
+const (
+	PATCH_MAGIC      = "PCTPATCH1"
+	PATCH_COPY       = 'C'
+	PATCH_INSERT     = 'I'
+	PATCH_BLOCK_SIZE = 32      // min copy length
+	PATCH_MAX_SIZE   = 1 << 30 // max new bin size
+)
+
+var ErrInvalidPatch = errors.New("Invalid patch")
+
+// MakePatch returns the patch from old to new.  It's used to build patches
+// for the API, and for testing.
+func MakePatch(oldBin, newBin []byte) []byte {
+	// Index the blocks of oldBin.  Any match at least two blocks long contains
+	// a whole block, which is then extended backward and forward.
+	index := make(map[string]int)
+	for i := 0; i+PATCH_BLOCK_SIZE <= len(oldBin); i += PATCH_BLOCK_SIZE {
+		block := string(oldBin[i : i+PATCH_BLOCK_SIZE])
+		if _, ok := index[block]; !ok {
+			index[block] = i
+		}
+	}
+
+	patch := &bytes.Buffer{}
+	patch.WriteString(PATCH_MAGIC)
+	writeUvarint(patch, uint64(len(newBin)))
+
+	insert := 0 // start of bytes to insert
+	for i := 0; i+PATCH_BLOCK_SIZE <= len(newBin); {
+		j, ok := index[string(newBin[i:i+PATCH_BLOCK_SIZE])]
+		if !ok {
+			i++
+			continue
+		}
+		for i > insert && j > 0 && newBin[i-1] == oldBin[j-1] {
+			i--
+			j--
+		}
+		n := 0
+		for i+n < len(newBin) && j+n < len(oldBin) && newBin[i+n] == oldBin[j+n] {
+			n++
+		}
+		if i > insert {
+			patch.WriteByte(PATCH_INSERT)
+			writeUvarint(patch, uint64(i-insert))
+			patch.Write(newBin[insert:i])
+		}
+		patch.WriteByte(PATCH_COPY)
+		writeUvarint(patch, uint64(j))
+		writeUvarint(patch, uint64(n))
+		i += n
+		insert = i
+	}
+	if insert < len(newBin) {
+		patch.WriteByte(PATCH_INSERT)
+		writeUvarint(patch, uint64(len(newBin)-insert))
+		patch.Write(newBin[insert:])
+	}
+	return patch.Bytes()
+}
+
+// ApplyPatch returns the new bin made by applying the patch to the old bin.
+func ApplyPatch(oldBin, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte(PATCH_MAGIC)) {
+		return nil, ErrInvalidPatch
+	}
+	r := bytes.NewReader(patch[len(PATCH_MAGIC):])
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > PATCH_MAX_SIZE {
+		return nil, ErrInvalidPatch
+	}
+	// The size isn't verified until the end, so don't trust it to allocate.
+	// A new bin is usually about the size of the old one, else append grows it.
+	alloc := uint64(4*len(oldBin) + len(patch))
+	if size < alloc {
+		alloc = size
+	}
+	newBin := make([]byte, 0, alloc)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			break // end of patch
+		}
+		switch op {
+		case PATCH_COPY:
+			offset, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || n > uint64(len(oldBin)) || offset > uint64(len(oldBin))-n {
+				return nil, ErrInvalidPatch
+			}
+			newBin = append(newBin, oldBin[offset:offset+n]...)
+		case PATCH_INSERT:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, ErrInvalidPatch
+			}
+			buf := make([]byte, n)
+			r.Read(buf)
+			newBin = append(newBin, buf...)
+		default:
+			return nil, ErrInvalidPatch
+		}
+		if uint64(len(newBin)) > size {
+			return nil, ErrInvalidPatch
+		}
+	}
+	if uint64(len(newBin)) != size {
+		return nil, fmt.Errorf("Invalid patch: newBin bin is %d bytes, expected %d", len(newBin), size)
+	}
+	return newBin, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, x)])
+}
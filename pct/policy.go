@@ -0,0 +1,320 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+)
+
+const (
+	DEFAULT_POLICY_FILE = "/etc/percona-agent/policy.json"
+	CONFIRM_DIR         = "confirm" // in config dir
+	CONFIRM_TTL         = 15 * time.Minute
+)
+
+// Policy rule actions.
+const (
+	POLICY_ALLOW   = "allow"
+	POLICY_DENY    = "deny"
+	POLICY_CONFIRM = "confirm" // allow once after local confirmation
+)
+
+/**
+ * A command policy restricts what the API can make the agent do.  It's a JSON
+ * file outside the basedir, so the agent cannot change it, which must be owned
+ * by root (or the agent user) and not writable by anyone else:
+ *
+ *   {
+ *     "Default": "deny",
+ *     "Rules": [
+ *       {"Service": "agent", "Cmd": "Update", "Action": "confirm"},
+ *       {"Service": "*", "Cmd": "Status", "Action": "allow"},
+ *       {"Service": "qan", "Cmd": "*", "Action": "allow"}
+ *     ],
+ *     "AllowSQL": [
+ *       "^SET GLOBAL (slow_query_log|long_query_time|log_slow_[a-z_]+)\\s*=",
+ *       "^SELECT @@GLOBAL\\.(slow_query_log|long_query_time|log_slow_[a-z_]+)$"
+ *     ]
+ *   }
+ *
+ * The first rule whose Service and Cmd patterns (path.Match) match the command
+ * decides; if none match, Default does (allow if empty).  If AllowSQL is set,
+ * every SQL statement a command would run (the Set of each mysql.Query in its
+ * data, e.g. qan.Config.Start, and SELECT @@GLOBAL.<Verify>) must match one of
+ * its regexes.  A confirm rule
+ * allows the command once if the host owner confirmed it in the last
+ * CONFIRM_TTL with percona-agent -confirm service/cmd.  Without a policy file,
+ * all commands are allowed.
+ */
+type Policy struct {
+	Default  string
+	Rules    []PolicyRule
+	AllowSQL []string `json:",omitempty"`
+}
+
+type PolicyRule struct {
+	Service string // pattern, e.g. agent or *
+	Cmd     string // pattern, e.g. Update or *
+	Action  string // allow, deny, or confirm
+}
+
+type CmdPolicy struct {
+	file   string
+	policy Policy
+	sqlRe  []*regexp.Regexp
+	mux    *sync.Mutex // serializes confirmations
+}
+
+// LoadCmdPolicy loads the policy file.  If the file does not exist, it returns
+// nil, which allows all commands.
+func LoadCmdPolicy(file string) (*CmdPolicy, error) {
+	if !FileExists(file) {
+		return nil, nil
+	}
+	if err := CheckOwnerFile(file, "Policy"); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &CmdPolicy{
+		file: file,
+		mux:  &sync.Mutex{},
+	}
+	if err := json.Unmarshal(data, &p.policy); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s: %s", file, err)
+	}
+	if err := validAction(p.policy.Default, true); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s: Default: %s", file, err)
+	}
+	for i, rule := range p.policy.Rules {
+		if _, err := path.Match(rule.Service, ""); err != nil || rule.Service == "" {
+			return nil, fmt.Errorf("Invalid policy file %s: rule %d: invalid Service pattern: '%s'", file, i+1, rule.Service)
+		}
+		if _, err := path.Match(rule.Cmd, ""); err != nil || rule.Cmd == "" {
+			return nil, fmt.Errorf("Invalid policy file %s: rule %d: invalid Cmd pattern: '%s'", file, i+1, rule.Cmd)
+		}
+		if err := validAction(rule.Action, false); err != nil {
+			return nil, fmt.Errorf("Invalid policy file %s: rule %d: %s", file, i+1, err)
+		}
+	}
+	for _, sql := range p.policy.AllowSQL {
+		re, err := regexp.Compile("(?i)" + sql)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid policy file %s: AllowSQL %s: %s", file, sql, err)
+		}
+		p.sqlRe = append(p.sqlRe, re)
+	}
+	return p, nil
+}
+
+func (p *CmdPolicy) File() string {
+	if p == nil {
+		return ""
+	}
+	return p.file
+}
+
+// Check returns a CmdRejectedError if the policy does not allow the command,
+// else nil.  A nil policy allows all commands.
+func (p *CmdPolicy) Check(cmd *proto.Cmd) error {
+	if p == nil {
+		return nil
+	}
+
+	action := p.policy.Default
+	for _, rule := range p.policy.Rules {
+		serviceMatch, _ := path.Match(rule.Service, cmd.Service)
+		cmdMatch, _ := path.Match(rule.Cmd, cmd.Cmd)
+		if serviceMatch && cmdMatch {
+			action = rule.Action
+			break
+		}
+	}
+
+	switch action {
+	case POLICY_DENY:
+		return CmdRejectedError{Cmd: cmd.Cmd, Reason: "the local command policy denies " + cmd.Service + "/" + cmd.Cmd}
+	case POLICY_CONFIRM:
+		if !p.confirmed(cmd.Service, cmd.Cmd) {
+			return CmdRejectedError{
+				Cmd: cmd.Cmd,
+				Reason: fmt.Sprintf("it requires local confirmation: on the agent host run 'percona-agent -confirm %s/%s', then resend the command within %s",
+					cmd.Service, cmd.Cmd, CONFIRM_TTL),
+			}
+		}
+	}
+
+	if len(p.sqlRe) > 0 {
+		for _, sql := range CmdSQL(cmd.Data) {
+			if !p.allowSQL(sql) {
+				return CmdRejectedError{Cmd: cmd.Cmd, Reason: "the local command policy does not allow SQL: " + sql}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ConfirmCmd lets the next service/cmd command run if the policy requires
+// confirmation for it.  The confirmation expires after CONFIRM_TTL.
+func ConfirmCmd(serviceCmd string) error {
+	part := strings.SplitN(serviceCmd, "/", 2)
+	if len(part) != 2 || part[0] == "" || part[1] == "" || strings.ContainsAny(serviceCmd, " .\\") {
+		return fmt.Errorf("Invalid command: %s: expected service/cmd, e.g. agent/Update", serviceCmd)
+	}
+	dir := filepath.Join(Basedir.Dir("config"), CONFIRM_DIR)
+	if err := MakeDir(dir); err != nil && !os.IsExist(err) {
+		return err
+	}
+	expires := time.Now().Add(CONFIRM_TTL).Unix()
+	file := filepath.Join(dir, part[0]+"-"+part[1])
+	return ioutil.WriteFile(file, []byte(strconv.FormatInt(expires, 10)), 0600)
+}
+
+// CmdSQL returns the SQL statements in the command data: the Set value of
+// every mysql.Query, at any level, and the SELECT run for its Verify value.
+// Keys are matched case-insensitively, like encoding/json does.  Nested JSON in []byte fields, like
+// proto.ServiceData.Config, is decoded too.
+func CmdSQL(data []byte) []string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil
+	}
+	sql := []string{}
+	cmdSQL(v, "", &sql)
+	return sql
+}
+
+// --------------------------------------------------------------------------
+
+func validAction(action string, isDefault bool) error {
+	switch action {
+	case POLICY_ALLOW, POLICY_DENY, POLICY_CONFIRM:
+		return nil
+	case "":
+		if isDefault {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid action: '%s': expected allow, deny, or confirm", action)
+}
+
+func (p *CmdPolicy) confirmed(service, cmd string) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	file := filepath.Join(Basedir.Dir("config"), CONFIRM_DIR, service+"-"+cmd)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	os.Remove(file) // confirmation is used once
+	expires, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix() <= expires
+}
+
+func (p *CmdPolicy) allowSQL(sql string) bool {
+	sql = strings.TrimSpace(sql)
+	for _, re := range p.sqlRe {
+		if re.MatchString(sql) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOwnerFile returns an error if the file can be changed by anyone but
+// root or the current user, i.e. by a compromised agent running as another
+// user or by other users.
+func CheckOwnerFile(file, what string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s file %s must be writable only by its owner, it is %s", what, file, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s file %s must be owned by root or uid %d, it is owned by uid %d", what, file, os.Geteuid(), st.Uid)
+	}
+	return nil
+}
+
+func cmdSQL(v interface{}, key string, sql *[]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			cmdSQL(e, k, sql)
+		}
+	case []interface{}:
+		for _, e := range t {
+			cmdSQL(e, key, sql)
+		}
+	case string:
+		if strings.EqualFold(key, "Set") {
+			if t != "" {
+				*sql = append(*sql, t)
+			}
+			return
+		}
+		if strings.EqualFold(key, "Verify") {
+			if t != "" {
+				*sql = append(*sql, "SELECT @@GLOBAL."+t) // see mysql.Connection.Set
+			}
+			return
+		}
+		if nested, ok := nestedJSON(t); ok {
+			cmdSQL(nested, "", sql)
+		}
+	}
+}
+
+// nestedJSON decodes s if it's a JSON object or array encoded as a []byte
+// (base64), like proto.ServiceData.Config.
+func nestedJSON(s string) (interface{}, bool) {
+	if len(s) < 4 {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 || (data[0] != '{' && data[0] != '[') {
+		return nil, false
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
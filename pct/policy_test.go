@@ -0,0 +1,216 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/json"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// policy.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type PolicyTestSuite struct {
+	tmpDir     string
+	policyFile string
+}
+
+var _ = Suite(&PolicyTestSuite{})
+
+func (s *PolicyTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test-pct-policy")
+	t.Assert(err, IsNil)
+	t.Assert(pct.Basedir.Init(s.tmpDir), IsNil)
+	s.policyFile = filepath.Join(s.tmpDir, "policy.json")
+}
+
+func (s *PolicyTestSuite) TearDownTest(t *C) {
+	os.Remove(s.policyFile)
+	os.RemoveAll(filepath.Join(pct.Basedir.Dir("config"), pct.CONFIRM_DIR))
+}
+
+func (s *PolicyTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *PolicyTestSuite) writePolicy(t *C, policy string, mode os.FileMode) {
+	err := ioutil.WriteFile(s.policyFile, []byte(policy), mode)
+	t.Assert(err, IsNil)
+	t.Assert(os.Chmod(s.policyFile, mode), IsNil)
+}
+
+// --------------------------------------------------------------------------
+
+func (s *PolicyTestSuite) TestNoPolicy(t *C) {
+	// No policy file: nil policy which allows everything.
+	policy, err := pct.LoadCmdPolicy(s.policyFile)
+	t.Assert(err, IsNil)
+	t.Check(policy, IsNil)
+	t.Check(policy.Check(&proto.Cmd{Service: "agent", Cmd: "Update"}), IsNil)
+}
+
+func (s *PolicyTestSuite) TestInvalidPolicy(t *C) {
+	// Others must not be able to write the policy.
+	s.writePolicy(t, `{"Default":"deny"}`, 0666)
+	_, err := pct.LoadCmdPolicy(s.policyFile)
+	t.Check(err, NotNil)
+
+	s.writePolicy(t, `{"Default":"maybe"}`, 0644)
+	_, err = pct.LoadCmdPolicy(s.policyFile)
+	t.Check(err, NotNil)
+
+	s.writePolicy(t, `{"Rules":[{"Service":"agent","Cmd":"Update"}]}`, 0644)
+	_, err = pct.LoadCmdPolicy(s.policyFile)
+	t.Check(err, NotNil)
+
+	s.writePolicy(t, `{"AllowSQL":["SET (GLOBAL"]}`, 0644)
+	_, err = pct.LoadCmdPolicy(s.policyFile)
+	t.Check(err, NotNil)
+}
+
+func (s *PolicyTestSuite) TestRules(t *C) {
+	s.writePolicy(t, `{
+		"Default": "deny",
+		"Rules": [
+			{"Service": "agent", "Cmd": "Update", "Action": "deny"},
+			{"Service": "*", "Cmd": "Get*", "Action": "allow"},
+			{"Service": "qan", "Cmd": "*", "Action": "allow"}
+		]
+	}`, 0644)
+	policy, err := pct.LoadCmdPolicy(s.policyFile)
+	t.Assert(err, IsNil)
+	t.Assert(policy, NotNil)
+
+	t.Check(policy.Check(&proto.Cmd{Service: "qan", Cmd: "StartService"}), IsNil)
+	t.Check(policy.Check(&proto.Cmd{Service: "agent", Cmd: "GetConfig"}), IsNil)
+
+	// First matching rule wins.
+	err = policy.Check(&proto.Cmd{Service: "agent", Cmd: "Update"})
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+
+	// No matching rule: default.
+	err = policy.Check(&proto.Cmd{Service: "mm", Cmd: "StopService"})
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+}
+
+func (s *PolicyTestSuite) TestAllowSQL(t *C) {
+	s.writePolicy(t, `{
+		"AllowSQL": ["^SET GLOBAL (slow_query_log|long_query_time)\\s*="]
+	}`, 0600)
+	policy, err := pct.LoadCmdPolicy(s.policyFile)
+	t.Assert(err, IsNil)
+
+	// SQL is usually in a service config in proto.ServiceData.Config ([]byte).
+	config := map[string]interface{}{
+		"Start": []map[string]string{
+			{"Set": "SET GLOBAL slow_query_log=OFF"},
+			{"Set": "set global long_query_time = 0"},
+		},
+		"Stop": []map[string]string{
+			{"Set": "SET GLOBAL slow_query_log=OFF"},
+		},
+	}
+	configData, _ := json.Marshal(config)
+	data, _ := json.Marshal(proto.ServiceData{Name: "qan", Config: configData})
+	t.Check(pct.CmdSQL(data), HasLen, 3)
+
+	cmd := &proto.Cmd{Service: "agent", Cmd: "StartService", Data: data}
+	t.Check(policy.Check(cmd), IsNil)
+
+	config["Stop"] = []map[string]string{
+		{"Set": "DROP DATABASE mysql"},
+	}
+	configData, _ = json.Marshal(config)
+	cmd.Data, _ = json.Marshal(proto.ServiceData{Name: "qan", Config: configData})
+	err = policy.Check(cmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+DROP DATABASE mysql")
+}
+
+func (s *PolicyTestSuite) TestAllowSQLKeys(t *C) {
+	s.writePolicy(t, `{
+		"AllowSQL": [
+			"^SET GLOBAL long_query_time\\s*=",
+			"^SELECT @@GLOBAL\\.long_query_time$"
+		]
+	}`, 0600)
+	policy, err := pct.LoadCmdPolicy(s.policyFile)
+	t.Assert(err, IsNil)
+
+	// encoding/json matches keys case-insensitively, so "set" and "SET" are
+	// mysql.Query.Set too.  Verify values are run as SELECT @@GLOBAL.<var>.
+	for _, config := range []string{
+		`{"Start":[{"set":"DROP DATABASE x"}]}`,
+		`{"Start":[{"SET":"DROP DATABASE x"}]}`,
+		`{"Start":[{"Set":"SET GLOBAL long_query_time=0","verify":"long_query_time=0; DROP DATABASE x"}]}`,
+	} {
+		data, _ := json.Marshal(proto.ServiceData{Name: "qan", Config: []byte(config)})
+		err = policy.Check(&proto.Cmd{Service: "agent", Cmd: "StartService", Data: data})
+		t.Check(err, FitsTypeOf, pct.CmdRejectedError{}, Commentf(config))
+	}
+
+	config := `{"Start":[{"SET":"SET GLOBAL long_query_time=0","VERIFY":"long_query_time","Expect":"0"}]}`
+	data, _ := json.Marshal(proto.ServiceData{Name: "qan", Config: []byte(config)})
+	sql := pct.CmdSQL(data)
+	sort.Strings(sql)
+	t.Check(sql, DeepEquals, []string{"SELECT @@GLOBAL.long_query_time", "SET GLOBAL long_query_time=0"})
+	t.Check(policy.Check(&proto.Cmd{Service: "agent", Cmd: "StartService", Data: data}), IsNil)
+}
+
+func (s *PolicyTestSuite) TestConfirm(t *C) {
+	s.writePolicy(t, `{
+		"Rules": [
+			{"Service": "agent", "Cmd": "Update", "Action": "confirm"}
+		]
+	}`, 0644)
+	policy, err := pct.LoadCmdPolicy(s.policyFile)
+	t.Assert(err, IsNil)
+
+	// Not confirmed yet.
+	cmd := &proto.Cmd{Service: "agent", Cmd: "Update"}
+	err = policy.Check(cmd)
+	t.Check(err, FitsTypeOf, pct.CmdRejectedError{})
+	t.Check(err.Error(), Matches, ".+percona-agent -confirm agent/Update.+")
+
+	// Other commands are allowed by default.
+	t.Check(policy.Check(&proto.Cmd{Service: "agent", Cmd: "Restart"}), IsNil)
+
+	// Confirmed once, so it's allowed once.
+	t.Check(pct.ConfirmCmd("agent/Update"), IsNil)
+	t.Check(policy.Check(cmd), IsNil)
+	t.Check(policy.Check(cmd), FitsTypeOf, pct.CmdRejectedError{})
+
+	// Expired confirmation.
+	t.Check(pct.ConfirmCmd("agent/Update"), IsNil)
+	file := filepath.Join(pct.Basedir.Dir("config"), pct.CONFIRM_DIR, "agent-Update")
+	t.Assert(ioutil.WriteFile(file, []byte("1"), 0600), IsNil)
+	t.Check(policy.Check(cmd), FitsTypeOf, pct.CmdRejectedError{})
+
+	t.Check(pct.ConfirmCmd("agent"), NotNil)
+	t.Check(pct.ConfirmCmd("../agent/Update"), NotNil)
+}
@@ -19,6 +19,7 @@ package pct
 
 import (
 	"github.com/percona/cloud-protocol/proto"
+	"time"
 )
 
 type ServiceManager interface {
@@ -28,3 +29,27 @@ type ServiceManager interface {
 	GetConfig() ([]proto.AgentConfig, []error)
 	Handle(cmd *proto.Cmd) *proto.Reply
 }
+
+// A Drainer has buffered data which it can flush before it's stopped, e.g. on
+// shutdown.  Drain returns an error if it cannot flush within the timeout.
+type Drainer interface {
+	Drain(timeout time.Duration) error
+}
+
+// DrainChan sends a done chan to the goroutine which reads drainChan, then waits
+// for the goroutine to flush its data and close done, all within the timeout.
+func DrainChan(name string, drainChan chan chan bool, timeout time.Duration) error {
+	done := make(chan bool)
+	timer := time.After(timeout)
+	select {
+	case drainChan <- done:
+	case <-timer:
+		return DrainTimeoutError{Name: name, Timeout: timeout}
+	}
+	select {
+	case <-done:
+	case <-timer:
+		return DrainTimeoutError{Name: name, Timeout: timeout}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy value to not use a proxy even if HTTPS_PROXY, etc. is set.
+const NO_PROXY = "none"
+
+/**
+ * How the agent connects to the API, for REST calls (API) and websockets
+ * (client.WebsocketClient).  The zero value is a direct connection verified
+ * with the system CAs, except that the usual proxy env vars are honored:
+ * HTTPS_PROXY for https and wss, HTTP_PROXY for http and ws, and NO_PROXY.
+ * Only http:// proxies are supported; https and wss are tunneled through
+ * them with CONNECT.
+ */
+type TransportConfig struct {
+	Proxy    string // http://[user:pass@]host:port, overrides env; NO_PROXY to disable
+	NoProxy  string // comma-separated hosts or .domains not to proxy, overrides env
+	CAFile   string // PEM bundle of CAs to verify API and proxy certs, else system CAs
+	CertFile string // PEM client cert, e.g. for TLS-intercepting proxies
+	KeyFile  string // PEM key for CertFile
+}
+
+type transport struct {
+	config    TransportConfig
+	tlsConfig *tls.Config
+	mux       *sync.RWMutex
+}
+
+// Transport is global like Basedir: Init it once, before creating an API or
+// websocket clients, to apply the agent's config to all API traffic.
+var Transport = &transport{
+	tlsConfig: &tls.Config{},
+	mux:       &sync.RWMutex{},
+}
+
+func (t *transport) Init(config TransportConfig) error {
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No PEM certificates in CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return fmt.Errorf("Client cert file and key file must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.Proxy != "" && config.Proxy != NO_PROXY {
+		if _, err := parseProxy(config.Proxy); err != nil {
+			return err
+		}
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.config = config
+	t.tlsConfig = tlsConfig
+	return nil
+}
+
+// TLSConfig returns a copy of the TLS config for connections to serverName.
+func (t *transport) TLSConfig(serverName string) *tls.Config {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return &tls.Config{
+		RootCAs:      t.tlsConfig.RootCAs,
+		Certificates: t.tlsConfig.Certificates,
+		ServerName:   serverName,
+	}
+}
+
+// Proxy is an http.Transport.Proxy func.
+func (t *transport) Proxy(req *http.Request) (*url.URL, error) {
+	return t.ProxyURL(req.URL.Scheme, req.URL.Host)
+}
+
+// ProxyURL returns the proxy to use for the scheme (http, https, ws, wss) and
+// host[:port], or nil to connect directly.
+func (t *transport) ProxyURL(scheme, host string) (*url.URL, error) {
+	t.mux.RLock()
+	proxy := t.config.Proxy
+	noProxy := t.config.NoProxy
+	t.mux.RUnlock()
+
+	if proxy == "" {
+		if scheme == "https" || scheme == "wss" {
+			proxy = getEnv("HTTPS_PROXY", "https_proxy")
+		} else {
+			proxy = getEnv("HTTP_PROXY", "http_proxy")
+		}
+	}
+	if proxy == "" || proxy == NO_PROXY {
+		return nil, nil
+	}
+	if noProxy == "" {
+		noProxy = getEnv("NO_PROXY", "no_proxy")
+	}
+	if !useProxy(host, noProxy) {
+		return nil, nil
+	}
+	return parseProxy(proxy)
+}
+
+// Dial connects to addr (host:port) for the scheme (ws or wss), through the
+// proxy if there is one.  For wss the connection is TLS, verified with the
+// configured CAs; tlsConfig overrides the default TLS config if not nil.
+func (t *transport) Dial(scheme, addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	proxyURL, err := t.ProxyURL(scheme, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if proxyURL == nil {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	} else {
+		conn, err = connectProxy(proxyURL, addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme != "wss" && scheme != "https" {
+		return conn, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if tlsConfig == nil {
+		tlsConfig = t.TLSConfig(host)
+	} else if tlsConfig.ServerName == "" {
+		tlsConfig = &tls.Config{
+			RootCAs:            tlsConfig.RootCAs,
+			Certificates:       tlsConfig.Certificates,
+			InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+			ServerName:         host,
+		}
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// --------------------------------------------------------------------------
+
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy %s: %s", proxy, err)
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("Invalid proxy %s: only http:// proxies are supported", proxy)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy %s: no host", proxy)
+	}
+	return u, nil
+}
+
+// useProxy returns false if host[:port] is local or matches noProxy: a comma-
+// separated list of hosts, domains (.example.com or example.com matches
+// example.com and its subdomains), or * for all hosts.
+func useProxy(host, noProxy string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return false
+	}
+	for _, p := range strings.Split(noProxy, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			return false
+		}
+		if h, _, err := net.SplitHostPort(p); err == nil {
+			p = h
+		}
+		p = strings.TrimPrefix(p, ".")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return false
+		}
+	}
+	return true
+}
+
+// connectProxy opens a tunnel to addr through the proxy with HTTP CONNECT.
+func connectProxy(proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		proxyAddr = net.JoinHostPort(proxyAddr, "80")
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		pass, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s: %s", proxyAddr, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s: %s", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s: CONNECT %s: %s", proxyAddr, addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -22,6 +22,7 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -30,8 +31,78 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
+/**
+ * Updates are staged: Update() keeps a copy of the current bin in the Basedir
+ * bin dir, installs the new bin, and saves an UpdateState.  When the agent is
+ * restarted, the new version is on probation (see agent.Config.UpdateProbation):
+ * it must connect to the API and its services must run.  If not, or if it
+ * starts too many times during probation (i.e. it keeps crashing), Rollback()
+ * reinstalls the previous bin.  Every step is recorded in the update history.
+ */
+
+const (
+	UPDATE_STATE_FILE   = "update.json"        // in Basedir, see Basedir.File("update")
+	UPDATE_HISTORY_FILE = "update-history.log" // in Basedir, see Basedir.File("update-history")
+	UPDATE_PROBATION    = 300                  // seconds
+	UPDATE_MAX_STARTS   = 3
+	UPDATE_TIMEOUT      = 300 // seconds, the agent's timeout for the Update cmd
+)
+
+// Update events, see UpdateEvent.Event.
+const (
+	UPDATE_STAGED   = "staged"
+	UPDATE_STARTED  = "started"
+	UPDATE_OK       = "ok"
+	UPDATE_ROLLBACK = "rollback"
+)
+
+// Update channels, see UpdatePolicy.Channel.
+const (
+	UPDATE_CHANNEL_STABLE  = "stable"
+	UPDATE_CHANNEL_TESTING = "testing"
+)
+
+// UpdatePolicy limits which versions the agent updates to, and when.
+type UpdatePolicy struct {
+	Channel  string             // UPDATE_CHANNEL_STABLE (default) or UPDATE_CHANNEL_TESTING
+	Pin      string             // only update to this version
+	MaxMajor int64              // if > 0, don't update to a greater major version
+	Window   *MaintenanceWindow // when updates and restarts are allowed, nil=always
+}
+
+// Allow returns an UpdateNotAllowedError if the policy doesn't allow updating
+// to the version.  It doesn't check the maintenance window.
+func (p UpdatePolicy) Allow(version string) error {
+	if p.Pin != "" && version != p.Pin {
+		return UpdateNotAllowedError{Version: version, Reason: "agent is pinned to version " + p.Pin}
+	}
+	if p.MaxMajor > 0 {
+		if major, _, _ := VersionStringToInts(version); major > p.MaxMajor {
+			return UpdateNotAllowedError{Version: version, Reason: fmt.Sprintf("max major version is %d", p.MaxMajor)}
+		}
+	}
+	return nil
+}
+
+type UpdateState struct {
+	Version     string // new version, on probation
+	PrevVersion string
+	PrevBin     string // copy of previous bin in Basedir bin dir
+	Staged      time.Time
+	Starts      uint // of new version while on probation
+}
+
+type UpdateEvent struct {
+	Ts          time.Time
+	Event       string
+	Version     string
+	PrevVersion string
+	Reason      string `json:",omitempty"`
+}
+
 var PublicKey = []byte(`-----BEGIN PUBLIC KEY-----
 MIICIjANBgkqhkiG9w0BAQEFAAOCAg8AMIICCgKCAgEA3Ks0r5mrqcxOj95VLyCC
 JGkilUyyqIwK9YANtf1qOghQHM4qR1g22c+4iLalzcKuf7fRFWyEOmthUMJEdaPN
@@ -57,6 +128,7 @@ type Updater struct {
 	major     int64
 	minor     int64
 	patch     int64
+	policy    UpdatePolicy
 }
 
 func NewUpdater(logger *Logger, api APIConnector, pubKey []byte, currentBin, currentVersion string) *Updater {
@@ -82,13 +154,36 @@ func NewUpdater(logger *Logger, api APIConnector, pubKey []byte, currentBin, cur
 	return u
 }
 
+func (u *Updater) SetPolicy(policy UpdatePolicy) {
+	u.policy = policy
+}
+
+func (u *Updater) Policy() UpdatePolicy {
+	return u.policy
+}
+
+// Check returns the latest version in the update channel that the policy allows,
+// and whether it's a major, minor, or patch update.  If the agent is pinned, the
+// pinned version is the latest.
 func (u *Updater) Check() (string, string, error) {
-	url := fmt.Sprintf("%s/latest", u.api.EntryLink("download"), u.major, u.minor)
-	v, err := u.download(url)
-	if err != nil {
-		return "", "", err
+	var version string
+	if u.policy.Pin != "" {
+		version = u.policy.Pin
+	} else {
+		url := fmt.Sprintf("%s/latest", u.api.EntryLink("download"))
+		if u.policy.Channel != "" && u.policy.Channel != UPDATE_CHANNEL_STABLE {
+			url = fmt.Sprintf("%s/%s/latest", u.api.EntryLink("download"), u.policy.Channel)
+		}
+		v, err := u.download(url)
+		if err != nil {
+			return "", "", err
+		}
+		version = strings.TrimSpace(string(v))
+		if err := u.policy.Allow(version); err != nil {
+			u.logger.Info("Ignoring latest version:", err)
+			return "", "", nil
+		}
 	}
-	version := string(v)
 	major, minor, patch := VersionStringToInts(version)
 	switch {
 	case major > u.major:
@@ -103,17 +198,30 @@ func (u *Updater) Check() (string, string, error) {
 }
 
 func (u *Updater) Update(version string) error {
+	if err := u.policy.Allow(version); err != nil {
+		return err
+	}
 	u.logger.Info("Updating to", version)
 
-	// Download and decompress the gzipped bin and its signature.
+	// Download and decompress the gzipped bin and its signature.  If possible,
+	// resume a previous download, or patch the current bin, see download.go.
 	url := fmt.Sprintf("%s/percona-agent-%s", u.api.EntryLink("download"), version)
-	data, err := u.download(url + ".gz")
-	if err != nil {
-		return err
-	}
-	sig, err := u.download(url + ".sig")
-	if err != nil {
-		return err
+	var data, sig []byte
+	var err error
+	if rg, ok := u.api.(RangeGetter); ok {
+		data, sig, err = u.downloadResumable(rg, url, version)
+		if err != nil {
+			return err
+		}
+	} else {
+		data, err = u.download(url + ".gz")
+		if err != nil {
+			return err
+		}
+		sig, err = u.download(url + ".sig")
+		if err != nil {
+			return err
+		}
 	}
 
 	// Check the binary's signature.  It's signed by Percona.
@@ -139,16 +247,100 @@ func (u *Updater) Update(version string) error {
 		return fmt.Errorf("%s -version returns %s, expected %s", newBin, out, version)
 	}
 
+	// Keep a copy of the current bin to roll back to if the new one fails.
+	prevBin := filepath.Join(Basedir.Dir("bin"), "percona-agent-"+u.currentVersion)
+	u.logger.Info("Copying", u.currentBin, "to", prevBin)
+	if err := copyBin(u.currentBin, prevBin); err != nil {
+		return err
+	}
+
 	// Overwrite the current, running binary with new bin.
-	u.logger.Info("Moving", newBin, "to", u.currentBin)
-	if err := os.Rename(newBin, u.currentBin); err != nil {
+	u.logger.Info("Installing", newBin, "as", u.currentBin)
+	if err := copyBin(newBin, u.currentBin); err != nil {
+		return err
+	}
+	os.Remove(newBin)
+
+	state := &UpdateState{
+		Version:     version,
+		PrevVersion: u.currentVersion,
+		PrevBin:     prevBin,
+		Staged:      time.Now().UTC(),
+	}
+	if err := writeUpdateState(state); err != nil {
+		return err
+	}
+	u.record(UPDATE_STAGED, state, "")
+
+	u.logger.Info("Update staged; restart percona-agent to start", version, "on probation")
+	return nil
+}
+
+// Starting returns the state of the update on probation, if any, after counting
+// this start of the new version.  It returns nil if there's no update, or if
+// the previous version is running because the update was rolled back by the
+// start script after the new version exited with an error during probation.
+func (u *Updater) Starting() (*UpdateState, error) {
+	state, err := ReadUpdateState()
+	if err != nil || state == nil {
+		return nil, err
+	}
+	if state.Version != u.currentVersion {
+		if err := os.Remove(Basedir.File("update")); err != nil {
+			return nil, err
+		}
+		if state.PrevVersion == u.currentVersion {
+			reason := fmt.Sprintf("%s exited with an error", state.Version)
+			u.logger.Error(fmt.Sprintf("Rolled back percona-agent %s to %s: %s", state.Version, state.PrevVersion, reason))
+			u.record(UPDATE_ROLLBACK, state, reason)
+		}
+		return nil, nil
+	}
+	state.Starts++
+	if err := writeUpdateState(state); err != nil {
+		return nil, err
+	}
+	u.record(UPDATE_STARTED, state, "")
+	return state, nil
+}
+
+// Passed ends the probation of the update: the new version is kept.
+func (u *Updater) Passed(state *UpdateState) error {
+	if err := os.Remove(Basedir.File("update")); err != nil {
 		return err
 	}
+	u.logger.Info("Update to", state.Version, "passed probation")
+	u.record(UPDATE_OK, state, "")
+	return nil
+}
 
-	u.logger.Info("Update complete; restart percona-agent")
+// Rollback reinstalls the previous bin.  The agent must be restarted to run it.
+func (u *Updater) Rollback(state *UpdateState, reason string) error {
+	u.logger.Warn("Rolling back to", state.PrevVersion, "because", reason)
+	if err := copyBin(state.PrevBin, u.currentBin); err != nil {
+		return err
+	}
+	if err := os.Remove(Basedir.File("update")); err != nil {
+		return err
+	}
+	u.logger.Error(fmt.Sprintf("Rolled back percona-agent %s to %s: %s", state.Version, state.PrevVersion, reason))
+	u.record(UPDATE_ROLLBACK, state, reason)
 	return nil
 }
 
+func (u *Updater) record(event string, state *UpdateState, reason string) {
+	e := UpdateEvent{
+		Ts:          time.Now().UTC(),
+		Event:       event,
+		Version:     state.Version,
+		PrevVersion: state.PrevVersion,
+		Reason:      reason,
+	}
+	if err := appendUpdateHistory(e); err != nil {
+		u.logger.Warn("Cannot write update history:", err)
+	}
+}
+
 func (u *Updater) download(url string) ([]byte, error) {
 	u.logger.Debug("download:call:" + url)
 	defer u.logger.Debug("download:call")
@@ -184,3 +376,78 @@ func VersionStringToInts(version string) (int64, int64, int64) {
 	patch, _ := strconv.ParseInt(v[2], 10, 8)
 	return major, minor, patch
 }
+
+// ReadUpdateState returns the state of the update on probation, or nil if none.
+func ReadUpdateState() (*UpdateState, error) {
+	data, err := ioutil.ReadFile(Basedir.File("update"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &UpdateState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %s", Basedir.File("update"), err)
+	}
+	return state, nil
+}
+
+// UpdateHistory returns all update events, oldest first.
+func UpdateHistory() ([]UpdateEvent, error) {
+	data, err := ioutil.ReadFile(Basedir.File("update-history"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []UpdateEvent{}, nil
+		}
+		return nil, err
+	}
+	events := []UpdateEvent{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		e := UpdateEvent{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func writeUpdateState(state *UpdateState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(Basedir.File("update"), data, 0644)
+}
+
+func appendUpdateHistory(e UpdateEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(Basedir.File("update-history"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Copy src to dst by way of a temp file in dst's dir, so a running bin
+// is replaced atomically.
+func copyBin(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, os.FileMode(0755)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
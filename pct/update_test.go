@@ -19,12 +19,17 @@ package pct_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -47,6 +52,7 @@ func (s *UpdateTestSuite) SetUpSuite(t *C) {
 	var err error
 	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test-pct-update")
 	t.Assert(err, IsNil)
+	t.Assert(pct.Basedir.Init(s.tmpDir), IsNil)
 
 	s.logChan = make(chan *proto.LogEntry, 1000)
 	s.logger = pct.NewLogger(s.logChan, "qan-test")
@@ -55,6 +61,7 @@ func (s *UpdateTestSuite) SetUpSuite(t *C) {
 		"agent":     "http://localhost/agent",
 		"instances": "http://localhost/instances",
 		"update":    "http://localhost/update",
+		"download":  "http://localhost/download",
 	}
 	s.api = mock.NewAPI("http://localhost", "http://localhost", "123", "abc-123-def", links)
 
@@ -88,6 +95,9 @@ func (s *UpdateTestSuite) TearDownSuite(t *C) {
 // --------------------------------------------------------------------------
 
 func (s *UpdateTestSuite) TestCheck(t *C) {
+	defer os.Remove(pct.Basedir.File("update"))
+	defer os.Remove(pct.Basedir.File("update-history"))
+
 	// First make a very fake percona-agent "binary": just a file containing "A".
 	// Later we'll check that the update process overwrites this with the updated binary.
 	curBin := filepath.Join(s.tmpDir + "/percona-agent")
@@ -133,4 +143,322 @@ func (s *UpdateTestSuite) TestCheck(t *C) {
 	out, err := exec.Command(curBin, "-version").Output()
 	t.Assert(err, IsNil)
 	t.Check(strings.TrimSpace(string(out)), Equals, "percona-agent 1.0.1 rev 19b6b2ede12bfd2a012d40ac572a660be7aff1e7")
+
+	// The update is staged: the previous bin is kept to roll back to.
+	prevBin := filepath.Join(pct.Basedir.Dir("bin"), "percona-agent-1.0.0")
+	data, err := ioutil.ReadFile(prevBin)
+	t.Assert(err, IsNil)
+	t.Check(data, DeepEquals, []byte{0x41})
+
+	state, err := pct.ReadUpdateState()
+	t.Assert(err, IsNil)
+	t.Assert(state, NotNil)
+	t.Check(state.Version, Equals, "1.0.1")
+	t.Check(state.PrevVersion, Equals, "1.0.0")
+	t.Check(state.PrevBin, Equals, prevBin)
+	t.Check(state.Starts, Equals, uint(0))
+}
+
+func (s *UpdateTestSuite) TestRollback(t *C) {
+	defer os.Remove(pct.Basedir.File("update"))
+	defer os.Remove(pct.Basedir.File("update-history"))
+
+	// Current bin is the new version 1.0.1, previous bin is 1.0.0.
+	curBin := filepath.Join(s.tmpDir + "/percona-agent")
+	err := ioutil.WriteFile(curBin, []byte("1.0.1"), os.FileMode(0755))
+	t.Assert(err, IsNil)
+	prevBin := filepath.Join(pct.Basedir.Dir("bin"), "percona-agent-1.0.0")
+	err = ioutil.WriteFile(prevBin, []byte("1.0.0"), os.FileMode(0755))
+	t.Assert(err, IsNil)
+	state := &pct.UpdateState{
+		Version:     "1.0.1",
+		PrevVersion: "1.0.0",
+		PrevBin:     prevBin,
+	}
+	data, _ := json.Marshal(state)
+	err = ioutil.WriteFile(pct.Basedir.File("update"), data, 0644)
+	t.Assert(err, IsNil)
+
+	// New version starts, it's on probation.
+	u := pct.NewUpdater(s.logger, s.api, s.pubKey, curBin, "1.0.1")
+	got, err := u.Starting()
+	t.Assert(err, IsNil)
+	t.Assert(got, NotNil)
+	t.Check(got.Starts, Equals, uint(1))
+
+	got, err = u.Starting()
+	t.Assert(err, IsNil)
+	t.Check(got.Starts, Equals, uint(2))
+
+	// It fails probation, so the previous bin is reinstalled.
+	err = u.Rollback(got, "not connected to API")
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(curBin)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "1.0.0")
+	t.Check(pct.FileExists(pct.Basedir.File("update")), Equals, false)
+
+	// When restarted, the previous version has no update on probation.
+	u = pct.NewUpdater(s.logger, s.api, s.pubKey, curBin, "1.0.0")
+	got, err = u.Starting()
+	t.Assert(err, IsNil)
+	t.Check(got, IsNil)
+
+	events, err := pct.UpdateHistory()
+	t.Assert(err, IsNil)
+	t.Assert(events, HasLen, 3)
+	t.Check(events[0].Event, Equals, pct.UPDATE_STARTED)
+	t.Check(events[1].Event, Equals, pct.UPDATE_STARTED)
+	t.Check(events[2].Event, Equals, pct.UPDATE_ROLLBACK)
+	t.Check(events[2].Version, Equals, "1.0.1")
+	t.Check(events[2].PrevVersion, Equals, "1.0.0")
+	t.Check(events[2].Reason, Equals, "not connected to API")
+}
+
+func (s *UpdateTestSuite) TestRolledBackByScript(t *C) {
+	defer os.Remove(pct.Basedir.File("update-history"))
+
+	// The new version 1.0.1 exited with an error during probation, so the
+	// start script reinstalled and started the previous version.
+	state := &pct.UpdateState{
+		Version:     "1.0.1",
+		PrevVersion: "1.0.0",
+		Starts:      1,
+	}
+	data, _ := json.Marshal(state)
+	err := ioutil.WriteFile(pct.Basedir.File("update"), data, 0644)
+	t.Assert(err, IsNil)
+
+	u := pct.NewUpdater(s.logger, s.api, s.pubKey, filepath.Join(s.tmpDir, "percona-agent"), "1.0.0")
+	got, err := u.Starting()
+	t.Assert(err, IsNil)
+	t.Check(got, IsNil)
+	t.Check(pct.FileExists(pct.Basedir.File("update")), Equals, false)
+
+	events, err := pct.UpdateHistory()
+	t.Assert(err, IsNil)
+	t.Assert(events, HasLen, 1)
+	t.Check(events[0].Event, Equals, pct.UPDATE_ROLLBACK)
+	t.Check(events[0].Reason, Equals, "1.0.1 exited with an error")
+}
+
+func (s *UpdateTestSuite) TestPolicy(t *C) {
+	curBin := filepath.Join(s.tmpDir + "/percona-agent")
+	u := pct.NewUpdater(s.logger, s.api, s.pubKey, curBin, "1.0.0")
+
+	// Pinned to 1.0.1: Check returns it without asking the API, and
+	// Update refuses other versions without downloading anything.
+	u.SetPolicy(pct.UpdatePolicy{Pin: "1.0.1"})
+	level, version, err := u.Check()
+	t.Assert(err, IsNil)
+	t.Check(level, Equals, "patch")
+	t.Check(version, Equals, "1.0.1")
+	err = u.Update("1.0.2")
+	t.Check(err, FitsTypeOf, pct.UpdateNotAllowedError{})
+	t.Check(err, ErrorMatches, "Update to 1.0.2 not allowed: agent is pinned to version 1.0.1")
+
+	// Max major 1: the latest version 2.0.0 in the testing channel is ignored.
+	u.SetPolicy(pct.UpdatePolicy{Channel: pct.UPDATE_CHANNEL_TESTING, MaxMajor: 1})
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{[]byte("2.0.0")}
+	s.api.GetError = []error{nil}
+	level, version, err = u.Check()
+	t.Assert(err, IsNil)
+	t.Check(level, Equals, "")
+	t.Check(version, Equals, "")
+	err = u.Update("2.0.0")
+	t.Check(err, ErrorMatches, "Update to 2.0.0 not allowed: max major version is 1")
+}
+
+func (s *UpdateTestSuite) TestResumeDownload(t *C) {
+	defer os.Remove(pct.Basedir.File("update"))
+	defer os.Remove(pct.Basedir.File("update-history"))
+
+	curBin := filepath.Join(s.tmpDir + "/percona-agent")
+	err := ioutil.WriteFile(curBin, []byte{0x41}, os.FileMode(0755))
+	t.Assert(err, IsNil)
+
+	// The API has the gzipped bin, but no patch from 1.0.0.
+	gzBin := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzBin)
+	gz.Write(s.bin)
+	gz.Close()
+	url := "http://localhost/download/percona-agent-1.0.1"
+	api := mock.NewRangeAPI(s.api, map[string][]byte{url + ".gz": gzBin.Bytes()})
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{s.sig}
+	s.api.GetError = []error{nil}
+
+	// A previous try (e.g. before the agent was restarted) downloaded 1000 bytes,
+	// and the connection breaks again after 300k.
+	dir := filepath.Join(pct.Basedir.Dir("bin"), pct.DOWNLOAD_DIR)
+	t.Assert(pct.MakeDir(dir), IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "percona-agent-1.0.1.gz.part"), gzBin.Bytes()[0:1000], 0644)
+	t.Assert(err, IsNil)
+	api.FailAt = 300 * 1024
+
+	u := pct.NewUpdater(s.logger, api, s.pubKey, curBin, "1.0.0")
+	err = u.Update("1.0.1")
+	t.Assert(err, IsNil)
+
+	newBin, err := ioutil.ReadFile(curBin)
+	t.Assert(err, IsNil)
+	t.Check(bytes.Compare(s.bin, newBin), Equals, 0)
+
+	// First the patch (not found), then the bin from 1000, and again from
+	// where the broken connection stopped.
+	t.Assert(len(api.Ranges) > 3, Equals, true)
+	t.Check(api.Ranges[0], Equals, "http://localhost/download/percona-agent-1.0.0-1.0.1.patch 0")
+	t.Check(api.Ranges[1], Equals, url+".gz 1000")
+	t.Check(api.Ranges[2], Equals, fmt.Sprintf("%s.gz %d", url, 1000+pct.DOWNLOAD_CHUNK_SIZE))
+	t.Check(api.Ranges[3], Equals, fmt.Sprintf("%s.gz %d", url, 300*1024))
+
+	// The staged download is removed once complete.
+	files, _ := ioutil.ReadDir(dir)
+	t.Check(files, HasLen, 0)
+}
+
+func (s *UpdateTestSuite) TestStagedDownload(t *C) {
+	defer os.Remove(pct.Basedir.File("update"))
+	defer os.Remove(pct.Basedir.File("update-history"))
+
+	curBin := filepath.Join(s.tmpDir + "/percona-agent")
+	gzBin := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzBin)
+	gz.Write(s.bin)
+	gz.Close()
+	url := "http://localhost/download/percona-agent-1.0.1"
+	dir := filepath.Join(pct.Basedir.Dir("bin"), pct.DOWNLOAD_DIR)
+	t.Assert(pct.MakeDir(dir), IsNil)
+	part := filepath.Join(dir, "percona-agent-1.0.1.gz.part")
+
+	// The whole bin was downloaded but not installed (e.g. the agent was
+	// restarted), so the API returns 416 for the next range: it's complete.
+	err := ioutil.WriteFile(curBin, []byte{0x41}, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(part, gzBin.Bytes(), 0644)
+	t.Assert(err, IsNil)
+	api := mock.NewRangeAPI(s.api, map[string][]byte{url + ".gz": gzBin.Bytes()})
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{s.sig}
+	s.api.GetError = []error{nil}
+
+	u := pct.NewUpdater(s.logger, api, s.pubKey, curBin, "1.0.0")
+	err = u.Update("1.0.1")
+	t.Assert(err, IsNil)
+	newBin, err := ioutil.ReadFile(curBin)
+	t.Assert(err, IsNil)
+	t.Check(bytes.Compare(s.bin, newBin), Equals, 0)
+	t.Check(api.Ranges[1:], DeepEquals, []string{fmt.Sprintf("%s.gz %d", url, gzBin.Len())})
+
+	// The staged file is bigger than the bin (e.g. the bin changed), so it's
+	// truncated and the bin is downloaded again.
+	err = ioutil.WriteFile(curBin, []byte{0x41}, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(part, append(gzBin.Bytes(), []byte("junk")...), 0644)
+	t.Assert(err, IsNil)
+	api = mock.NewRangeAPI(s.api, map[string][]byte{url + ".gz": gzBin.Bytes()})
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{s.sig}
+	s.api.GetError = []error{nil}
+
+	u = pct.NewUpdater(s.logger, api, s.pubKey, curBin, "1.0.0")
+	err = u.Update("1.0.1")
+	t.Assert(err, IsNil)
+	newBin, err = ioutil.ReadFile(curBin)
+	t.Assert(err, IsNil)
+	t.Check(bytes.Compare(s.bin, newBin), Equals, 0)
+	t.Assert(len(api.Ranges) > 2, Equals, true)
+	t.Check(api.Ranges[1], Equals, fmt.Sprintf("%s.gz %d", url, gzBin.Len()+4))
+	t.Check(api.Ranges[2], Equals, url+".gz 0")
+
+	files, _ := ioutil.ReadDir(dir)
+	t.Check(files, HasLen, 0)
+}
+
+func (s *UpdateTestSuite) TestPatchUpdate(t *C) {
+	defer os.Remove(pct.Basedir.File("update"))
+	defer os.Remove(pct.Basedir.File("update-history"))
+
+	// The current bin 1.0.0 is like 1.0.1 with a few changes.
+	oldBin := make([]byte, len(s.bin))
+	copy(oldBin, s.bin)
+	for i := 1000; i < len(oldBin); i += 100000 {
+		oldBin[i]++
+	}
+	curBin := filepath.Join(s.tmpDir + "/percona-agent")
+	err := ioutil.WriteFile(curBin, oldBin, os.FileMode(0755))
+	t.Assert(err, IsNil)
+
+	patch := pct.MakePatch(oldBin, s.bin)
+	t.Check(len(patch) < len(s.bin)/100, Equals, true)
+	patched, err := pct.ApplyPatch(oldBin, patch)
+	t.Assert(err, IsNil)
+	t.Check(bytes.Compare(patched, s.bin), Equals, 0)
+
+	// The API has only the patch.
+	patchUrl := "http://localhost/download/percona-agent-1.0.0-1.0.1.patch"
+	api := mock.NewRangeAPI(s.api, map[string][]byte{patchUrl: patch})
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{s.sig}
+	s.api.GetError = []error{nil}
+
+	u := pct.NewUpdater(s.logger, api, s.pubKey, curBin, "1.0.0")
+	err = u.Update("1.0.1")
+	t.Assert(err, IsNil)
+
+	newBin, err := ioutil.ReadFile(curBin)
+	t.Assert(err, IsNil)
+	t.Check(bytes.Compare(s.bin, newBin), Equals, 0)
+	t.Check(api.Ranges, DeepEquals, []string{patchUrl + " 0"})
+
+	// A patch that doesn't make the signed bin is not used.
+	_, err = pct.ApplyPatch(oldBin, patch[0:len(patch)-10])
+	t.Check(err, NotNil)
+	_, err = pct.ApplyPatch(oldBin, []byte("foo"))
+	t.Check(err, Equals, pct.ErrInvalidPatch)
+}
+
+func (s *UpdateTestSuite) TestMalformedPatch(t *C) {
+	oldBin := []byte(strings.Repeat("0123456789", 10))
+
+	uvarint := func(x uint64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutUvarint(buf, x)]
+	}
+	patch := func(size uint64, ops ...[]byte) []byte {
+		p := append([]byte(pct.PATCH_MAGIC), uvarint(size)...)
+		for _, op := range ops {
+			p = append(p, op...)
+		}
+		return p
+	}
+	copyOp := func(offset, n uint64) []byte {
+		return append(append([]byte{pct.PATCH_COPY}, uvarint(offset)...), uvarint(n)...)
+	}
+
+	// Valid: copy the first 10 bytes, insert 3.
+	newBin, err := pct.ApplyPatch(oldBin, patch(13, copyOp(0, 10), []byte{pct.PATCH_INSERT, 3, 'a', 'b', 'c'}))
+	t.Assert(err, IsNil)
+	t.Check(string(newBin), Equals, "0123456789abc")
+
+	bad := map[string][]byte{
+		"huge size":         patch(math.MaxUint64, copyOp(0, 10)),
+		"copy past end":     patch(10, copyOp(95, 10)),
+		"copy offset wraps": patch(10, copyOp(math.MaxUint64-4, 10)),
+		"copy length wraps": patch(10, copyOp(10, math.MaxUint64-4)),
+		"insert past end":   patch(10, []byte{pct.PATCH_INSERT, 10, 'a'}),
+		"bad op":            patch(10, []byte{'X'}),
+		"truncated size":    append([]byte(pct.PATCH_MAGIC), 0xff),
+		"truncated copy":    patch(10, []byte{pct.PATCH_COPY, 0}),
+		"more than size":    patch(5, copyOp(0, 10)),
+	}
+	for name, p := range bad {
+		_, err := pct.ApplyPatch(oldBin, p)
+		t.Check(err, Equals, pct.ErrInvalidPatch, Commentf(name))
+	}
+
+	// Less than size is invalid too, but the error says how much less.
+	_, err = pct.ApplyPatch(oldBin, patch(20, copyOp(0, 10)))
+	t.Check(err, NotNil)
 }
@@ -0,0 +1,187 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * A MaintenanceWindow is a cron-like spec of the minutes (host local time)
+ * when the agent may update and restart itself: "min hour day month weekday",
+ * each field *, N, N-M, or a comma-separated list of them, with an optional
+ * /step.  For example, "* 2-3 * * 6" is Saturday from 02:00 to 03:59.  Like
+ * cron, if both day and weekday are restricted (neither starts with *), a day
+ * matches if either does: "* 2 1 * 6" is 02:00 on the 1st and on Saturdays.
+ * Specs that never open, e.g. "* * 31 2 *", are invalid.
+ */
+type MaintenanceWindow struct {
+	spec   string
+	fields [5][]bool
+	dayOr  bool // day and weekday are both restricted, so either matches
+}
+
+const WINDOW_MAX_YEARS = 5 // Next searches this far, e.g. for Feb 29
+
+// Max days per month, including Feb 29.
+var windowMonthDays = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+var windowFields = [5]struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day", 1, 31},
+	{"month", 1, 12},
+	{"weekday", 0, 6}, // Sunday=0
+}
+
+func ParseMaintenanceWindow(spec string) (*MaintenanceWindow, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("Invalid maintenance window %q: need 5 fields (min hour day month weekday), got %d", spec, len(parts))
+	}
+	w := &MaintenanceWindow{spec: spec}
+	for i, part := range parts {
+		f := windowFields[i]
+		set, err := parseWindowField(part, f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window %q: %s: %s", spec, f.name, err)
+		}
+		w.fields[i] = set
+	}
+	w.dayOr = !strings.HasPrefix(parts[2], "*") && !strings.HasPrefix(parts[4], "*")
+	if !w.opens() {
+		return nil, fmt.Errorf("Invalid maintenance window %q: no month has the days", spec)
+	}
+	return w, nil
+}
+
+func (w *MaintenanceWindow) String() string {
+	return w.spec
+}
+
+// Open returns true if t is in the window.  A nil window is always open.
+func (w *MaintenanceWindow) Open(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	return w.fields[0][t.Minute()] &&
+		w.fields[1][t.Hour()] &&
+		w.dayOpen(t)
+}
+
+// Next returns the next time the window opens after t.  A parsed window always
+// opens within a few years (e.g. "* * 29 2 *" in the next leap year); the zero
+// time is returned if it doesn't.
+func (w *MaintenanceWindow) Next(t time.Time) time.Time {
+	if w == nil {
+		return t
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(WINDOW_MAX_YEARS, 0, 0); t.Before(end); {
+		var next time.Time
+		switch {
+		case !w.dayOpen(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !w.fields[1][t.Hour()]:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !w.fields[0][t.Minute()]:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !next.After(t) {
+			next = t.Add(time.Minute) // DST change
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+func (w *MaintenanceWindow) dayOpen(t time.Time) bool {
+	if !w.fields[3][int(t.Month())] {
+		return false
+	}
+	if w.dayOr {
+		return w.fields[2][t.Day()] || w.fields[4][int(t.Weekday())]
+	}
+	return w.fields[2][t.Day()] && w.fields[4][int(t.Weekday())]
+}
+
+// opens returns true if there's a month with one of the days.  Every weekday
+// is in every month, so only the day can make a window that never opens.
+func (w *MaintenanceWindow) opens() bool {
+	if w.dayOr {
+		return true
+	}
+	for month := 1; month <= 12; month++ {
+		if !w.fields[3][month] {
+			continue
+		}
+		for day := 1; day <= windowMonthDays[month]; day++ {
+			if w.fields[2][day] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseWindowField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if n := strings.Index(item, "/"); n >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[n+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", item)
+			}
+			item = item[:n]
+		}
+		lo, hi := min, max
+		if item != "*" {
+			var err error
+			r := strings.SplitN(item, "-", 2)
+			if lo, err = strconv.Atoi(r[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", item)
+			}
+			hi = lo
+			if step > 1 {
+				hi = max // N/step is N-max/step, like cron
+			}
+			if len(r) == 2 {
+				if hi, err = strconv.Atoi(r[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", item)
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("%q out of range %d-%d", item, min, max)
+			}
+		}
+		for i := lo; i <= hi; i += step {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// window.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type WindowTestSuite struct {
+}
+
+var _ = Suite(&WindowTestSuite{})
+
+func (s *WindowTestSuite) TestOpen(t *C) {
+	// Saturday 02:00-03:59.
+	w, err := pct.ParseMaintenanceWindow("* 2-3 * * 6")
+	t.Assert(err, IsNil)
+	t.Check(w.String(), Equals, "* 2-3 * * 6")
+
+	sat := time.Date(2015, time.March, 7, 2, 30, 0, 0, time.Local) // Saturday
+	t.Check(w.Open(sat), Equals, true)
+	t.Check(w.Open(sat.Add(-31*time.Minute)), Equals, false) // 01:59
+	t.Check(w.Open(sat.Add(89*time.Minute)), Equals, true)   // 03:59
+	t.Check(w.Open(sat.Add(90*time.Minute)), Equals, false)  // 04:00
+	t.Check(w.Open(sat.AddDate(0, 0, 1)), Equals, false)     // Sunday
+
+	// Next opening after Saturday 04:00 is the next Saturday 02:00.
+	next := w.Next(sat.Add(90 * time.Minute))
+	t.Check(next.Equal(time.Date(2015, time.March, 14, 2, 0, 0, 0, time.Local)), Equals, true)
+
+	// Lists and steps: every 15 minutes during 01:00 and 13:00.
+	w, err = pct.ParseMaintenanceWindow("*/15 1,13 * * *")
+	t.Assert(err, IsNil)
+	t.Check(w.Open(time.Date(2015, time.March, 7, 13, 45, 0, 0, time.Local)), Equals, true)
+	t.Check(w.Open(time.Date(2015, time.March, 7, 13, 46, 0, 0, time.Local)), Equals, false)
+	t.Check(w.Open(time.Date(2015, time.March, 7, 12, 45, 0, 0, time.Local)), Equals, false)
+
+	// Like cron, if day and weekday are both restricted, either matches: the
+	// 1st (a Sunday) and Saturdays, not only a Saturday the 1st.
+	w, err = pct.ParseMaintenanceWindow("0 2 1 * 6")
+	t.Assert(err, IsNil)
+	t.Check(w.Open(time.Date(2015, time.March, 1, 2, 0, 0, 0, time.Local)), Equals, true)
+	t.Check(w.Open(sat.Add(-30*time.Minute)), Equals, true)
+	t.Check(w.Open(time.Date(2015, time.March, 2, 2, 0, 0, 0, time.Local)), Equals, false)
+	next = w.Next(time.Date(2015, time.March, 1, 2, 0, 0, 0, time.Local))
+	t.Check(next.Equal(time.Date(2015, time.March, 7, 2, 0, 0, 0, time.Local)), Equals, true)
+
+	// ...but if either is *, both must match: Saturdays in March.
+	w, err = pct.ParseMaintenanceWindow("0 2 * 3 6")
+	t.Assert(err, IsNil)
+	t.Check(w.Open(time.Date(2015, time.March, 1, 2, 0, 0, 0, time.Local)), Equals, false)
+	t.Check(w.Open(sat.Add(-30*time.Minute)), Equals, true)
+
+	// Feb 29 opens in the next leap year.
+	w, err = pct.ParseMaintenanceWindow("0 2 29 2 *")
+	t.Assert(err, IsNil)
+	next = w.Next(sat)
+	t.Check(next.Equal(time.Date(2016, time.February, 29, 2, 0, 0, 0, time.Local)), Equals, true)
+
+	// A nil window (none configured) is always open.
+	var none *pct.MaintenanceWindow
+	t.Check(none.Open(sat), Equals, true)
+}
+
+func (s *WindowTestSuite) TestInvalid(t *C) {
+	_, err := pct.ParseMaintenanceWindow("* 2-3 * *")
+	t.Check(err, ErrorMatches, ".+need 5 fields.+")
+	_, err = pct.ParseMaintenanceWindow("* 2-25 * * *")
+	t.Check(err, ErrorMatches, ".+hour: \"2-25\" out of range 0-23")
+	_, err = pct.ParseMaintenanceWindow("* * * * sat")
+	t.Check(err, ErrorMatches, ".+weekday: invalid value \"sat\"")
+	_, err = pct.ParseMaintenanceWindow("*/0 * * * *")
+	t.Check(err, ErrorMatches, ".+minute: invalid step in \"\\*/0\"")
+
+	// Windows that never open.
+	_, err = pct.ParseMaintenanceWindow("* * 31 2 *")
+	t.Check(err, ErrorMatches, ".+no month has the days")
+	_, err = pct.ParseMaintenanceWindow("0 0 31 4,6,9,11 *")
+	t.Check(err, ErrorMatches, ".+no month has the days")
+}
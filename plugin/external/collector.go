@@ -0,0 +1,346 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package external
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * An external collector is a program, written in any language, which the agent
+ * runs as a subprocess.  They talk JSON over stdio, one object per line.  Every
+ * Collect seconds the agent writes a request to the collector's stdin:
+ *
+ *   {"Cmd":"Collect","Ts":1420070400}
+ *
+ * The collector writes messages to its stdout, usually one "metrics" message
+ * in response to a request, but it can write any message at any time:
+ *
+ *   {"Type":"metrics","Service":"redis","InstanceId":1,"Ts":1420070400,
+ *    "Metrics":[{"Name":"redis/connected_clients","Type":"gauge","Number":5}]}
+ *   {"Type":"data","Service":"redis-info","Data":{...}}
+ *   {"Type":"log","Level":"warning","Msg":"..."}
+ *
+ * Metrics are sent as an mm.Collection to the collector's aggregator, so they
+ * are reported like metrics from built-in monitors.  Data is spooled as-is for
+ * the given service.  Service and InstanceId default to the collector's config.
+ * Lines on stderr are logged as warnings.  When the agent closes stdin, the
+ * collector must exit; if it doesn't, it's killed.  If the collector exits
+ * otherwise, it's restarted after a backoff wait.
+ */
+
+const (
+	MSG_METRICS = "metrics"
+	MSG_DATA    = "data"
+	MSG_LOG     = "log"
+)
+
+const (
+	STOP_TIMEOUT = 5 // seconds for the collector to exit after stdin is closed
+)
+
+type Request struct {
+	Cmd string
+	Ts  int64 // UTC Unix timestamp
+}
+
+type Message struct {
+	Type string
+	proto.ServiceInstance
+	Ts      int64           `json:",omitempty"`
+	Metrics []mm.Metric     `json:",omitempty"`
+	Data    json.RawMessage `json:",omitempty"`
+	Level   string          `json:",omitempty"` // debug, info, warning, error
+	Msg     string          `json:",omitempty"`
+}
+
+type Collector struct {
+	config         CollectorConfig
+	logger         *pct.Logger
+	collectionChan chan *mm.Collection
+	spool          data.Spooler
+	// --
+	tickChan chan time.Time
+	sync     *pct.SyncChan
+	status   *pct.Status
+	running  bool
+	mux      *sync.Mutex // guards running
+	backoff  *pct.Backoff
+}
+
+func NewCollector(config CollectorConfig, logger *pct.Logger, collectionChan chan *mm.Collection, spool data.Spooler) *Collector {
+	c := &Collector{
+		config:         config,
+		logger:         logger,
+		collectionChan: collectionChan,
+		spool:          spool,
+		// --
+		sync:    pct.NewSyncChan(),
+		status:  pct.NewStatus([]string{config.alias()}),
+		mux:     &sync.Mutex{},
+		backoff: pct.NewBackoff(5 * time.Minute),
+	}
+	return c
+}
+
+// @goroutine[0]
+func (c *Collector) Start(tickChan chan time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.running {
+		return pct.ServiceIsRunningError{Service: c.config.alias()}
+	}
+	if _, err := exec.LookPath(c.config.Cmd); err != nil {
+		return err
+	}
+	c.tickChan = tickChan
+	c.sync = pct.NewSyncChan()
+	go c.run()
+	c.running = true
+	return nil
+}
+
+// @goroutine[0]
+func (c *Collector) Stop() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.running {
+		return nil
+	}
+	c.sync.Stop()
+	c.sync.Wait()
+	c.running = false
+	return nil
+}
+
+// @goroutine[0:1]
+func (c *Collector) Status() map[string]string {
+	return c.status.All()
+}
+
+func (c *Collector) TickChan() chan time.Time {
+	return c.tickChan
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[1]
+func (c *Collector) run() {
+	alias := c.config.alias()
+	defer func() {
+		if err := recover(); err != nil {
+			c.logger.Error("Collector crashed: ", err)
+		}
+		c.status.Update(alias, "Stopped")
+		c.sync.Done()
+	}()
+
+	for {
+		c.status.Update(alias, "Starting")
+		select {
+		case <-time.After(c.backoff.Wait()):
+		case <-c.sync.StopChan:
+			c.sync.Graceful()
+			return
+		}
+		if stopped := c.runCmd(); stopped {
+			return
+		}
+	}
+}
+
+// runCmd runs the collector until it exits or it's stopped.  It returns true
+// if stopped.
+// @goroutine[1]
+func (c *Collector) runCmd() bool {
+	alias := c.config.alias()
+
+	cmd := exec.Command(c.config.Cmd, c.config.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		c.logger.Error(err)
+		return false
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		c.logger.Error(err)
+		return false
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		c.logger.Error(err)
+		return false
+	}
+	if err := cmd.Start(); err != nil {
+		c.logger.Error("Cannot start " + c.config.Cmd + ": " + err.Error())
+		return false
+	}
+	c.logger.Info("Started", c.config.Cmd, "pid", cmd.Process.Pid)
+	c.status.Update(alias, fmt.Sprintf("Running (pid %d)", cmd.Process.Pid))
+
+	// Read stderr and stdout until the collector closes them, i.e. exits.
+	go c.logStderr(stderr)
+	msgChan := make(chan *Message, 10)
+	go c.readMessages(stdout, msgChan)
+
+	exitChan := make(chan error, 1)
+	exited := false
+	for !exited {
+		select {
+		case now := <-c.tickChan:
+			req, _ := json.Marshal(Request{Cmd: "Collect", Ts: now.UTC().Unix()})
+			if _, err := stdin.Write(append(req, '\n')); err != nil {
+				c.logger.Warn("Cannot send request: " + err.Error())
+			}
+		case msg, ok := <-msgChan:
+			if !ok {
+				// stdout closed: wait for the collector to exit.
+				msgChan = nil
+				go func() { exitChan <- cmd.Wait() }()
+				continue
+			}
+			c.backoff.Success()
+			c.handle(msg)
+		case err := <-exitChan:
+			if err == nil {
+				err = fmt.Errorf("exit status 0")
+			}
+			c.logger.Warn(c.config.Cmd + " exited: " + err.Error())
+			exited = true
+		case <-c.sync.StopChan:
+			c.status.Update(alias, "Stopping")
+			stdin.Close()
+			if msgChan != nil {
+				// Handle messages until the collector exits, e.g. last metrics.
+				go func() {
+					for msg := range msgChan {
+						c.handle(msg)
+					}
+					exitChan <- cmd.Wait()
+				}()
+			}
+			select {
+			case <-exitChan:
+			case <-time.After(STOP_TIMEOUT * time.Second):
+				c.logger.Warn(c.config.Cmd + " did not exit, killing it")
+				cmd.Process.Kill()
+				<-exitChan
+			}
+			c.logger.Info("Stopped", c.config.Cmd)
+			c.sync.Graceful()
+			return true
+		}
+	}
+	stdin.Close()
+	return false
+}
+
+// @goroutine[2]
+func (c *Collector) readMessages(stdout io.Reader, msgChan chan *Message) {
+	defer close(msgChan)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(line, msg); err != nil {
+			c.logger.Warn("Invalid message: " + err.Error())
+			continue
+		}
+		msgChan <- msg
+	}
+	if err := scanner.Err(); err != nil {
+		c.logger.Warn("Cannot read messages: " + err.Error())
+	}
+}
+
+// @goroutine[3]
+func (c *Collector) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		c.logger.Warn(scanner.Text())
+	}
+}
+
+// @goroutine[1]
+func (c *Collector) handle(msg *Message) {
+	if msg.Service == "" {
+		msg.Service = c.config.service()
+		msg.InstanceId = c.config.InstanceId
+	}
+	switch msg.Type {
+	case MSG_METRICS:
+		for _, metric := range msg.Metrics {
+			if !mm.MetricTypes[metric.Type] {
+				c.logger.Warn("Invalid metric type: " + metric.Name + " " + metric.Type)
+				return
+			}
+		}
+		if msg.Ts == 0 {
+			msg.Ts = time.Now().UTC().Unix()
+		}
+		collection := &mm.Collection{
+			ServiceInstance: msg.ServiceInstance,
+			Ts:              msg.Ts,
+			Metrics:         msg.Metrics,
+		}
+		select {
+		case c.collectionChan <- collection:
+		default:
+			c.logger.Warn("Lost metrics; aggregator is busy")
+		}
+	case MSG_DATA:
+		if len(msg.Data) == 0 {
+			c.logger.Warn("Data message has no data")
+			return
+		}
+		if err := c.spool.Write(msg.Service, msg.Data); err != nil {
+			c.logger.Warn("Cannot spool data: " + err.Error())
+		}
+	case MSG_LOG:
+		switch strings.ToLower(msg.Level) {
+		case "debug":
+			c.logger.Debug(msg.Msg)
+		case "info":
+			c.logger.Info(msg.Msg)
+		case "error":
+			c.logger.Error(msg.Msg)
+		default:
+			c.logger.Warn(msg.Msg)
+		}
+	default:
+		c.logger.Warn("Unknown message type: " + msg.Type)
+	}
+}
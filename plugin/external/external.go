@@ -0,0 +1,264 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package external
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/plugin"
+	"github.com/percona/percona-agent/ticker"
+)
+
+/**
+ * The external service runs the external collectors in its config file
+ * (external.conf), see collector.go for the protocol.  For example:
+ *
+ *   {"Collectors":[{"Name":"redis","Cmd":"/usr/local/bin/redis-collector","Collect":10}]}
+ *
+ * Each collector has its own aggregator which reports its metrics every Report
+ * seconds.  Collectors are configured only by the config file: restart the
+ * agent to apply changes.
+ */
+
+const (
+	SERVICE_NAME = "external"
+)
+
+const (
+	DEFAULT_COLLECT = 10 // seconds
+	DEFAULT_REPORT  = 60 // seconds
+	FLUSH_TIMEOUT   = 2  // seconds for a collector's aggregator to report on stop
+)
+
+func init() {
+	plugin.Register(plugin.Plugin{
+		Name:   SERVICE_NAME,
+		After:  []string{"mm"}, // so the local metrics store and alerter are running
+		Config: func() interface{} { return &Config{} },
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			return NewManager(deps.Logger(SERVICE_NAME), config.(*Config), deps.Clock, deps.Spooler, deps.Sinks...), nil
+		},
+	})
+}
+
+type Config struct {
+	Collectors []CollectorConfig
+}
+
+type CollectorConfig struct {
+	Name       string   // unique, e.g. redis
+	Cmd        string   // program to run
+	Args       []string `json:",omitempty"`
+	Service    string   `json:",omitempty"` // default: Name
+	InstanceId uint     `json:",omitempty"`
+	Collect    uint     // seconds
+	Report     uint     // seconds
+}
+
+func (c CollectorConfig) alias() string {
+	return SERVICE_NAME + "-" + c.Name
+}
+
+func (c CollectorConfig) service() string {
+	if c.Service != "" {
+		return c.Service
+	}
+	return c.Name
+}
+
+type binding struct {
+	collector      *Collector
+	aggregator     *mm.Aggregator
+	collectionChan chan *mm.Collection
+}
+
+type Manager struct {
+	logger *pct.Logger
+	config *Config
+	clock  ticker.Manager
+	spool  data.Spooler
+	sinks  []mm.CollectionSink
+	// --
+	collectors map[string]*binding
+	running    bool
+	mux        *sync.RWMutex // guards collectors and running
+	status     *pct.Status
+}
+
+func NewManager(logger *pct.Logger, config *Config, clock ticker.Manager, spool data.Spooler, sinks ...mm.CollectionSink) *Manager {
+	m := &Manager{
+		logger: logger,
+		config: config,
+		clock:  clock,
+		spool:  spool,
+		sinks:  sinks,
+		// --
+		collectors: make(map[string]*binding),
+		mux:        &sync.RWMutex{},
+		status:     pct.NewStatus([]string{SERVICE_NAME}),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[0]
+func (m *Manager) Start() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.running {
+		return pct.ServiceIsRunningError{Service: SERVICE_NAME}
+	}
+
+	// A collector that can't start doesn't stop the others.
+	for _, config := range m.config.Collectors {
+		if err := m.startCollector(config); err != nil {
+			m.logger.Error("Cannot start " + config.alias() + ": " + err.Error())
+			continue
+		}
+		m.logger.Info("Started " + config.alias())
+	}
+
+	m.running = true
+	m.logger.Info("Started")
+	m.status.Update(SERVICE_NAME, fmt.Sprintf("Running %d collectors", len(m.collectors)))
+	return nil
+}
+
+// Stop stops the collectors, then their aggregators report their partial
+// interval so no metrics are lost on shutdown.
+// @goroutine[0]
+func (m *Manager) Stop() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for name, b := range m.collectors {
+		m.status.Update(SERVICE_NAME, "Stopping "+name)
+		if err := b.collector.Stop(); err != nil {
+			m.logger.Warn("Failed to stop " + name + ": " + err.Error())
+		}
+		m.clock.Remove(b.collector.TickChan())
+		if err := b.aggregator.Flush(FLUSH_TIMEOUT * time.Second); err != nil {
+			m.logger.Warn(err)
+		}
+		b.aggregator.Stop()
+		delete(m.collectors, name)
+	}
+	m.running = false
+	m.logger.Info("Stopped")
+	m.status.Update(SERVICE_NAME, "Stopped")
+	return nil
+}
+
+// @goroutine[0]
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	m.status.UpdateRe(SERVICE_NAME, "Handling", cmd)
+	defer m.status.Update(SERVICE_NAME, "Running")
+
+	switch cmd.Cmd {
+	case "GetConfig":
+		config, errs := m.GetConfig()
+		return cmd.Reply(config, errs...)
+	default:
+		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+	}
+}
+
+// @goroutine[1]
+func (m *Manager) Status() map[string]string {
+	status := m.status.All()
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	for _, b := range m.collectors {
+		for k, v := range b.collector.Status() {
+			status[k] = v
+		}
+	}
+	return status
+}
+
+func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
+	bytes, err := json.Marshal(m.config)
+	if err != nil {
+		return nil, []error{err}
+	}
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	config := proto.AgentConfig{
+		InternalService: SERVICE_NAME,
+		Config:          string(bytes),
+		Running:         m.running,
+	}
+	return []proto.AgentConfig{config}, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Manager) startCollector(config CollectorConfig) error {
+	if config.Name == "" || config.Cmd == "" {
+		return errors.New("Name and Cmd are required")
+	}
+	name := config.alias()
+	if _, ok := m.collectors[name]; ok {
+		return errors.New("Duplicate collector")
+	}
+	if config.Collect == 0 {
+		config.Collect = DEFAULT_COLLECT
+	}
+	if config.Report == 0 {
+		config.Report = DEFAULT_REPORT
+	}
+	if config.Collect > config.Report {
+		return fmt.Errorf("Collect (%d) must be less than or equal to Report (%d)", config.Collect, config.Report)
+	}
+
+	logger := pct.NewLogger(m.logger.LogChan(), name)
+	collectionChan := make(chan *mm.Collection, 5)
+	aggregator := mm.NewAggregator(logger, int64(config.Report), collectionChan, m.spool, m.sinks...)
+	instanceConfig := mm.InstanceConfig{
+		Collect: config.Collect,
+	}
+	if err := aggregator.SetInstanceConfig(config.service(), config.InstanceId, instanceConfig); err != nil {
+		return err
+	}
+	collector := NewCollector(config, logger, collectionChan, m.spool)
+
+	tickChan := make(chan time.Time)
+	aggregator.Start()
+	if err := collector.Start(tickChan); err != nil {
+		aggregator.Stop()
+		return err
+	}
+
+	// Synchronized ticker like mm monitors so all metrics align in charts.
+	m.clock.Add(tickChan, config.Collect, true)
+	m.collectors[name] = &binding{collector, aggregator, collectionChan}
+	return nil
+}
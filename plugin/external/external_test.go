@@ -0,0 +1,164 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package external_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/plugin/external"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+// Responds to every request with metrics and data.
+var collectorScript = `#!/bin/sh
+echo '{"Type":"log","Level":"info","Msg":"hello"}'
+while read req; do
+  echo '{"Type":"metrics","Metrics":[{"Name":"foo/threads","Type":"gauge","Number":3}]}'
+  echo '{"Type":"data","Service":"foo-info","Data":{"version":"1.0"}}'
+done
+`
+
+type TestSuite struct {
+	logChan  chan *proto.LogEntry
+	logger   *pct.Logger
+	dataChan chan interface{}
+	spool    *mock.Spooler
+	tmpDir   string
+	cmd      string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "external-test")
+	s.dataChan = make(chan interface{}, 10)
+	s.spool = mock.NewSpooler(s.dataChan)
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	s.cmd = filepath.Join(s.tmpDir, "collector.sh")
+	err = ioutil.WriteFile(s.cmd, []byte(collectorScript), 0755)
+	t.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestCollector(t *C) {
+	config := external.CollectorConfig{
+		Name:       "foo",
+		Cmd:        s.cmd,
+		InstanceId: 1,
+		Collect:    1,
+		Report:     60,
+	}
+	collectionChan := make(chan *mm.Collection, 1)
+	c := external.NewCollector(config, s.logger, collectionChan, s.spool)
+
+	tickChan := make(chan time.Time)
+	err := c.Start(tickChan)
+	t.Assert(err, IsNil)
+
+	now := time.Unix(1420070400, 0)
+	tickChan <- now
+
+	var collection *mm.Collection
+	select {
+	case collection = <-collectionChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Collector did not send metrics")
+	}
+	t.Check(collection.Service, Equals, "foo")
+	t.Check(collection.InstanceId, Equals, uint(1))
+	t.Check(collection.Metrics, DeepEquals, []mm.Metric{{Name: "foo/threads", Type: "gauge", Number: 3}})
+
+	var data interface{}
+	select {
+	case data = <-s.dataChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Collector did not spool data")
+	}
+	bytes, _ := json.Marshal(data)
+	t.Check(string(bytes), Equals, `{"version":"1.0"}`)
+
+	got := test.WaitLogChan(s.logChan, 10)
+	found := false
+	for _, entry := range got {
+		if entry.Msg == "hello" && entry.Level == proto.LOG_INFO {
+			found = true
+		}
+	}
+	t.Check(found, Equals, true)
+
+	t.Check(c.Status()["external-foo"], Matches, `Running \(pid \d+\)`)
+
+	// Stop closes stdin, so the collector exits.
+	err = c.Stop()
+	t.Assert(err, IsNil)
+	t.Check(c.Status()["external-foo"], Equals, "Stopped")
+}
+
+func (s *TestSuite) TestManager(t *C) {
+	config := &external.Config{
+		Collectors: []external.CollectorConfig{
+			{Name: "foo", Cmd: s.cmd},
+			{Name: "bar", Cmd: filepath.Join(s.tmpDir, "does-not-exist")},
+		},
+	}
+	clock := mock.NewClock()
+	m := external.NewManager(s.logger, config, clock, s.spool)
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	// A collector which can't start doesn't stop the others.
+	status := m.Status()
+	t.Check(status["external"], Equals, "Running 1 collectors")
+	t.Check(status["external-bar"], Equals, "")
+	t.Check(clock.Added, DeepEquals, []uint{external.DEFAULT_COLLECT})
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].InternalService, Equals, "external")
+	t.Check(configs[0].Running, Equals, true)
+
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	t.Check(clock.Removed, HasLen, 1)
+	t.Check(m.Status()["external"], Equals, "Stopped")
+}
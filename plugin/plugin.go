@@ -0,0 +1,217 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package plugin
+
+/**
+ * Services register a Plugin to be built and started by the agent without
+ * editing bin/percona-agent/main.go.  The core services (log, data, instance,
+ * and mrms) are started first because they provide the Deps that every other
+ * service needs; then the plugins are built in dependency order (Plugin.After)
+ * and started.  A package registers its plugin in init(), so the agent only
+ * needs to import it:
+ *
+ *   func init() {
+ *       plugin.Register(plugin.Plugin{
+ *           Name:    "foo",
+ *           After:   []string{"mm"},
+ *           Config:  func() interface{} { return &foo.Config{Interval: 60} },
+ *           Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+ *               return foo.NewManager(deps.Logger("foo"), config.(*foo.Config), deps.Spooler), nil
+ *           },
+ *       })
+ *   }
+ */
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mrms"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+// Deps are the core services and shared objects which plugins are built with.
+type Deps struct {
+	LogChan     chan *proto.LogEntry
+	Spooler     data.Spooler
+	Clock       ticker.Manager
+	Repo        *instance.Repo
+	MRMS        mrms.Monitor
+	ConnFactory mysql.ConnectionFactory
+	Sinks       []mm.CollectionSink // for mm collections, e.g. local metrics store
+}
+
+func (d Deps) Logger(name string) *pct.Logger {
+	return pct.NewLogger(d.LogChan, name)
+}
+
+// Factory makes the plugin's service manager.  config is the value returned
+// by Plugin.Config after the plugin's config file, if any, is decoded into it,
+// or nil if the plugin has no config.
+type Factory func(deps Deps, config interface{}) (pct.ServiceManager, error)
+
+type Plugin struct {
+	Name    string             // service name, e.g. "mm"; also the config file name
+	After   []string           // services which must be started first
+	Config  func() interface{} // optional: pointer to the default config
+	Factory Factory
+}
+
+var plugins = make(map[string]Plugin)
+var pluginsMux = &sync.Mutex{}
+
+// Register makes a plugin available to the agent.  It's usually called from
+// init(), so it panics if the plugin is invalid or its name is a duplicate,
+// like database/sql.Register.
+func Register(p Plugin) {
+	pluginsMux.Lock()
+	defer pluginsMux.Unlock()
+	if p.Name == "" {
+		panic("plugin.Register: plugin has no name")
+	}
+	if p.Factory == nil {
+		panic("plugin.Register: plugin " + p.Name + " has no factory")
+	}
+	if _, dupe := plugins[p.Name]; dupe {
+		panic("plugin.Register: duplicate plugin " + p.Name)
+	}
+	plugins[p.Name] = p
+}
+
+// Unregister removes a plugin.  It's only used by tests.
+func Unregister(name string) {
+	pluginsMux.Lock()
+	defer pluginsMux.Unlock()
+	delete(plugins, name)
+}
+
+// Plugins returns the names of all registered plugins, sorted.
+func Plugins() []string {
+	pluginsMux.Lock()
+	defer pluginsMux.Unlock()
+	names := []string{}
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Order returns the registered plugins in start order: every plugin after the
+// services in its After list.  Otherwise plugins are ordered by name.  The
+// services already running (the core services) satisfy dependencies but are
+// not returned.  An unknown dependency or a dependency cycle is an error.
+func Order(running map[string]pct.ServiceManager) ([]string, error) {
+	pluginsMux.Lock()
+	defer pluginsMux.Unlock()
+
+	names := []string{}
+	for name := range plugins {
+		if _, ok := running[name]; ok {
+			return nil, fmt.Errorf("Plugin %s: service already running", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	order := []string{}
+	state := map[string]int{} // 1=visiting, 2=done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("Plugin dependency cycle: %v", append(path, name))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, dep := range plugins[name].After {
+			if _, ok := running[dep]; ok {
+				continue
+			}
+			if _, ok := plugins[dep]; !ok {
+				return fmt.Errorf("Plugin %s depends on unknown service %s", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, []string{}); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Build makes the service manager of a registered plugin.  The plugin's config
+// file, if it exists, overrides its default config.
+func Build(name string, deps Deps) (pct.ServiceManager, error) {
+	pluginsMux.Lock()
+	p, ok := plugins[name]
+	pluginsMux.Unlock()
+	if !ok {
+		return nil, pct.UnknownServiceError{Service: name}
+	}
+	var config interface{}
+	if p.Config != nil {
+		config = p.Config()
+		if err := pct.Basedir.ReadConfig(name, config); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Invalid %s config: %s", name, err)
+		}
+	}
+	manager, err := p.Factory(deps, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error making %s manager: %s", name, err)
+	}
+	return manager, nil
+}
+
+// StartAll builds and starts every registered plugin in order, adding its
+// manager to services.  It stops at the first error.  The start order is
+// returned so the agent knows which services came from plugins.
+// @goroutine[0]
+func StartAll(deps Deps, services map[string]pct.ServiceManager) ([]string, error) {
+	order, err := Order(services)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range order {
+		manager, err := Build(name, deps)
+		if err != nil {
+			return nil, err
+		}
+		if err := manager.Start(); err != nil {
+			return nil, fmt.Errorf("Error starting %s manager: %s", name, err)
+		}
+		services[name] = manager
+	}
+	return order, nil
+}
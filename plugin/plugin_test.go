@@ -0,0 +1,147 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package plugin_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/plugin"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type fooConfig struct {
+	Interval uint
+	Name     string
+}
+
+type TestSuite struct {
+	logChan   chan *proto.LogEntry
+	tmpDir    string
+	traceChan chan string
+	readyChan chan bool
+	configs   map[string]*fooConfig
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.traceChan = make(chan string, 100)
+	s.readyChan = make(chan bool, 100)
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *TestSuite) SetUpTest(t *C) {
+	for _, name := range plugin.Plugins() {
+		plugin.Unregister(name)
+	}
+	s.configs = make(map[string]*fooConfig)
+}
+
+func (s *TestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *TestSuite) register(name string, after ...string) {
+	plugin.Register(plugin.Plugin{
+		Name:   name,
+		After:  after,
+		Config: func() interface{} { return &fooConfig{Interval: 60} },
+		Factory: func(deps plugin.Deps, config interface{}) (pct.ServiceManager, error) {
+			s.configs[name] = config.(*fooConfig)
+			return mock.NewMockServiceManager(name, s.readyChan, s.traceChan), nil
+		},
+	})
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestOrder(t *C) {
+	running := map[string]pct.ServiceManager{
+		"data": mock.NewMockServiceManager("data", s.readyChan, s.traceChan),
+	}
+
+	// Ordered by name, except after dependencies.  Running services
+	// satisfy dependencies.
+	s.register("qan", "data")
+	s.register("mm")
+	s.register("external", "mm", "data")
+	s.register("alert", "external")
+	order, err := plugin.Order(running)
+	t.Assert(err, IsNil)
+	t.Check(order, DeepEquals, []string{"mm", "external", "alert", "qan"})
+
+	// Unknown dependency.
+	s.register("foo", "bar")
+	_, err = plugin.Order(running)
+	t.Check(err, NotNil)
+	plugin.Unregister("foo")
+
+	// Dependency cycle.
+	plugin.Unregister("mm")
+	s.register("mm", "alert")
+	_, err = plugin.Order(running)
+	t.Check(err, NotNil)
+
+	// Duplicate plugins are a programming error.
+	t.Check(func() { s.register("qan") }, PanicMatches, ".*duplicate plugin qan")
+}
+
+func (s *TestSuite) TestStartAll(t *C) {
+	s.register("foo")
+	s.register("bar", "foo")
+
+	// foo has a config file which overrides its default config.
+	err := pct.Basedir.WriteConfigString("foo", `{"Name":"foo1"}`)
+	t.Assert(err, IsNil)
+	defer pct.Basedir.RemoveConfig("foo")
+
+	s.readyChan <- true
+	s.readyChan <- true
+	services := map[string]pct.ServiceManager{}
+	started, err := plugin.StartAll(plugin.Deps{LogChan: s.logChan}, services)
+	t.Assert(err, IsNil)
+	t.Check(started, DeepEquals, []string{"foo", "bar"})
+	t.Check(<-s.traceChan, Equals, "Start foo")
+	t.Check(<-s.traceChan, Equals, "Start bar")
+	t.Check(services["foo"], NotNil)
+	t.Check(services["bar"], NotNil)
+
+	t.Check(s.configs["foo"], DeepEquals, &fooConfig{Interval: 60, Name: "foo1"})
+	t.Check(s.configs["bar"], DeepEquals, &fooConfig{Interval: 60})
+
+	// Plugins can't replace running services.
+	_, err = plugin.StartAll(plugin.Deps{LogChan: s.logChan}, services)
+	t.Check(err, NotNil)
+}
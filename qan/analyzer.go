@@ -98,7 +98,7 @@ func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysql
 		name:                name,
 		mysqlConfiguredChan: make(chan bool, 1),
 		workerDoneChan:      make(chan *Interval, 1),
-		status:              pct.NewStatus([]string{name, name + "-last-interval", name + "-next-interval"}),
+		status:              pct.NewStatus([]string{name, name + "-last-interval", name + "-next-interval", name + "-mysql-pool"}),
 		runSync:             pct.NewSyncChan(),
 		configureMySQLSync:  pct.NewSyncChan(),
 		mux:                 &sync.RWMutex{},
@@ -145,6 +145,7 @@ func (a *RealAnalyzer) Status() map[string]string {
 	} else {
 		a.status.Update(a.name+"-next-interval", "")
 	}
+	a.status.Update(a.name+"-mysql-pool", a.mysqlConn.Stats().String())
 	return a.status.Merge(a.worker.Status())
 }
 
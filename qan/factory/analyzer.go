@@ -76,7 +76,7 @@ func (f *RealAnalyzerFactory) Make(
 		panic("Invalid analyzerType: " + analyzerType)
 	}
 	return qan.NewRealAnalyzer(
-		pct.NewLogger(f.logChan, name),
+		pct.NewLogger(f.logChan, name).With("service", config.Service, "instance", config.InstanceId),
 		config,
 		f.iterFactory.Make(analyzerType, mysqlConn, tickChan),
 		mysqlConn,
@@ -100,17 +100,20 @@ func (f *RealWorkerFactory) Make(name string, mysqlConn mysql.Connector) *Worker
 }
 
 func GetDigestRows(mysqlConn mysql.Connector, c chan<- *DigestRow, doneChan chan<- error) error {
-	rows, err := mysqlConn.DB().Query(
-		"SELECT " +
-			" COALESCE(SCHEMA_NAME, ''), COALESCE(DIGEST, ''), COUNT_STAR," +
-			" SUM_TIMER_WAIT, MIN_TIMER_WAIT, AVG_TIMER_WAIT, MAX_TIMER_WAIT," +
-			" SUM_LOCK_TIME," +
-			" SUM_ERRORS, SUM_WARNINGS," +
-			" SUM_ROWS_AFFECTED, SUM_ROWS_SENT, SUM_ROWS_EXAMINED," +
-			" SUM_CREATED_TMP_DISK_TABLES, SUM_CREATED_TMP_TABLES," +
-			" SUM_SELECT_FULL_JOIN, SUM_SELECT_FULL_RANGE_JOIN, SUM_SELECT_RANGE, SUM_SELECT_RANGE_CHECK, SUM_SELECT_SCAN," +
-			" SUM_SORT_MERGE_PASSES, SUM_SORT_RANGE, SUM_SORT_ROWS, SUM_SORT_SCAN," +
-			" SUM_NO_INDEX_USED, SUM_NO_GOOD_INDEX_USED" +
+	// The timeout applies until all rows are read, so it's canceled in the
+	// goroutine that reads them.
+	ctx, cancel := mysqlConn.Context()
+	rows, err := mysqlConn.DB().QueryContext(ctx,
+		"SELECT "+
+			" COALESCE(SCHEMA_NAME, ''), COALESCE(DIGEST, ''), COUNT_STAR,"+
+			" SUM_TIMER_WAIT, MIN_TIMER_WAIT, AVG_TIMER_WAIT, MAX_TIMER_WAIT,"+
+			" SUM_LOCK_TIME,"+
+			" SUM_ERRORS, SUM_WARNINGS,"+
+			" SUM_ROWS_AFFECTED, SUM_ROWS_SENT, SUM_ROWS_EXAMINED,"+
+			" SUM_CREATED_TMP_DISK_TABLES, SUM_CREATED_TMP_TABLES,"+
+			" SUM_SELECT_FULL_JOIN, SUM_SELECT_FULL_RANGE_JOIN, SUM_SELECT_RANGE, SUM_SELECT_RANGE_CHECK, SUM_SELECT_SCAN,"+
+			" SUM_SORT_MERGE_PASSES, SUM_SORT_RANGE, SUM_SORT_ROWS, SUM_SORT_SCAN,"+
+			" SUM_NO_INDEX_USED, SUM_NO_GOOD_INDEX_USED"+
 			" FROM performance_schema.events_statements_summary_by_digest")
 	if err != nil {
 		// This bubbles up to the analyzer which logs it as an error:
@@ -118,12 +121,14 @@ func GetDigestRows(mysqlConn mysql.Connector, c chan<- *DigestRow, doneChan chan
 		//   1. Worker.Run().getSnapShot()
 		//   2. Worker.getSnapshot().getRows() (ptr to this func)
 		//   3. here
+		cancel()
 		return err
 	}
 	go func() {
 		var err error
 		defer func() {
 			rows.Close()
+			cancel()
 			doneChan <- err
 		}()
 		for rows.Next() {
@@ -172,8 +177,10 @@ func GetDigestText(mysqlConn mysql.Connector, digest string) (string, error) {
 	query := fmt.Sprintf("SELECT DIGEST_TEXT"+
 		" FROM performance_schema.events_statements_summary_by_digest"+
 		" WHERE DIGEST='%s' LIMIT 1", digest)
+	ctx, cancel := mysqlConn.Context()
+	defer cancel()
 	var digestText string
-	err := mysqlConn.DB().QueryRow(query).Scan(&digestText)
+	err := mysqlConn.DB().QueryRowContext(ctx, query).Scan(&digestText)
 	return digestText, err
 }
 
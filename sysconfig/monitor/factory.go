@@ -64,7 +64,7 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (sysconfig.
 		monitor = mysql.NewMonitor(
 			alias,
 			config,
-			pct.NewLogger(f.logChan, alias),
+			pct.NewLogger(f.logChan, alias).With("service", service, "instance", instanceId),
 			mysqlConn.NewConnection(mysqlIt.DSN),
 		)
 	default:
@@ -93,7 +93,9 @@ func (m *Monitor) Stop() error {
 
 // @goroutine[0]
 func (m *Monitor) Status() map[string]string {
-	return m.status.All()
+	status := m.status.All()
+	status[m.name+"-mysql-pool"] = m.conn.Stats().String()
+	return status
 }
 
 // @goroutine[0]
@@ -185,7 +187,9 @@ func (m *Monitor) GetGlobalVariables(conn *sql.DB, c *sysconfig.Report) error {
 
 	m.status.Update(m.name, "Getting SHOW GLOBAL VARIABLES")
 
-	rows, err := conn.Query("SHOW /*!50002 GLOBAL */ VARIABLES")
+	ctx, cancel := m.conn.Context()
+	defer cancel()
+	rows, err := conn.QueryContext(ctx, "SHOW /*!50002 GLOBAL */ VARIABLES")
 	if err != nil {
 		return err
 	}
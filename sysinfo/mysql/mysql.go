@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/pct/cmd"
 )
@@ -64,7 +65,12 @@ func (m *MySQL) Handle(protoCmd *proto.Cmd) *proto.Reply {
 
 	// Parse DSN to get user, pass, host, port, socket as separate fields
 	// @todo parsing DSN should be as a method on proto.MySQLInstance.DSN or at least parser should be injected
-	dsn, err := NewDSN(mysqlIt.DSN)
+	// Credentials can be in a file, etc. (see mysql.ResolveDSN).
+	resolved, err := mysql.ResolveDSN(mysqlIt.DSN)
+	if err != nil {
+		return protoCmd.Reply(nil, err)
+	}
+	dsn, err := NewDSN(resolved)
 	if err != nil {
 		return protoCmd.Reply(nil, err)
 	}
@@ -18,6 +18,9 @@
 package mock
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 )
 
@@ -112,3 +115,45 @@ func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, erro
 func (a *API) URL(paths ...string) string {
 	return ""
 }
+
+// RangeAPI is an API which is also a pct.RangeGetter.  It serves Files by URL.
+// If FailAt > 0, the first GetRange to reach that offset stops there and returns
+// an error, like a broken connection.
+type RangeAPI struct {
+	*API
+	Files  map[string][]byte
+	FailAt int64
+	Ranges []string // "url offset" of every GetRange
+}
+
+func NewRangeAPI(api *API, files map[string][]byte) *RangeAPI {
+	a := &RangeAPI{
+		API:    api,
+		Files:  files,
+		Ranges: []string{},
+	}
+	return a
+}
+
+func (a *RangeAPI) GetRange(apiKey, url string, offset, size int64, w io.Writer) (int, int64, error) {
+	a.Ranges = append(a.Ranges, fmt.Sprintf("%s %d", url, offset))
+	data, ok := a.Files[url]
+	if !ok {
+		return http.StatusNotFound, -1, nil
+	}
+	total := int64(len(data))
+	if offset > 0 && offset >= total {
+		return http.StatusRequestedRangeNotSatisfiable, total, nil
+	}
+	end := offset + size
+	if end > total {
+		end = total
+	}
+	if a.FailAt > offset && a.FailAt < end {
+		w.Write(data[offset:a.FailAt])
+		a.FailAt = 0
+		return http.StatusPartialContent, total, errors.New("connection reset by peer")
+	}
+	w.Write(data[offset:end])
+	return http.StatusPartialContent, total, nil
+}
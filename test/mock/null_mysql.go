@@ -18,6 +18,7 @@
 package mock
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/percona/cloud-protocol/proto"
@@ -119,6 +120,14 @@ func (n *NullMySQL) Uptime() (int64, error) {
 	return n.uptime, nil
 }
 
+func (n *NullMySQL) Context() (context.Context, context.CancelFunc) {
+	return context.WithCancel(context.Background())
+}
+
+func (n *NullMySQL) Stats() mysql.ConnectionStats {
+	return mysql.ConnectionStats{}
+}
+
 func (n *NullMySQL) GetUptimeCount() uint {
 	return n.uptimeCount
 }
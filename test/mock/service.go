@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/pct"
+	"time"
 )
 
 type MockServiceManager struct {
@@ -94,3 +95,25 @@ func (m *MockServiceManager) Handle(cmd *proto.Cmd) *proto.Reply {
 func (m *MockServiceManager) Reset() {
 	m.status.Update(m.name, "")
 }
+
+/////////////////////////////////////////////////////////////////////////////
+
+// A MockServiceManager which is also a pct.Drainer.
+type MockDrainServiceManager struct {
+	*MockServiceManager
+	DrainErr error
+}
+
+func NewMockDrainServiceManager(name string, readyChan chan bool, traceChan chan string) *MockDrainServiceManager {
+	m := &MockDrainServiceManager{
+		MockServiceManager: NewMockServiceManager(name, readyChan, traceChan),
+	}
+	return m
+}
+
+func (m *MockDrainServiceManager) Drain(timeout time.Duration) error {
+	m.traceChan <- "Drain " + m.name
+	// Return when caller is ready.  This allows us to simulate slow drains.
+	<-m.readyChan
+	return m.DrainErr
+}
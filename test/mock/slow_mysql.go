@@ -18,6 +18,7 @@
 package mock
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -75,6 +76,14 @@ func (s *SlowMySQL) Uptime() (int64, error) {
 	return s.realConnection.Uptime()
 }
 
+func (s *SlowMySQL) Context() (context.Context, context.CancelFunc) {
+	return s.realConnection.Context()
+}
+
+func (s *SlowMySQL) Stats() mysql.ConnectionStats {
+	return s.realConnection.Stats()
+}
+
 func (s *SlowMySQL) SetGlobalDelay(delay time.Duration) {
 	s.globalDelay = delay
 }